@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// artifactsStdout writes the debug artifacts to stdout instead of files
+const artifactsStdout = "stdout"
+
+// artifact captures what a failed compilation or match was run with, so that
+// the failure can be reproduced from the artifact its fatal result references
+type artifact struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Tag of the request and XR the failure was recovered from
+	Tag string `json:"tag,omitempty"`
+	XR  string `json:"xr,omitempty"`
+	// Phase that failed, compile or match
+	Phase string `json:"phase"`
+	Error string `json:"error"`
+	// Input of the failed export
+	Input v1beta1.CUEInput `json:"input"`
+	// Tags and Values built from the injections of the export
+	Tags   []string               `json:"tags,omitempty"`
+	Values map[string]interface{} `json:"values,omitempty"`
+	// Output is the raw cue output, empty when the compilation failed
+	Output string `json:"output,omitempty"`
+}
+
+// artifactSink writes debug artifacts as json, a nil sink writes nothing
+type artifactSink struct {
+	mu sync.Mutex
+	// dir the artifacts are written to as <id>.json, or stdout when empty
+	dir    string
+	stdout io.Writer
+	// redactor masks the secrets of the artifacts when set
+	redactor *redactor
+}
+
+// newArtifactSink returns the sink of the --debug-artifacts destination,
+// stdout or a directory, an empty destination disables the artifacts. The
+// artifacts are masked by the redactor before they are written.
+func newArtifactSink(dest string, r *redactor) (*artifactSink, error) {
+	switch dest {
+	case "":
+		return nil, nil
+	case artifactsStdout:
+		return &artifactSink{stdout: os.Stdout, redactor: r}, nil
+	}
+	if err := os.MkdirAll(dest, 0o750); err != nil {
+		return nil, errors.Wrapf(err, "cannot create debug artifacts directory %q", dest)
+	}
+	return &artifactSink{dir: dest, redactor: r}, nil
+}
+
+// redact returns the artifact with the injected tags and values, the output
+// and the error masked by the redactor
+func (a artifact) redact(r *redactor) artifact {
+	if r == nil {
+		return a
+	}
+	if a.Tags != nil {
+		tags := make([]string, len(a.Tags))
+		for i, t := range a.Tags {
+			tags[i] = r.message(t)
+		}
+		a.Tags = tags
+	}
+	if a.Values != nil {
+		a.Values, _ = r.value(a.Values).(map[string]interface{})
+	}
+	a.Output = r.message(a.Output)
+	a.Error = r.message(a.Error)
+	return a
+}
+
+// write writes the artifact to the sink
+func (s *artifactSink) write(a artifact) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal debug artifact")
+	}
+	if s.dir != "" {
+		return errors.Wrap(os.WriteFile(filepath.Join(s.dir, a.ID+".json"), b, 0o600), "cannot write debug artifact")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.stdout.Write(append(b, '\n'))
+	return errors.Wrap(err, "cannot write debug artifact")
+}
+
+// dump writes the artifact of a failure and references it in the
+// fatal result of the response. A failure to write the artifact is logged and
+// does not change the response.
+func (s *artifactSink) dump(log logging.Logger, rsp *fnv1beta1.RunFunctionResponse, ids requestIDs, a artifact) {
+	if s == nil {
+		return
+	}
+	a.ID = randomID(8)
+	a.Time = time.Now().UTC()
+	a.Tag, a.XR = ids.tag, ids.xr
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+			a.Error = r.GetMessage()
+		}
+	}
+	if err := s.write(a.redact(s.redactor)); err != nil {
+		log.Info("Cannot write debug artifact", "error", err)
+		return
+	}
+	log.Info("Wrote debug artifact", "artifact", a.ID, "phase", a.Phase)
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+			r.Message = fmt.Sprintf("%s (debug artifact %s)", r.GetMessage(), a.ID)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDebugArtifacts(t *testing.T) {
+	input := func(target, value string) *fnv1beta1.RunFunctionRequest {
+		in, _ := json.Marshal(map[string]interface{}{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind":       "CUEInput",
+			"metadata":   map[string]interface{}{"name": "artifacts"},
+			"export":     map[string]interface{}{"target": target, "value": value},
+		})
+		return &fnv1beta1.RunFunctionRequest{
+			Meta:  &fnv1beta1.RequestMeta{Tag: "hello"},
+			Input: resource.MustStructJSON(string(in)),
+			Observed: &fnv1beta1.State{
+				Composite: &fnv1beta1.Resource{
+					Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+				},
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		reason     string
+		req        *fnv1beta1.RunFunctionRequest
+		wantPhase  string
+		wantOutput bool
+	}{
+		"CompileFailed": {
+			reason:    "A failed compilation should be captured without output",
+			req:       input("Resources", "a: 1\na: 2\n"),
+			wantPhase: "compile",
+		},
+		"MatchFailed": {
+			reason:     "A failed match should be captured with the raw cue output",
+			req:        input("PatchDesired", "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n"),
+			wantPhase:  "match",
+			wantOutput: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			sink, err := newArtifactSink(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &Function{log: logging.NewNopLogger(), artifacts: sink}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fatal := fatalResult(rsp)
+			if fatal == nil {
+				t.Fatalf("%s\nRunFunction(...): want a fatal result, got none", tc.reason)
+			}
+			m := regexp.MustCompile(`\(debug artifact ([0-9a-f]+)\)$`).FindStringSubmatch(fatal.Error())
+			if m == nil {
+				t.Fatalf("%s\nRunFunction(...): want the fatal result to reference the artifact, got %q", tc.reason, fatal.Error())
+			}
+			b, err := os.ReadFile(filepath.Join(dir, m[1]+".json"))
+			if err != nil {
+				t.Fatalf("%s\nos.ReadFile(...): %v", tc.reason, err)
+			}
+			a := artifact{}
+			if err := json.Unmarshal(b, &a); err != nil {
+				t.Fatal(err)
+			}
+			if a.Phase != tc.wantPhase || a.Tag != "hello" || a.XR != "XR/my-xr" || a.Input.Name != "artifacts" || a.Error == "" {
+				t.Errorf("%s\nartifact: unexpected %+v", tc.reason, a)
+			}
+			if (a.Output != "") != tc.wantOutput {
+				t.Errorf("%s\nartifact: want output %t, got %q", tc.reason, tc.wantOutput, a.Output)
+			}
+		})
+	}
+}
+
+func TestArtifactRedact(t *testing.T) {
+	r, err := newRedactor("password", []string{"Secret:data.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := artifact{
+		Tags:   []string{"region=us-east-1", "password=hunter2"},
+		Values: map[string]interface{}{"db": map[string]interface{}{"password": "hunter2", "host": "db"}},
+		Output: "apiVersion: v1\nkind: Secret\ndata:\n  password: hunter2\n",
+		Error:  `conflicting values "password": "hunter2"`,
+	}
+
+	want := artifact{
+		Tags:   []string{"region=us-east-1", "password=" + redacted},
+		Values: map[string]interface{}{"db": map[string]interface{}{"password": redacted, "host": "db"}},
+		Output: "apiVersion: v1\nkind: Secret\ndata:\n  password: " + redacted + "\n",
+		Error:  `conflicting values "password": "` + redacted + `"`,
+	}
+	if diff := cmp.Diff(want, a.redact(r)); diff != "" {
+		t.Errorf("redact(...): -want, +got:\n%s", diff)
+	}
+	if a.Values["db"].(map[string]interface{})["password"] != "hunter2" {
+		t.Errorf("redact(...): the values of the artifact should not be modified")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"gopkg.in/yaml.v3"
+
+	"k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// renderBases renders the composed resources of the base of a PatchResources
+// resource. The base is either an object, or a string holding a stream of
+// yaml or json documents that each render a resource, so that bases can be
+// authored as they are in a Composition.
+func renderBases(raw []byte) ([]*composed.Unstructured, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, errors.New("base is empty")
+	}
+	if raw[0] != '"' {
+		cd := composed.New()
+		if err := json.Unmarshal(raw, cd); err != nil {
+			return nil, errors.Wrap(jsonPosition(err), "cannot unmarshal JSON data")
+		}
+		return []*composed.Unstructured{cd}, nil
+	}
+
+	var src string
+	if err := json.Unmarshal(raw, &src); err != nil {
+		return nil, errors.Wrap(jsonPosition(err), "cannot unmarshal base string")
+	}
+	return renderYAMLBases(src)
+}
+
+// renderYAMLBases renders a resource from each document of the yaml stream,
+// empty documents are skipped
+func renderYAMLBases(src string) ([]*composed.Unstructured, error) {
+	out := []*composed.Unstructured{}
+	d := yaml.NewDecoder(strings.NewReader(src))
+	for i := 1; ; i++ {
+		n := &yaml.Node{}
+		err := d.Decode(n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// The errors of the decoder name the line of the stream
+			return nil, errors.Wrapf(err, "cannot parse YAML document %d", i)
+		}
+		doc := n
+		if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+			doc = doc.Content[0]
+		}
+		if doc.Kind == yaml.ScalarNode && doc.Tag == "!!null" {
+			continue
+		}
+		if doc.Kind != yaml.MappingNode {
+			return nil, errors.Errorf("YAML document %d at line %d is not an object", i, doc.Line)
+		}
+		obj := map[string]interface{}{}
+		if err := doc.Decode(&obj); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode YAML document %d at line %d", i, doc.Line)
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot convert YAML document %d at line %d to JSON", i, doc.Line)
+		}
+		cd := composed.New()
+		if err := json.Unmarshal(b, cd); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal YAML document %d at line %d", i, doc.Line)
+		}
+		out = append(out, cd)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("base holds no YAML documents")
+	}
+	return out, nil
+}
+
+// jsonPosition adds the byte offset of a JSON syntax error to its message
+func jsonPosition(err error) error {
+	se := &stdjson.SyntaxError{}
+	if errors.As(err, &se) {
+		return errors.Wrapf(err, "at offset %d", se.Offset)
+	}
+	return err
+}
+
+// baseName returns the name a base of the PatchResources target is added to
+// the desired resources as, its metadata.name or with the name resource key
+// the name of its resource, suffixed with the index of the base when the
+// resource renders several
+func baseName(key v1beta1.ResourceKey, resourceName string, i, n int, base *composed.Unstructured) resource.Name {
+	if key != v1beta1.ResourceKeyName {
+		return resource.Name(base.GetName())
+	}
+	if n == 1 {
+		return resource.Name(resourceName)
+	}
+	return resource.Name(fmt.Sprintf("%s-%d", resourceName, i))
+}
+
+// patchedBases returns the results of the bases added as the names that
+// documents patched, named after the name they are added as
+func patchedBases(names []resource.Name, desired map[resource.Name]*resource.DesiredComposed, matches desiredMatch) []objectResult {
+	out := []objectResult{}
+	for _, name := range names {
+		dcd := desired[name]
+		if _, ok := matches[dcd]; !ok {
+			continue
+		}
+		out = append(out, objectResult{
+			action:     actionCreated,
+			object:     "resource",
+			name:       string(name),
+			kind:       dcd.Resource.GetKind(),
+			apiVersion: dcd.Resource.GetAPIVersion(),
+		})
+	}
+	return out
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestRenderBases(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		raw     string
+		want    []map[string]interface{}
+		wantErr string
+	}{
+		"Object": {
+			reason: "An object base should render a resource",
+			raw:    `{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": {"name": "bucket"}}`,
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": map[string]interface{}{"name": "bucket"}},
+			},
+		},
+		"YAML": {
+			reason: "A YAML string base should render a resource",
+			raw:    `"apiVersion: example.org/v1\nkind: Bucket\nmetadata:\n  name: bucket\nspec:\n  size: 3\n"`,
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": map[string]interface{}{"name": "bucket"}, "spec": map[string]interface{}{"size": int64(3)}},
+			},
+		},
+		"JSONString": {
+			reason: "A JSON string base should render a resource, JSON being YAML",
+			raw:    `"{\"apiVersion\": \"example.org/v1\", \"kind\": \"Bucket\"}"`,
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket"},
+			},
+		},
+		"MultipleDocuments": {
+			reason: "Each document of a multi-document YAML base should render a resource, skipping empty documents",
+			raw:    `"---\napiVersion: example.org/v1\nkind: Bucket\n---\n---\napiVersion: example.org/v1\nkind: Queue\n"`,
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket"},
+				{"apiVersion": "example.org/v1", "kind": "Queue"},
+			},
+		},
+		"InvalidYAML": {
+			reason:  "A YAML syntax error should name the document and line",
+			raw:     `"apiVersion: example.org/v1\nkind: Queue\n---\napiVersion: example.org/v1\nkind: Bucket\nmetadata: name: bucket\n"`,
+			wantErr: "cannot parse YAML document 2: yaml: line 6: mapping values are not allowed in this context",
+		},
+		"NotAnObject": {
+			reason:  "A YAML document that is not an object should name the document and line",
+			raw:     `"apiVersion: example.org/v1\nkind: Queue\n---\n- kind: Bucket\n"`,
+			wantErr: "YAML document 2 at line 4 is not an object",
+		},
+		"NoDocuments": {
+			reason:  "A YAML base without documents should return an error",
+			raw:     `"---\n"`,
+			wantErr: "base holds no YAML documents",
+		},
+		"Empty": {
+			reason:  "An empty base should return an error",
+			raw:     ``,
+			wantErr: "base is empty",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := renderBases([]byte(tc.raw))
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("%s\nrenderBases(...): want error %q, got none", tc.reason, tc.wantErr)
+				}
+				if diff := cmp.Diff(tc.wantErr, err.Error()); diff != "" {
+					t.Errorf("%s\nrenderBases(...): -want error, +got error:\n%s", tc.reason, diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nrenderBases(...): unexpected error: %v", tc.reason, err)
+			}
+			objects := []map[string]interface{}{}
+			for _, cd := range got {
+				objects = append(objects, cd.Object)
+			}
+			if diff := cmp.Diff(tc.want, objects); diff != "" {
+				t.Errorf("%s\nrenderBases(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestBaseName(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		key    v1beta1.ResourceKey
+		i, n   int
+		want   resource.Name
+	}{
+		"MetadataName": {
+			reason: "A base should be named by its metadata.name by default",
+			n:      1,
+			want:   "my-bucket",
+		},
+		"Name": {
+			reason: "A base should be named after its resource with the name resource key",
+			key:    v1beta1.ResourceKeyName,
+			n:      1,
+			want:   "bucket",
+		},
+		"NameMultiple": {
+			reason: "The bases of a resource rendering several should be suffixed with their index",
+			key:    v1beta1.ResourceKeyName,
+			i:      1,
+			n:      2,
+			want:   "bucket-1",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			base := composed.New()
+			base.SetName("my-bucket")
+			got := baseName(tc.key, "bucket", tc.i, tc.n, base)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nbaseName(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
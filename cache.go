@@ -0,0 +1,136 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// templateCache is a least recently used cache of built templates, so that
+// repeated reconciles of the same template skip loading and building it and
+// only fill it with the state of the request. A built template is not safe for
+// concurrent use, so concurrent compilations of a template each take a replica
+// of it, built once and reused by later compilations. Each replica is built in
+// a cue context of its own, which is dropped with the template when it is
+// evicted.
+type templateCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	// hits and misses count the replicas taken idle from the cache and
+	// the replicas built
+	hits   uint64
+	misses uint64
+}
+
+// cachedTemplate is a template of the cache and its idle replicas
+type cachedTemplate struct {
+	key  string
+	idle []*templateReplica
+}
+
+// templateReplica is a built replica of a cached template
+type templateReplica struct {
+	cache    *templateCache
+	template *cachedTemplate
+	value    cue.Value
+}
+
+// release returns the replica to its template once its compilation is done
+func (r *templateReplica) release() {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	r.template.idle = append(r.template.idle, r)
+}
+
+// newTemplateCache returns a cache of size templates, a size of 0 disables
+// the cache and returns nil
+func newTemplateCache(size int) *templateCache {
+	if size <= 0 {
+		return nil
+	}
+	return &templateCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns an idle replica of the template cached for the key, reserved for
+// a compilation until it is released. A replica is built in a new context when
+// the template is not cached or all its replicas are in use, templates that
+// fail to build are not cached.
+func (c *templateCache) get(key string, build func(ctx *cue.Context) (cue.Value, error)) (*templateReplica, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		t := e.Value.(*cachedTemplate)
+		if n := len(t.idle); n > 0 {
+			r := t.idle[n-1]
+			t.idle = t.idle[:n-1]
+			c.hits++
+			c.mu.Unlock()
+			return r, nil
+		}
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	v, err := build(cuecontext.New())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The template may have been cached by a concurrent compilation, the
+	// replica then joins its replicas
+	if e, ok := c.entries[key]; ok {
+		return &templateReplica{cache: c, template: e.Value.(*cachedTemplate), value: v}, nil
+	}
+	t := &cachedTemplate{key: key}
+	c.entries[key] = c.lru.PushFront(t)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedTemplate).key)
+	}
+	return &templateReplica{cache: c, template: t, value: v}, nil
+}
+
+// stats returns the number of replicas taken idle from the cache and built
+func (c *templateCache) stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// len returns the number of cached templates
+func (c *templateCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// templateKey hashes what a template is built from: its source, its libraries,
+// its module and the definitions declared for it. The tags and the state filled
+// into the built template are not part of the key.
+func templateKey(input v1beta1.CUEInput, opts compileOpts) string {
+	defs, _ := stateDefs(opts)
+	b, _ := json.Marshal(struct {
+		Value     v1beta1.Value     `json:"value"`
+		Libraries map[string]string `json:"libraries,omitempty"`
+		Module    *v1beta1.Module   `json:"module,omitempty"`
+		Defs      []string          `json:"defs,omitempty"`
+	}{input.Export.Value, opts.libraries, opts.module, defs})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"cuelang.org/go/cue"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestTemplateCache(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	cases := map[string]struct {
+		reason string
+		size   int
+		keys   []string
+		fail   map[string]bool
+		// wantBuilds are the keys built, in order
+		wantBuilds []string
+		wantLen    int
+	}{
+		"Hit": {
+			reason:     "A cached template should not be built again",
+			size:       2,
+			keys:       []string{"a", "a", "a"},
+			wantBuilds: []string{"a"},
+			wantLen:    1,
+		},
+		"Evict": {
+			reason:     "The least recently used template should be evicted when the cache is full",
+			size:       2,
+			keys:       []string{"a", "b", "a", "c", "a", "b"},
+			wantBuilds: []string{"a", "b", "c", "b"},
+			wantLen:    2,
+		},
+		"BuildError": {
+			reason:     "A template that fails to build should not be cached",
+			size:       2,
+			keys:       []string{"a", "a"},
+			fail:       map[string]bool{"a": true},
+			wantBuilds: []string{"a", "a"},
+			wantLen:    0,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := newTemplateCache(tc.size)
+			var builds []string
+			for _, key := range tc.keys {
+				tpl, err := c.get(key, func(ctx *cue.Context) (cue.Value, error) {
+					builds = append(builds, key)
+					if tc.fail[key] {
+						return cue.Value{}, errBoom
+					}
+					return ctx.CompileString(`a: 1`), nil
+				})
+				if err != nil {
+					continue
+				}
+				tpl.release()
+			}
+			if diff := cmp.Diff(tc.wantBuilds, builds); diff != "" {
+				t.Errorf("%s\nc.get(...): -want builds, +got builds:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantLen, c.len()); diff != "" {
+				t.Errorf("%s\nc.len(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestTemplateCacheReplicas(t *testing.T) {
+	c := newTemplateCache(1)
+	builds := 0
+	build := func(ctx *cue.Context) (cue.Value, error) {
+		builds++
+		return ctx.CompileString(`a: 1`), nil
+	}
+
+	// Concurrent compilations of a template should each take a replica
+	a, _ := c.get("a", build)
+	b, _ := c.get("a", build)
+	if a == b || builds != 2 {
+		t.Errorf("c.get(...): want a replica built for each concurrent compilation, got %d builds", builds)
+	}
+	a.release()
+	b.release()
+
+	// Released replicas should be reused
+	for i := 0; i < 2; i++ {
+		r, _ := c.get("a", build)
+		defer r.release()
+	}
+	if builds != 2 {
+		t.Errorf("c.get(...): want released replicas reused, got %d builds", builds)
+	}
+	if got := c.len(); got != 1 {
+		t.Errorf("c.len(): want replicas cached as 1 template, got %d", got)
+	}
+}
+
+func TestCUECompileCachedConcurrent(t *testing.T) {
+	in := v1beta1.CUEInput{
+		Export: v1beta1.Export{
+			Value: v1beta1.Value("replicas: #observed.composite.spec.replicas\n"),
+		},
+	}
+	cache := newTemplateCache(8)
+	pool := newEvalPool(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(replicas int) {
+			defer wg.Done()
+			w, err := pool.acquire(context.Background())
+			if err != nil {
+				t.Errorf("pool.acquire(...): unexpected error: %v", err)
+				return
+			}
+			defer pool.release(w)
+			observed := map[string]interface{}{"composite": map[string]interface{}{"spec": map[string]interface{}{"replicas": replicas}}}
+			out, err := cueCompile(outputJSON, in, compileOpts{parseData: true, observed: observed, cache: cache, cueCtx: w})
+			if err != nil {
+				t.Errorf("cueCompile(...): unexpected error: %v", err)
+				return
+			}
+			want := []map[string]interface{}{{"replicas": float64(replicas)}}
+			if diff := cmp.Diff(want, out.data); diff != "" {
+				t.Errorf("cueCompile(...): -want, +got:\n%s", diff)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCUECompileCached(t *testing.T) {
+	in := v1beta1.CUEInput{
+		Export: v1beta1.Export{
+			Value: v1beta1.Value("name: string @tag(name)\nreplicas: #observed.composite.spec.replicas\n"),
+		},
+	}
+	observed := func(replicas int) map[string]interface{} {
+		return map[string]interface{}{"composite": map[string]interface{}{"spec": map[string]interface{}{"replicas": replicas}}}
+	}
+
+	cache := newTemplateCache(8)
+	compile := func(tags []string, replicas int) []map[string]interface{} {
+		t.Helper()
+		out, err := cueCompile(outputJSON, in, compileOpts{parseData: true, tags: tags, observed: observed(replicas), cache: cache})
+		if err != nil {
+			t.Fatalf("cueCompile(...): unexpected error: %v", err)
+		}
+		return out.data
+	}
+
+	want := []map[string]interface{}{{"name": "a", "replicas": float64(1)}}
+	if diff := cmp.Diff(want, compile([]string{"name=a"}, 1)); diff != "" {
+		t.Errorf("cueCompile(...): -want, +got:\n%s", diff)
+	}
+	// The cached template should be filled with the state of each compilation
+	want = []map[string]interface{}{{"name": "a", "replicas": float64(3)}}
+	if diff := cmp.Diff(want, compile([]string{"name=a"}, 3)); diff != "" {
+		t.Errorf("cueCompile(...): cached template: -want, +got:\n%s", diff)
+	}
+	if got := cache.len(); got != 1 {
+		t.Errorf("cache.len(): want 1 template cached for the same source and tags, got %d", got)
+	}
+	// Other tags should be filled into the same cached template
+	want = []map[string]interface{}{{"name": "b", "replicas": float64(3)}}
+	if diff := cmp.Diff(want, compile([]string{"name=b"}, 3)); diff != "" {
+		t.Errorf("cueCompile(...): other tags: -want, +got:\n%s", diff)
+	}
+	if got := cache.len(); got != 1 {
+		t.Errorf("cache.len(): want 1 template cached for different tags, got %d", got)
+	}
+	if hits, misses := cache.stats(); hits != 2 || misses != 1 {
+		t.Errorf("cache.stats(): want 2 hits and 1 miss, got %d hits and %d misses", hits, misses)
+	}
+}
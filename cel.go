@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// The variables the source of a tag is bound to in CEL tag expressions
+const (
+	celXRVar          = "xr"
+	celContextVar     = "context"
+	celEnvironmentVar = "environment"
+	celResourceVar    = "resource"
+)
+
+// celSourceVar returns the variable the source is bound to
+func celSourceVar(source v1beta1.TagSource) string {
+	switch source {
+	case v1beta1.TagSourceContext:
+		return celContextVar
+	case v1beta1.TagSourceEnvironment:
+		return celEnvironmentVar
+	case v1beta1.TagSourceResource:
+		return celResourceVar
+	default:
+		return celXRVar
+	}
+}
+
+// evalCEL evaluates the CEL expression against the source bound to the
+// variable and returns the result, maps and lists are returned as
+// map[string]interface{} and []interface{} so they are injected like values
+// read from a path
+func evalCEL(expr, variable string, source map[string]interface{}) (interface{}, error) {
+	env, err := cel.NewEnv(
+		cel.Variable(variable, cel.DynType),
+		ext.Strings(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create CEL environment")
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, errors.Wrap(iss.Err(), "cannot compile CEL expression")
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create CEL program")
+	}
+	out, _, err := prg.Eval(map[string]interface{}{variable: source})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot evaluate CEL expression")
+	}
+	switch out.Type() {
+	case types.MapType, types.ListType:
+		v, err := out.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot convert CEL result of type %s", out.Type().TypeName())
+		}
+		return v.(*structpb.Value).AsInterface(), nil
+	default:
+		return out.Value(), nil
+	}
+}
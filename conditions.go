@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	xpv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// condition is a status condition of the XR set by the template in #conditions
+type condition struct {
+	// Type of the condition, for example DatabaseHealthy
+	Type string `json:"type"`
+	// Status of the condition, one of True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// Reason is a CamelCase reason for the status of the condition
+	Reason string `json:"reason"`
+	// Message is a human readable explanation of the status
+	Message string `json:"message,omitempty"`
+}
+
+// validate checks the condition has a type, a reason and a valid status
+func (c condition) validate() error {
+	if c.Type == "" || c.Reason == "" {
+		return errors.New("type and reason are required")
+	}
+	switch c.Status {
+	case corev1.ConditionTrue, corev1.ConditionFalse, corev1.ConditionUnknown:
+	default:
+		return errors.Errorf("invalid status %q: must be True, False or Unknown", c.Status)
+	}
+	if xpv1.ConditionType(c.Type) == xpv1.TypeReady || xpv1.ConditionType(c.Type) == xpv1.TypeSynced {
+		return errors.Errorf("type %s is managed by Crossplane", c.Type)
+	}
+	return nil
+}
+
+// setConditions sets the conditions on the desired XR, a condition whose status
+// did not change keeps the last transition time of the observed XR
+func setConditions(oxr, dxr *resource.Composite, conditions []condition, now time.Time) error {
+	for i, c := range conditions {
+		if err := c.validate(); err != nil {
+			return errors.Wrapf(err, "invalid condition at index %d", i)
+		}
+		cond := xpv1.Condition{
+			Type:               xpv1.ConditionType(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: metav1.NewTime(now),
+			Reason:             xpv1.ConditionReason(c.Reason),
+			Message:            c.Message,
+		}
+		if observed := oxr.Resource.GetCondition(cond.Type); observed.Status == cond.Status && !observed.LastTransitionTime.IsZero() {
+			cond.LastTransitionTime = observed.LastTransitionTime
+		}
+		dxr.Resource.SetConditions(cond)
+	}
+	return nil
+}
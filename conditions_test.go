@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	xpv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+	"github.com/google/go-cmp/cmp"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSetConditions(t *testing.T) {
+	then := metav1.NewTime(time.Date(2023, 9, 1, 10, 30, 0, 0, time.UTC))
+	now := time.Date(2023, 9, 2, 10, 30, 0, 0, time.UTC)
+	healthy := condition{Type: "DatabaseHealthy", Status: corev1.ConditionTrue, Reason: "Available", Message: "all replicas are available"}
+
+	cases := map[string]struct {
+		reason     string
+		observed   []xpv1.Condition
+		conditions []condition
+		want       []xpv1.Condition
+		wantErr    error
+	}{
+		"NewCondition": {
+			reason:     "A new condition should transition now",
+			conditions: []condition{healthy},
+			want: []xpv1.Condition{{
+				Type: "DatabaseHealthy", Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(now),
+				Reason: "Available", Message: "all replicas are available",
+			}},
+		},
+		"UnchangedStatus": {
+			reason:     "A condition whose status did not change should keep its last transition time",
+			observed:   []xpv1.Condition{{Type: "DatabaseHealthy", Status: corev1.ConditionTrue, LastTransitionTime: then, Reason: "Available"}},
+			conditions: []condition{healthy},
+			want: []xpv1.Condition{{
+				Type: "DatabaseHealthy", Status: corev1.ConditionTrue, LastTransitionTime: then,
+				Reason: "Available", Message: "all replicas are available",
+			}},
+		},
+		"ChangedStatus": {
+			reason:     "A condition whose status changed should transition now",
+			observed:   []xpv1.Condition{{Type: "DatabaseHealthy", Status: corev1.ConditionFalse, LastTransitionTime: then, Reason: "Unavailable"}},
+			conditions: []condition{healthy},
+			want: []xpv1.Condition{{
+				Type: "DatabaseHealthy", Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(now),
+				Reason: "Available", Message: "all replicas are available",
+			}},
+		},
+		"InvalidStatus": {
+			reason:     "A condition with an invalid status should return an error",
+			conditions: []condition{{Type: "DatabaseHealthy", Status: "Yes", Reason: "Available"}},
+			wantErr:    errors.Wrapf(errors.Errorf("invalid status %q: must be True, False or Unknown", "Yes"), "invalid condition at index %d", 0),
+		},
+		"Managed": {
+			reason:     "The conditions managed by Crossplane should not be set",
+			conditions: []condition{{Type: "Ready", Status: corev1.ConditionTrue, Reason: "Available"}},
+			wantErr:    errors.Wrapf(errors.Errorf("type %s is managed by Crossplane", "Ready"), "invalid condition at index %d", 0),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			oxr := &resource.Composite{Resource: composite.New()}
+			oxr.Resource.SetConditions(tc.observed...)
+			dxr := &resource.Composite{Resource: composite.New()}
+
+			err := setConditions(oxr, dxr, tc.conditions, now)
+			if diff := cmp.Diff(tc.wantErr, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nsetConditions(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			var got []xpv1.Condition
+			if err := dxr.Resource.GetValueInto("status.conditions", &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nsetConditions(...): -want conditions, +got conditions:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionConditions(t *testing.T) {
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "conditions"},
+			"export": {
+				"target": "XR",
+				"value": "#conditions: [{\n\ttype: \"DatabaseHealthy\"\n\tstatus: \"False\"\n\treason: \"ReplicasUnavailable\"\n\tmessage: \"\\(#observed.composite.spec.replicas) replicas are unavailable\"\n}]\nspec: replicas: #observed.composite.spec.replicas\n"
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}, "spec": {"replicas": 3}}`),
+			},
+		},
+	}
+	now := time.Date(2023, 9, 1, 10, 30, 0, 0, time.UTC)
+	f := &Function{log: logging.NewNopLogger(), now: func() time.Time { return now }}
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := resource.MustStructJSON(`{
+		"apiVersion": "example.org/v1",
+		"kind": "XR",
+		"spec": {"replicas": 3},
+		"status": {"conditions": [{
+			"type": "DatabaseHealthy",
+			"status": "False",
+			"lastTransitionTime": "2023-09-01T10:30:00Z",
+			"reason": "ReplicasUnavailable",
+			"message": "3 replicas are unavailable"
+		}]}
+	}`).AsMap()
+	if diff := cmp.Diff(want, rsp.GetDesired().GetComposite().GetResource().AsMap()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want desired XR, +got desired XR:\n%s\nresults: %v", diff, rsp.GetResults())
+	}
+}
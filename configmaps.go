@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// configMapCacheSize is the number of ConfigMaps the function caches
+const configMapCacheSize = 64
+
+// configMapGetter returns the data of the ConfigMap
+type configMapGetter func(ctx context.Context, namespace, name string) (map[string]string, error)
+
+// inClusterConfigMaps returns a getter of the ConfigMaps of the cluster the
+// function runs in, the client is only created on first use so that the
+// function runs outside of a cluster as long as no export references a
+// ConfigMap
+func inClusterConfigMaps() configMapGetter {
+	var (
+		once   sync.Once
+		client corev1.CoreV1Interface
+		err    error
+	)
+	return func(ctx context.Context, namespace, name string) (map[string]string, error) {
+		once.Do(func() {
+			var cfg *rest.Config
+			if cfg, err = rest.InClusterConfig(); err != nil {
+				err = errors.Wrap(err, "cannot get in-cluster config")
+				return
+			}
+			client, err = corev1.NewForConfig(cfg)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create kubernetes client")
+		}
+		cm, err := client.ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return cm.Data, nil
+	}
+}
+
+// configMapValues fetches the values of exports from ConfigMaps. A fetched
+// ConfigMap is cached and polled again once it is older than the refresh
+// interval, the least recently fetched ConfigMap is evicted from a full cache.
+// The cached copy of a ConfigMap that cannot be polled again is served stale,
+// unless the ConfigMap no longer exists.
+type configMapValues struct {
+	get     configMapGetter
+	refresh time.Duration
+	size    int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cachedConfigMap
+}
+
+// cachedConfigMap is the data of a ConfigMap and the time it was fetched
+type cachedConfigMap struct {
+	data    map[string]string
+	fetched time.Time
+}
+
+// newConfigMapValues returns the values of the ConfigMaps of the getter, a
+// ConfigMap is polled again once it is older than refresh and at most size
+// ConfigMaps are cached
+func newConfigMapValues(get configMapGetter, refresh time.Duration, size int) *configMapValues {
+	return &configMapValues{
+		get:     get,
+		refresh: refresh,
+		size:    size,
+		now:     time.Now,
+		entries: map[string]cachedConfigMap{},
+	}
+}
+
+// Resolve returns the value at the key of the referenced ConfigMap, and
+// whether it is served stale
+func (c *configMapValues) Resolve(ctx context.Context, ref v1beta1.ConfigMapKeyRef) (string, *staleValue, error) {
+	data, stale, err := c.data(ctx, ref.Namespace, ref.Name)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "cannot get ConfigMap %s/%s", ref.Namespace, ref.Name)
+	}
+	value, ok := data[ref.Key]
+	if !ok {
+		return "", nil, errors.Errorf("ConfigMap %s/%s has no key %q", ref.Namespace, ref.Name, ref.Key)
+	}
+	return value, stale, nil
+}
+
+// data returns the data of the ConfigMap from the cache, or fetches it when it
+// is not cached or older than the refresh interval. The cached data is served
+// stale when the ConfigMap cannot be fetched.
+func (c *configMapValues) data(ctx context.Context, namespace, name string) (map[string]string, *staleValue, error) {
+	key := namespace + "/" + name
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Sub(e.fetched) < c.refresh {
+		return e.data, nil, nil
+	}
+
+	data, err := c.get(ctx, namespace, name)
+	if err != nil {
+		if ok && !kerrors.IsNotFound(err) {
+			return e.data, &staleValue{source: "ConfigMap " + key, age: c.now().Sub(e.fetched), err: err}, nil
+		}
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		oldest := ""
+		for k, e := range c.entries {
+			if oldest == "" || e.fetched.Before(c.entries[oldest].fetched) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = cachedConfigMap{data: data, fetched: c.now()}
+	return data, nil, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestConfigMapValues(t *testing.T) {
+	errBoom := errors.New("boom")
+	start := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	// resolve is a resolution of a ConfigMap key after the elapsed time
+	type resolve struct {
+		ref     v1beta1.ConfigMapKeyRef
+		elapsed time.Duration
+	}
+	ref := func(name, key string) v1beta1.ConfigMapKeyRef {
+		return v1beta1.ConfigMapKeyRef{Namespace: "crossplane-system", Name: name, Key: key}
+	}
+	cases := map[string]struct {
+		reason   string
+		size     int
+		resolves []resolve
+		fail     bool
+		// failFrom fails the fetches from the fetch at the index, when set
+		failFrom int
+		failErr  error
+		// wantFetches are the ConfigMaps fetched, in order
+		wantFetches []string
+		wantValues  []string
+		// wantStale are whether each value is served stale
+		wantStale []bool
+		wantErr   bool
+	}{
+		"Cached": {
+			reason:      "A ConfigMap should be fetched once within the refresh interval",
+			size:        2,
+			resolves:    []resolve{{ref: ref("a", "template.cue")}, {ref: ref("a", "other.cue"), elapsed: 30 * time.Second}},
+			wantFetches: []string{"crossplane-system/a"},
+			wantValues:  []string{"a: template.cue", "a: other.cue"},
+		},
+		"Refreshed": {
+			reason:      "A ConfigMap older than the refresh interval should be fetched again",
+			size:        2,
+			resolves:    []resolve{{ref: ref("a", "template.cue")}, {ref: ref("a", "template.cue"), elapsed: 2 * time.Minute}},
+			wantFetches: []string{"crossplane-system/a", "crossplane-system/a"},
+			wantValues:  []string{"a: template.cue", "a: template.cue"},
+		},
+		"Evicted": {
+			reason:      "The least recently fetched ConfigMap should be evicted from a full cache",
+			size:        1,
+			resolves:    []resolve{{ref: ref("a", "template.cue")}, {ref: ref("b", "template.cue")}, {ref: ref("a", "template.cue")}},
+			wantFetches: []string{"crossplane-system/a", "crossplane-system/b", "crossplane-system/a"},
+			wantValues:  []string{"a: template.cue", "b: template.cue", "a: template.cue"},
+		},
+		"MissingKey": {
+			reason:      "A key missing from the ConfigMap should return an error",
+			size:        1,
+			resolves:    []resolve{{ref: ref("a", "missing.cue")}},
+			wantFetches: []string{"crossplane-system/a"},
+			wantErr:     true,
+		},
+		"FetchError": {
+			reason:      "A ConfigMap that cannot be fetched should return an error",
+			size:        1,
+			resolves:    []resolve{{ref: ref("a", "template.cue")}},
+			fail:        true,
+			wantFetches: []string{"crossplane-system/a"},
+			wantErr:     true,
+		},
+		"Stale": {
+			reason:      "The cached copy of a ConfigMap that cannot be fetched again should be served stale",
+			size:        1,
+			resolves:    []resolve{{ref: ref("a", "template.cue")}, {ref: ref("a", "template.cue"), elapsed: 2 * time.Minute}},
+			failFrom:    1,
+			failErr:     errBoom,
+			wantFetches: []string{"crossplane-system/a", "crossplane-system/a"},
+			wantValues:  []string{"a: template.cue", "a: template.cue"},
+			wantStale:   []bool{false, true},
+		},
+		"Deleted": {
+			reason:      "The cached copy of a ConfigMap that no longer exists should not be served",
+			size:        1,
+			resolves:    []resolve{{ref: ref("a", "template.cue")}, {ref: ref("a", "template.cue"), elapsed: 2 * time.Minute}},
+			failFrom:    1,
+			failErr:     kerrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, "a"),
+			wantFetches: []string{"crossplane-system/a", "crossplane-system/a"},
+			wantValues:  []string{"a: template.cue"},
+			wantStale:   []bool{false},
+			wantErr:     true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var fetches []string
+			get := func(_ context.Context, namespace, name string) (map[string]string, error) {
+				fetches = append(fetches, namespace+"/"+name)
+				if tc.fail {
+					return nil, errBoom
+				}
+				if tc.failErr != nil && len(fetches) > tc.failFrom {
+					return nil, tc.failErr
+				}
+				return map[string]string{"template.cue": name + ": template.cue", "other.cue": name + ": other.cue"}, nil
+			}
+			c := newConfigMapValues(get, time.Minute, tc.size)
+			now := start
+			c.now = func() time.Time { return now }
+
+			var values []string
+			var stale []bool
+			for i, r := range tc.resolves {
+				now = now.Add(r.elapsed)
+				v, s, err := c.Resolve(context.Background(), r.ref)
+				if tc.wantErr && i == len(tc.resolves)-1 {
+					if err == nil {
+						t.Errorf("%s\nResolve(...): want error, got none", tc.reason)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s\nResolve(...): unexpected error: %v", tc.reason, err)
+				}
+				values = append(values, v)
+				stale = append(stale, s != nil)
+			}
+			if diff := cmp.Diff(tc.wantFetches, fetches); diff != "" {
+				t.Errorf("%s\nResolve(...): -want fetches, +got fetches:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantValues, values); diff != "" {
+				t.Errorf("%s\nResolve(...): -want values, +got values:\n%s", tc.reason, diff)
+			}
+			if tc.wantStale != nil {
+				if diff := cmp.Diff(tc.wantStale, stale); diff != "" {
+					t.Errorf("%s\nResolve(...): -want stale, +got stale:\n%s", tc.reason, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFunctionValueFrom(t *testing.T) {
+	template := "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n"
+	get := func(_ context.Context, _, _ string) (map[string]string, error) {
+		return map[string]string{"template.cue": template}, nil
+	}
+	wrongDigest := "sha256:" + strings.Repeat("0", 64)
+
+	cases := map[string]struct {
+		reason    string
+		digest    string
+		wantFatal string
+	}{
+		"Unpinned": {
+			reason: "A value without a digest should be compiled",
+		},
+		"Pinned": {
+			reason: "A value matching its pinned digest should be compiled",
+			digest: sha256Digest([]byte(template)),
+		},
+		"DigestMismatch": {
+			reason:    "A value not matching its pinned digest should fail the function",
+			digest:    wrongDigest,
+			wantFatal: "cannot verify valueFrom: digest " + sha256Digest([]byte(template)) + " does not match the pinned digest " + wrongDigest,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), configMaps: newConfigMapValues(get, time.Minute, 1)}
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(`{
+					"apiVersion": "cue.fn.crossplane.io/v1beta1",
+					"kind": "CUEInput",
+					"metadata": {"name": "configmap"},
+					"export": {
+						"target": "Resources",
+						"valueFrom": {
+							"configMapRef": {"namespace": "crossplane-system", "name": "templates", "key": "template.cue"},
+							"digest": "` + tc.digest + `"
+						}
+					}
+				}`),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantFatal != "" {
+				got := ""
+				if err := fatalResult(rsp); err != nil {
+					got = err.Error()
+				}
+				if diff := cmp.Diff(tc.wantFatal, got); diff != "" {
+					t.Errorf("%s\nRunFunction(...): -want fatal result, +got fatal result:\n%s", tc.reason, diff)
+				}
+				return
+			}
+			if err := fatalResult(rsp); err != nil {
+				t.Fatalf("%s\nRunFunction(...): unexpected fatal result: %v", tc.reason, err)
+			}
+			if _, ok := rsp.GetDesired().GetResources()["configmap"]; !ok {
+				t.Errorf("%s\nRunFunction(...): want the resource rendered from the ConfigMap, got %v", tc.reason, rsp.GetDesired().GetResources())
+			}
+		})
+	}
+}
+
+func TestRunFunctionStaleValue(t *testing.T) {
+	template := "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n"
+	fetched := false
+	get := func(_ context.Context, _, _ string) (map[string]string, error) {
+		if fetched {
+			return nil, errors.New("connection refused")
+		}
+		fetched = true
+		return map[string]string{"template.cue": template}, nil
+	}
+	start := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	configMaps := newConfigMapValues(get, time.Minute, 1)
+	configMaps.now = func() time.Time { return now }
+	reg := prometheus.NewRegistry()
+	f := &Function{log: logging.NewNopLogger(), configMaps: configMaps, metrics: newMetrics(reg, nil)}
+
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "configmap"},
+			"export": {
+				"target": "Resources",
+				"valueFrom": {"configMapRef": {"namespace": "crossplane-system", "name": "templates", "key": "template.cue"}}
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+			},
+		},
+	}
+	if _, err := f.RunFunction(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	now = start.Add(90 * time.Second)
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fatalResult(rsp); err != nil {
+		t.Fatalf("RunFunction(...): unexpected fatal result: %v", err)
+	}
+	if _, ok := rsp.GetDesired().GetResources()["configmap"]; !ok {
+		t.Errorf("RunFunction(...): want the resource rendered from the stale ConfigMap, got %v", rsp.GetDesired().GetResources())
+	}
+	var warnings []string
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_WARNING {
+			warnings = append(warnings, r.GetMessage())
+		}
+	}
+	want := []string{"serving a stale copy of ConfigMap crossplane-system/templates fetched 1m30s ago: cannot refresh it: connection refused"}
+	if diff := cmp.Diff(want, warnings); diff != "" {
+		t.Errorf("RunFunction(...): -want warnings, +got warnings:\n%s", diff)
+	}
+
+	wantMetrics := `
+# HELP function_cue_stale_value_age_seconds Age in seconds of the last value served stale because its remote source could not be refreshed, by source. It is reset to 0 once the source is refreshed.
+# TYPE function_cue_stale_value_age_seconds gauge
+function_cue_stale_value_age_seconds{source="configmap"} 90
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(wantMetrics), "function_cue_stale_value_age_seconds"); err != nil {
+		t.Errorf("GatherAndCompare(...): %v", err)
+	}
+}
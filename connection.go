@@ -1,10 +1,12 @@
 package main
 
 import (
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
 	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
 	"github.com/crossplane/crossplane-runtime/pkg/reconciler/managed"
 	"github.com/crossplane/function-sdk-go/resource"
 
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/apimachinery/pkg/util/validation/field"
@@ -98,6 +100,40 @@ func extractConnectionDetails(observed map[resource.Name]resource.ObservedCompos
 	return out, nil
 }
 
+// connectionDetailsAnnotation holds a JSON list of the connection details of
+// the document it annotates, they match the document so they don't need to
+// repeat its apiVersion, kind and name like #connectionDetails
+const connectionDetailsAnnotation = "function-cue.fn/connection-details"
+
+// takeConnectionDetails removes the connectionDetailsAnnotation from the
+// documents and returns the connection details it held
+func takeConnectionDetails(data []map[string]interface{}) ([]connectionDetail, error) {
+	var out []connectionDetail
+	for _, d := range data {
+		u := unstructured.Unstructured{Object: d}
+		annotations := u.GetAnnotations()
+		v, ok := annotations[connectionDetailsAnnotation]
+		if !ok {
+			continue
+		}
+		var details []connectionDetail
+		if err := json.Unmarshal([]byte(v), &details); err != nil {
+			return nil, errors.Wrapf(err, "cannot parse %s annotation of %s %q", connectionDetailsAnnotation, u.GetKind(), u.GetName())
+		}
+		for _, detail := range details {
+			detail.Match = match{ApiVersion: u.GetAPIVersion(), Kind: u.GetKind(), Name: u.GetName()}
+			out = append(out, detail)
+		}
+
+		delete(annotations, connectionDetailsAnnotation)
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		u.SetAnnotations(annotations)
+	}
+	return out, nil
+}
+
 // fromFieldPath tries to read the value from the supplied field path first as a
 // plain string. If this fails, it falls back to reading it as JSON.
 func fromFieldPath(from runtime.Object, path string) ([]byte, error) {
@@ -131,4 +131,79 @@ func TestExtractConnectionDetails(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestTakeConnectionDetails(t *testing.T) {
+	bucket := func(annotations map[string]interface{}) map[string]interface{} {
+		metadata := map[string]interface{}{"name": "bucket"}
+		if annotations != nil {
+			metadata["annotations"] = annotations
+		}
+		return map[string]interface{}{"apiVersion": "s3.nobu.dev/v1", "kind": "Bucket", "metadata": metadata}
+	}
+
+	cases := map[string]struct {
+		reason   string
+		data     []map[string]interface{}
+		want     []connectionDetail
+		wantData []map[string]interface{}
+		wantErr  bool
+	}{
+		"Annotated": {
+			reason: "Connection details annotated on a document should match the document and the annotation should be removed",
+			data: []map[string]interface{}{
+				bucket(map[string]interface{}{
+					connectionDetailsAnnotation: `[{"name": "bucket-arn", "type": "FromFieldPath", "fromFieldPath": "status.atProvider.arn"}]`,
+					"example.org/keep":          "true",
+				}),
+			},
+			want: []connectionDetail{{
+				Match:         match{ApiVersion: "s3.nobu.dev/v1", Kind: "Bucket", Name: "bucket"},
+				Name:          "bucket-arn",
+				Type:          connectionDetailTypeFromFieldPath,
+				FromFieldPath: pointer.String("status.atProvider.arn"),
+			}},
+			wantData: []map[string]interface{}{bucket(map[string]interface{}{"example.org/keep": "true"})},
+		},
+		"OnlyAnnotation": {
+			reason: "The annotations should be removed when the connection details were the only annotation",
+			data: []map[string]interface{}{
+				bucket(map[string]interface{}{connectionDetailsAnnotation: `[{"name": "password", "type": "FromConnectionSecretKey", "fromConnectionSecretKey": "attribute.password"}]`}),
+			},
+			want: []connectionDetail{{
+				Match:                   match{ApiVersion: "s3.nobu.dev/v1", Kind: "Bucket", Name: "bucket"},
+				Name:                    "password",
+				Type:                    connectionDetailTypeFromConnectionSecretKey,
+				FromConnectionSecretKey: pointer.String("attribute.password"),
+			}},
+			wantData: []map[string]interface{}{{"apiVersion": "s3.nobu.dev/v1", "kind": "Bucket", "metadata": map[string]interface{}{"name": "bucket"}}},
+		},
+		"NotAnnotated": {
+			reason:   "Documents without the annotation should be left unchanged",
+			data:     []map[string]interface{}{bucket(nil)},
+			wantData: []map[string]interface{}{bucket(nil)},
+		},
+		"InvalidAnnotation": {
+			reason:  "An annotation that is not a JSON list of connection details should return an error",
+			data:    []map[string]interface{}{bucket(map[string]interface{}{connectionDetailsAnnotation: "password"})},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := takeConnectionDetails(tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("\n%s\ntakeConnectionDetails(...): unexpected error: %v", tc.reason, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("\n%s\ntakeConnectionDetails(...): -want details, +got details:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantData, tc.data); diff != "" {
+				t.Errorf("\n%s\ntakeConnectionDetails(...): -want data, +got data:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -3,16 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/crossplane-contrib/function-cue/input/v1beta1"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/ast/astutil"
 	"cuelang.org/go/cue/build"
+	"cuelang.org/go/cue/cuecontext"
 	"cuelang.org/go/cue/errors"
 	"cuelang.org/go/cue/load"
 	"cuelang.org/go/cue/parser"
@@ -50,20 +57,124 @@ const (
 	outputTXT  cueOutputFmt = cueOutputFmt(inputTXT)
 )
 
-type compiler struct {
-	encoder *encoder
-	data    []map[string]interface{}
-	strData []string
-	outBuf  *bytes.Buffer
-	outFmt  cueOutputFmt
-	value   cue.Value
+// cueContexts are the long-lived cue contexts templates are built in outside of
+// the workers of an evalPool, such as by the commands of the cli. A context is
+// not safe for concurrent use, so each compilation takes one from the pool and
+// returns it once the values built in it are decoded.
+var cueContexts = sync.Pool{
+	New: func() interface{} { return &cueContext{Context: cuecontext.New()} },
 }
 
-// newCompiler creates a new cue compiler based off the input/output formats, tags and expressions
-// a cue api config is created and cue Instances are built off of the input template
-// the cue instance value is wrapped with the expression if it is passed
-// validation on the cue template is also run during this step
-func newCompiler(input string, inputFmt cueInputFmt, outputFmt cueOutputFmt, expr *ast.Expr, tags []string) (*compiler, error) {
+// maxContextBuilds is the number of templates built in a context before it is
+// retired, a context keeps every instance built in it so reusing it forever
+// would grow the memory of the function without bound
+const maxContextBuilds = 1000
+
+// cueContext is a pooled cue context and the number of templates built in it,
+// which is counted by the compilations building in it
+type cueContext struct {
+	*cue.Context
+	builds int
+}
+
+// acquireCUEContext takes a context from the pool
+func acquireCUEContext() *cueContext {
+	return cueContexts.Get().(*cueContext)
+}
+
+// releaseCUEContext returns the context to the pool unless it is retired
+func releaseCUEContext(c *cueContext) {
+	if c.builds < maxContextBuilds {
+		cueContexts.Put(c)
+	}
+}
+
+// stateDefs returns the definitions the pipeline state is filled into and
+// their state, #observed, #desired, #context, #extraResources, #meta and
+// #values are declared for the template so that they can be referenced without
+// declaring them, as is #request when the export injects the request
+func stateDefs(opts compileOpts) ([]string, map[string]map[string]interface{}) {
+	states := map[string]map[string]interface{}{
+		observedDef:       opts.observed,
+		desiredDef:        opts.desired,
+		contextDef:        opts.context,
+		extraResourcesDef: opts.extraResources,
+		metaDef:           opts.meta,
+		valuesDef:         opts.inputValues,
+		requestDef:        opts.request,
+	}
+	var defs []string
+	for _, def := range []string{observedDef, desiredDef, contextDef, extraResourcesDef, metaDef, valuesDef, requestDef} {
+		if states[def] != nil {
+			defs = append(defs, def)
+		}
+	}
+	return defs, states
+}
+
+// buildTemplate builds the template into a cue value in the context and
+// declares the definitions of the pipeline state, the tags are only filled
+// into the built template
+func buildTemplate(ctx *cue.Context, input string, opts compileOpts) (cue.Value, error) {
+	defs, _ := stateDefs(opts)
+	switch {
+	case opts.module != nil:
+		return loadModule(ctx, *opts.module, defs...)
+	case opts.dir != "":
+		return loadDir(ctx, opts.dir, defs...)
+	default:
+		return loadValue(ctx, input, inputCUE, opts.libraries, nil, defs...)
+	}
+}
+
+// fillTemplate fills the built template, the supplied tags and values are
+// filled into their matching @tag fields, opts.now is injected into #now and
+// the pipeline state is filled into its definitions
+func fillTemplate(inst cue.Value, opts compileOpts) (cue.Value, error) {
+	defs, states := stateDefs(opts)
+	v, err := fillTags(inst, opts.tags, opts.values)
+	if err != nil {
+		return v, err
+	}
+	v = fillNow(v, opts.now)
+	for _, def := range defs {
+		v = v.FillPath(cue.MakePath(cue.Def(def)), states[def])
+	}
+	return v, nil
+}
+
+// lookupExportPath returns the sub-value of the template at the path, an empty
+// path is the template itself
+func lookupExportPath(v cue.Value, path string) (cue.Value, error) {
+	if path == "" {
+		return v, nil
+	}
+	p := cue.ParsePath(path)
+	if err := p.Err(); err != nil {
+		return v, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	sub := v.LookupPath(p)
+	if !sub.Exists() {
+		return v, fmt.Errorf("path %q not found in the template", path)
+	}
+	return sub, nil
+}
+
+// evalExpr evaluates the expression in the scope of the template, a nil
+// expression evaluates to the template itself
+func evalExpr(v cue.Value, expr ast.Expr) cue.Value {
+	if expr == nil {
+		return v
+	}
+	return v.Context().BuildExpr(expr,
+		cue.Scope(v),
+		cue.InferBuiltins(true),
+	)
+}
+
+// loadValue loads and builds the input into a cue value, the supplied tags are injected into the build
+// and the definitions are declared for the input
+func loadValue(ctx *cue.Context, input string, inputFmt cueInputFmt, libraries map[string]string, tags []string, defs ...string) (cue.Value, error) {
 	loadCfg := &load.Config{
 		Stdin:      strings.NewReader(input),
 		Dir:        "/",
@@ -73,292 +184,794 @@ func newCompiler(input string, inputFmt cueInputFmt, outputFmt cueOutputFmt, exp
 		},
 		Tags: tags,
 	}
-	builds := load.Instances([]string{string(inputFmt) + ":", "-"}, loadCfg)
+	args := []string{string(inputFmt) + ":", "-"}
+	// The libraries are files of the package of the value, sorted so that
+	// the instance is built the same way for each compilation
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := libraryPath(name)
+		loadCfg.Overlay[p] = load.FromString(libraries[name])
+		args = append(args, p)
+	}
+	builds := load.Instances(args, loadCfg)
 	if len(builds) < 1 {
-		return &compiler{}, fmt.Errorf("cannot load instances: %s", string(inputFmt))
-	} else if err := builds[0].Err; err != nil {
-		return &compiler{}, fmt.Errorf("failed to load: %w", err)
+		return cue.Value{}, fmt.Errorf("cannot load instances: %s", string(inputFmt))
 	}
+	if len(names) != 0 {
+		joinPackage(builds[0])
+	}
+	return buildValue(ctx, builds, defs...)
+}
+
+// libraryPackage is the package of a value and its libraries when none of
+// their files declare a package
+const libraryPackage = "template"
 
-	insts := cue.Build(builds)
-	if len(insts) < 1 {
-		return &compiler{}, fmt.Errorf("cannot build instances: %+v", *builds[0])
+// joinPackage declares the package of the instance in its files without a
+// package clause, cue only resolves references between the files of a named
+// package. The clause is added to the syntax of the files so that the
+// positions of their errors are unchanged.
+func joinPackage(b *build.Instance) {
+	if b.PkgName == "" {
+		b.PkgName = libraryPackage
 	}
-	inst := insts[0]
-	if err := inst.Err; err != nil {
-		return &compiler{}, fmt.Errorf("failed to build: %w", err)
+	for _, f := range b.Files {
+		if f.PackageName() != "" {
+			continue
+		}
+		f.Decls = append([]ast.Decl{&ast.Package{Name: ast.NewIdent(b.PkgName)}}, f.Decls...)
 	}
-	concrete := true
-	switch outputFmt {
-	case outputCUE:
-		concrete = false
-	case outputJSON, outputYAML, outputTXT:
-	default:
-		return &compiler{}, fmt.Errorf("unsupported output format: %q", outputFmt)
+}
+
+// libraryDir is the directory the libraries of an export are loaded from,
+// they only exist in the overlay of the loader
+const libraryDir = "/"
+
+// libraryPath returns the path the library is loaded from
+func libraryPath(name string) string {
+	return filepath.Join(libraryDir, name)
+}
+
+// loadDir loads and builds the cue package in dir into a cue value, imports are
+// resolved from the cue module containing dir
+func loadDir(ctx *cue.Context, dir string, defs ...string) (cue.Value, error) {
+	builds := load.Instances([]string{"."}, &load.Config{
+		Dir: dir,
+	})
+	if len(builds) < 1 {
+		return cue.Value{}, fmt.Errorf("cannot load instances: %s", dir)
+	}
+	return buildValue(ctx, builds, defs...)
+}
+
+// moduleRoot is the directory modules are loaded from, their files only exist
+// in the overlay of the loader and are never written to disk
+const moduleRoot = "/cue-module"
+
+// loadModule loads and builds the package of the module into a cue value,
+// imports are resolved from the files of the module
+func loadModule(ctx *cue.Context, m v1beta1.Module, defs ...string) (cue.Value, error) {
+	overlay := make(map[string]load.Source, len(m.Files))
+	for p, content := range m.Files {
+		overlay[filepath.Join(moduleRoot, filepath.FromSlash(p))] = load.FromString(content)
+	}
+	dir := filepath.Join(moduleRoot, filepath.FromSlash(m.Package))
+	builds := load.Instances([]string{"."}, &load.Config{
+		Dir:        dir,
+		ModuleRoot: moduleRoot,
+		Overlay:    overlay,
+	})
+	if len(builds) < 1 {
+		return cue.Value{}, fmt.Errorf("cannot load instances: %s", m.Package)
+	}
+	return buildValue(ctx, builds, defs...)
+}
+
+// buildValue builds the first of the loaded instances into a cue value in the
+// context, the definitions are declared as open values in the instance
+func buildValue(ctx *cue.Context, builds []*build.Instance, defs ...string) (cue.Value, error) {
+	if err := builds[0].Err; err != nil {
+		return cue.Value{}, fmt.Errorf("failed to load: %w", err)
+	}
+	if err := embedDocuments(builds[0]); err != nil {
+		return cue.Value{}, fmt.Errorf("cannot declare #%s: %w", documentsDef, err)
+	}
+	for _, def := range defs {
+		if err := declareDef(builds[0], def); err != nil {
+			return cue.Value{}, fmt.Errorf("cannot declare #%s: %w", def, err)
+		}
+	}
+
+	// Build errors are recorded on the instance, the errors of the value are
+	// only known once it is evaluated and are reported when it is validated
+	v := ctx.BuildInstance(builds[0])
+	if err := builds[0].Err; err != nil {
+		return cue.Value{}, fmt.Errorf("failed to build: %w", err)
+	}
+	return v, nil
+}
+
+// embedDocuments moves the lists embedded at the top-level of the files of the
+// instance into the #documents definition, a value cannot be both a list and a
+// struct holding the definitions the pipeline state is filled into. Templates
+// may also set their documents in #documents, which are then exported instead
+// of the template.
+func embedDocuments(b *build.Instance) error {
+	for _, f := range b.Files {
+		moved := false
+		for i, d := range f.Decls {
+			e, ok := d.(*ast.EmbedDecl)
+			if !ok {
+				continue
+			}
+			if _, ok := e.Expr.(*ast.ListLit); !ok {
+				continue
+			}
+			f.Decls[i] = &ast.Field{
+				Label: ast.NewIdent("#" + documentsDef),
+				Value: e.Expr,
+			}
+			moved = true
+		}
+		if !moved {
+			continue
+		}
+		var err errors.Error
+		astutil.Resolve(f, func(pos token.Pos, msg string, args ...interface{}) {
+			err = errors.Append(err, errors.Newf(pos, msg, args...))
+		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	v := inst.Value()
-	if expr != nil {
-		v = v.Context().BuildExpr(*expr,
-			cue.Scope(v),
-			cue.InferBuiltins(true),
-		)
+// declareDef declares the definition as top in the first file of the instance,
+// so that templates can reference a definition filled by the function without
+// declaring it themselves, templates declaring it are left unchanged.
+// Files without a package clause cannot reference each other, so the
+// declaration is added to a file of the template instead of a file of its own
+// and the references of the already parsed file are resolved again
+func declareDef(b *build.Instance, def string) error {
+	if len(b.Files) == 0 {
+		return fmt.Errorf("instance %s has no files", b.DisplayPath)
 	}
-	if err := v.Validate(cue.Concrete(concrete)); err != nil {
-		return &compiler{}, fmt.Errorf("failed to validate: %w", err)
+	for _, f := range b.Files {
+		for _, d := range f.Decls {
+			if field, ok := d.(*ast.Field); ok {
+				if name, _, _ := ast.LabelName(field.Label); name == "#"+def {
+					return nil
+				}
+			}
+		}
 	}
+	f := b.Files[0]
+	f.Decls = append(f.Decls, &ast.Field{
+		Label: ast.NewIdent("#" + def),
+		Value: ast.NewIdent("_"),
+	})
+	var err errors.Error
+	astutil.Resolve(f, func(pos token.Pos, msg string, args ...interface{}) {
+		err = errors.Append(err, errors.Newf(pos, msg, args...))
+	})
+	return err
+}
 
+// encodeValue encodes the evaluated template in the output format
+func encodeValue(v cue.Value, outputFmt cueOutputFmt) (string, error) {
 	f, err := parseFile(string(outputFmt)+":-", exportMode)
 	if err != nil {
-		var buf bytes.Buffer
-		return &compiler{}, fmt.Errorf("failed to parse file from %v: %s", string(outputFmt)+":-", buf.Bytes())
+		return "", fmt.Errorf("failed to parse file from %v: %w", string(outputFmt)+":-", err)
 	}
-	var outBuf bytes.Buffer
-	encConf := &config{
-		Out:    &outBuf,
-		Stdin:  loadCfg.Stdin,
+	var buf bytes.Buffer
+	e, err := newEncoder(f, &config{
+		Out:    &buf,
 		Mode:   exportMode,
 		Schema: v,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to build encoder: %w", err)
+	}
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// decodeDocuments decodes the evaluated template into documents, a struct is
+// a single document, a list holds a document per element and a struct of
+// resources a document per field, a string is parsed as a stream of json or
+// yaml documents
+// The documents are decoded into map[string]interface{} so that they can be
+// applied into an unstructured.Unstructured{Object: map[string]interface{}}
+func decodeDocuments(v cue.Value, format v1beta1.ExportFormat) ([]map[string]interface{}, error) {
+	v, _ = v.Default()
+	if v.Kind() == cue.StringKind {
+		s, err := v.String()
+		if err != nil {
+			return nil, err
+		}
+		return parseStream(s)
 	}
-	e, err := newEncoder(f, encConf)
+	values, err := documentValues(v, format)
 	if err != nil {
-		return &compiler{}, fmt.Errorf("failed to build encoder: %w", err)
+		return nil, err
+	}
+	docs := make([]map[string]interface{}, 0, len(values))
+	for i, dv := range values {
+		doc, err := decodeDocument(dv, i)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
 	}
+	return docs, nil
+}
 
-	return &compiler{
-		encoder: e,
-		outBuf:  &outBuf,
-		outFmt:  outputFmt,
-		value:   v,
-	}, nil
+// documentValues returns the values of the documents of the evaluated template,
+// a struct is a single document unless it is a struct of resources or the
+// format is fields, a list holds a document per element
+func documentValues(v cue.Value, format v1beta1.ExportFormat) ([]cue.Value, error) {
+	var (
+		iter *cue.Iterator
+		err  error
+	)
+	switch v.Kind() {
+	case cue.StructKind:
+		if format == v1beta1.ExportFormatObject || (format != v1beta1.ExportFormatFields && !isResourceStruct(v)) {
+			return []cue.Value{v}, nil
+		}
+		iter, err = v.Fields()
+	case cue.ListKind:
+		var list cue.Iterator
+		list, err = v.List()
+		iter = &list
+	default:
+		return nil, fmt.Errorf("cannot decode documents from %s", v.Kind())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var values []cue.Value
+	for iter.Next() {
+		values = append(values, iter.Value())
+	}
+	return values, nil
 }
 
-func (c *compiler) Compile() error {
-	return c.encoder.Encode(c.value)
+// isResourceStruct reports whether the struct is not a resource itself and each
+// of its fields is one, a resource being a struct with an apiVersion and a kind
+func isResourceStruct(v cue.Value) bool {
+	isResource := func(v cue.Value) bool {
+		return v.IncompleteKind() == cue.StructKind &&
+			v.LookupPath(cue.ParsePath("apiVersion")).Exists() &&
+			v.LookupPath(cue.ParsePath("kind")).Exists()
+	}
+	if isResource(v) {
+		return false
+	}
+	iter, err := v.Fields()
+	if err != nil {
+		return false
+	}
+	n := 0
+	for ; iter.Next(); n++ {
+		if !isResource(iter.Value()) {
+			return false
+		}
+	}
+	return n > 0
 }
 
-// String of the compiled cue template
-func (c compiler) String() string {
-	return c.outBuf.String()
+// decodeDocument decodes the value of the document at the index
+func decodeDocument(v cue.Value, i int) (map[string]interface{}, error) {
+	doc, err := decodeJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("document at index %d is not a struct", i)
+	}
+	return m, nil
 }
 
-// Bytes of the compiled cue template
-func (c compiler) Bytes() []byte {
-	return c.outBuf.Bytes()
+// checkFormat checks the evaluated value of an expression is of the kind of the
+// format of the export, the documents are then decoded by the kind of the
+// value. A stream is a string unless the expression marshals the value, which
+// is then decoded instead.
+func checkFormat(v cue.Value, format v1beta1.ExportFormat, marshalled bool) error {
+	var want cue.Kind
+	switch format {
+	case v1beta1.ExportFormatObject, v1beta1.ExportFormatFields:
+		want = cue.StructKind
+	case v1beta1.ExportFormatList:
+		want = cue.ListKind
+	case v1beta1.ExportFormatStream:
+		if marshalled {
+			return nil
+		}
+		want = cue.StringKind
+	default:
+		return nil
+	}
+	// Values holding non-concrete documents keep the kind they evaluate to
+	v, _ = v.Default()
+	if k := v.IncompleteKind(); k != want {
+		return fmt.Errorf("format %s requires a %s, the expression evaluates to %s", format, want, k)
+	}
+	return nil
 }
 
-// Parse parses the compiled cue template output stored in c.outBuf
-// Into an array of map[string]interface{}
-// It is necessary to compile into a map[string]interface{} so that it can be applied into
-// An unstructured.Unstructured{Object: map[string]interface{}}
-func (c *compiler) Parse() ([]map[string]interface{}, error) {
+// incompleteDocument is a document skipped because it holds non-concrete values
+type incompleteDocument struct {
+	// Index of the document in the generated documents
+	Index int `json:"index"`
+	// Paths of the non-concrete values relative to the document
+	Paths []string `json:"paths"`
+}
+
+// decodeCompleteDocuments decodes the concrete documents of the evaluated
+// template like decodeDocuments, the documents holding non-concrete values are
+// skipped and returned with their non-concrete paths. The index of the first
+// document is offset by the documents already generated.
+func decodeCompleteDocuments(v cue.Value, format v1beta1.ExportFormat, offset int) ([]map[string]interface{}, []incompleteDocument, error) {
+	v, _ = v.Default()
+	if v.Kind() != cue.StructKind && v.Kind() != cue.ListKind {
+		if paths := incompletePaths(v); len(paths) != 0 {
+			return nil, []incompleteDocument{{Index: offset, Paths: paths}}, nil
+		}
+		docs, err := decodeDocuments(v, format)
+		return docs, nil, err
+	}
+
+	values, err := documentValues(v, format)
+	if err != nil {
+		return nil, nil, err
+	}
 	var (
-		data map[string]interface{}
+		docs       []map[string]interface{}
+		incomplete []incompleteDocument
 	)
-
-	// If the current data set is not empty, return that
-	if len(c.data) != 0 {
-		return c.data, nil
+	for i, dv := range values {
+		if paths := incompletePaths(dv); len(paths) != 0 {
+			incomplete = append(incomplete, incompleteDocument{Index: offset + i, Paths: paths})
+			continue
+		}
+		doc, err := decodeDocument(dv, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		docs = append(docs, doc)
 	}
+	return docs, incomplete, nil
+}
 
-	// If there is no data, return an empty data map
-	if len(c.outBuf.Bytes()) == 0 {
-		return c.data, nil
+// incompletePaths returns the paths of the non-concrete values of the value
+// relative to it, in the order they are reported
+func incompletePaths(v cue.Value) []string {
+	err := v.Validate(cue.Concrete(true))
+	if err == nil {
+		return nil
 	}
+	prefix := len(v.Path().Selectors())
+	var paths []string
+	seen := map[string]bool{}
+	for _, e := range errors.Errors(err) {
+		p := e.Path()
+		if len(p) > prefix {
+			p = p[prefix:]
+		} else {
+			p = nil
+		}
+		// A value is reported once per conjunct it is not concrete in
+		if path := strings.Join(p, "."); !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
 
-	// Otherwise parse the data
-	// If there are no expressions, expect a JSON object
-	if c.outFmt == outputJSON {
-		if err := json.Unmarshal(c.Bytes(), &data); err != nil {
-			return c.data, errors.Wrapf(err, token.NoPos, "failed unmarshalling JSON:\n%s", c.String())
+// decodeJSON decodes the concrete value into the types encoding/json decodes
+// JSON into, so that decoded documents are alike to documents parsed from
+// JSON and can be deep copied by unstructured objects
+func decodeJSON(v cue.Value) (interface{}, error) {
+	v, _ = v.Default()
+	switch v.Kind() {
+	case cue.NullKind:
+		return nil, nil
+	case cue.BoolKind:
+		return v.Bool()
+	case cue.IntKind, cue.FloatKind:
+		return v.Float64()
+	case cue.StringKind:
+		return v.String()
+	case cue.BytesKind:
+		b, err := v.Bytes()
+		return base64.StdEncoding.EncodeToString(b), err
+	case cue.ListKind:
+		iter, err := v.List()
+		if err != nil {
+			return nil, err
 		}
-		c.data = append(c.data, data)
-	} else {
-		// If there are MarshalStream expressions, the output will be 'text'
-		// The streamType will determine the document formats
-		scanner := bufio.NewScanner(bytes.NewReader(c.Bytes()))
-		var (
-			document string
-
-			streamType = outputYAML
-		)
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Determine the type of document needed ot be parsed
-			// document will be "" on initialization of a new yaml or json document
-			if document == "" && strings.HasPrefix(line, "{") {
-				streamType = outputJSON
+		l := []interface{}{}
+		for iter.Next() {
+			e, err := decodeJSON(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, e)
+		}
+		return l, nil
+	case cue.StructKind:
+		iter, err := v.Fields()
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		for iter.Next() {
+			f, err := decodeJSON(iter.Value())
+			if err != nil {
+				return nil, err
 			}
+			m[iter.Label()] = f
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("%s: incomplete value %s", v.Path(), v.IncompleteKind())
+	}
+}
 
-			// Check if there are multiple documents
-			if streamType == outputYAML {
-				if line == "---" {
-					// End of document
-					if err := yaml.Unmarshal([]byte(document), &data); err != nil {
-						return c.data, errors.Wrapf(err, token.NoPos, "failed unmarshalling YAML to JSON:\n%s", document)
-					}
-					c.data = append(c.data, data)
+// decodeDef decodes the definition of the template into the output, a template
+// that does not declare the definition leaves the output unset
+func decodeDef(v cue.Value, def outputDef, into interface{}) error {
+	dv := v.LookupPath(cue.MakePath(cue.Def(string(def))))
+	if !dv.Exists() {
+		return nil
+	}
+	if err := dv.Validate(cue.Concrete(true)); err != nil {
+		return fmt.Errorf("failed to validate: %w", err)
+	}
+	return dv.Decode(into)
+}
 
-					// Reset document and data
-					document = ""
-					data = map[string]interface{}{}
-				} else {
-					document += fmt.Sprintln(line)
-				}
-			} else if streamType == outputJSON {
-				// If the line is empty skip it
-				if strings.TrimSuffix(line, "\n") == "" {
-					continue
-				}
+// parseStream parses a stream of json documents, one per line, or of yaml
+// documents separated by ---, as produced by json.MarshalStream and
+// yaml.MarshalStream
+func parseStream(s string) ([]map[string]interface{}, error) {
+	var (
+		docs []map[string]interface{}
+		data map[string]interface{}
+	)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	var (
+		document string
 
-				// JSON Documents come out line by line
-				if err := json.Unmarshal([]byte(line), &data); err != nil {
-					return c.data, errors.Wrapf(err, token.NoPos, "failed unmarshalling JSON:\n%s", line)
+		streamType = outputYAML
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Determine the type of document needed ot be parsed
+		// document will be "" on initialization of a new yaml or json document
+		if document == "" && strings.HasPrefix(line, "{") {
+			streamType = outputJSON
+		}
+
+		// Check if there are multiple documents
+		if streamType == outputYAML {
+			if line == "---" {
+				// End of document
+				if err := yaml.Unmarshal([]byte(document), &data); err != nil {
+					return docs, errors.Wrapf(err, token.NoPos, "failed unmarshalling YAML to JSON:\n%s", document)
 				}
-				c.data = append(c.data, data)
+				docs = append(docs, data)
 
+				// Reset document and data
 				document = ""
 				data = map[string]interface{}{}
 			} else {
-				return c.data, fmt.Errorf("unknown stream type %s", streamType)
+				document += fmt.Sprintln(line)
+			}
+		} else {
+			// If the line is empty skip it
+			if strings.TrimSuffix(line, "\n") == "" {
+				continue
 			}
-		}
 
-		// Check if there is a document left over
-		// this is only necessary for yaml documents since they are multiline and sepaarated by ---
-		// If the multiline yaml ends with --- the document will get set to "" on sucess
-		if document != "" && streamType == outputYAML {
-			// End of document
-			if err := yaml.Unmarshal([]byte(document), &data); err != nil {
-				return c.data, errors.Wrapf(err, token.NoPos, "failed unmarshalling YAML to JSON:\n%s", document)
+			// JSON Documents come out line by line
+			if err := json.Unmarshal([]byte(line), &data); err != nil {
+				return docs, errors.Wrapf(err, token.NoPos, "failed unmarshalling JSON:\n%s", line)
 			}
-			c.data = append(c.data, data)
+			docs = append(docs, data)
+
+			document = ""
+			data = map[string]interface{}{}
 		}
 	}
-	return c.data, nil
+
+	// Check if there is a document left over
+	// this is only necessary for yaml documents since they are multiline and sepaarated by ---
+	// If the multiline yaml ends with --- the document will get set to "" on sucess
+	if document != "" && streamType == outputYAML {
+		// End of document
+		if err := yaml.Unmarshal([]byte(document), &data); err != nil {
+			return docs, errors.Wrapf(err, token.NoPos, "failed unmarshalling YAML to JSON:\n%s", document)
+		}
+		docs = append(docs, data)
+	}
+	return docs, nil
 }
 
 // compileOpts informs the compiler weather or not to parse the data into []map[string]interface
 // or to only return the output, this is really only used during cue_test.go as fn_test.go covers the parsing
 // this allows for cue_tests to output any type of data format, allowing easier test coverage of general
-// cue functionality, the supplied tags are injected into the build
+// cue functionality, the supplied tags and values are filled into their matching
+// @tag fields of the built template, a non zero now is injected as #now
+// and a non empty dir loads the cue package in dir instead of the input value
 type compileOpts struct {
 	parseData bool
 	tags      []string
+	values    map[string]interface{}
+	now       time.Time
+	dir       string
+	module    *v1beta1.Module
+	// libraries are compiled in the package of the inline value
+	libraries map[string]string
+	// observed is the observed state filled into #observed
+	observed map[string]interface{}
+	// desired is the desired state filled into #desired
+	desired map[string]interface{}
+	// context is the pipeline context filled into #context
+	context map[string]interface{}
+	// extraResources are the extra resources filled into #extraResources
+	extraResources map[string]interface{}
+	// meta is the metadata of the request filled into #meta
+	meta map[string]interface{}
+	// inputValues are the values of the input filled into #values
+	inputValues map[string]interface{}
+	// request is the RunFunctionRequest filled into #request when the export
+	// injects it
+	request map[string]interface{}
+	// cache caches the built template when set, templates loaded from a
+	// directory are not cached
+	cache *templateCache
+	// cueCtx is the context of the evaluation worker the template is built in
+	// when it is not cached, a context is taken from the pool when unset
+	cueCtx *cueContext
+	// limits bound the output of the compilation
+	limits evalLimits
 }
 
-var (
-	errConnectionDetailsNotFound = fmt.Errorf("failed to validate: reference \"#%s\" not found", connectionDetails)
-	errReadinessChecksNotFound   = fmt.Errorf("failed to validate: reference \"#%s\" not found", readinessChecks)
-)
-
 type compileOutput struct {
 	// Data is the parsed output data, excluding configuration expressions
 	data           []map[string]interface{}
 	connectionData []connectionDetail
 	readinessData  []readinessCheck
-	string         string
+	requirements   map[string]extraResourceSelector
+	conditions     []condition
+	results        []result
+	// incomplete are the documents skipped for holding non-concrete values
+	// when the export allows incomplete values
+	incomplete []incompleteDocument
+	// expressions are the documents decoded from each named expression
+	expressions []expressionOutput
+	string      string
+}
+
+// expressionOutput is the number of documents a named expression decoded to
+type expressionOutput struct {
+	Name      string         `json:"name"`
+	Target    v1beta1.Target `json:"target,omitempty"`
+	Documents int            `json:"documents"`
+}
+
+// appendExpression appends the documents of the expression to the outputs of
+// the named expressions, unnamed expressions are not reported
+func appendExpression(outputs []expressionOutput, x v1beta1.Expression, documents int) []expressionOutput {
+	if x.Name == "" {
+		return outputs
+	}
+	return append(outputs, expressionOutput{Name: x.Name, Target: x.Target, Documents: documents})
+}
+
+// rendered returns the output as text, the decoded documents are rendered as
+// json on demand rather than on every compilation as they can be large
+func (o compileOutput) rendered() string {
+	if len(o.data) == 0 {
+		return o.string
+	}
+	var b strings.Builder
+	for _, d := range o.data {
+		r, err := json.MarshalIndent(d, "", "    ")
+		if err != nil {
+			fmt.Fprintf(&b, "failed rendering cue output: %v\n", err)
+			continue
+		}
+		b.Write(r)
+		b.WriteString("\n")
+	}
+	return b.String()
 }
 
 // cueCompile starting point for cue compilation
 // Compiles a CUE template depending on the CUEInput configuration
-// Passed in input and defined by the cueOutputFmt
-// Returns both an array of parsed maps of the data and string representations of the data
+// The template is built once in a pooled cue context and each expression is
+// evaluated against it, with parseData the documents are decoded from the
+// evaluated values, otherwise they are encoded in the cueOutputFmt
 //
-// #connectionDetails is injected into the expressionList in order to allow the user to provider
-// connectionDetails per document
-// This will probably need to be refactored if more information is passed to the compiler this way
+// The definitions the template sets the function outputs in, such as
+// #connectionDetails, are decoded into their fields of the output
 func cueCompile(out cueOutputFmt, input v1beta1.CUEInput, opts compileOpts) (compileOutput, error) {
 	var (
 		output compileOutput
 	)
 	// Build list of expressions from input
-	exprs, err := buildExprs(input)
+	exprs, specs, err := exportExprs(input.Export)
 	if err != nil {
 		return output, fmt.Errorf("failed building expression(s): %w", err)
 	}
-	// #connectionDetails expression is always injected into the end of the expression list
-	// #readinessChecks expression is always injected into the end of the expression list
-	if len(exprs) != len(input.Export.Options.Expressions)+len(defaultExprs) {
-		return output, fmt.Errorf("number of expressions %d!=%d expressions input", len(exprs), len(input.Export.Options.Expressions))
+	// A template without expressions is exported as a whole
+	if len(exprs) == 0 {
+		exprs = []ast.Expr{nil}
 	}
-	// if the only expression in the list is #connectionDetails and #readinessChecks
-	if len(exprs) == len(defaultExprs) {
-		// add a nil expression to the beginning
-		exprs = append([]exprDetail{{expr: nil, exprTarget: document}}, exprs...)
+	// Documents without a target of their own are sent to the routes and the
+	// target of the export
+	if specs == nil {
+		specs = make([]v1beta1.Expression, len(exprs))
 	}
 
-	// Run compilation per expression
-	// Output is appended to outputData
-	// Compile string output is added to cmpStr
-	// connection details is output to connectionData
-	for _, expr := range exprs {
-		var (
-			err error
-			c   *compiler
-		)
-		if expr.exprTarget != document {
-			// readinessChecks and connectionDetails are always output as Streams
-			out = outputTXT
-		}
-
-		c, err = newCompiler(input.Export.Value, inputCUE, out, expr.expr, opts.tags)
-		if err != nil &&
-			(err.Error() == errConnectionDetailsNotFound.Error() ||
-				err.Error() == errReadinessChecksNotFound.Error()) {
-			// Condition - that there is no #connectionDetails or #readinessChecks expression
-			// If there are no connection details or readiness checks then an empty list is returned
-			continue
-		} else if err != nil {
+	concrete := true
+	switch out {
+	case outputCUE:
+		concrete = opts.parseData
+	case outputJSON, outputYAML, outputTXT:
+	default:
+		return output, fmt.Errorf("failed creating cue compiler: unsupported output format: %q", out)
+	}
+
+	// A module is compiled in place of the inline value
+	if input.Export.Module != nil {
+		opts.module = input.Export.Module
+	}
+	opts.libraries = input.Export.Libraries
+	opts.inputValues, err = inputValues(input.Export.Options.Values)
+	if err != nil {
+		return output, err
+	}
+
+	// Templates are built in a pooled context unless they are cached, a
+	// cached template is built once and only filled for each compilation
+	var inst cue.Value
+	if opts.cache != nil && opts.dir == "" {
+		t, err := opts.cache.get(templateKey(input, opts), func(ctx *cue.Context) (cue.Value, error) {
+			return buildTemplate(ctx, string(input.Export.Value), opts)
+		})
+		if err != nil {
 			return output, fmt.Errorf("failed creating cue compiler: %w", err)
 		}
-		if err = c.Compile(); err != nil {
-			return output, fmt.Errorf("failed compiling cue template: %w", err)
+		defer t.release()
+		inst = t.value
+	} else {
+		ctx := opts.cueCtx
+		if ctx == nil {
+			ctx = acquireCUEContext()
+			defer releaseCUEContext(ctx)
 		}
+		ctx.builds++
+		inst, err = buildTemplate(ctx.Context, string(input.Export.Value), opts)
+		if err != nil {
+			return output, fmt.Errorf("failed creating cue compiler: %w", err)
+		}
+	}
+	root, err := fillTemplate(inst, opts)
+	if err != nil {
+		return output, fmt.Errorf("failed creating cue compiler: %w", err)
+	}
+	// Only the sub-value at the path is exported, the definitions the
+	// function outputs are read from are still read from the root
+	// A template exported as a whole exports its #documents when it sets them
+	v, err := lookupExportPath(root, input.Export.Options.Path)
+	if err != nil {
+		return output, err
+	}
+	if input.Export.Options.Path == "" && len(exprs) == 1 && exprs[0] == nil {
+		if docs := root.LookupPath(cue.MakePath(cue.Def(documentsDef))); docs.Exists() {
+			v = docs
+		}
+	}
 
-		// only attempt to parse data if specified
-		if opts.parseData == true {
-			data, err := c.Parse()
-			if err != nil {
-				return output, fmt.Errorf("failed parsing cue output: %w", err)
+	// Run compilation per expression
+	// Decoded documents are appended to output.data
+	// Encoded output is appended to output.string
+	// The steps of all expressions count towards the limit
+	steps := 0
+	for i, expr := range exprs {
+		marshalled := false
+		if opts.parseData {
+			// The documents are decoded from the value the expression
+			// marshals rather than parsed back from the marshalled stream
+			value := marshalledValue(expr)
+			marshalled, expr = value != expr, value
+		}
+		ev := evalExpr(v, expr)
+		// Documents holding non-concrete values are skipped rather than
+		// failing the compilation when the export allows incomplete values,
+		// so only the values are validated here
+		allowIncomplete := opts.parseData && input.Export.Options.AllowIncomplete
+		if err := ev.Validate(cue.Concrete(concrete && !allowIncomplete)); err != nil {
+			return output, exprError(specs[i], fmt.Errorf("failed creating cue compiler: failed to validate: %w", err))
+		}
+		if err := opts.limits.countSteps(ev, &steps); err != nil {
+			return output, exprError(specs[i], err)
+		}
+		if opts.parseData {
+			if err := checkFormat(ev, input.Export.Options.Format, marshalled); err != nil {
+				return output, exprError(specs[i], fmt.Errorf("failed parsing cue output: %w", err))
 			}
+		}
 
-			// If the expression is a readinessCheck or connectionDetails configuration
-			// Add that data to the specific output
-			if expr.exprTarget != document {
-				// this is a little silly to have to convert this back to a string
-				// maybe there's a better way to do this
-				tmp, err := json.Marshal(data)
-				if err != nil {
-					return output, fmt.Errorf("failed marshalling connection details: %w", err)
-				}
+		if allowIncomplete {
+			docs, incomplete, err := decodeCompleteDocuments(ev, input.Export.Options.Format, len(output.data)+len(output.incomplete))
+			if err != nil {
+				return output, exprError(specs[i], fmt.Errorf("failed parsing cue output: %w", err))
+			}
+			output.data = append(output.data, annotateTarget(docs, specs[i].Target)...)
+			output.expressions = appendExpression(output.expressions, specs[i], len(docs))
+			output.incomplete = append(output.incomplete, incomplete...)
+			continue
+		}
 
-				if expr.exprTarget == connectionDetails {
-					if err := json.Unmarshal(tmp, &output.connectionData); err != nil {
-						return output, fmt.Errorf("failed unmarshalling connection details: %w", err)
-					}
-				} else if expr.exprTarget == readinessChecks {
-					if err := json.Unmarshal(tmp, &output.readinessData); err != nil {
-						return output, fmt.Errorf("failed unmarshalling readiness checks: %w", err)
-					}
-				} else {
-					return output, fmt.Errorf("unknown exprTarget %s", expr.exprTarget)
-				}
-			} else {
-				output.data = append(output.data, data...)
+		if opts.parseData {
+			docs, err := decodeDocuments(ev, input.Export.Options.Format)
+			if err != nil {
+				return output, exprError(specs[i], fmt.Errorf("failed parsing cue output: %w", err))
 			}
+			output.data = append(output.data, annotateTarget(docs, specs[i].Target)...)
+			output.expressions = appendExpression(output.expressions, specs[i], len(docs))
+			continue
 		}
 
+		s, err := encodeValue(ev, out)
+		if err != nil {
+			return output, exprError(specs[i], fmt.Errorf("failed compiling cue template: %w", err))
+		}
 		// If there are multiple yaml documents, then separate them by ---
-		if out == outputTXT || out == outputYAML {
-			if output.string == "" {
-				output.string += c.String()
-			} else {
-				output.string += fmt.Sprintf("---\n%s", c.String())
-			}
-		} else if out == outputJSON || out == outputCUE {
-			// Multiple json documents do not need to be separated
-			output.string += c.String()
+		if (out == outputTXT || out == outputYAML) && output.string != "" {
+			output.string += "---\n"
+		}
+		// Multiple json documents do not need to be separated
+		output.string += s
+	}
+	if err := opts.limits.checkOutput(output, opts.parseData); err != nil {
+		return output, err
+	}
+
+	// Decode the definitions the template sets the function outputs in
+	for _, d := range []struct {
+		def  outputDef
+		into interface{}
+	}{
+		{connectionDetails, &output.connectionData},
+		{readinessChecks, &output.readinessData},
+		{requirements, &output.requirements},
+		{conditions, &output.conditions},
+		{results, &output.results},
+	} {
+		if err := decodeDef(root, d.def, d.into); err != nil {
+			return output, fmt.Errorf("failed decoding #%s: %w", d.def, err)
+		}
+	}
+
+	// Vet the generated documents against the schema definitions of their kind
+	if opts.parseData && input.Export.Options.Validate != "" {
+		if err := vetDocuments(input.Export.Options.Validate, output.data); err != nil {
+			return output, err
 		}
 	}
 
@@ -424,77 +1037,409 @@ func toFile(i, v cue.Value, filename string) (*build.File, error) {
 	return f, nil
 }
 
+// tagSources are the objects the values of tags are read from
+type tagSources struct {
+	xr       *resource.Composite
+	context  map[string]interface{}
+	observed map[resource.Name]resource.ObservedComposed
+}
+
 // buildTags builds the tags to be injected into the cue template
-// Values are gathered from the Observed XR
-func buildTags(tags []v1beta1.Tag, xr *resource.Composite) ([]string, error) {
-	res := make([]string, len(tags))
-	for i, t := range tags {
-		fromMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(xr.Resource)
+// Values are gathered from the Observed XR, the pipeline context, the
+// EnvironmentConfig data in the context or an observed composed resource,
+// depending on the source of the tag
+// Scalar values are returned as cue tags, maps and lists cannot be passed as
+// cue tags so they are returned as structured values keyed by the tag name
+func buildTags(tags []v1beta1.Tag, sources tagSources) ([]string, map[string]interface{}, error) {
+	res := []string{}
+	values := map[string]interface{}{}
+	for _, t := range tags {
+		fromMap, err := sources.get(t)
 		if err != nil {
-			return res, errors.Wrapf(err, token.NoPos, "cannot convert xr %q to unstructured", xr.Resource.GetName())
+			return res, values, err
+		}
+
+		var in interface{}
+		if t.CEL != "" {
+			in, err = evalCEL(t.CEL, celSourceVar(t.Source), fromMap)
+			if err != nil {
+				return res, values, errors.Wrapf(err, token.NoPos, "cannot compute tag %q", t.Name)
+			}
+		} else {
+			in, err = fieldpath.Pave(fromMap).GetValue(t.Path)
+			switch {
+			case fieldpath.IsNotFound(err) && t.Default != nil:
+				in = *t.Default
+			case err != nil:
+				return res, values, errors.Wrapf(err, token.NoPos, "cannot get value from path %q", t.Path)
+			}
 		}
 
-		in, err := fieldpath.Pave(fromMap).GetValue(t.Path)
+		switch in.(type) {
+		case map[string]interface{}, []interface{}:
+			if len(t.Transforms) != 0 {
+				return res, values, fmt.Errorf("cannot transform tag %q: transforms are only supported on scalar values", t.Name)
+			}
+			if t.Type != "" && t.Type != v1beta1.TagTypeJSON {
+				return res, values, fmt.Errorf("cannot inject tag %q as %s: the value is a map or list", t.Name, t.Type)
+			}
+			values[t.Name] = in
+			continue
+		}
+
+		value, err := transformTag(fmt.Sprintf("%v", in), t.Transforms)
 		if err != nil {
-			return res, errors.Wrapf(err, token.NoPos, "cannot get value from path %q", t.Path)
+			return res, values, errors.Wrapf(err, token.NoPos, "cannot transform tag %q", t.Name)
 		}
 
-		res[i] = fmt.Sprintf("%s=%s", t.Name, in)
+		// cue tags are strings, typed values are unified into the tagged
+		// field as structured values so they keep their type
+		if t.Type == "" || t.Type == v1beta1.TagTypeString {
+			res = append(res, fmt.Sprintf("%s=%s", t.Name, value))
+			continue
+		}
+		typed, err := typedTag(value, t.Type)
+		if err != nil {
+			return res, values, fmt.Errorf("cannot inject tag %q as %s: %w", t.Name, t.Type, err)
+		}
+		values[t.Name] = typed
 	}
-	return res, nil
+	return res, values, nil
 }
 
-// exprDetail holds configuration for an expression and what its output data parsing should target to
-type exprDetail struct {
-	expr       *ast.Expr
-	exprTarget exprTarget
+// typedTag parses the value of a tag into its type
+func typedTag(value string, typ v1beta1.TagType) (interface{}, error) {
+	switch typ {
+	case v1beta1.TagTypeInt:
+		return strconv.ParseInt(value, 10, 64)
+	case v1beta1.TagTypeNumber:
+		return strconv.ParseFloat(value, 64)
+	case v1beta1.TagTypeBool:
+		return strconv.ParseBool(value)
+	case v1beta1.TagTypeJSON:
+		var v interface{}
+		err := json.Unmarshal([]byte(value), &v)
+		return v, err
+	default:
+		return value, nil
+	}
 }
 
-// exprTarget are the available expression targets to parse the output data to
-type exprTarget string
+// get returns the object the value of the tag is read from
+func (s tagSources) get(t v1beta1.Tag) (map[string]interface{}, error) {
+	switch t.Source {
+	case v1beta1.TagSourceContext:
+		return s.context, nil
+	case v1beta1.TagSourceEnvironment:
+		// A pipeline without an EnvironmentConfig has no environment, paths
+		// are then not found and fall back to their default
+		env, _ := s.context[environmentContextKey].(map[string]interface{})
+		return env, nil
+	case v1beta1.TagSourceResource:
+		// A resource that was not created yet is not observed, paths are then
+		// not found and fall back to their default
+		o, ok := s.observed[resource.Name(t.ResourceName)]
+		if !ok {
+			return nil, nil
+		}
+		return o.Resource.UnstructuredContent(), nil
+	default:
+		fromMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(s.xr.Resource)
+		if err != nil {
+			return nil, errors.Wrapf(err, token.NoPos, "cannot convert xr %q to unstructured", s.xr.Resource.GetName())
+		}
+		return fromMap, nil
+	}
+}
 
-const (
-	// document target implies the expression is to be parsed for additional or patch document data
-	document exprTarget = "document"
-	// connectionDetails targets the compilation data to store into connectionDetails
-	connectionDetails exprTarget = "connectionDetails"
-	// readienssChecks targets the compilation data to be stored into readinessChecks
-	readinessChecks exprTarget = "readinessChecks"
-)
+// taggedField is a field annotated with a @tag attribute
+type taggedField struct {
+	path cue.Path
+	// kind is the kind the values of the tag are parsed into
+	kind cue.Kind
+	// shorthands are the values the tag can be set to by their name alone
+	shorthands []string
+}
 
-var (
-	// conDetailsExpr is the string representation of connection details to be passed
-	// From the user to function-cue
-	conDetailsExpr = fmt.Sprintf("json.MarshalStream(#%s)", connectionDetails)
-	// readinessChecksExpr is the string representation of readiness checks to be passed
-	// From the user to function-cue
-	readinessChecksExpr = fmt.Sprintf("json.MarshalStream(#%s)", readinessChecks)
-	// defaultExprs contains a list of default expressions that are always run
-	defaultExprs = []string{conDetailsExpr, readinessChecksExpr}
-)
+// taggedFields returns the fields of the value annotated with a @tag
+// attribute, keyed by the name of their tag
+func taggedFields(v cue.Value) map[string][]taggedField {
+	fields := map[string][]taggedField{}
+	var walk func(cue.Value)
+	walk = func(v cue.Value) {
+		iter, err := v.Fields(cue.Definitions(true), cue.Hidden(true), cue.Optional(true))
+		if err != nil {
+			return
+		}
+		for iter.Next() {
+			fv := iter.Value()
+			a := fv.Attribute("tag")
+			if name, err := a.String(0); err == nil {
+				f := taggedField{path: fv.Path(), kind: cue.StringKind}
+				if typ, ok, _ := a.Lookup(1, "type"); ok {
+					switch typ {
+					case "int":
+						f.kind = cue.IntKind
+					case "number":
+						f.kind = cue.NumberKind
+					case "bool":
+						f.kind = cue.BoolKind
+					}
+				}
+				if short, ok, _ := a.Lookup(1, "short"); ok {
+					f.shorthands = strings.Split(short, "|")
+				}
+				fields[name] = append(fields[name], f)
+			}
+			walk(fv)
+		}
+	}
+	walk(v)
+	return fields
+}
 
-// buildExprs takes input from the CUEInput and builds cue compatible expressions to be passed to the cue compiler
-func buildExprs(input v1beta1.CUEInput) (exprs []exprDetail, err error) {
-	// #connectionDetails is always added to the end, whether it exists or not
-	// RunFunction will take these details and add them to the XR if found
-	for _, expr := range append(input.Export.Options.Expressions, defaultExprs...) {
-		if expr != "" {
-			var parsed ast.Expr
-			parsed, err = parser.ParseExpr("--expression", expr)
-			if err != nil {
-				err = fmt.Errorf("failed to parse expression: %w", err)
-				return
+// fillTags fills the tags into the fields annotated with a matching @tag
+// attribute the way cue injects them into a build, name=value tags are parsed
+// into the type of their field and shorthand tags set the field they are
+// declared by. The structured values are unified into their tagged fields.
+// The tags are filled into the built template rather than injected into its
+// build so that the template is built once for every value of its tags.
+func fillTags(v cue.Value, tags []string, values map[string]interface{}) (cue.Value, error) {
+	if len(tags) == 0 && len(values) == 0 {
+		return v, nil
+	}
+	fields := taggedFields(v)
+
+	filled := v
+	for _, t := range tags {
+		if p := strings.Index(t, "="); p > 0 {
+			name := t[:p]
+			if len(fields[name]) == 0 {
+				return v, fmt.Errorf("no tag for %q", name)
 			}
-			detail := exprDetail{expr: &parsed, exprTarget: document}
-			if expr == conDetailsExpr {
-				detail.exprTarget = connectionDetails
-			} else if expr == readinessChecksExpr {
-				detail.exprTarget = readinessChecks
+			for _, f := range fields[name] {
+				x, err := tagValue(v.Context(), name, t[p+1:], f.kind)
+				if err != nil {
+					return v, err
+				}
+				filled = filled.FillPath(f.path, x)
 			}
-			exprs = append(exprs, detail)
+			continue
 		}
+		found := false
+		for name, fs := range fields {
+			for _, f := range fs {
+				for _, s := range f.shorthands {
+					if s != t {
+						continue
+					}
+					found = true
+					x, err := tagValue(v.Context(), name, t, f.kind)
+					if err != nil {
+						return v, err
+					}
+					filled = filled.FillPath(f.path, x)
+				}
+			}
+		}
+		if !found {
+			return v, fmt.Errorf("tag %q not used in any file", t)
+		}
+	}
+	for name, val := range values {
+		for _, f := range fields[name] {
+			filled = filled.FillPath(f.path, val)
+		}
+	}
+	return filled, nil
+}
+
+// tagValue parses the value of a tag into a value of the kind of its field,
+// numbers are parsed as cue expressions
+func tagValue(ctx *cue.Context, name, value string, kind cue.Kind) (cue.Value, error) {
+	switch kind {
+	case cue.IntKind, cue.NumberKind:
+		x := ctx.CompileString(value)
+		if err := x.Err(); err != nil {
+			return x, fmt.Errorf("invalid number for tag %s: %w", name, err)
+		}
+		return x, nil
+	case cue.BoolKind:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return cue.Value{}, fmt.Errorf("invalid boolean value %q for tag %s", value, name)
+		}
+		return ctx.Encode(b), nil
+	default:
+		return ctx.Encode(value), nil
+	}
+}
+
+// nowDef is the definition the evaluation time is injected into
+const nowDef = "now"
+
+// observedDef is the definition the observed state is injected into, the
+// observed XR is available as #observed.composite and the observed composed
+// resources as #observed.resources
+const observedDef = "observed"
+
+// desiredDef is the definition the desired state of the previous functions in
+// the pipeline is injected into, as #desired.composite and #desired.resources
+const desiredDef = "desired"
+
+// contextDef is the definition the pipeline context is injected into, keyed by
+// the context keys written by Crossplane and the previous functions
+const contextDef = "context"
+
+// metaDef is the definition the metadata of the request is injected into, such
+// as its tag and the claim of the XR
+const metaDef = "meta"
+
+// valuesDef is the definition the values of the input are injected into
+const valuesDef = "values"
+
+// inputValues decodes the values of the input, a template is always filled
+// with values so that it can default them
+func inputValues(raw *runtime.RawExtension) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if raw == nil || len(raw.Raw) == 0 {
+		return values, nil
+	}
+	// Numbers are decoded as written, so integers are not filled as floats
+	d := json.NewDecoder(bytes.NewReader(raw.Raw))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil {
+		return nil, fmt.Errorf("cannot decode values: %w", err)
+	}
+	return decodeNumbers(values).(map[string]interface{}), nil
+}
+
+// decodeNumbers replaces the json numbers of the value by an int64 when they
+// are integers and by a float64 otherwise
+func decodeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = decodeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = decodeNumbers(e)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// fillNow injects the evaluation time into the #now definition as an RFC 3339 timestamp
+// templates opt in by setting inject_now, so renders without it stay reproducible
+func fillNow(v cue.Value, now time.Time) cue.Value {
+	if now.IsZero() {
+		return v
+	}
+	return v.FillPath(cue.MakePath(cue.Def(nowDef)), now.UTC().Format(time.RFC3339))
+}
+
+// outputDef is a definition the template sets a function output in
+type outputDef string
+
+const (
+	// connectionDetails is decoded into the connection details of the XR
+	connectionDetails outputDef = "connectionDetails"
+	// readinessChecks is decoded into the readiness checks of the desired resources
+	readinessChecks outputDef = "readinessChecks"
+	// requirements is decoded into the extra resource requirements
+	requirements outputDef = "requirements"
+	// conditions is decoded into the XR status conditions
+	conditions outputDef = "conditions"
+	// results is decoded into the function results
+	results outputDef = "results"
+)
+
+// exportExprs returns the expressions of the export and the expression of the
+// input each of them is parsed from, which names it and sets the target of its
+// documents. The expressions of the export take the place of its
+// options.expressions, which have no name or target of their own.
+func exportExprs(e v1beta1.Export) ([]ast.Expr, []v1beta1.Expression, error) {
+	if len(e.Expressions) == 0 {
+		exprs, err := parseExprs(e.Options.Expressions)
+		return exprs, nil, err
+	}
+	exprs := make([]ast.Expr, len(e.Expressions))
+	for i, x := range e.Expressions {
+		expr, err := parser.ParseExpr("expressions", x.Expr)
+		if err != nil {
+			return nil, nil, exprError(x, fmt.Errorf("failed to parse expression %q: %w", x.Expr, err))
+		}
+		exprs[i] = expr
+	}
+	return exprs, e.Expressions, nil
+}
+
+// exprError names the expression in the error of its evaluation when it is
+// named
+func exprError(x v1beta1.Expression, err error) error {
+	if x.Name == "" {
+		return err
+	}
+	return &expressionError{name: x.Name, err: err}
+}
+
+// expressionError is the error of the evaluation of a named expression
+type expressionError struct {
+	name string
+	err  error
+}
+
+func (e *expressionError) Error() string {
+	return fmt.Sprintf("expression %q: %v", e.name, e.err)
+}
+
+func (e *expressionError) Unwrap() error {
+	return e.err
+}
+
+// parseExprs parses the expressions of the input into cue expressions
+func parseExprs(exprs []string) ([]ast.Expr, error) {
+	var parsed []ast.Expr
+	for _, expr := range exprs {
+		if expr == "" {
+			continue
+		}
+		e, err := parser.ParseExpr("--expression", expr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse expression: %w", err)
+		}
+		parsed = append(parsed, e)
+	}
+	return parsed, nil
+}
+
+// marshalledValue returns the argument of an expression marshalling it with
+// the json or yaml package, such as yaml.MarshalStream(objects), other
+// expressions are returned as is
+func marshalledValue(expr ast.Expr) ast.Expr {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return expr
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return expr
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok || (pkg.Name != "json" && pkg.Name != "yaml") {
+		return expr
+	}
+	if name, _, _ := ast.LabelName(sel.Sel); name != "Marshal" && name != "MarshalStream" {
+		return expr
 	}
-	return
+	return call.Args[0]
 }
 
 // hasEncoding determines if a cue value is concrete or has a default concrete setting
@@ -3,10 +3,17 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/crossplane-contrib/function-cue/input/v1beta1"
 
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/crossplane/function-sdk-go/resource/composite"
 	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
 )
 
 var testTable = []struct {
@@ -71,7 +78,7 @@ func TestCUECompile(t *testing.T) {
 				Options: v1beta1.ExportOptions{
 					Expressions: tv.Expressions,
 				},
-				Value: tv.InVal,
+				Value: v1beta1.Value(tv.InVal),
 			},
 		}
 		out, err := cueCompile(tv.Out, in, compileOpts{
@@ -116,7 +123,7 @@ func TestCUECompileFailures(t *testing.T) {
 				Options: v1beta1.ExportOptions{
 					Expressions: tv.Expressions,
 				},
-				Value: tv.InVal,
+				Value: v1beta1.Value(tv.InVal),
 			},
 		}
 		out, err := cueCompile(tv.Out, in, compileOpts{parseData: false})
@@ -124,3 +131,965 @@ func TestCUECompileFailures(t *testing.T) {
 		assert.Equal(t, tv.Err, err.Error(), "%s: expected error %q: got %q", desc, tv.Err, err.Error())
 	}
 }
+
+// TestCUECompileInjectValues for structured values filled into their matching @tag fields
+func TestCUECompileInjectValues(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		value  string
+		values map[string]interface{}
+		want   string
+	}{
+		"Map": {
+			reason: "A map should be filled into the tagged field as a struct",
+			value:  "tags: {[string]: string} @tag(tags)\n",
+			values: map[string]interface{}{"tags": map[string]interface{}{"team": "platform"}},
+			want:   "{\n    \"tags\": {\n        \"team\": \"platform\"\n    }\n}\n",
+		},
+		"List": {
+			reason: "A list should be filled into a nested tagged field",
+			value:  "spec: zones: [...string] @tag(zones)\nspec: count: len(spec.zones)\n",
+			values: map[string]interface{}{"zones": []interface{}{"a", "b"}},
+			want:   "{\n    \"spec\": {\n        \"zones\": [\n            \"a\",\n            \"b\"\n        ],\n        \"count\": 2\n    }\n}\n",
+		},
+		"Definition": {
+			reason: "A tagged definition should be filled and usable by regular fields",
+			value:  "#tags: {...} @tag(tags)\nlabels: #tags\n",
+			values: map[string]interface{}{"tags": map[string]interface{}{"env": "prod"}},
+			want:   "{\n    \"labels\": {\n        \"env\": \"prod\"\n    }\n}\n",
+		},
+		"Typed": {
+			reason: "Typed scalars should be filled into fields constrained to their type",
+			value:  "replicas: int @tag(replicas)\nenabled: bool @tag(enabled)\nratio: number @tag(ratio)\n",
+			values: map[string]interface{}{"replicas": int64(3), "enabled": true, "ratio": 0.5},
+			want:   "{\n    \"replicas\": 3,\n    \"enabled\": true,\n    \"ratio\": 0.5\n}\n",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Value: v1beta1.Value(tc.value),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{values: tc.values})
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+// TestCUECompileInjectTags for tags filled into their matching @tag fields of
+// the built template
+func TestCUECompileInjectTags(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		value  string
+		tags   []string
+		want   string
+		err    string
+	}{
+		"Hidden": {
+			reason: "A tag should be filled into a hidden field",
+			value:  "_env: string @tag(env)\nhost: \"\\(_env).domain.com\"\n",
+			tags:   []string{"env=prod"},
+			want:   "{\n    \"host\": \"prod.domain.com\"\n}\n",
+		},
+		"Typed": {
+			reason: "A tag should be parsed into the type of its field",
+			value:  "replicas: int @tag(replicas,type=int)\nenabled: bool @tag(enabled,type=bool)\n",
+			tags:   []string{"replicas=3", "enabled=true"},
+			want:   "{\n    \"replicas\": 3,\n    \"enabled\": true\n}\n",
+		},
+		"Shorthand": {
+			reason: "A shorthand tag should set the field that declares it",
+			value:  "env: string @tag(env,short=prod|staging)\n",
+			tags:   []string{"staging"},
+			want:   "{\n    \"env\": \"staging\"\n}\n",
+		},
+		"InvalidBool": {
+			reason: "A tag that does not parse into the type of its field should fail the compilation",
+			value:  "enabled: bool @tag(enabled,type=bool)\n",
+			tags:   []string{"enabled=maybe"},
+			err:    "failed creating cue compiler: invalid boolean value \"maybe\" for tag enabled",
+		},
+		"NoTag": {
+			reason: "A tag without a matching field should fail the compilation",
+			value:  "name: string @tag(name)\n",
+			tags:   []string{"region=eu"},
+			err:    "failed creating cue compiler: no tag for \"region\"",
+		},
+		"UnusedShorthand": {
+			reason: "A shorthand tag no field declares should fail the compilation",
+			value:  "env: string @tag(env,short=prod|staging)\n",
+			tags:   []string{"dev"},
+			err:    "failed creating cue compiler: tag \"dev\" not used in any file",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Value: v1beta1.Value(tc.value),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{tags: tc.tags})
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+// TestCUECompileDecode for documents decoded from the evaluated template
+func TestCUECompileDecode(t *testing.T) {
+	generated := map[string]interface{}{"apiVersion": "example.org/v1", "kind": "Generated", "spec": map[string]interface{}{"replicas": float64(2)}}
+	cases := map[string]struct {
+		reason      string
+		value       string
+		expressions []string
+		want        []map[string]interface{}
+	}{
+		"Struct": {
+			reason: "A struct should be decoded as a single document with JSON typed numbers",
+			value:  "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nspec: replicas: 2\n",
+			want:   []map[string]interface{}{generated},
+		},
+		"List": {
+			reason: "A list should be decoded as a document per element",
+			value:  "[{apiVersion: \"example.org/v1\", kind: \"Generated\", spec: replicas: 2}, {apiVersion: \"example.org/v1\", kind: \"Other\"}]\n",
+			want: []map[string]interface{}{
+				generated,
+				{"apiVersion": "example.org/v1", "kind": "Other"},
+			},
+		},
+		"MarshalStream": {
+			reason:      "A marshalled stream should be decoded from the marshalled value",
+			value:       "objects: [{apiVersion: \"example.org/v1\", kind: \"Generated\", spec: replicas: 1 + 1}]\n",
+			expressions: []string{"yaml.MarshalStream(objects)"},
+			want:        []map[string]interface{}{generated},
+		},
+		"String": {
+			reason:      "A string expression should be parsed as a stream of documents",
+			value:       "import \"encoding/json\"\n\nobject: {apiVersion: \"example.org/v1\", kind: \"Generated\", spec: replicas: 2}\nout: json.Marshal(object)\n",
+			expressions: []string{"out"},
+			want:        []map[string]interface{}{generated},
+		},
+		"Expressions": {
+			reason:      "The documents of every expression should be decoded in order",
+			value:       "a: {apiVersion: \"example.org/v1\", kind: \"Generated\", spec: replicas: 2}\nb: [{apiVersion: \"example.org/v1\", kind: \"Other\"}]\n",
+			expressions: []string{"a", "json.MarshalStream(b)"},
+			want: []map[string]interface{}{
+				generated,
+				{"apiVersion": "example.org/v1", "kind": "Other"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Options: v1beta1.ExportOptions{Expressions: tc.expressions},
+					Value:   v1beta1.Value(tc.value),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{parseData: true})
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.data, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileFormat(t *testing.T) {
+	generated := map[string]interface{}{"apiVersion": "example.org/v1", "kind": "Generated"}
+	template := "import \"encoding/yaml\"\n\n" +
+		"object: {apiVersion: \"example.org/v1\", kind: \"Generated\"}\n" +
+		"objects: [object]\n" +
+		"resources: {a: object, b: object}\n" +
+		"stream: yaml.MarshalStream(objects)\n"
+	cases := map[string]struct {
+		reason     string
+		format     v1beta1.ExportFormat
+		expression string
+		want       []map[string]interface{}
+		wantErr    string
+	}{
+		"Object": {
+			reason:     "A struct should be a single document",
+			format:     v1beta1.ExportFormatObject,
+			expression: "object",
+			want:       []map[string]interface{}{generated},
+		},
+		"ObjectOfResources": {
+			reason:     "A struct of resources should be a single document",
+			format:     v1beta1.ExportFormatObject,
+			expression: "resources",
+			want:       []map[string]interface{}{{"a": generated, "b": generated}},
+		},
+		"NotObject": {
+			reason:     "A list should not be an object",
+			format:     v1beta1.ExportFormatObject,
+			expression: "objects",
+			wantErr:    "failed parsing cue output: format object requires a struct, the expression evaluates to list",
+		},
+		"List": {
+			reason:     "Each element of a list should be a document",
+			format:     v1beta1.ExportFormatList,
+			expression: "objects",
+			want:       []map[string]interface{}{generated},
+		},
+		"NotList": {
+			reason:     "A struct should not be a list",
+			format:     v1beta1.ExportFormatList,
+			expression: "object",
+			wantErr:    "failed parsing cue output: format list requires a list, the expression evaluates to struct",
+		},
+		"Fields": {
+			reason:     "Each field of a struct should be a document",
+			format:     v1beta1.ExportFormatFields,
+			expression: "resources",
+			want:       []map[string]interface{}{generated, generated},
+		},
+		"NotFields": {
+			reason:     "A list should not be a struct of documents",
+			format:     v1beta1.ExportFormatFields,
+			expression: "objects",
+			wantErr:    "failed parsing cue output: format fields requires a struct, the expression evaluates to list",
+		},
+		"MarshalledStream": {
+			reason:     "A marshalled stream should be decoded from the value it marshals",
+			format:     v1beta1.ExportFormatStream,
+			expression: "yaml.MarshalStream(objects)",
+			want:       []map[string]interface{}{generated},
+		},
+		"Stream": {
+			reason:     "A string should be parsed as a stream of documents",
+			format:     v1beta1.ExportFormatStream,
+			expression: "stream",
+			want:       []map[string]interface{}{generated},
+		},
+		"NotStream": {
+			reason:     "A list that is not marshalled should not be a stream",
+			format:     v1beta1.ExportFormatStream,
+			expression: "objects",
+			wantErr:    "failed parsing cue output: format stream requires a string, the expression evaluates to list",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Options: v1beta1.ExportOptions{Format: tc.format, Expressions: []string{tc.expression}},
+					Value:   v1beta1.Value(template),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{parseData: true})
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.data, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileDocuments(t *testing.T) {
+	observed := map[string]interface{}{"composite": map[string]interface{}{"spec": map[string]interface{}{"region": "eu-west-1"}}}
+	cases := map[string]struct {
+		reason string
+		value  string
+		want   []map[string]interface{}
+	}{
+		"TopLevelList": {
+			reason: "A top-level list should be filled with the observed state and hold a document per element",
+			value: "[{apiVersion: \"example.org/v1\", kind: \"Bucket\", spec: region: #observed.composite.spec.region},\n" +
+				" {apiVersion: \"example.org/v1\", kind: \"Queue\"}]\n",
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket", "spec": map[string]interface{}{"region": "eu-west-1"}},
+				{"apiVersion": "example.org/v1", "kind": "Queue"},
+			},
+		},
+		"StructOfResources": {
+			reason: "A struct whose fields are all resources should hold a document per field",
+			value: "bucket: {apiVersion: \"example.org/v1\", kind: \"Bucket\", spec: region: #observed.composite.spec.region}\n" +
+				"queue: {apiVersion: \"example.org/v1\", kind: \"Queue\"}\n",
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket", "spec": map[string]interface{}{"region": "eu-west-1"}},
+				{"apiVersion": "example.org/v1", "kind": "Queue"},
+			},
+		},
+		"Resource": {
+			reason: "A resource should be a single document",
+			value:  "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nspec: region: #observed.composite.spec.region\n",
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "Bucket", "spec": map[string]interface{}{"region": "eu-west-1"}},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{Export: v1beta1.Export{Value: v1beta1.Value(tc.value)}}
+			out, err := cueCompile(outputJSON, in, compileOpts{parseData: true, observed: observed})
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.data, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileAllowIncomplete(t *testing.T) {
+	bucket := map[string]interface{}{"kind": "Bucket", "spec": map[string]interface{}{"region": "eu-west-1"}}
+	cases := map[string]struct {
+		reason         string
+		value          string
+		want           []map[string]interface{}
+		wantIncomplete []incompleteDocument
+		wantErr        bool
+	}{
+		"Complete": {
+			reason: "Concrete documents should all be decoded",
+			value:  "[{kind: \"Bucket\", spec: region: \"eu-west-1\"}]\n",
+			want:   []map[string]interface{}{bucket},
+		},
+		"SkipDocument": {
+			reason:         "Only the documents holding non-concrete values should be skipped",
+			value:          "[{kind: \"Bucket\", spec: region: \"eu-west-1\"}, {kind: \"Table\", spec: {region: string, size: int}}]\n",
+			want:           []map[string]interface{}{bucket},
+			wantIncomplete: []incompleteDocument{{Index: 1, Paths: []string{"spec.region", "spec.size"}}},
+		},
+		"SkipStruct": {
+			reason:         "A struct holding non-concrete values should be skipped",
+			value:          "#region: string\nkind: \"Bucket\"\nspec: region: #region\n",
+			wantIncomplete: []incompleteDocument{{Index: 0, Paths: []string{"spec.region"}}},
+		},
+		"Conflict": {
+			reason:  "Errors other than non-concrete values should still fail the compilation",
+			value:   "[{kind: \"Bucket\", spec: region: \"eu-west-1\" & \"us-east-1\"}]\n",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Options: v1beta1.ExportOptions{AllowIncomplete: true},
+					Value:   v1beta1.Value(tc.value),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{parseData: true})
+			if tc.wantErr {
+				assert.NotNil(t, err, "%s: expected an error", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.data, "%s", tc.reason)
+			assert.Equal(t, tc.wantIncomplete, out.incomplete, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileExportPath(t *testing.T) {
+	template := `#results: [{message: "exported \(resources.storage.metadata.name)"}]
+resources: {
+	storage: {apiVersion: "example.org/v1", kind: "Bucket", metadata: name: "bucket"}
+	network: {apiVersion: "example.org/v1", kind: "Network", metadata: name: "network"}
+}
+`
+	cases := map[string]struct {
+		reason      string
+		path        string
+		expressions []string
+		want        []map[string]interface{}
+		wantResults []result
+		wantErr     string
+	}{
+		"Path": {
+			reason:      "Only the sub-value at the path should be exported, with the definitions of the template",
+			path:        "resources.storage",
+			want:        []map[string]interface{}{{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": map[string]interface{}{"name": "bucket"}}},
+			wantResults: []result{{Message: "exported bucket"}},
+		},
+		"Expressions": {
+			reason:      "Expressions should be evaluated in the scope of the sub-value",
+			path:        "resources",
+			expressions: []string{"network"},
+			want:        []map[string]interface{}{{"apiVersion": "example.org/v1", "kind": "Network", "metadata": map[string]interface{}{"name": "network"}}},
+			wantResults: []result{{Message: "exported bucket"}},
+		},
+		"NotFound": {
+			reason:  "A path missing from the template should fail the compilation",
+			path:    "resources.database",
+			wantErr: `path "resources.database" not found in the template`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Options: v1beta1.ExportOptions{Path: tc.path, Expressions: tc.expressions},
+					Value:   v1beta1.Value(template),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{parseData: true})
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.data, "%s", tc.reason)
+			assert.Equal(t, tc.wantResults, out.results, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileInjectNow(t *testing.T) {
+	frozen := time.Date(2023, time.September, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	cases := map[string]struct {
+		reason string
+		value  string
+		now    time.Time
+		want   string
+	}{
+		"Injected": {
+			reason: "The time should be injected into #now as an RFC 3339 UTC timestamp",
+			value:  "#now: string\ncreated: #now\n",
+			now:    frozen,
+			want:   "{\n    \"created\": \"2023-09-01T10:30:00Z\"\n}\n",
+		},
+		"NotInjected": {
+			reason: "#now should be left to the template when no time is injected",
+			value:  "#now: *\"unknown\" | string\ncreated: #now\n",
+			want:   "{\n    \"created\": \"unknown\"\n}\n",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Value: v1beta1.Value(tc.value),
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{now: tc.now})
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileValues(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		value   string
+		values  string
+		want    string
+		wantErr string
+	}{
+		"Values": {
+			reason: "The values of the input should be unified into #values",
+			value:  "#values: {replicas: *1 | int, image: string}\nreplicas: #values.replicas\nimage: #values.image\n",
+			values: `{"replicas": 3, "image": "nginx"}`,
+			want:   "{\n    \"replicas\": 3,\n    \"image\": \"nginx\"\n}\n",
+		},
+		"Defaults": {
+			reason: "The defaults of #values should be used when the input does not set them",
+			value:  "#values: replicas: *1 | int\nreplicas: #values.replicas\n",
+			want:   "{\n    \"replicas\": 1\n}\n",
+		},
+		"Undeclared": {
+			reason: "The values should be referenced without declaring #values",
+			value:  "image: #values.image\n",
+			values: `{"image": "nginx"}`,
+			want:   "{\n    \"image\": \"nginx\"\n}\n",
+		},
+		"Conflict": {
+			reason:  "Values conflicting with the schema of #values should return an error",
+			value:   "#values: replicas: int\nreplicas: #values.replicas\n",
+			values:  `{"replicas": "three"}`,
+			wantErr: "conflicting values",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Value: v1beta1.Value(tc.value),
+				},
+			}
+			if tc.values != "" {
+				in.Export.Options.Values = &runtime.RawExtension{Raw: []byte(tc.values)}
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{})
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	xr := &resource.Composite{Resource: composite.New()}
+	xr.Resource.SetName("my-xr")
+	_ = xr.Resource.SetString("spec.parameters.team", "Platform")
+	_ = xr.Resource.SetValue("spec.parameters.replicas", 3)
+	_ = xr.Resource.SetValue("spec.parameters.zones", []interface{}{"a", "b"})
+	_ = xr.Resource.SetString("status.atProvider.id", "vpc-1234")
+	xr.Resource.SetUID("0b1c2d3e")
+	xr.Resource.SetLabels(map[string]string{"example.org/team": "platform"})
+	defaultCtx := map[string]interface{}{
+		"example.org/settings": map[string]interface{}{"tier": "gold", "config": `{"size": 2}`},
+		environmentContextKey: map[string]interface{}{
+			"cluster": map[string]interface{}{"region": "eu-west-1", "zones": []interface{}{"a", "b"}},
+		},
+	}
+	role := composed.New()
+	role.SetName("my-role")
+	_ = role.SetString("status.atProvider.arn", "arn:aws:iam::123456789012:role/my-role")
+	observed := map[resource.Name]resource.ObservedComposed{"role": {Resource: role}}
+
+	cases := map[string]struct {
+		reason     string
+		tags       []v1beta1.Tag
+		fnctx      map[string]interface{}
+		wantTags   []string
+		wantValues map[string]interface{}
+		wantErr    string
+	}{
+		"Path": {
+			reason:     "A scalar read from a path should be injected as a tag",
+			tags:       []v1beta1.Tag{{Name: "name", Path: "metadata.name"}},
+			wantTags:   []string{"name=my-xr"},
+			wantValues: map[string]interface{}{},
+		},
+		"PathInteger": {
+			reason:     "An integer read from a path should be formatted as a number",
+			tags:       []v1beta1.Tag{{Name: "replicas", Path: "spec.parameters.replicas"}},
+			wantTags:   []string{"replicas=3"},
+			wantValues: map[string]interface{}{},
+		},
+		"PathStatus": {
+			reason:     "A scalar read from the status of the XR should be injected as a tag",
+			tags:       []v1beta1.Tag{{Name: "vpc", Path: "status.atProvider.id"}},
+			wantTags:   []string{"vpc=vpc-1234"},
+			wantValues: map[string]interface{}{},
+		},
+		"PathMetadata": {
+			reason: "The uid and a label of the XR should be injected as tags",
+			tags: []v1beta1.Tag{
+				{Name: "uid", Path: "metadata.uid"},
+				{Name: "team", Path: "metadata.labels[example.org/team]"},
+			},
+			wantTags:   []string{"uid=0b1c2d3e", "team=platform"},
+			wantValues: map[string]interface{}{},
+		},
+		"PathDefault": {
+			reason:     "The default should be injected when the path does not exist",
+			tags:       []v1beta1.Tag{{Name: "region", Path: "spec.parameters.region", Default: pointer.String("us-east-1")}},
+			wantTags:   []string{"region=us-east-1"},
+			wantValues: map[string]interface{}{},
+		},
+		"PathMissing": {
+			reason:  "A path that does not exist without a default should return an error",
+			tags:    []v1beta1.Tag{{Name: "region", Path: "spec.parameters.region"}},
+			wantErr: `cannot get value from path "spec.parameters.region"`,
+		},
+		"ContextPath": {
+			reason:     "A tag with the context source should be read from the pipeline context",
+			tags:       []v1beta1.Tag{{Name: "tier", Source: v1beta1.TagSourceContext, Path: "[example.org/settings].tier"}},
+			wantTags:   []string{"tier=gold"},
+			wantValues: map[string]interface{}{},
+		},
+		"EnvironmentPath": {
+			reason:     "A tag with the environment source should be read from the EnvironmentConfig data",
+			tags:       []v1beta1.Tag{{Name: "region", Source: v1beta1.TagSourceEnvironment, Path: "cluster.region"}},
+			wantTags:   []string{"region=eu-west-1"},
+			wantValues: map[string]interface{}{},
+		},
+		"EnvironmentCEL": {
+			reason: "The environment should be available to CEL expressions as environment",
+			tags: []v1beta1.Tag{{
+				Name:   "zones",
+				Source: v1beta1.TagSourceEnvironment,
+				CEL:    `environment.cluster.zones.map(z, environment.cluster.region + z)`,
+			}},
+			wantTags:   []string{},
+			wantValues: map[string]interface{}{"zones": []interface{}{"eu-west-1a", "eu-west-1b"}},
+		},
+		"NoEnvironment": {
+			reason:     "The default should be injected when the pipeline has no environment",
+			tags:       []v1beta1.Tag{{Name: "region", Source: v1beta1.TagSourceEnvironment, Path: "cluster.region", Default: pointer.String("us-east-1")}},
+			fnctx:      map[string]interface{}{},
+			wantTags:   []string{"region=us-east-1"},
+			wantValues: map[string]interface{}{},
+		},
+		"ResourcePath": {
+			reason:     "A tag with the resource source should be read from the observed composed resource",
+			tags:       []v1beta1.Tag{{Name: "arn", Source: v1beta1.TagSourceResource, ResourceName: "role", Path: "status.atProvider.arn"}},
+			wantTags:   []string{"arn=arn:aws:iam::123456789012:role/my-role"},
+			wantValues: map[string]interface{}{},
+		},
+		"ResourceCEL": {
+			reason: "The observed composed resource should be available to CEL expressions as resource",
+			tags: []v1beta1.Tag{{
+				Name:         "role",
+				Source:       v1beta1.TagSourceResource,
+				ResourceName: "role",
+				CEL:          `resource.status.atProvider.arn.split("/")[1]`,
+			}},
+			wantTags:   []string{"role=my-role"},
+			wantValues: map[string]interface{}{},
+		},
+		"ResourceNotObserved": {
+			reason:     "The default should be injected when the resource is not observed yet",
+			tags:       []v1beta1.Tag{{Name: "arn", Source: v1beta1.TagSourceResource, ResourceName: "policy", Path: "status.atProvider.arn", Default: pointer.String("")}},
+			wantTags:   []string{"arn="},
+			wantValues: map[string]interface{}{},
+		},
+		"TypeInt": {
+			reason:     "An int tag should be injected as a structured value so it stays numeric",
+			tags:       []v1beta1.Tag{{Name: "replicas", Path: "spec.parameters.replicas", Type: v1beta1.TagTypeInt}},
+			wantTags:   []string{},
+			wantValues: map[string]interface{}{"replicas": int64(3)},
+		},
+		"TypeBool": {
+			reason:     "A bool tag should parse the transformed value",
+			tags:       []v1beta1.Tag{{Name: "enabled", Path: "metadata.labels[example.org/team]", Type: v1beta1.TagTypeBool, Transforms: []v1beta1.TagTransform{{Type: v1beta1.Replace, Regex: "platform", Replacement: "true"}}}},
+			wantTags:   []string{},
+			wantValues: map[string]interface{}{"enabled": true},
+		},
+		"TypeJSON": {
+			reason:     "A json tag should parse a JSON encoded string",
+			tags:       []v1beta1.Tag{{Name: "config", Source: v1beta1.TagSourceContext, Path: "[example.org/settings].config", Type: v1beta1.TagTypeJSON}},
+			wantTags:   []string{},
+			wantValues: map[string]interface{}{"config": map[string]interface{}{"size": float64(2)}},
+		},
+		"TypeString": {
+			reason:     "A string tag should be injected as a cue tag",
+			tags:       []v1beta1.Tag{{Name: "replicas", Path: "spec.parameters.replicas", Type: v1beta1.TagTypeString}},
+			wantTags:   []string{"replicas=3"},
+			wantValues: map[string]interface{}{},
+		},
+		"TypeInvalid": {
+			reason:  "A value that does not parse as the type should return an error",
+			tags:    []v1beta1.Tag{{Name: "team", Path: "spec.parameters.team", Type: v1beta1.TagTypeInt}},
+			wantErr: `cannot inject tag "team" as int`,
+		},
+		"TypeMismatch": {
+			reason:  "A map or list should not be injected as a scalar type",
+			tags:    []v1beta1.Tag{{Name: "zones", Path: "spec.parameters.zones", Type: v1beta1.TagTypeNumber}},
+			wantErr: `cannot inject tag "zones" as number: the value is a map or list`,
+		},
+		"CELConcatenation": {
+			reason: "A CEL expression should compute the tag from several fields",
+			tags: []v1beta1.Tag{{
+				Name: "id",
+				CEL:  `xr.metadata.name + "-" + xr.spec.parameters.team.lowerAscii()`,
+			}},
+			wantTags:   []string{"id=my-xr-platform"},
+			wantValues: map[string]interface{}{},
+		},
+		"CELDefault": {
+			reason: "A CEL expression should be able to default a missing field",
+			tags: []v1beta1.Tag{{
+				Name: "region",
+				CEL:  `has(xr.spec.parameters.region) ? xr.spec.parameters.region : "us-east-1"`,
+			}},
+			wantTags:   []string{"region=us-east-1"},
+			wantValues: map[string]interface{}{},
+		},
+		"CELInteger": {
+			reason: "An integer computed by CEL should be formatted as a number",
+			tags: []v1beta1.Tag{{
+				Name: "count",
+				CEL:  `size(xr.spec.parameters.zones) * 2`,
+			}},
+			wantTags:   []string{"count=4"},
+			wantValues: map[string]interface{}{},
+		},
+		"CELList": {
+			reason: "A list computed by CEL should be injected as a structured value",
+			tags: []v1beta1.Tag{{
+				Name: "zones",
+				CEL:  `xr.spec.parameters.zones.map(z, "eu-" + z)`,
+			}},
+			wantTags:   []string{},
+			wantValues: map[string]interface{}{"zones": []interface{}{"eu-a", "eu-b"}},
+		},
+		"CELTransformed": {
+			reason: "Transforms should be applied to the value computed by CEL",
+			tags: []v1beta1.Tag{{
+				Name:       "team",
+				CEL:        `xr.spec.parameters.team`,
+				Transforms: []v1beta1.TagTransform{{Type: v1beta1.ToUpper}},
+			}},
+			wantTags:   []string{"team=PLATFORM"},
+			wantValues: map[string]interface{}{},
+		},
+		"CELCompileError": {
+			reason:  "An invalid CEL expression should return an error",
+			tags:    []v1beta1.Tag{{Name: "bad", CEL: `xr.metadata.name +`}},
+			wantErr: `cannot compute tag "bad": cannot compile CEL expression`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fnctx := tc.fnctx
+			if fnctx == nil {
+				fnctx = defaultCtx
+			}
+			tags, values, err := buildTags(tc.tags, tagSources{xr: xr, context: fnctx, observed: observed})
+			if tc.wantErr != "" {
+				assert.NotNil(t, err, "%s: expected an error", tc.reason)
+				assert.Contains(t, err.Error(), tc.wantErr, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.wantTags, tags, "%s", tc.reason)
+			assert.Equal(t, tc.wantValues, values, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileModule(t *testing.T) {
+	files := map[string]string{
+		"cue.mod/module.cue":  `module: "example.org/platform"`,
+		"schemas/bucket.cue":  "package schemas\n\n#Bucket: {\n\tapiVersion: \"s3.aws.upbound.io/v1beta1\"\n\tkind:       \"Bucket\"\n\tmetadata: name: string\n}\n",
+		"bucket.cue":          "package platform\n\nimport \"example.org/platform/schemas\"\n\nschemas.#Bucket & {metadata: name: #name}\n",
+		"name.cue":            "package platform\n\n#name: string @tag(name)\n",
+		"network/network.cue": "package network\n\nkind: \"Network\"\n",
+	}
+
+	cases := map[string]struct {
+		reason  string
+		module  v1beta1.Module
+		tags    []string
+		want    string
+		wantErr string
+	}{
+		"Imports": {
+			reason: "The package at the module root should be compiled with its imports and tags",
+			module: v1beta1.Module{Files: files},
+			tags:   []string{"name=my-bucket"},
+			want:   "{\n    \"apiVersion\": \"s3.aws.upbound.io/v1beta1\",\n    \"kind\": \"Bucket\",\n    \"metadata\": {\n        \"name\": \"my-bucket\"\n    }\n}\n",
+		},
+		"Package": {
+			reason: "The package directory of the module should be compiled",
+			module: v1beta1.Module{Files: files, Package: "network"},
+			want:   "{\n    \"kind\": \"Network\"\n}\n",
+		},
+		"MissingImport": {
+			reason:  "An import missing from the module should return an error",
+			module:  v1beta1.Module{Files: map[string]string{"cue.mod/module.cue": `module: "example.org/platform"`, "a.cue": "package a\n\nimport \"example.org/platform/missing\"\n\nx: missing.y\n"}},
+			wantErr: "failed creating cue compiler: failed to load: ",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := tc.module
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Module: &m,
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{tags: tc.tags})
+			if tc.wantErr != "" {
+				assert.NotNil(t, err, "%s: expected an error", tc.reason)
+				assert.Contains(t, err.Error(), tc.wantErr, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileLibraries(t *testing.T) {
+	libraries := map[string]string{
+		"metadata.cue": "#metadata: {\n\tname: string\n\tlabels: team: \"platform\"\n}\n",
+		"bucket.cue":   "#Bucket: {\n\tapiVersion: \"s3.aws.upbound.io/v1beta1\"\n\tkind:       \"Bucket\"\n\tmetadata:   #metadata\n}\n",
+	}
+
+	cases := map[string]struct {
+		reason    string
+		value     string
+		libraries map[string]string
+		tags      []string
+		want      string
+		wantErr   string
+	}{
+		"Definitions": {
+			reason:    "The definitions of the libraries should be in scope of the value",
+			value:     "#name: string @tag(name)\n#Bucket & {metadata: name: #name}\n",
+			libraries: libraries,
+			tags:      []string{"name=my-bucket"},
+			want:      "{\n    \"apiVersion\": \"s3.aws.upbound.io/v1beta1\",\n    \"kind\": \"Bucket\",\n    \"metadata\": {\n        \"name\": \"my-bucket\",\n        \"labels\": {\n            \"team\": \"platform\"\n        }\n    }\n}\n",
+		},
+		"Conflict": {
+			reason:    "A value conflicting with a library should return an error",
+			value:     "#metadata: name: 1\n",
+			libraries: libraries,
+			wantErr:   "conflicting values",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Value:     v1beta1.Value(tc.value),
+					Libraries: tc.libraries,
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{tags: tc.tags})
+			if tc.wantErr != "" {
+				assert.NotNil(t, err, "%s: expected an error", tc.reason)
+				assert.Contains(t, err.Error(), tc.wantErr, "%s", tc.reason)
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+func TestCUECompileObserved(t *testing.T) {
+	observed := map[string]interface{}{
+		"composite": map[string]interface{}{
+			"apiVersion": "example.org/v1",
+			"kind":       "XR",
+			"metadata":   map[string]interface{}{"name": "my-xr"},
+			"spec":       map[string]interface{}{"parameters": map[string]interface{}{"region": "eu-west-1"}},
+		},
+	}
+
+	cases := map[string]struct {
+		reason   string
+		value    string
+		module   *v1beta1.Module
+		observed map[string]interface{}
+		desired  map[string]interface{}
+		want     string
+		wantErr  string
+	}{
+		"Undeclared": {
+			reason:   "The observed XR should be referenced without declaring #observed",
+			value:    "region: #observed.composite.spec.parameters.region\nname: \"\\(#observed.composite.metadata.name)-bucket\"\n",
+			observed: observed,
+			want:     "{\n    \"region\": \"eu-west-1\",\n    \"name\": \"my-xr-bucket\"\n}\n",
+		},
+		"Schema": {
+			reason:   "A schema declared for #observed should be unified with the observed XR",
+			value:    "#observed: composite: spec: parameters: region: string\nregion: #observed.composite.spec.parameters.region\n",
+			observed: observed,
+			want:     "{\n    \"region\": \"eu-west-1\"\n}\n",
+		},
+		"SchemaViolation": {
+			reason:   "An observed XR violating the declared schema should return an error",
+			value:    "#observed: composite: spec: parameters: region: \"us-east-1\"\nregion: #observed.composite.spec.parameters.region\n",
+			observed: observed,
+			wantErr:  "conflicting values",
+		},
+		"Package": {
+			reason: "The observed XR should be referenced from a package of a module",
+			module: &v1beta1.Module{Files: map[string]string{
+				"cue.mod/module.cue": `module: "example.org/app"`,
+				"app.cue":            "package app\n\nregion: #observed.composite.spec.parameters.region\n",
+			}},
+			observed: observed,
+			want:     "{\n    \"region\": \"eu-west-1\"\n}\n",
+		},
+		"Resources": {
+			reason: "Observed composed resources should be referenced by their resource name",
+			value:  "if #observed.resources.cluster.status.atProvider.id != _|_ {\n\tclusterId: #observed.resources.cluster.status.atProvider.id\n}\n",
+			observed: map[string]interface{}{
+				"composite": observed["composite"],
+				"resources": map[string]interface{}{
+					"cluster": map[string]interface{}{
+						"apiVersion": "example.org/v1",
+						"kind":       "Cluster",
+						"status":     map[string]interface{}{"atProvider": map[string]interface{}{"id": "cluster-1234"}},
+					},
+				},
+			},
+			want: "{\n    \"clusterId\": \"cluster-1234\"\n}\n",
+		},
+		"ResourcesNotReady": {
+			reason: "Templates should be able to test for fields of observed composed resources that are not set yet",
+			value:  "if #observed.resources.cluster.status.atProvider.id != _|_ {\n\tclusterId: #observed.resources.cluster.status.atProvider.id\n}\n",
+			observed: map[string]interface{}{
+				"composite": observed["composite"],
+				"resources": map[string]interface{}{},
+			},
+			want: "{}\n",
+		},
+		"Desired": {
+			reason: "Resources desired by previous functions should be read and unified from #desired.resources",
+			value:  "#desired.resources.bucket & {spec: region: \"eu-west-1\" | \"us-east-1\"}\n",
+			desired: map[string]interface{}{
+				"composite": observed["composite"],
+				"resources": map[string]interface{}{
+					"bucket": map[string]interface{}{
+						"apiVersion": "example.org/v1",
+						"kind":       "Bucket",
+						"spec":       map[string]interface{}{"region": "eu-west-1"},
+					},
+				},
+			},
+			want: "{\n    \"spec\": {\n        \"region\": \"eu-west-1\"\n    },\n    \"apiVersion\": \"example.org/v1\",\n    \"kind\": \"Bucket\"\n}\n",
+		},
+		"DesiredClosed": {
+			reason: "Fields should not be added to the closed #desired definition",
+			value:  "#desired.resources.bucket & {spec: acl: \"private\"}\n",
+			desired: map[string]interface{}{
+				"composite": observed["composite"],
+				"resources": map[string]interface{}{
+					"bucket": map[string]interface{}{"apiVersion": "example.org/v1", "kind": "Bucket", "spec": map[string]interface{}{"region": "eu-west-1"}},
+				},
+			},
+			wantErr: "spec.acl: field not allowed",
+		},
+		"NotObserved": {
+			reason:  "Without an observed state #observed should not be declared",
+			value:   "region: #observed.composite.spec.parameters.region\n",
+			wantErr: "reference \"#observed\" not found",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{
+				Export: v1beta1.Export{
+					Value:  v1beta1.Value(tc.value),
+					Module: tc.module,
+				},
+			}
+			out, err := cueCompile(outputJSON, in, compileOpts{observed: tc.observed, desired: tc.desired})
+			if tc.wantErr != "" {
+				assert.NotNil(t, err, "%s: expected an error", tc.reason)
+				if err != nil {
+					assert.Contains(t, err.Error(), tc.wantErr, "%s", tc.reason)
+				}
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+)
+
+// debugAnnotation opts a single XR into debugging when set to "true", its
+// debug messages are logged without --debug and the compiled output and the
+// changes to the desired state are attached to the results
+const debugAnnotation = "function-cue.fn/debug"
+
+// debugEnabled returns whether the XR opted into debugging
+func debugEnabled(xr *resource.Composite) bool {
+	return xr.Resource.GetAnnotations()[debugAnnotation] == "true"
+}
+
+// verboseLogger logs debug messages at the info level so that they are
+// logged for a debugged XR when the function runs without --debug
+type verboseLogger struct {
+	logging.Logger
+}
+
+func (l verboseLogger) Debug(msg string, keysAndValues ...any) {
+	l.Logger.Info(msg, keysAndValues...)
+}
+
+func (l verboseLogger) WithValues(keysAndValues ...any) logging.Logger {
+	return verboseLogger{Logger: l.Logger.WithValues(keysAndValues...)}
+}
+
+// debugResults returns the results attached to the response of a debugged XR,
+// the compiled cue output followed by a diff of each desired resource the
+// function changed from the desired state in the request. The sensitive fields
+// are masked by the redactor before they are diffed.
+func debugResults(req *fnv1beta1.RunFunctionRequest, compiled string, dxr *resource.Composite, desired map[resource.Name]*resource.DesiredComposed, r *redactor) ([]*fnv1beta1.Result, error) {
+	results := []*fnv1beta1.Result{{
+		Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+		Message:  fmt.Sprintf("compiled cue output:\n%s", compiled),
+	}}
+
+	prevXR, err := request.GetDesiredCompositeResource(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get desired composite resource")
+	}
+	if diff := cmp.Diff(r.value(prevXR.Resource.UnstructuredContent()), r.value(dxr.Resource.UnstructuredContent())); diff != "" {
+		results = append(results, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+			Message:  fmt.Sprintf("desired xr changed (-before +after):\n%s", diff),
+		})
+	}
+
+	prev, err := request.GetDesiredComposedResources(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get desired composed resources from %T", req)
+	}
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		before := map[string]interface{}{}
+		if p, ok := prev[resource.Name(name)]; ok {
+			before = p.Resource.UnstructuredContent()
+		}
+		diff := cmp.Diff(r.value(before), r.value(desired[resource.Name(name)].Resource.UnstructuredContent()))
+		if diff == "" {
+			continue
+		}
+		results = append(results, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+			Message:  fmt.Sprintf("desired resource %q changed (-before +after):\n%s", name, diff),
+		})
+	}
+	return results, nil
+}
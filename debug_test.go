@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunFunctionDebugAnnotation(t *testing.T) {
+	input := resource.MustStructJSON(`{
+		"apiVersion": "cue.fn.crossplane.io/v1beta1",
+		"kind": "CUEInput",
+		"metadata": {"name": "debugged"},
+		"export": {
+			"target": "Resources",
+			"value": "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\nspec: replicas: 2\n"
+		}
+	}`)
+
+	cases := map[string]struct {
+		reason      string
+		annotations string
+		// want are the substrings expected in each result after the success message
+		want []string
+	}{
+		"NotAnnotated": {
+			reason:      "An XR without the debug annotation should only get the success results",
+			annotations: `{}`,
+		},
+		"Disabled": {
+			reason:      "An XR with the debug annotation set to false should only get the success results",
+			annotations: `{"function-cue.fn/debug": "false"}`,
+		},
+		"Enabled": {
+			reason:      "An XR with the debug annotation should get the compiled output and the desired state diffs",
+			annotations: `{"function-cue.fn/debug": "true"}`,
+			want: []string{
+				"compiled cue output:\n",
+				"desired xr changed (-before +after):\n",
+				"desired resource \"debugged\" changed (-before +after):\n",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: input,
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{
+							"apiVersion": "example.org/v1",
+							"kind": "XR",
+							"metadata": {"name": "my-xr", "annotations": ` + tc.annotations + `}
+						}`),
+					},
+				},
+			}
+
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(context.Background(), req)
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+
+			results := rsp.GetResults()
+			assert.Len(t, results, 1+len(tc.want), "%s", tc.reason)
+			assert.Equal(t, `created resource "generated:Generated"`, results[0].GetMessage(), "%s", tc.reason)
+			for i, want := range tc.want {
+				if len(results) <= i+1 {
+					break
+				}
+				assert.Equal(t, fnv1beta1.Severity_SEVERITY_NORMAL, results[i+1].GetSeverity(), "%s", tc.reason)
+				assert.True(t, strings.HasPrefix(results[i+1].GetMessage(), want), "%s: expected result to start with %q, got %q", tc.reason, want, results[i+1].GetMessage())
+			}
+			if len(tc.want) != 0 && len(results) == 1+len(tc.want) {
+				assert.Contains(t, results[1].GetMessage(), `"generated"`, "%s: the compiled output should be attached", tc.reason)
+				assert.Contains(t, results[3].GetMessage(), "replicas", "%s: the diff should show the rendered fields", tc.reason)
+			}
+		})
+	}
+}
+
+func TestVerboseLogger(t *testing.T) {
+	rec := &recordingLogger{}
+	log := verboseLogger{Logger: rec}.WithValues("xr-name", "my-xr")
+	log.Debug("compiled")
+
+	assert.Equal(t, []string{"info: compiled"}, rec.msgs, "debug messages should be logged at the info level")
+}
+
+// recordingLogger records the level and message of each log line
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Info(msg string, _ ...any)  { l.msgs = append(l.msgs, "info: "+msg) }
+func (l *recordingLogger) Debug(msg string, _ ...any) { l.msgs = append(l.msgs, "debug: "+msg) }
+func (l *recordingLogger) WithValues(_ ...any) logging.Logger {
+	return l
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/ghodss/yaml"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// defaultInput is the export of the default input of the function, which is
+// merged under the export, or every export, of each function input so that
+// operational options are set once per installation of the function
+type defaultInput map[string]interface{}
+
+// loadDefaultInput reads the default input from a CUEInput YAML file, only its
+// export is used and it cannot set a template
+func loadDefaultInput(path string) (defaultInput, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path) //nolint:gosec // the file is set by the operator of the function
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read default input")
+	}
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse default input")
+	}
+	in := v1beta1.CUEInput{}
+	if err := json.Unmarshal(j, &in); err != nil {
+		return nil, errors.Wrap(err, "cannot parse default input")
+	}
+	if len(in.Exports) != 0 {
+		return nil, errors.New("invalid default input: exports cannot be set, set the defaults of every export in export")
+	}
+	e := in.Export
+	if e.Value != "" || e.TemplateRef != nil || e.ValueFrom != nil || e.Module != nil {
+		return nil, errors.New("invalid default input: export cannot set value, valueFrom, templateRef or module")
+	}
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(j, &m); err != nil {
+		return nil, errors.Wrap(err, "cannot parse default input")
+	}
+	d, _ := m["export"].(map[string]interface{})
+	return d, nil
+}
+
+// apply merges the default input under the export of the input, or under each
+// of its exports, the fields the input sets keep their values
+func (d defaultInput) apply(s *structpb.Struct) (*structpb.Struct, error) {
+	if len(d) == 0 {
+		return s, nil
+	}
+	in := s.AsMap()
+	if exports, ok := in["exports"].([]interface{}); ok && len(exports) != 0 {
+		for i, e := range exports {
+			if e, ok := e.(map[string]interface{}); ok {
+				exports[i] = mergeUnder(d, e)
+			}
+		}
+	} else {
+		e, _ := in["export"].(map[string]interface{})
+		in["export"] = mergeUnder(d, e)
+	}
+	return structpb.NewStruct(in)
+}
+
+// mergeUnder returns the values merged over the defaults, objects set in both
+// are merged recursively while the other values replace their default
+func mergeUnder(defaults, values map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(defaults)+len(values))
+	for k, v := range defaults {
+		out[k] = v
+	}
+	for k, v := range values {
+		if v == nil {
+			continue
+		}
+		dm, dok := out[k].(map[string]interface{})
+		vm, vok := v.(map[string]interface{})
+		if dok && vok {
+			out[k] = mergeUnder(dm, vm)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestDefaultInput(t *testing.T) {
+	defaults := `apiVersion: cue.fn.crossplane.io/v1beta1
+kind: CUEInput
+export:
+  overwrite: true
+  options:
+    propagateMetadata: {}
+    timeout: 10s
+    defaults:
+      deletionPolicy: Orphan
+`
+
+	cases := map[string]struct {
+		reason   string
+		defaults string
+		input    string
+		want     string
+		wantErr  bool
+	}{
+		"Export": {
+			reason:   "The default export should be merged under the export, the fields of the export keep their values",
+			defaults: defaults,
+			input:    `{"export": {"value": "a: 1", "options": {"timeout": "5s", "defaults": {"managementPolicies": ["Observe"]}}}}`,
+			want:     `{"export": {"value": "a: 1", "overwrite": true, "options": {"propagateMetadata": {}, "timeout": "5s", "defaults": {"deletionPolicy": "Orphan", "managementPolicies": ["Observe"]}}}}`,
+		},
+		"Exports": {
+			reason:   "The default export should be merged under each export",
+			defaults: defaults,
+			input:    `{"exports": [{"value": "a: 1"}, {"value": "b: 1", "overwrite": false}]}`,
+			want: `{"exports": [
+				{"value": "a: 1", "overwrite": true, "options": {"propagateMetadata": {}, "timeout": "10s", "defaults": {"deletionPolicy": "Orphan"}}},
+				{"value": "b: 1", "overwrite": false, "options": {"propagateMetadata": {}, "timeout": "10s", "defaults": {"deletionPolicy": "Orphan"}}}
+			]}`,
+		},
+		"Template": {
+			reason:   "A default input setting a template should return an error",
+			defaults: "export:\n  value: 'a: 1'\n",
+			wantErr:  true,
+		},
+		"MultipleExports": {
+			reason:   "A default input setting exports should return an error",
+			defaults: "exports:\n- overwrite: true\n",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "defaults.yaml")
+			if err := os.WriteFile(path, []byte(tc.defaults), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			d, err := loadDefaultInput(path)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\nloadDefaultInput(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nloadDefaultInput(...): unexpected error: %v", tc.reason, err)
+			}
+			got, err := d.apply(resource.MustStructJSON(tc.input))
+			if err != nil {
+				t.Fatalf("%s\napply(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(resource.MustStructJSON(tc.want), got, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\napply(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
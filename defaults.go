@@ -0,0 +1,68 @@
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// resourceDefaults is the spec defaulted into the generated managed resources
+type resourceDefaults map[string]interface{}
+
+// newResourceDefaults returns the spec fields set by the defaults option,
+// nothing is defaulted without the option
+func newResourceDefaults(d *v1beta1.ResourceDefaults) resourceDefaults {
+	if d == nil {
+		return nil
+	}
+	spec := resourceDefaults{}
+	if d.DeletionPolicy != "" {
+		spec["deletionPolicy"] = d.DeletionPolicy
+	}
+	if len(d.ManagementPolicies) != 0 {
+		policies := make([]interface{}, len(d.ManagementPolicies))
+		for i, a := range d.ManagementPolicies {
+			policies[i] = string(a)
+		}
+		spec["managementPolicies"] = policies
+	}
+	if d.ProviderConfigRef != nil {
+		spec["providerConfigRef"] = map[string]interface{}{"name": d.ProviderConfigRef.Name}
+	}
+	return spec
+}
+
+// apply deep defaults the spec of the resource when it is a managed resource,
+// that is when it holds a spec.forProvider, the fields the resource sets keep
+// their values
+func (d resourceDefaults) apply(u *unstructured.Unstructured) {
+	if len(d) == 0 {
+		return
+	}
+	spec, ok := u.Object["spec"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if _, ok := spec["forProvider"]; !ok {
+		return
+	}
+	defaultMissing(spec, d)
+}
+
+// defaultMissing sets the fields of from that are missing from into, objects
+// set in both are defaulted recursively
+func defaultMissing(into, from map[string]interface{}) {
+	for k, v := range from {
+		existing, ok := into[k]
+		if !ok {
+			into[k] = runtime.DeepCopyJSONValue(v)
+			continue
+		}
+		em, eok := existing.(map[string]interface{})
+		fm, fok := v.(map[string]interface{})
+		if eok && fok {
+			defaultMissing(em, fm)
+		}
+	}
+}
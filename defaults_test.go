@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestResourceDefaults(t *testing.T) {
+	defaults := &v1beta1.ResourceDefaults{
+		DeletionPolicy:     "Orphan",
+		ManagementPolicies: []v1beta1.ManagementAction{v1beta1.ManagementObserve},
+		ProviderConfigRef:  &v1beta1.ProviderConfigRef{Name: "default"},
+	}
+
+	cases := map[string]struct {
+		reason   string
+		defaults *v1beta1.ResourceDefaults
+		resource map[string]interface{}
+		want     map[string]interface{}
+	}{
+		"Disabled": {
+			reason:   "Nothing should be defaulted without the option",
+			resource: map[string]interface{}{"spec": map[string]interface{}{"forProvider": map[string]interface{}{}}},
+			want:     map[string]interface{}{"spec": map[string]interface{}{"forProvider": map[string]interface{}{}}},
+		},
+		"ManagedResource": {
+			reason:   "Every policy should be defaulted into a managed resource",
+			defaults: defaults,
+			resource: map[string]interface{}{"spec": map[string]interface{}{"forProvider": map[string]interface{}{}}},
+			want: map[string]interface{}{"spec": map[string]interface{}{
+				"forProvider":        map[string]interface{}{},
+				"deletionPolicy":     "Orphan",
+				"managementPolicies": []interface{}{"Observe"},
+				"providerConfigRef":  map[string]interface{}{"name": "default"},
+			}},
+		},
+		"ResourceWins": {
+			reason:   "The policies a resource sets should keep their values",
+			defaults: defaults,
+			resource: map[string]interface{}{"spec": map[string]interface{}{
+				"forProvider":       map[string]interface{}{},
+				"deletionPolicy":    "Delete",
+				"providerConfigRef": map[string]interface{}{"name": "aws"},
+			}},
+			want: map[string]interface{}{"spec": map[string]interface{}{
+				"forProvider":        map[string]interface{}{},
+				"deletionPolicy":     "Delete",
+				"managementPolicies": []interface{}{"Observe"},
+				"providerConfigRef":  map[string]interface{}{"name": "aws"},
+			}},
+		},
+		"NotManaged": {
+			reason:   "A resource without a spec.forProvider should not be defaulted",
+			defaults: defaults,
+			resource: map[string]interface{}{"spec": map[string]interface{}{"compositionRef": map[string]interface{}{"name": "xnetworks"}}},
+			want:     map[string]interface{}{"spec": map[string]interface{}{"compositionRef": map[string]interface{}{"name": "xnetworks"}}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			u := &unstructured.Unstructured{Object: tc.resource}
+			newResourceDefaults(tc.defaults).apply(u)
+			if diff := cmp.Diff(tc.want, u.Object); diff != "" {
+				t.Errorf("%s\napply(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cueerrors "cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/token"
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// valueFile is the name the inline value of the export is reported as, cue
+// reads it from stdin and positions it as -
+const valueFile = "export.value"
+
+// diagnostic is a cue error at a position of the source of the template
+type diagnostic struct {
+	// File of the template, relative to its module or directory
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+	// Path of the field in error
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+	// Snippet is the line of the source in error with a caret at its column
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// String formats the diagnostic as file:line:column: path: message followed by
+// its snippet
+func (d diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		fmt.Fprintf(&b, "%s:%d:%d: ", d.File, d.Line, d.Column)
+	}
+	if d.Path != "" {
+		b.WriteString(d.Path + ": ")
+	}
+	b.WriteString(d.Message)
+	if d.Snippet != "" {
+		b.WriteString("\n" + d.Snippet)
+	}
+	return b.String()
+}
+
+// compileError is a failed compilation and the diagnostics of its cue errors
+type compileError struct {
+	err         error
+	diagnostics []diagnostic
+	// expression names the expression that failed when it is named
+	expression string
+}
+
+func (e *compileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *compileError) Unwrap() error {
+	return e.err
+}
+
+// diagnose returns the error of the compilation with the diagnostics of the
+// cue errors it wraps, errors without positions are returned unchanged
+func diagnose(err error, input v1beta1.CUEInput, opts compileOpts) error {
+	if err == nil {
+		return nil
+	}
+	var diags []diagnostic
+	for _, e := range cueerrors.Errors(err) {
+		format, args := e.Msg()
+		d := diagnostic{
+			Path:    strings.Join(e.Path(), "."),
+			Message: fmt.Sprintf(format, args...),
+		}
+		if pos := errorPosition(e); pos.IsValid() {
+			d.File, d.Line, d.Column = pos.Filename(), pos.Line(), pos.Column()
+			d.Snippet = snippet(source(d.File, input, opts), d.Line, d.Column)
+			d.File = displayFile(d.File, input, opts)
+		}
+		diags = append(diags, d)
+	}
+	if len(diags) == 0 {
+		return err
+	}
+	ce := &compileError{err: err, diagnostics: diags}
+	var xe *expressionError
+	if errors.As(err, &xe) {
+		ce.expression = xe.name
+	}
+	return ce
+}
+
+// errorPosition returns the position of the error, errors such as conflicts
+// are only positioned at the values they unify
+func errorPosition(e cueerrors.Error) token.Pos {
+	if pos := e.Position(); pos.IsValid() && pos.Line() > 0 {
+		return pos
+	}
+	for _, pos := range e.InputPositions() {
+		if pos.IsValid() && pos.Line() > 0 {
+			return pos
+		}
+	}
+	return token.NoPos
+}
+
+// source returns the source of the file of the template, or an empty string
+// when it is unknown
+func source(file string, input v1beta1.CUEInput, opts compileOpts) string {
+	if name, ok := libraryName(file, input); ok {
+		return input.Export.Libraries[name]
+	}
+	switch {
+	case file == "-":
+		return string(input.Export.Value)
+	case input.Export.Module != nil:
+		rel, err := filepath.Rel(moduleRoot, file)
+		if err != nil {
+			return ""
+		}
+		return input.Export.Module.Files[filepath.ToSlash(rel)]
+	case opts.dir != "":
+		b, err := os.ReadFile(file) //nolint:gosec // the file is part of the template being compiled
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// displayFile returns the name of the file reported to users, the libraries
+// of the export are reported by their name
+func displayFile(file string, input v1beta1.CUEInput, opts compileOpts) string {
+	if file == "-" {
+		return valueFile
+	}
+	if name, ok := libraryName(file, input); ok {
+		return name
+	}
+	for _, root := range []string{moduleRoot, opts.dir} {
+		if root == "" {
+			continue
+		}
+		if rel, err := filepath.Rel(root, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return file
+}
+
+// libraryName returns the name of the library of the export loaded from the
+// file, and whether the file is a library
+func libraryName(file string, input v1beta1.CUEInput) (string, bool) {
+	if input.Export.Module != nil || filepath.Dir(file) != filepath.Clean(libraryDir) {
+		return "", false
+	}
+	name := filepath.Base(file)
+	_, ok := input.Export.Libraries[name]
+	return name, ok
+}
+
+// snippet returns the line of the source with a caret under the column, tabs
+// before the column are kept so that the caret lines up, a column past the end
+// of the line points at the end of the input
+func snippet(src string, line, column int) string {
+	lines := strings.Split(src, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	text := strings.TrimRight(lines[line-1], "\r")
+	var caret strings.Builder
+	for i := 0; i < column-1; i++ {
+		if i < len(text) && text[i] == '\t' {
+			caret.WriteByte('\t')
+			continue
+		}
+		caret.WriteByte(' ')
+	}
+	gutter := fmt.Sprintf("%4d | ", line)
+	return gutter + text + "\n" + strings.Repeat(" ", len(gutter)-2) + "| " + caret.String() + "^"
+}
+
+// compileFailed sets a fatal result for the failed compilation, the cue errors
+// are listed with their position and a snippet of their source, and are logged
+// with their position as structured fields
+func compileFailed(log logging.Logger, rsp *fnv1beta1.RunFunctionResponse, err error) {
+	var ce *compileError
+	if !errors.As(err, &ce) {
+		response.Fatal(rsp, errors.Wrap(err, "failed compiling cue template"))
+		return
+	}
+	lines := make([]string, 0, len(ce.diagnostics))
+	for _, d := range ce.diagnostics {
+		log.Info("CUE compilation error", "file", d.File, "line", d.Line, "column", d.Column, "path", d.Path, "error", d.Message)
+		lines = append(lines, d.String())
+	}
+	if ce.expression != "" {
+		response.Fatal(rsp, errors.Errorf("failed compiling cue template: expression %q:\n%s", ce.expression, strings.Join(lines, "\n")))
+		return
+	}
+	response.Fatal(rsp, errors.Errorf("failed compiling cue template:\n%s", strings.Join(lines, "\n")))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestDiagnose(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		input  v1beta1.CUEInput
+		want   []diagnostic
+	}{
+		"Conflict": {
+			reason: "A conflict should be positioned at the value in the template",
+			input:  v1beta1.CUEInput{Export: v1beta1.Export{Value: "a: 1\nb: a & 2\n"}},
+			want: []diagnostic{{
+				File:    valueFile,
+				Line:    2,
+				Column:  8,
+				Path:    "b",
+				Message: "conflicting values 2 and 1",
+				Snippet: "   2 | b: a & 2\n     |        ^",
+			}},
+		},
+		"Syntax": {
+			reason: "A syntax error should be positioned in the template",
+			input:  v1beta1.CUEInput{Export: v1beta1.Export{Value: "a: {\n\tb: 1\n\tc:\n"}},
+			want: []diagnostic{{
+				File:    valueFile,
+				Line:    3,
+				Column:  5,
+				Message: "expected operand, found 'EOF'",
+				Snippet: "   3 | \tc:\n     | \t   ^",
+			}},
+		},
+		"Module": {
+			reason: "An error in a module should be positioned in its file relative to the module",
+			input: v1beta1.CUEInput{Export: v1beta1.Export{Module: &v1beta1.Module{Files: map[string]string{
+				"cue.mod/module.cue": `module: "example.org/platform"`,
+				"bucket.cue":         "package platform\n\nname: 1 & \"b\"\n",
+			}}}},
+			want: []diagnostic{{
+				File:    "bucket.cue",
+				Line:    3,
+				Column:  7,
+				Path:    "name",
+				Message: "conflicting values 1 and \"b\" (mismatched types int and string)",
+				Snippet: "   3 | name: 1 & \"b\"\n     |       ^",
+			}},
+		},
+		"Library": {
+			reason: "An error in a library should be positioned in the library by its name",
+			input: v1beta1.CUEInput{Export: v1beta1.Export{
+				Value:     "name: #name\n",
+				Libraries: map[string]string{"names.cue": "#name: 1 & \"b\"\n"},
+			}},
+			want: []diagnostic{{
+				File:    "names.cue",
+				Line:    1,
+				Column:  8,
+				Path:    "name",
+				Message: "conflicting values 1 and \"b\" (mismatched types int and string)",
+				Snippet: "   1 | #name: 1 & \"b\"\n     |        ^",
+			}, {
+				File:    "names.cue",
+				Line:    1,
+				Column:  8,
+				Path:    "#name",
+				Message: "conflicting values 1 and \"b\" (mismatched types int and string)",
+				Snippet: "   1 | #name: 1 & \"b\"\n     |        ^",
+			}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			opts := compileOpts{parseData: true}
+			_, err := cueCompile(outputJSON, tc.input, opts)
+			ce, ok := diagnose(err, tc.input, opts).(*compileError)
+			if !ok {
+				t.Fatalf("%s\ndiagnose(...): want a compile error, got %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, ce.diagnostics); diff != "" {
+				t.Errorf("%s\ndiagnose(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCompileFailed(t *testing.T) {
+	in := v1beta1.CUEInput{Export: v1beta1.Export{Value: "a: 1\nb: a & 2\n"}}
+	_, err := cueCompile(outputJSON, in, compileOpts{parseData: true})
+
+	rsp := &fnv1beta1.RunFunctionResponse{}
+	compileFailed(logging.NewNopLogger(), rsp, diagnose(err, in, compileOpts{parseData: true}))
+	want := "failed compiling cue template:\nexport.value:2:8: b: conflicting values 2 and 1\n   2 | b: a & 2\n     |        ^"
+	if diff := cmp.Diff(want, rsp.GetResults()[0].GetMessage()); diff != "" {
+		t.Errorf("compileFailed(...): -want message, +got message:\n%s", diff)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// snapshot is a copy of the desired state taken before an export in diff mode,
+// the state the export produced is compared against it and restored to it
+type snapshot struct {
+	xr         map[string]interface{}
+	connection resource.ConnectionDetails
+	desired    map[resource.Name]*resource.DesiredComposed
+	context    *structpb.Struct
+	outputs    int
+	pruned     int
+	ready      fnv1beta1.Ready
+}
+
+// takeSnapshot copies the desired state of the pipeline
+func takeSnapshot(s *pipelineState) snapshot {
+	sn := snapshot{
+		xr:         runtime.DeepCopyJSON(s.dxr.Resource.UnstructuredContent()),
+		connection: resource.ConnectionDetails{},
+		desired:    make(map[resource.Name]*resource.DesiredComposed, len(s.desired)),
+		context:    proto.Clone(s.context).(*structpb.Struct),
+		outputs:    len(s.outputs),
+		pruned:     len(s.pruned),
+		ready:      s.ready,
+	}
+	for k, v := range s.dxr.ConnectionDetails {
+		sn.connection[k] = append([]byte(nil), v...)
+	}
+	for name, dcd := range s.desired {
+		sn.desired[name] = &resource.DesiredComposed{
+			Resource: &composed.Unstructured{Unstructured: *dcd.Resource.Unstructured.DeepCopy()},
+			Ready:    dcd.Ready,
+		}
+	}
+	return sn
+}
+
+// restore sets the desired state of the pipeline back to the snapshot, the
+// state is restored in place since it is shared with the caller
+func (sn snapshot) restore(s *pipelineState) {
+	s.dxr.Resource.SetUnstructuredContent(sn.xr)
+	s.dxr.ConnectionDetails = sn.connection
+	for name := range s.desired {
+		delete(s.desired, name)
+	}
+	for name, dcd := range sn.desired {
+		s.desired[name] = dcd
+	}
+	s.context.Fields = sn.context.GetFields()
+	s.outputs = s.outputs[:sn.outputs]
+	s.pruned = s.pruned[:sn.pruned]
+	s.ready = sn.ready
+}
+
+// diffState returns a message for each object of the desired state that differs
+// from the snapshot, listing the changed fields. The objects are compared with
+// their sensitive fields masked by the redactor, so that the values of secrets
+// are never printed, and the messages are redacted like any other result.
+func diffState(sn snapshot, s *pipelineState, r *redactor) []string {
+	var msgs []string
+	if changes := diffValues("", r.value(sn.xr), r.value(s.dxr.Resource.UnstructuredContent())); len(changes) != 0 {
+		msgs = append(msgs, diffMessage("xr", changes))
+	}
+
+	names := map[resource.Name]bool{}
+	for name := range sn.desired {
+		names[name] = true
+	}
+	for name := range s.desired {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, string(name))
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		var before, after interface{}
+		if dcd, ok := sn.desired[resource.Name(name)]; ok {
+			before = r.value(dcd.Resource.UnstructuredContent())
+		}
+		if dcd, ok := s.desired[resource.Name(name)]; ok {
+			after = r.value(dcd.Resource.UnstructuredContent())
+		}
+		if changes := diffValues("", before, after); len(changes) != 0 {
+			msgs = append(msgs, diffMessage(fmt.Sprintf("resource %q", name), changes))
+		}
+	}
+
+	if changes := diffValues("", r.value(sn.context.AsMap()), r.value(s.context.AsMap())); len(changes) != 0 {
+		msgs = append(msgs, diffMessage("context", changes))
+	}
+	for i, msg := range msgs {
+		msgs[i] = r.message(msg)
+	}
+	return msgs
+}
+
+// diffResults returns a result for each object of the desired state that
+// differs from the snapshot, or a single result when nothing differs
+func diffResults(sn snapshot, s *pipelineState, r *redactor) []*fnv1beta1.Result {
+	msgs := diffState(sn, s, r)
+	if len(msgs) == 0 {
+		msgs = []string{"diff: no changes to the desired state"}
+	}
+	results := make([]*fnv1beta1.Result, 0, len(msgs))
+	for _, msg := range msgs {
+		results = append(results, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+			Message:  msg,
+		})
+	}
+	return results
+}
+
+// diffMessage formats the changes of an object
+func diffMessage(object string, changes []string) string {
+	return fmt.Sprintf("diff of %s:\n%s", object, strings.Join(changes, "\n"))
+}
+
+// diffValues returns the changes between the values, one per line as
+// "+ path: value" for added fields, "- path: value" for removed fields and
+// "~ path: old -> new" for changed fields, objects are compared field by field
+// and other values, including lists, as a whole
+func diffValues(path string, before, after interface{}) []string {
+	bm, bok := before.(map[string]interface{})
+	am, aok := after.(map[string]interface{})
+	if bok && aok {
+		keys := map[string]bool{}
+		for k := range bm {
+			keys[k] = true
+		}
+		for k := range am {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		var changes []string
+		for _, k := range sorted {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			bv, inBefore := bm[k]
+			av, inAfter := am[k]
+			switch {
+			case !inBefore:
+				changes = append(changes, fmt.Sprintf("+ %s: %s", p, diffJSON(av)))
+			case !inAfter:
+				changes = append(changes, fmt.Sprintf("- %s: %s", p, diffJSON(bv)))
+			default:
+				changes = append(changes, diffValues(p, bv, av)...)
+			}
+		}
+		return changes
+	}
+
+	b, a := diffJSON(before), diffJSON(after)
+	switch {
+	case b == a:
+		return nil
+	case before == nil:
+		return []string{fmt.Sprintf("+ %s: %s", diffPath(path), a)}
+	case after == nil:
+		return []string{fmt.Sprintf("- %s: %s", diffPath(path), b)}
+	}
+	return []string{fmt.Sprintf("~ %s: %s -> %s", diffPath(path), b, a)}
+}
+
+// diffPath returns the path of a change, the root of an object is "."
+func diffPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// diffJSON formats a value of a change as compact json, html characters are
+// not escaped so that values such as the redacted mask read as they are
+func diffJSON(v interface{}) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
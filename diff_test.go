@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffValues(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		before interface{}
+		after  interface{}
+		want   []string
+	}{
+		"Unchanged": {
+			reason: "Equal values should have no changes",
+			before: map[string]interface{}{"spec": map[string]interface{}{"replicas": 3.0}},
+			after:  map[string]interface{}{"spec": map[string]interface{}{"replicas": 3.0}},
+		},
+		"Fields": {
+			reason: "Added, removed and changed fields should be listed by their path",
+			before: map[string]interface{}{"spec": map[string]interface{}{"replicas": 3.0, "region": "eu-west-1"}},
+			after:  map[string]interface{}{"spec": map[string]interface{}{"replicas": 5.0, "zones": []interface{}{"a"}}},
+			want: []string{
+				`- spec.region: "eu-west-1"`,
+				`~ spec.replicas: 3 -> 5`,
+				`+ spec.zones: ["a"]`,
+			},
+		},
+		"Lists": {
+			reason: "Lists should be compared as a whole",
+			before: map[string]interface{}{"items": []interface{}{"a", "b"}},
+			after:  map[string]interface{}{"items": []interface{}{"a", "c"}},
+			want:   []string{`~ items: ["a","b"] -> ["a","c"]`},
+		},
+		"Added": {
+			reason: "An added object should be listed as a whole",
+			after:  map[string]interface{}{"kind": "Bucket"},
+			want:   []string{`+ .: {"kind":"Bucket"}`},
+		},
+		"Removed": {
+			reason: "A removed object should be listed as a whole",
+			before: map[string]interface{}{"kind": "Bucket"},
+			want:   []string{`- .: {"kind":"Bucket"}`},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := diffValues("", tc.before, tc.after)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ndiffValues(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
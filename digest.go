@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// sha256Digest returns the digest of b in the sha256:<hex> form of OCI
+// descriptors
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyDigest returns an error when the digest of b does not match the pinned
+// digest, an empty pin matches every digest
+func verifyDigest(b []byte, pinned string) error {
+	if pinned == "" {
+		return nil
+	}
+	if got := sha256Digest(b); got != pinned {
+		return errors.Errorf("digest %s does not match the pinned digest %s", got, pinned)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+const externalNameAnnotation = "crossplane.io/external-name"
+
+// externalNamer sets the external name of the generated composed resources
+// from the externalName template, a nil externalNamer sets nothing
+type externalNamer struct {
+	ctx      *cue.Context
+	template string
+	xr       map[string]interface{}
+}
+
+// newExternalNamer returns the externalNamer of the option, nil without the
+// option
+func newExternalNamer(o *v1beta1.ExternalName, xr *resource.Composite) *externalNamer {
+	if o == nil {
+		return nil
+	}
+	n := &externalNamer{ctx: cuecontext.New(), template: o.Template, xr: map[string]interface{}{}}
+	if xr != nil {
+		n.xr = xr.Resource.UnstructuredContent()
+	}
+	return n
+}
+
+// apply annotates the resource with the external name the template evaluates
+// to, a resource that already sets the annotation keeps its value
+func (n *externalNamer) apply(u *unstructured.Unstructured) error {
+	if n == nil {
+		return nil
+	}
+	if _, ok := u.GetAnnotations()[externalNameAnnotation]; ok {
+		return nil
+	}
+
+	scope := n.ctx.Encode(map[string]interface{}{"xr": n.xr, "resource": u.Object})
+	v := n.ctx.CompileString(n.template, cue.Filename("externalName.template"), cue.Scope(scope))
+	name, err := v.String()
+	if err != nil {
+		return errors.Wrapf(err, "cannot evaluate the external name of %q", u.GetName())
+	}
+	if name == "" {
+		return errors.Errorf("cannot evaluate the external name of %q: template evaluates to an empty string", u.GetName())
+	}
+
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[externalNameAnnotation] = name
+	u.SetAnnotations(annotations)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestExternalName(t *testing.T) {
+	xr := &resource.Composite{Resource: composite.New()}
+	xr.Resource.SetName("my-xr")
+	xr.Resource.SetLabels(map[string]string{"example.org/team": "platform"})
+
+	cases := map[string]struct {
+		reason      string
+		option      *v1beta1.ExternalName
+		xr          *resource.Composite
+		annotations map[string]string
+		want        map[string]string
+		wantErr     bool
+	}{
+		"Disabled": {
+			reason: "Nothing should be set without the option",
+			xr:     xr,
+		},
+		"Template": {
+			reason: "The external name should interpolate the XR and the resource",
+			option: &v1beta1.ExternalName{Template: `"\(xr.metadata.labels["example.org/team"])-\(xr.metadata.name)-\(resource.metadata.name)"`},
+			xr:     xr,
+			want:   map[string]string{externalNameAnnotation: "platform-my-xr-bucket"},
+		},
+		"ResourceWins": {
+			reason:      "An external name the resource sets should keep its value",
+			option:      &v1beta1.ExternalName{Template: `"\(xr.metadata.name)"`},
+			xr:          xr,
+			annotations: map[string]string{externalNameAnnotation: "existing"},
+			want:        map[string]string{externalNameAnnotation: "existing"},
+		},
+		"MissingField": {
+			reason:  "A template referencing a missing field should return an error",
+			option:  &v1beta1.ExternalName{Template: `"\(xr.spec.id)"`},
+			xr:      xr,
+			wantErr: true,
+		},
+		"NoXR": {
+			reason:  "A template referencing the XR without an XR should return an error",
+			option:  &v1beta1.ExternalName{Template: `"\(xr.metadata.name)"`},
+			wantErr: true,
+		},
+		"Empty": {
+			reason:  "A template evaluating to an empty string should return an error",
+			option:  &v1beta1.ExternalName{Template: `""`},
+			xr:      xr,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			u := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			u.SetName("bucket")
+			u.SetAnnotations(tc.annotations)
+			err := newExternalNamer(tc.option, tc.xr).apply(u)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\napply(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\napply(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, u.GetAnnotations()); diff != "" {
+				t.Errorf("%s\napply(...): -want annotations, +got annotations:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
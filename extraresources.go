@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// extraResourcesDef is the definition the extra resources fetched for the
+// requirements of the template are injected into, keyed by requirement name
+const extraResourcesDef = "extraResources"
+
+// extraResourceSelector selects the extra resources of a requirement, either
+// by name or by labels
+type extraResourceSelector struct {
+	APIVersion  string            `json:"apiVersion"`
+	Kind        string            `json:"kind"`
+	MatchName   string            `json:"matchName,omitempty"`
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
+
+// validate checks the selector has a type and exactly one match
+func (s extraResourceSelector) validate() error {
+	if s.APIVersion == "" || s.Kind == "" {
+		return errors.New("apiVersion and kind are required")
+	}
+	if (s.MatchName == "") == (len(s.MatchLabels) == 0) {
+		return errors.New("exactly one of matchName or matchLabels is required")
+	}
+	return nil
+}
+
+// getExtraResources returns the extra resources fetched by Crossplane for the
+// requirements of the previous invocation, keyed by requirement name
+func getExtraResources(req *fnv1beta1.RunFunctionRequest) (map[string]interface{}, error) {
+	entries, err := unknownBytes(req, requestExtraResourcesField)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse extra resources")
+	}
+	extra := make(map[string]interface{}, len(entries))
+	for _, e := range entries {
+		name, value, err := mapEntry(e)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse extra resources")
+		}
+		// Resources holds the repeated Resource items in field 1
+		items, err := consumeBytesField(value, 1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse extra resources %q", name)
+		}
+		resources := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			r := &fnv1beta1.Resource{}
+			if err := proto.Unmarshal(item, r); err != nil {
+				return nil, errors.Wrapf(err, "cannot parse extra resources %q", name)
+			}
+			resources = append(resources, r.GetResource().AsMap())
+		}
+		extra[name] = resources
+	}
+	return extra, nil
+}
+
+// setRequirements sets the extra resources required by the template, Crossplane
+// fetches them and runs the function again with them
+func setRequirements(rsp *fnv1beta1.RunFunctionResponse, reqs map[string]extraResourceSelector) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(reqs))
+	for name := range reqs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Requirements holds the map of ResourceSelectors in field 1
+	var b []byte
+	for _, name := range names {
+		sel := reqs[name]
+		if err := sel.validate(); err != nil {
+			return fmt.Errorf("invalid requirement %q: %w", name, err)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendMapEntry(nil, name, appendSelector(nil, sel)))
+	}
+	setUnknownBytes(rsp, responseRequirementsField, b)
+	return nil
+}
+
+// appendSelector appends the wire encoding of a ResourceSelector
+func appendSelector(b []byte, s extraResourceSelector) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, s.APIVersion)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, s.Kind)
+	if s.MatchName != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		return protowire.AppendString(b, s.MatchName)
+	}
+
+	// MatchLabels holds the map of labels in field 1
+	keys := make([]string, 0, len(s.MatchLabels))
+	for k := range s.MatchLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var labels []byte
+	for _, k := range keys {
+		labels = protowire.AppendTag(labels, 1, protowire.BytesType)
+		labels = protowire.AppendBytes(labels, appendMapEntry(nil, k, []byte(s.MatchLabels[k])))
+	}
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	return protowire.AppendBytes(b, labels)
+}
+
+// appendMapEntry appends the wire encoding of a map entry with a string key
+// and a length delimited value
+func appendMapEntry(b []byte, key string, value []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// mapEntry decodes a map entry with a string key and a length delimited value
+func mapEntry(b []byte) (string, []byte, error) {
+	keys, err := consumeBytesField(b, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	values, err := consumeBytesField(b, 2)
+	if err != nil {
+		return "", nil, err
+	}
+	// The last occurrence of a field wins
+	var key string
+	var value []byte
+	if len(keys) != 0 {
+		key = string(keys[len(keys)-1])
+	}
+	if len(values) != 0 {
+		value = values[len(values)-1]
+	}
+	return key, value, nil
+}
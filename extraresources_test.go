@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+// setExtraResources encodes the extra resources into the request like Crossplane
+func setExtraResources(t *testing.T, req *fnv1beta1.RunFunctionRequest, extra map[string][]string) {
+	t.Helper()
+	for name, resources := range extra {
+		var items []byte
+		for _, r := range resources {
+			b, err := proto.Marshal(&fnv1beta1.Resource{Resource: resource.MustStructJSON(r)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			items = protowire.AppendTag(items, 1, protowire.BytesType)
+			items = protowire.AppendBytes(items, b)
+		}
+		setUnknownBytes(req, requestExtraResourcesField, appendMapEntry(nil, name, items))
+	}
+}
+
+// getRequirements decodes the requirements of the response like Crossplane
+func getRequirements(t *testing.T, rsp *fnv1beta1.RunFunctionResponse) map[string]extraResourceSelector {
+	t.Helper()
+	fields, err := unknownBytes(rsp, responseRequirementsField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	entries, err := consumeBytesField(fields[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := map[string]extraResourceSelector{}
+	for _, e := range entries {
+		name, value, err := mapEntry(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sel := extraResourceSelector{}
+		for _, f := range []struct {
+			num protowire.Number
+			to  *string
+		}{{1, &sel.APIVersion}, {2, &sel.Kind}, {3, &sel.MatchName}} {
+			v, err := consumeBytesField(value, f.num)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v) != 0 {
+				*f.to = string(v[0])
+			}
+		}
+		labels, err := consumeBytesField(value, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range labels {
+			entries, err := consumeBytesField(l, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sel.MatchLabels = map[string]string{}
+			for _, e := range entries {
+				k, v, err := mapEntry(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sel.MatchLabels[k] = string(v)
+			}
+		}
+		reqs[name] = sel
+	}
+	return reqs
+}
+
+func TestRunFunctionExtraResources(t *testing.T) {
+	input := func(value string) string {
+		return `{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "network"},
+			"export": {
+				"target": "Resources",
+				"value": "` + value + `"
+			}
+		}`
+	}
+	// The template requires the subnets of the XR's network and creates an
+	// instance in the first subnet once Crossplane fetched them
+	template := `#requirements: {\n` +
+		`\tsubnets: {apiVersion: \"ec2.aws.upbound.io/v1beta1\", kind: \"Subnet\", matchLabels: network: \"my-network\"}\n` +
+		`\tconfig: {apiVersion: \"apiextensions.crossplane.io/v1alpha1\", kind: \"EnvironmentConfig\", matchName: \"network\"}\n` +
+		`}\n` +
+		`if #extraResources.subnets != _|_ {\n` +
+		`\tapiVersion: \"ec2.aws.upbound.io/v1beta1\"\n` +
+		`\tkind: \"Instance\"\n` +
+		`\tmetadata: name: \"instance\"\n` +
+		`\tspec: forProvider: subnetId: #extraResources.subnets[0].status.atProvider.id\n` +
+		`}\n`
+	requirements := map[string]extraResourceSelector{
+		"subnets": {APIVersion: "ec2.aws.upbound.io/v1beta1", Kind: "Subnet", MatchLabels: map[string]string{"network": "my-network"}},
+		"config":  {APIVersion: "apiextensions.crossplane.io/v1alpha1", Kind: "EnvironmentConfig", MatchName: "network"},
+	}
+
+	cases := map[string]struct {
+		reason      string
+		input       string
+		extra       map[string][]string
+		want        map[string]extraResourceSelector
+		wantDesired map[string]*fnv1beta1.Resource
+		wantFatal   string
+	}{
+		"Requirements": {
+			reason: "The requirements of the template should be returned before the extra resources are fetched",
+			input:  input(template),
+			want:   requirements,
+		},
+		"ExtraResources": {
+			reason: "The fetched extra resources should be available to the template in #extraResources",
+			input:  input(template),
+			extra: map[string][]string{
+				"subnets": {`{"apiVersion": "ec2.aws.upbound.io/v1beta1", "kind": "Subnet", "metadata": {"name": "subnet-a"}, "status": {"atProvider": {"id": "subnet-1234"}}}`},
+				"config":  {},
+			},
+			want: requirements,
+			wantDesired: map[string]*fnv1beta1.Resource{
+				"network": {
+					Resource: resource.MustStructJSON(`{"apiVersion": "ec2.aws.upbound.io/v1beta1", "kind": "Instance", "metadata": {"name": "instance"}, "spec": {"forProvider": {"subnetId": "subnet-1234"}}}`),
+				},
+			},
+		},
+		"NoRequirements": {
+			reason: "A template without requirements should not return any",
+			input:  input(`apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n`),
+			wantDesired: map[string]*fnv1beta1.Resource{
+				"network": {
+					Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Generated", "metadata": {"name": "generated"}}`),
+				},
+			},
+		},
+		"InvalidRequirement": {
+			reason:    "A requirement without a match should return a fatal result",
+			input:     input(`#requirements: subnets: {apiVersion: \"ec2.aws.upbound.io/v1beta1\", kind: \"Subnet\"}\n`),
+			wantFatal: "cannot set extra resource requirements: invalid requirement \"subnets\": exactly one of matchName or matchLabels is required",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(tc.input),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+					},
+				},
+			}
+			setExtraResources(t, req, tc.extra)
+
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			var fatal string
+			for _, r := range rsp.GetResults() {
+				if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+					fatal = r.GetMessage()
+				}
+			}
+			if diff := cmp.Diff(tc.wantFatal, fatal); diff != "" {
+				t.Fatalf("%s\nf.RunFunction(...): -want fatal result, +got fatal result:\n%s", tc.reason, diff)
+			}
+			if tc.wantFatal != "" {
+				return
+			}
+			if diff := cmp.Diff(tc.want, getRequirements(t, rsp)); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want requirements, +got requirements:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantDesired, rsp.GetDesired().GetResources(), protocmp.Transform(), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired, +got desired:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
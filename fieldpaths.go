@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// fieldSegment returns the segment of the field of an object, the key is used
+// as is so keys holding periods, slashes or brackets, such as the keys of
+// annotations, are never split or parsed
+func fieldSegment(key string) fieldpath.Segment {
+	return fieldpath.Segment{Type: fieldpath.SegmentField, Field: key}
+}
+
+// indexSegment returns the segment of the item of a list at the index
+func indexSegment(i int) fieldpath.Segment {
+	return fieldpath.Segment{Type: fieldpath.SegmentIndex, Index: uint(i)}
+}
+
+// childPath returns the path of the child of the path at the segment, the path
+// is copied so that sibling paths never share their segments
+func childPath(path fieldpath.Segments, s fieldpath.Segment) fieldpath.Segments {
+	out := make(fieldpath.Segments, len(path), len(path)+1)
+	copy(out, path)
+	return append(out, s)
+}
+
+// content returns the content of the object, initialising an object without
+// content
+func content(u *unstructured.Unstructured) map[string]interface{} {
+	if u.Object == nil {
+		u.Object = map[string]interface{}{}
+	}
+	return u.Object
+}
+
+// getPath returns the value at the path of the object, nil when a field or an
+// item of the path is not set
+func getPath(obj map[string]interface{}, path fieldpath.Segments) (interface{}, error) {
+	var in interface{} = obj
+	for i, s := range path {
+		switch s.Type {
+		case fieldpath.SegmentField:
+			m, ok := in.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s: not an object", path[:i])
+			}
+			in = m[s.Field]
+		case fieldpath.SegmentIndex:
+			l, ok := in.([]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s: not an array", path[:i])
+			}
+			if int(s.Index) >= len(l) {
+				return nil, nil
+			}
+			in = l[s.Index]
+		}
+		if in == nil {
+			return nil, nil
+		}
+	}
+	return in, nil
+}
+
+// setPath sets the value at the path of the object, creating the objects and
+// growing the lists of the path that are not set
+func setPath(obj map[string]interface{}, path fieldpath.Segments, v interface{}) error {
+	if len(path) == 0 {
+		return errors.New("cannot set a value at an empty path")
+	}
+	var in interface{} = obj
+	for i, s := range path {
+		final := i == len(path)-1
+		switch s.Type {
+		case fieldpath.SegmentField:
+			m, ok := in.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("%s is not an object", path[:i])
+			}
+			if final {
+				m[s.Field] = v
+				return nil
+			}
+			m[s.Field] = prepare(m[s.Field], path[i+1])
+			in = m[s.Field]
+		case fieldpath.SegmentIndex:
+			l, ok := in.([]interface{})
+			if !ok {
+				return errors.Errorf("%s is not an array", path[:i])
+			}
+			if final {
+				l[s.Index] = v
+				return nil
+			}
+			l[s.Index] = prepare(l[s.Index], path[i+1])
+			in = l[s.Index]
+		}
+	}
+	return nil
+}
+
+// prepare returns the value of a segment of a path with the container the next
+// segment sets a value in, a list is grown to hold the index of the next
+// segment
+func prepare(v interface{}, next fieldpath.Segment) interface{} {
+	if v == nil {
+		if next.Type == fieldpath.SegmentIndex {
+			return make([]interface{}, next.Index+1)
+		}
+		return map[string]interface{}{}
+	}
+	if l, ok := v.([]interface{}); ok && next.Type == fieldpath.SegmentIndex && int(next.Index) >= len(l) {
+		return append(l, make([]interface{}, int(next.Index)-len(l)+1)...)
+	}
+	return v
+}
@@ -4,28 +4,79 @@ import (
 	"context"
 	"fmt"
 	"sort"
-	"strings"
+	"time"
 
 	"github.com/crossplane-contrib/function-cue/input/v1beta1"
 
 	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
-	rresource "github.com/crossplane/crossplane-runtime/pkg/resource"
 	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
 	"github.com/crossplane/function-sdk-go/request"
 	"github.com/crossplane/function-sdk-go/resource"
 	"github.com/crossplane/function-sdk-go/resource/composed"
 	"github.com/crossplane/function-sdk-go/response"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/util/json"
 )
 
 // Function returns whatever response you ask it to.
 type Function struct {
 	fnv1beta1.UnimplementedFunctionRunnerServiceServer
 
-	log logging.Logger
+	log  logging.Logger
+	mode runMode
+	// name of the function, injected into #meta
+	name string
+	// templates resolves the templates referenced by templateRef
+	templates templateSources
+	// modules fetches the dependencies of modules from OCI registries
+	modules *moduleFetcher
+	// now returns the time injected into templates that set inject_now and
+	// the transition time of the XR conditions set by templates, it is
+	// frozen to a fixed time to keep renders reproducible in tests
+	now func() time.Time
+	// isolation runs each cue evaluation in a resource limited worker
+	// subprocess when set
+	isolation *workerLimits
+	// sizeWarning is the serialized size in bytes at which desired
+	// resources are warned about, 0 disables the warnings
+	sizeWarning int
+	// timeout is the maximum time of a cue evaluation, 0 is unlimited
+	timeout time.Duration
+	// abandoned bounds the evaluations abandoned after their timeout that
+	// still run, they are not bounded when it is nil
+	abandoned *abandonedEvals
+	// limits bound what a cue evaluation generates
+	limits evalLimits
+	// pool bounds the number of concurrent cue evaluations, evaluations are
+	// not bounded when it is nil
+	pool *evalPool
+	// cache caches built templates when set
+	cache *templateCache
+	// metrics records the prometheus metrics of the function when set
+	metrics *metrics
+	// tracer records the spans of RunFunction calls when set
+	tracer *tracer
+	// artifacts captures the failed compilations and matches when set
+	artifacts *artifactSink
+	// configMaps resolves the values referenced by valueFrom when set
+	configMaps *configMapValues
+	// git resolves the values referenced by valueFrom from git repositories
+	// when set
+	git *gitValues
+	// defaults are merged under the exports of every function input when set
+	defaults defaultInput
+	// logCompileOutput logs the output of each cue compilation at debug level
+	logCompileOutput bool
+	// redactor masks the values of secret keys in the logged compile output
+	// and in the results when set
+	redactor *redactor
+	// schemas are the CRD schemas the generated resources are validated
+	// against
+	schemas crdSchemas
 }
 
 // RunFunction runs the Function.
@@ -44,21 +95,49 @@ type Function struct {
 // Or new DesiredComposed resources are created,
 //
 // TODO(nobu): refactor this
-func (f *Function) RunFunction(_ context.Context, req *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
+func (f *Function) RunFunction(ctx context.Context, req *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
+	start := time.Now()
+	ctx, sp := f.tracer.start(ctx, "RunFunction", "tag", req.GetMeta().GetTag())
+	rsp, err := f.runFunction(ctx, req)
+	// Values of the redacted keys are masked in every result, including
+	// the results raised by templates and the compiled output of debugging
+	f.redactor.results(rsp.GetResults())
+	if err != nil {
+		sp.end(err)
+	} else {
+		sp.end(fatalResult(rsp))
+	}
+	f.metrics.observeRun(time.Since(start), rsp)
+	return rsp, err
+}
+
+// runFunction runs the Function, RunFunction records its metrics
+func (f *Function) runFunction(ctx context.Context, req *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
 	log := f.log.WithValues("tag", req.GetMeta().GetTag())
 	log.Info("Running Function")
 
+	if f.mode == runModeOperation {
+		return f.runOperation(ctx, req)
+	}
+
 	rsp := response.To(req, response.DefaultTTL)
 
-	in := &v1beta1.CUEInput{}
-	if err := request.GetInput(req, in); err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot get function input from %T", req))
-		return rsp, nil
-	}
-	if err := in.Validate(); err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "invalid function input"))
+	// Resolving the input parses ConfigMaps and packfiles of git repositories
+	var in *v1beta1.CUEInput
+	err := recoverPhase(log, requestIDs{tag: req.GetMeta().GetTag()}, "input", func() error {
+		var warnings []*fnv1beta1.Result
+		var err error
+		in, warnings, err = f.getInput(ctx, req)
+		rsp.Results = append(rsp.Results, warnings...)
+		return err
+	})
+	if err != nil {
+		response.Fatal(rsp, err)
 		return rsp, nil
 	}
+	// The input sets how long Crossplane caches the response, so that the
+	// #meta.ttl of the templates is the ttl of the response
+	rsp.Meta.Ttl = durationpb.New(responseTTL(in))
 
 	// The composite resource that actually exists.
 	oxr, err := request.GetObservedCompositeResource(req)
@@ -66,12 +145,19 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1beta1.RunFunctionRequ
 		response.Fatal(rsp, errors.Wrap(err, "cannot get observed composite resource"))
 		return rsp, nil
 	}
+	debug := debugEnabled(oxr)
+	if debug {
+		log = verboseLogger{Logger: log}
+	}
 	log = log.WithValues(
 		"xr-version", oxr.Resource.GetAPIVersion(),
 		"xr-kind", oxr.Resource.GetKind(),
 		"xr-name", oxr.Resource.GetName(),
-		"target", in.Export.Target,
 	)
+	ids := requestIDs{
+		tag: req.GetMeta().GetTag(),
+		xr:  fmt.Sprintf("%s/%s", oxr.Resource.GetKind(), oxr.Resource.GetName()),
+	}
 
 	// The composite resource desired by previous functions in the pipeline.
 	dxr, err := request.GetDesiredCompositeResource(req)
@@ -97,264 +183,1170 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1beta1.RunFunctionRequ
 	}
 	log.Debug(fmt.Sprintf("ObservedComposed resources: %d", len(observed)))
 
-	var (
-		outputFmt = outputJSON
-	)
-	// If there is only 1 expression, check if the expression itself is a stream
-	// If so, it should also be TXT output
-	if len(in.Export.Options.Expressions) == 1 && strings.Contains(in.Export.Options.Expressions[0], "MarshalStream") {
-		outputFmt = outputTXT
-	} else if len(in.Export.Options.Expressions) > 1 {
-		// Multiple expressions are always a stream
-		outputFmt = outputJSON
-	}
-	// Build the cue (-t --inject) tags off of values from the Observed XR
-	tags, err := buildTags(in.Export.Options.Inject, oxr)
+	// The pipeline context, passed on to the next function in the pipeline
+	fnctx, err := getContext(req)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "failed building tags"))
+		response.Fatal(rsp, errors.Wrap(err, "cannot get pipeline context"))
 		return rsp, nil
 	}
 
-	// Run cueCompile to get the output
-	// Ignore the string output because it is already parsed with
-	// parseData: true
-	// The output used is produced as []map[string]interface{}
-	log.Info("compiling cue template from input")
-	cmpOut, err := cueCompile(outputFmt, *in, compileOpts{
-		parseData: true,
-		tags:      tags,
-	})
+	// The extra resources Crossplane fetched for the requirements of the
+	// template on the previous invocation
+	extra, err := getExtraResources(req)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "failed compiling cue template"))
+		response.Fatal(rsp, errors.Wrap(err, "cannot get extra resources"))
 		return rsp, nil
 	}
-	log.Debug(fmt.Sprintf("CUE compile output:\n%s", cmpOut.string))
-	log.Debug(fmt.Sprintf("Connection Data: %+v\n", cmpOut.connectionData))
 
-	// Add the compiled data to the desired resources
-	// Based on the input target
-	// Store the objects into the output object
-	// For success messages later
-	// TODO move this giant switch into some other function
-	log.Info("Setting output to target")
-	output := successOutput{
-		target: in.Export.Target,
+	// Each export is compiled and applied in order, later exports see the
+	// desired state and the context built by the earlier ones
+	state := &pipelineState{
+		oxr:      oxr,
+		dxr:      dxr,
+		observed: observed,
+		desired:  desired,
+		context:  fnctx,
+		extra:    extra,
+		meta:     f.metaScope(req, rsp, oxr),
+		req:      req,
+		debug:    debug,
 	}
-	conf := addResourcesConf{
-		overwrite: in.Export.Overwrite,
-	}
-	switch output.target {
-	case v1beta1.XR:
-		conf.data = cmpOut.data
-		if err := addResourcesTo(dxr, conf); err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot add resources to XR"))
+	for _, ein := range in.Inputs() {
+		elog := log.WithValues("target", ein.Export.Target)
+		// An export in diff mode reports the changes it makes to the desired
+		// state and leaves the state as it was
+		var sn snapshot
+		if ein.Export.Options.Diff {
+			sn = takeSnapshot(state)
+		}
+		ectx, sp := f.tracer.start(ctx, "runExport", "input", ein.Name, "target", string(ein.Export.Target))
+		ok := f.runExport(ectx, elog, ids, &ein, state, rsp)
+		sp.end(fatalResult(rsp))
+		if !ok {
 			return rsp, nil
 		}
-		output.object = dxr
-		output.msgCount = 1
-	case v1beta1.PatchDesired:
-		log.Debug("Matching PatchDesired Resources")
-		desiredMatches, err := matchResources(desired, cmpOut.data)
+		if ein.Export.Options.Diff {
+			// The diff is redacted before it is logged
+			diff := diffResults(sn, state, f.redactor)
+			for _, r := range diff {
+				elog.Info(r.GetMessage())
+			}
+			state.results = append(state.results, diff...)
+			sn.restore(state)
+		}
+	}
+
+	_, sp := f.tracer.start(ctx, "assembleResponse")
+	defer func() { sp.end(fatalResult(rsp)) }()
+
+	// Set dxr and desired state
+	log.Debug("Setting desired XR state")
+	if err := response.SetDesiredCompositeResource(rsp, dxr); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composite resource in %T", rsp))
+		return rsp, nil
+	}
+	rsp.Desired.Composite.Ready = state.ready
+
+	if err := setContext(rsp, fnctx); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set pipeline context in %T", rsp))
+		return rsp, nil
+	}
+
+	log.Debug(fmt.Sprintf("Setting %d DesiredComposed resource(s)", len(desired)))
+	if err := response.SetDesiredComposedResources(rsp, desired); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composed resources in %T", rsp))
+		return rsp, nil
+	}
+	// The desired composed resources of the response are only added to, the
+	// pruned resources are removed from them
+	for _, name := range state.pruned {
+		if _, ok := desired[name]; !ok {
+			delete(rsp.Desired.Resources, string(name))
+		}
+	}
+	warnings, err := sizeWarnings(desired, f.sizeWarning)
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	// Output success
+	for _, output := range state.outputs {
+		log.Debug(fmt.Sprintf("Set %d resource(s) to the %s target", output.msgCount, output.target))
+		output.setSuccessResults()
+		f.redactor.objectResults(output.results)
+		for _, r := range output.results {
+			log.Debug("Set resource", "action", r.action, "name", r.name, "kind", r.kind, "apiVersion", r.apiVersion)
+		}
+		rsp.Results = append(rsp.Results, output.successResults()...)
+		rsp.Results = append(rsp.Results, output.warningResults()...)
+	}
+	for _, msg := range warnings {
+		rsp.Results = append(rsp.Results, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+			Message:  msg,
+		})
+	}
+	rsp.Results = append(rsp.Results, state.results...)
+	// Attach the compiled output and the desired state changes for an XR
+	// that opted into debugging
+	if debug {
+		results, err := debugResults(req, state.compiled, dxr, desired, f.redactor)
 		if err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot match resources to desired"))
+			response.Fatal(rsp, errors.Wrap(err, "cannot build debug results"))
 			return rsp, nil
 		}
-		log.Debug(fmt.Sprintf("Matched %+v", desiredMatches))
+		rsp.Results = append(rsp.Results, results...)
+	}
 
-		if err := addResourcesTo(desiredMatches, conf); err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot update existing DesiredComposed"))
-			return rsp, nil
+	log.Info("Successfully processed function-cue resources",
+		"input", in.Name)
+
+	return rsp, nil
+}
+
+// exportSkipped returns the result reporting the export as skipped when its
+// when expression evaluates to false against the states, or nil when the
+// export runs
+func exportSkipped(in *v1beta1.CUEInput, states map[string]interface{}) (*fnv1beta1.Result, error) {
+	run, err := evaluateWhen(in.Export.When, states)
+	if err != nil || run {
+		return nil, err
+	}
+	return &fnv1beta1.Result{
+		Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+		Message:  fmt.Sprintf("skipped export to %s: when evaluated to false", in.Export.Target),
+	}, nil
+}
+
+// shapeDocuments reshapes the compiled documents before they are routed to
+// their targets, in compositions and operations alike. Documents wrapping a
+// resource with its target are unwrapped, the transform and the overrides are
+// applied, the connection details annotated on the documents are taken into
+// the output and plain manifests are wrapped into provider-kubernetes Objects.
+func shapeDocuments(log logging.Logger, ids requestIDs, in *v1beta1.CUEInput, out *compileOutput) error {
+	// Documents wrapping a resource with its target are unwrapped into the
+	// resource annotated with the target
+	out.data = unwrapTargets(out.data)
+
+	// Reshape the compiled documents with the transform expression
+	err := recoverPhase(log, ids, "transform", func() error {
+		var err error
+		out.data, err = postProcess(in.Export.Transform, out.data)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot transform compiled documents")
+	}
+
+	// Unify the input overrides with the compiled documents
+	err = recoverPhase(log, ids, "merge", func() error {
+		var err error
+		out.data, err = applyOverrides(in.Export.Overrides, out.data)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot apply overrides")
+	}
+
+	// Connection details annotated on the compiled documents match them
+	docDetails, err := takeConnectionDetails(out.data)
+	if err != nil {
+		return errors.Wrap(err, "cannot get connection details from documents")
+	}
+	out.connectionData = append(out.connectionData, docDetails...)
+
+	// Wrap plain Kubernetes manifests into provider-kubernetes Objects
+	out.data = wrapObjects(in.Export.Options.KubernetesObject, out.data)
+	return nil
+}
+
+// pipelineState is the state the exports of an input are applied to in order
+type pipelineState struct {
+	oxr      *resource.Composite
+	dxr      *resource.Composite
+	observed map[resource.Name]resource.ObservedComposed
+	desired  map[resource.Name]*resource.DesiredComposed
+	context  *structpb.Struct
+	extra    map[string]interface{}
+	// meta is the metadata of the request filled into #meta
+	meta map[string]interface{}
+
+	// outputs of the targets for the success messages
+	outputs []successOutput
+	// pruned desired composed resources
+	pruned []resource.Name
+	// results raised by the templates that are not fatal
+	results []*fnv1beta1.Result
+	// req is the request of the pipeline, filled into #request for the
+	// exports that inject it
+	req *fnv1beta1.RunFunctionRequest
+	// request is the json representation of req, decoded by the first
+	// export that injects it
+	request map[string]interface{}
+	// ready is the readiness of the composite resource computed by the
+	// compositeReady expression of an export, it is not set by default
+	ready fnv1beta1.Ready
+	// debug is set for an XR that opted into debugging, the compiled output
+	// is only rendered for it
+	debug bool
+	// compiled output of the templates for debugging
+	compiled string
+}
+
+// runExport compiles the export of the input and applies the output to the
+// state, false is returned when the response is fatal
+func (f *Function) runExport(ctx context.Context, log logging.Logger, ids requestIDs, in *v1beta1.CUEInput, s *pipelineState, rsp *fnv1beta1.RunFunctionResponse) bool {
+	// An export whose when expression is false is skipped without changing
+	// the desired state
+	skipped, err := exportSkipped(in, map[string]interface{}{
+		observedDef: observedScope(s.oxr, s.observed),
+		contextDef:  s.context.AsMap(),
+		metaDef:     s.meta,
+	})
+	if err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+	if skipped != nil {
+		log.Debug("Skipping export, when evaluated to false")
+		s.results = append(s.results, targetResults([]*fnv1beta1.Result{skipped}, in.Export.Options.ResultsTarget)...)
+		return true
+	}
+
+	// The readiness of the composite resource is computed from the observed
+	// state, a later export computing it takes precedence
+	if expr := in.Export.Options.CompositeReady; expr != "" {
+		ready, err := evaluateBool("compositeReady", expr, map[string]interface{}{
+			observedDef: observedScope(s.oxr, s.observed),
+			contextDef:  s.context.AsMap(),
+			metaDef:     s.meta,
+		})
+		if err != nil {
+			response.Fatal(rsp, err)
+			return false
 		}
-		output.object = cmpOut.data
-		output.msgCount = len(cmpOut.data)
-	case v1beta1.PatchResources:
-		// Render the List of DesiredComposed resources from the input
-		// Update the existing desired map to be created as a base
-		for _, r := range in.Export.Resources {
-			tmp := &resource.DesiredComposed{Resource: composed.New()}
+		s.ready = fnv1beta1.Ready_READY_FALSE
+		if ready {
+			s.ready = fnv1beta1.Ready_READY_TRUE
+		}
+		log.Debug("Computed composite readiness", "ready", ready)
+	}
 
-			if err := renderFromJSON(tmp.Resource, r.Base.Raw); err != nil {
-				response.Fatal(rsp, errors.Wrapf(err, "cannot parse base template of composed resource %q", r.Name))
-				return rsp, nil
+	// A Validate export only vets the observed XR against its schema
+	if in.Export.Target == v1beta1.Validate {
+		results, err := validationResults(in, s.oxr)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot validate XR"))
+			return false
+		}
+		results = targetResults(results, in.Export.Options.ResultsTarget)
+		for _, r := range results {
+			if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+				rsp.Results = append(rsp.Results, results...)
+				return false
 			}
+		}
+		s.results = append(s.results, results...)
+		return true
+	}
 
-			desired[resource.Name(tmp.Resource.GetName())] = tmp
+	// Build the cue (-t --inject) tags off of values from the Observed XR, the
+	// pipeline context and the observed composed resources
+	tags, values, err := buildTags(in.Export.Options.Inject, tagSources{
+		xr:       s.oxr,
+		context:  s.context.AsMap(),
+		observed: s.observed,
+	})
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "failed building tags"))
+		return false
+	}
+
+	// Run cueCompile to get the output
+	// Ignore the string output because it is already parsed with
+	// parseData: true
+	// The output used is produced as []map[string]interface{}
+	log.Info("compiling cue template from input")
+	var cmpOut compileOutput
+	opts := compileOpts{
+		parseData:      true,
+		tags:           tags,
+		values:         values,
+		now:            f.injectedNow(in),
+		observed:       observedScope(s.oxr, s.observed),
+		desired:        desiredScope(s.dxr, s.desired),
+		context:        s.context.AsMap(),
+		extraResources: s.extra,
+		meta:           s.meta,
+	}
+	if in.Export.Options.InjectRequest {
+		if s.request == nil {
+			if s.request, err = requestScope(s.req); err != nil {
+				response.Fatal(rsp, errors.Wrap(err, "cannot inject request"))
+				return false
+			}
 		}
+		opts.request = s.request
+	}
+	err = f.evaluate(ctx, in, func(ctx context.Context) error {
+		return recoverPhase(log, ids, "compile", func() error {
+			var err error
+			cmpOut, err = f.compile(ctx, outputJSON, *in, opts)
+			return err
+		})
+	})
+	if err != nil {
+		compileFailed(log, rsp, err)
+		f.artifacts.dump(log, rsp, ids, artifact{Phase: "compile", Input: *in, Tags: tags, Values: values})
+		return false
+	}
+	log.Debug("Compiled CUE output", "documents", len(cmpOut.data), "connection-details", len(cmpOut.connectionData))
+	if f.logCompileOutput {
+		log.Debug("CUE compile output", "output", f.redactor.render(cmpOut))
+	}
+	if s.debug {
+		s.compiled += f.redactor.render(cmpOut)
+	}
 
-		// Match the data to the desired resources
-		desiredMatches, err := matchResources(desired, cmpOut.data)
+	// Results raised by the template, a fatal result fails the pipeline
+	// without changing the desired state
+	tmplResults, fatal, err := templateResults(cmpOut.results)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot get results from template"))
+		return false
+	}
+	tmplResults = targetResults(tmplResults, in.Export.Options.ResultsTarget)
+	if fatal {
+		rsp.Results = append(rsp.Results, tmplResults...)
+		return false
+	}
+	s.results = append(s.results, tmplResults...)
+	s.results = append(s.results, targetResults(incompleteResults(cmpOut.incomplete), in.Export.Options.ResultsTarget)...)
+	if in.Export.Options.ResultsMode != v1beta1.ResultsNone {
+		s.results = append(s.results, targetResults(expressionResults(cmpOut.expressions), in.Export.Options.ResultsTarget)...)
+	}
+
+	// Ask Crossplane for the extra resources the template requires, a
+	// template waiting for them renders empty documents which are dropped
+	if err := setRequirements(rsp, cmpOut.requirements); err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot set extra resource requirements"))
+		return false
+	}
+	if len(cmpOut.requirements) != 0 {
+		cmpOut.data = dropEmpty(cmpOut.data)
+	}
+
+	if err := shapeDocuments(log, ids, in, &cmpOut); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	// Route the compiled data to the input target(s)
+	// Add the compiled data to the desired resources
+	// Based on each target
+	// Store the objects into the output objects
+	// For success messages later
+	log.Info("Setting output to target")
+	existing := make(map[resource.Name]bool, len(s.desired))
+	for name := range s.desired {
+		existing[name] = true
+	}
+	routed, err := routeData(in.Export.Routes, in.Export.Target, cmpOut.data)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot route documents"))
+		return false
+	}
+	for _, rd := range routed {
+		log.Debug(fmt.Sprintf("Routing %d document(s) to %s", len(rd.data), rd.target))
+		violations, err := f.schemas.check(in.Export.Options.ValidationPolicy, rd.target, rd.data)
 		if err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot match resources to input resources"))
-			return rsp, nil
+			response.Fatal(rsp, err)
+			return false
 		}
-
-		if err := addResourcesTo(desiredMatches, conf); err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot add resources to DesiredComposed"))
-			return rsp, nil
+		var output successOutput
+		err = recoverPhase(log, ids, "match", func() error {
+			var err error
+			output, err = applyTarget(rd.target, rd.data, targetState{
+				in:      in,
+				oxr:     s.oxr,
+				dxr:     s.dxr,
+				desired: s.desired,
+				context: s.context,
+				ctx:     ctx,
+				tracer:  f.tracer,
+			})
+			return err
+		})
+		f.metrics.observeTarget(rd.target, len(rd.data), err)
+		if err != nil {
+			response.Fatal(rsp, err)
+			f.artifacts.dump(log, rsp, ids, artifact{Phase: "match", Input: *in, Tags: tags, Values: values, Output: f.redactor.render(cmpOut)})
+			return false
 		}
-		output.object = cmpOut.data
-		output.msgCount = len(cmpOut.data)
-	case v1beta1.Resources:
-		conf.basename = in.Name
-		conf.data = cmpOut.data
-		if err := addResourcesTo(desired, conf); err != nil {
-			response.Fatal(rsp, errors.Wrapf(err, "cannot add resources to DesiredComposed"))
-			return rsp, nil
+		output.warnings = append(output.warnings, violations...)
+		s.outputs = append(s.outputs, output)
+	}
+
+	// Prune the resources created by the input in earlier reconciles that it
+	// no longer creates
+	if in.Export.Prune {
+		pruned := pruneResources(in.Name, s.observed, s.desired)
+		s.pruned = append(s.pruned, pruned...)
+		for _, name := range pruned {
+			log.Debug(fmt.Sprintf("Pruned desired composed resource %q", name))
+			s.results = append(s.results, targetResults([]*fnv1beta1.Result{{
+				Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+				Message:  fmt.Sprintf("pruned resource %q", name),
+			}}, in.Export.Options.ResultsTarget)...)
 		}
-		// Pass data here instead of desired
-		// This is because there already may be desired objects
-		output.object = cmpOut.data
-		output.msgCount = len(cmpOut.data)
 	}
 
 	// Get the connection details and propagate them to the xr
-	conn, err := extractConnectionDetails(observed, cmpOut.connectionData)
+	conn, err := extractConnectionDetails(s.observed, cmpOut.connectionData)
 	if err != nil {
 		response.Fatal(rsp, errors.Wrap(err, "cannot get connection details from ObservedComposed"))
-		return rsp, nil
+		return false
 	}
 	log.Debug(fmt.Sprintf("Setting %d connectionDetails", len(conn)))
 	for k, v := range conn {
-		dxr.ConnectionDetails[k] = v
+		s.dxr.ConnectionDetails[k] = v
 	}
 
 	// Reconcile the readiness data from observed -> desired
 	// depending on readiness propagation configuration from readinessData
 	// set dxr to ready if all the readiness checks pass
+	// The resources the export added to the desired composed resources are
+	// ready by their Ready condition with autoReady
+	auto := map[resource.Name]bool{}
+	if in.Export.Options.AutoReady {
+		for name := range s.desired {
+			auto[name] = !existing[name]
+		}
+	}
 	log.Debug("Reconciling readiness")
-	err = reconcileReadiness(observed, desired, cmpOut.readinessData)
+	err = reconcileReadiness(s.observed, s.desired, cmpOut.readinessData, auto)
 	if err != nil {
 		response.Fatal(rsp, errors.Wrap(err, "failed checking readiness: xr is not ready"))
-		return rsp, nil
+		return false
+	}
+	// Readiness set explicitly by the template takes precedence
+	if err := applyReadyAnnotations(s.desired); err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot set readiness of desired composed resources"))
+		return false
 	}
 
-	// Set dxr and desired state
-	log.Debug(fmt.Sprintf("Setting desired XR state to %+v", dxr.Resource))
-	if err := response.SetDesiredCompositeResource(rsp, dxr); err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composite resource in %T", rsp))
-		return rsp, nil
+	// Surface the conditions computed by the template on the XR
+	if err := setConditions(s.oxr, s.dxr, cmpOut.conditions, f.clock()); err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot set XR conditions"))
+		return false
 	}
 
-	for _, d := range desired {
-		log.Debug(fmt.Sprintf("Setting DesiredComposed state to %+v", d.Resource))
+	return true
+}
+
+// injectedNow returns the time to inject as #now, the zero time is returned
+// unless the input opts in with inject_now so renders stay reproducible
+func (f *Function) injectedNow(in *v1beta1.CUEInput) time.Time {
+	if !in.Export.Options.InjectNow {
+		return time.Time{}
 	}
-	if err := response.SetDesiredComposedResources(rsp, desired); err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composed resources in %T", rsp))
-		return rsp, nil
+	return f.clock()
+}
+
+// clock returns the current time, or the frozen time when it is frozen
+func (f *Function) clock() time.Time {
+	if f.now == nil {
+		return time.Now()
 	}
-	log.Debug(fmt.Sprintf("Set %d resource(s) to the desired state", output.msgCount))
+	return f.now()
+}
 
-	// Output success
-	output.setSuccessMsgs()
-	for _, msg := range output.msgs {
-		rsp.Results = append(rsp.Results, &fnv1beta1.Result{
-			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
-			Message:  msg,
-		})
+// dropEmpty returns the documents that have any fields
+func dropEmpty(data []map[string]interface{}) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(data))
+	for _, d := range data {
+		if len(d) != 0 {
+			out = append(out, d)
+		}
 	}
+	return out
+}
 
-	log.Info("Successfully processed function-cue resources",
-		"input", in.Name)
+// observedScope returns the value filled into #observed, the observed XR and
+// the observed composed resources keyed by their resource name
+func observedScope(oxr *resource.Composite, observed map[resource.Name]resource.ObservedComposed) map[string]interface{} {
+	resources := make(map[string]interface{}, len(observed))
+	for name, o := range observed {
+		resources[string(name)] = o.Resource.UnstructuredContent()
+	}
+	return map[string]interface{}{
+		"composite": compositeScope(oxr),
+		"resources": resources,
+	}
+}
 
-	return rsp, nil
+// defaultFunctionName is the name of the function in #meta unless it is set
+const defaultFunctionName = "function-cue"
+
+// metaScope returns the value filled into #meta, the tag of the request, the
+// TTL of the response, the name of the function, and the claim and composition
+// revision of the XR when the XR has them. Every field is set, empty when it is
+// unknown, so that templates can reference them without defaults.
+func (f *Function) metaScope(req *fnv1beta1.RunFunctionRequest, rsp *fnv1beta1.RunFunctionResponse, oxr *resource.Composite) map[string]interface{} {
+	name := f.name
+	if name == "" {
+		name = defaultFunctionName
+	}
+	claim := map[string]interface{}{"namespace": "", "name": ""}
+	revision := ""
+	if oxr != nil {
+		if ref := oxr.Resource.GetClaimReference(); ref != nil {
+			claim["namespace"], claim["name"] = ref.Namespace, ref.Name
+		}
+		if ref := oxr.Resource.GetCompositionRevisionReference(); ref != nil {
+			revision = ref.Name
+		}
+	}
+	return map[string]interface{}{
+		"tag":                 req.GetMeta().GetTag(),
+		"ttl":                 rsp.GetMeta().GetTtl().AsDuration().String(),
+		"function":            name,
+		"compositionRevision": revision,
+		"claim":               claim,
+	}
 }
 
-// renderFromJSON renders the supplied resource from JSON bytes.
-func renderFromJSON(o rresource.Object, data []byte) error {
-	if err := json.Unmarshal(data, o); err != nil {
-		return errors.Wrap(err, "cannot unmarshal JSON data")
+// desiredScope returns the value filled into #desired, the XR and the composed
+// resources desired by the previous functions in the pipeline, keyed by their
+// resource name
+func desiredScope(dxr *resource.Composite, desired map[resource.Name]*resource.DesiredComposed) map[string]interface{} {
+	resources := make(map[string]interface{}, len(desired))
+	for name, d := range desired {
+		resources[string(name)] = d.Resource.UnstructuredContent()
+	}
+	return map[string]interface{}{
+		"composite": dxr.Resource.UnstructuredContent(),
+		"resources": resources,
 	}
-	return nil
+}
+
+// getInput gets the function input from the request, validates it and resolves
+// any referenced template into the export value. A value served stale because
+// its source cannot be refreshed is returned as a warning result.
+func (f *Function) getInput(ctx context.Context, req *fnv1beta1.RunFunctionRequest) (*v1beta1.CUEInput, []*fnv1beta1.Result, error) {
+	in := &v1beta1.CUEInput{}
+	raw, err := f.defaults.apply(req.GetInput())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot merge default input")
+	}
+	if err := request.GetInput(&fnv1beta1.RunFunctionRequest{Input: raw}, in); err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot get function input from %T", req)
+	}
+	if err := in.Validate(); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid function input")
+	}
+	var warnings []*fnv1beta1.Result
+	warn := func(stale *staleValue) {
+		if stale != nil {
+			warnings = append(warnings, &fnv1beta1.Result{
+				Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+				Message:  stale.warning(),
+			})
+		}
+	}
+	stale, err := f.resolveExport(ctx, &in.Export)
+	if err != nil {
+		return nil, nil, err
+	}
+	warn(stale)
+	for i := range in.Exports {
+		stale, err := f.resolveExport(ctx, &in.Exports[i])
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot resolve export at index %d", i)
+		}
+		warn(stale)
+	}
+	return in, warnings, nil
+}
+
+// resolveExport resolves any referenced template, ConfigMap or git file into
+// the export value and fetches the dependencies of its module. The stale value
+// of a template, ConfigMap or git file that cannot be refreshed is returned
+// when served.
+func (f *Function) resolveExport(ctx context.Context, e *v1beta1.Export) (*staleValue, error) {
+	var stale *staleValue
+	// Resolve the referenced ConfigMap or git file into the export value
+	if from := e.ValueFrom; from != nil {
+		var value string
+		var err error
+		value, stale, err = f.resolveValueFrom(ctx, *from)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot resolve valueFrom")
+		}
+		if err := verifyDigest([]byte(value), from.Digest); err != nil {
+			return nil, errors.Wrap(err, "cannot verify valueFrom")
+		}
+		e.Value = v1beta1.Value(value)
+	}
+	// Resolve the referenced template into the export value
+	if ref := e.TemplateRef; ref != nil {
+		var value string
+		var err error
+		value, stale, err = f.templates.Resolve(*ref)
+		f.metrics.observeStale("template", stale, err)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot resolve template %q", ref.Name)
+		}
+		if err := verifyDigest([]byte(value), ref.Digest); err != nil {
+			return nil, errors.Wrapf(err, "cannot verify template %q", ref.Name)
+		}
+		e.Value = v1beta1.Value(value)
+	}
+	// Fetch the dependencies of the module from its registries, fetched
+	// modules are immutable and always served from the cache
+	if m := e.Module; m != nil && len(e.Options.Registries) != 0 {
+		modules := f.modules
+		if modules == nil {
+			modules = newModuleFetcher("")
+		}
+		if err := modules.fetchDeps(m, e.Options.Registries); err != nil {
+			return nil, errors.Wrap(err, "cannot fetch module dependencies")
+		}
+	}
+	return stale, nil
+}
+
+// resolveValueFrom returns the cue value of the source the reference sets, and
+// whether it is served stale
+func (f *Function) resolveValueFrom(ctx context.Context, from v1beta1.ValueFrom) (string, *staleValue, error) {
+	switch {
+	case from.ConfigMapRef != nil:
+		if f.configMaps == nil {
+			return "", nil, errors.New("ConfigMaps are not enabled")
+		}
+		value, stale, err := f.configMaps.Resolve(ctx, *from.ConfigMapRef)
+		f.metrics.observeStale("configmap", stale, err)
+		return value, stale, err
+	case from.Git != nil:
+		if f.git == nil {
+			return "", nil, errors.New("git repositories are not enabled")
+		}
+		value, stale, err := f.git.Resolve(ctx, *from.Git)
+		f.metrics.observeStale("git", stale, err)
+		return value, stale, err
+	}
+	return "", nil, errors.New("valueFrom has no source")
+}
+
+// targetState holds the state that compiled data is added to by a target
+type targetState struct {
+	in *v1beta1.CUEInput
+	// oxr is the observed XR the immutable fields of the XR target are
+	// checked against
+	oxr     *resource.Composite
+	dxr     *resource.Composite
+	desired map[resource.Name]*resource.DesiredComposed
+	context *structpb.Struct
+	// ctx carries the span the spans of matching and adding resources are
+	// children of
+	ctx    context.Context
+	tracer *tracer
+}
+
+// matchResources matches the data to the desired resources in a span
+func (s targetState) matchResources(data []map[string]interface{}) (desiredMatch, []int) {
+	_, sp := s.tracer.start(s.ctx, "matchResources")
+	defer sp.end(nil)
+	return matchResources(s.desired, data, s.in.Export.Options.MatchBy)
+}
+
+// addResources adds the data of the conf to the object in a span
+func (s targetState) addResources(o any, conf addResourcesConf) error {
+	_, sp := s.tracer.start(s.ctx, "addResourcesTo")
+	err := addResourcesTo(o, conf)
+	sp.end(err)
+	return err
+}
+
+// applyTarget adds the compiled data to the objects selected by the target
+// The returned successOutput holds the objects for the success messages
+func applyTarget(target v1beta1.Target, data []map[string]interface{}, s targetState) (successOutput, error) {
+	output := successOutput{
+		target:        target,
+		mode:          s.in.Export.Options.ResultsMode,
+		resultsTarget: s.in.Export.Options.ResultsTarget,
+	}
+	conf := addResourcesConf{
+		overwrite:    s.in.Export.Overwrite,
+		strategy:     s.in.Export.Options.MergeStrategy,
+		lists:        newListMerge(s.in.Export.Options.ListMerge),
+		owner:        owner(s.in),
+		propagated:   propagatedMetadata(s.in.Export.Options.PropagateMetadata, s.oxr),
+		externalName: newExternalNamer(s.in.Export.Options.ExternalName, s.oxr),
+		defaults:     newResourceDefaults(s.in.Export.Options.Defaults),
+		namespace:    newXRNamespace(s.oxr),
+	}
+	switch target {
+	case v1beta1.XR:
+		if err := protectXR(s.oxr, data, s.in.Export.ImmutableFields); err != nil {
+			return output, errors.Wrap(err, "cannot add resources to XR")
+		}
+		conf.data = data
+		if err := s.addResources(s.dxr, conf); err != nil {
+			return output, errors.Wrapf(err, "cannot add resources to XR")
+		}
+		output.object = s.dxr
+		output.msgCount = 1
+	case v1beta1.XRStatus:
+		conf.data = data
+		if err := s.addResources(&compositeStatus{s.dxr}, conf); err != nil {
+			return output, errors.Wrapf(err, "cannot add resources to XR status")
+		}
+		output.object = s.dxr
+		output.msgCount = 1
+	case v1beta1.PatchDesired:
+		desiredMatches, unmatched := s.matchResources(data)
+		matched, err := applyUnmatched(data, unmatched, s, &output)
+		if err != nil {
+			return output, errors.Wrapf(err, "cannot match resources to desired")
+		}
+
+		if err := s.addResources(desiredMatches, conf); err != nil {
+			return output, errors.Wrapf(err, "cannot update existing DesiredComposed")
+		}
+		output.object = matched
+		output.msgCount = len(matched)
+	case v1beta1.PatchResources:
+		// Render the List of DesiredComposed resources from the input
+		// Update the existing desired map to be created as a base
+		key := s.in.Export.Options.ResourceKey
+		// added are the resources of the bases added as each name, a name
+		// can only be added once with the name resource key, otherwise a
+		// later base replaces an earlier one of the same metadata.name
+		added := map[resource.Name]string{}
+		var names []resource.Name
+		for _, r := range s.in.Export.Resources {
+			if r.Base == nil {
+				return output, errors.Errorf("resource %q has no base", r.Name)
+			}
+			bases, err := renderBases(r.Base.Raw)
+			if err != nil {
+				return output, errors.Wrapf(err, "cannot parse base template of composed resource %q", r.Name)
+			}
+
+			for i, base := range bases {
+				conf.propagated.apply(&base.Unstructured)
+				conf.namespace.apply(&base.Unstructured)
+				conf.defaults.apply(&base.Unstructured)
+				if err := conf.externalName.apply(&base.Unstructured); err != nil {
+					return output, errors.Wrapf(err, "cannot name base template of composed resource %q", r.Name)
+				}
+				tmp := &resource.DesiredComposed{Resource: base}
+				if conf.owner != "" {
+					setOwner(tmp, conf.owner)
+				}
+				name := baseName(key, r.Name, i, len(bases), base)
+				if other, ok := added[name]; ok && key == v1beta1.ResourceKeyName {
+					return output, errors.Errorf("base templates of composed resources %q and %q are both named %q", other, r.Name, name)
+				}
+				added[name] = r.Name
+				names = append(names, name)
+				s.desired[name] = tmp
+			}
+		}
+
+		// Match the data to the desired resources
+		desiredMatches, unmatched := s.matchResources(data)
+		matched, err := applyUnmatched(data, unmatched, s, &output)
+		if err != nil {
+			return output, errors.Wrapf(err, "cannot match resources to input resources")
+		}
+
+		if err := s.addResources(desiredMatches, conf); err != nil {
+			return output, errors.Wrapf(err, "cannot add resources to DesiredComposed")
+		}
+		output.object = matched
+		output.msgCount = len(matched)
+		// The results of bases named after their resource name them rather
+		// than the documents patching them
+		if key == v1beta1.ResourceKeyName {
+			output.bases = patchedBases(names, s.desired, desiredMatches)
+			output.msgCount = len(output.bases)
+		}
+	case v1beta1.Resources:
+		conf.basename = s.in.Name
+		conf.data = data
+		if err := s.addResources(s.desired, conf); err != nil {
+			return output, errors.Wrapf(err, "cannot add resources to DesiredComposed")
+		}
+		// Pass data here instead of desired
+		// This is because there already may be desired objects
+		output.object = data
+		output.msgCount = len(data)
+	case v1beta1.Context:
+		if s.in.Export.ContextKey == "" {
+			return output, errors.New("the Context target requires a contextKey")
+		}
+		v, err := contextValue(data)
+		if err != nil {
+			return output, errors.Wrapf(err, "cannot convert documents to context key %q", s.in.Export.ContextKey)
+		}
+		s.context.Fields[s.in.Export.ContextKey] = v
+		output.object = s.in.Export.ContextKey
+		output.msgCount = 1
+	default:
+		return output, fmt.Errorf("unknown target %q", target)
+	}
+	return output, nil
+}
+
+// routedData is the compiled data routed to a target
+type routedData struct {
+	target v1beta1.Target
+	data   []map[string]interface{}
+}
+
+// routeData splits the compiled data between targets
+// A document annotated with its own target is sent to it, other documents are
+// sent to the target of the first route they match, and documents that match
+// no route are sent to the default target
+// Without routes or annotated targets all of the data is sent to the default
+// target
+func routeData(routes []v1beta1.Route, target v1beta1.Target, data []map[string]interface{}) ([]routedData, error) {
+	routed := make([]routedData, len(routes)+1)
+	for i, r := range routes {
+		routed[i].target = r.Target
+	}
+	routed[len(routes)].target = target
+	// Documents annotated with the same target are applied together
+	annotated := map[v1beta1.Target]int{}
+
+	for _, d := range data {
+		t, err := takeTarget(d)
+		if err != nil {
+			return nil, err
+		}
+		u := unstructured.Unstructured{Object: d}
+		i := len(routes)
+		switch j, ok := annotated[t]; {
+		case t == "":
+			for j, r := range routes {
+				if r.Match.Matches(u.GetAPIVersion(), u.GetKind(), u.GetName()) {
+					i = j
+					break
+				}
+			}
+		case ok:
+			i = j
+		default:
+			i = len(routed)
+			annotated[t] = i
+			routed = append(routed, routedData{target: t})
+		}
+		routed[i].data = append(routed[i].data, d)
+	}
+
+	// Only keep the routes that had data routed to them, the default target is
+	// always applied so that an export without documents still applies the
+	// bases of its resources or clears its target
+	out := []routedData{}
+	for i, rd := range routed {
+		if len(rd.data) != 0 || i == len(routes) {
+			out = append(out, rd)
+		}
+	}
+	return out, nil
 }
 
 // desiredMatch matches a list of data to apply to a desired resource
 // This is used when targeting PatchDesired resources
 type desiredMatch map[*resource.DesiredComposed][]map[string]interface{}
 
+// resourceNameField is the field of a document naming the desired resource it
+// patches by its key in the desired resources, such as desired["my-bucket"]
+const resourceNameField = "resourceName"
+
+// takeResourceNameField returns the desired resource named by the resourceName
+// field of the document and removes the field
+func takeResourceNameField(d map[string]interface{}) string {
+	n, ok := d[resourceNameField].(string)
+	if !ok || n == "" {
+		return ""
+	}
+	delete(d, resourceNameField)
+	return n
+}
+
 // matchResources finds and associates the data to the desired resource
-// The length of the passed data should match the total count of desired match data
-func matchResources(desired map[resource.Name]*resource.DesiredComposed, data []map[string]interface{}) (desiredMatch, error) {
-	// Looks through the current desired match and matches an object based on the name+kind
-	findDesired := func(desired map[resource.Name]*resource.DesiredComposed, apiVersion, name, kind string) *resource.DesiredComposed {
-		for _, d := range desired {
-			if d.Resource.GetName() == name && d.Resource.GetKind() == kind && d.Resource.GetAPIVersion() == apiVersion {
-				return d
-			}
-		}
-		return nil
+// The data is matched on the matchBy keys, or on the apiVersion, kind and name
+// by default, and a document patches every desired resource it matches
+// A document with a resourceName field only patches the desired resource of
+// that name, whatever the matchBy keys
+// The indexes of the documents that match no desired resource are returned
+func matchResources(desired map[resource.Name]*resource.DesiredComposed, data []map[string]interface{}, matchBy []v1beta1.MatchKey) (desiredMatch, []int) {
+	if len(matchBy) == 0 {
+		matchBy = v1beta1.DefaultMatchBy
 	}
 
 	// Iterate over the data patches and match them to desired resources
 	matches := make(desiredMatch)
-	count := 0
-	// Get total count of all the match patches to apply
-	// this count should match the initial count of the supplied data
-	// otherwise we lost something somewhere
-	for _, d := range data {
+	var unmatched []int
+	for i, d := range data {
 		u := unstructured.Unstructured{Object: d}
-		// PatchDesired
-		if found := findDesired(desired, u.GetAPIVersion(), u.GetName(), u.GetKind()); found != nil {
-			if _, ok := matches[found]; !ok {
-				matches[found] = []map[string]interface{}{d}
-			} else {
-				matches[found] = append(matches[found], d)
+		// The resource name field and annotation only select the resource,
+		// they are not patched onto it
+		resourceName := takeResourceNameField(d)
+		explicit := resourceName != ""
+		for _, k := range matchBy {
+			if k == v1beta1.MatchResourceName {
+				if n := takeCompositionResourceName(&u); !explicit {
+					resourceName = n
+				}
 			}
-			count++
 		}
+
+		found := false
+		if explicit {
+			if dcd, ok := desired[resource.Name(resourceName)]; ok {
+				matches[dcd] = append(matches[dcd], d)
+				found = true
+			}
+		} else {
+			for name, dcd := range desired {
+				if !matchesDesired(u, resourceName, name, dcd, matchBy) {
+					continue
+				}
+				matches[dcd] = append(matches[dcd], d)
+				found = true
+			}
+		}
+		if !found {
+			// The resource name annotation names the resource an unmatched
+			// document is created as
+			if resourceName != "" {
+				annotations := u.GetAnnotations()
+				if annotations == nil {
+					annotations = map[string]string{}
+				}
+				annotations[compositionResourceNameAnnotation] = resourceName
+				u.SetAnnotations(annotations)
+			}
+			unmatched = append(unmatched, i)
+		}
+	}
+
+	return matches, unmatched
+}
+
+// applyUnmatched applies the unmatched policy of the input to the documents
+// that matched no desired resource, and returns the documents that did
+// By default unmatched documents are an error, they are skipped with a warning
+// with the skip policy and added as new resources with the create policy
+func applyUnmatched(data []map[string]interface{}, unmatched []int, s targetState, output *successOutput) ([]map[string]interface{}, error) {
+	if len(unmatched) == 0 {
+		return data, nil
 	}
-	if count != len(data) {
-		return matches, fmt.Errorf("failed to match all resources, found %d / %d patches", count, len(data))
+	policy := s.in.Export.Options.UnmatchedPolicy
+	if policy == "" || policy == v1beta1.UnmatchedError {
+		return nil, fmt.Errorf("failed to match all resources, found %d / %d patches", len(data)-len(unmatched), len(data))
 	}
 
-	return matches, nil
+	var matched, rest []map[string]interface{}
+	for i, d := range data {
+		if len(unmatched) != 0 && unmatched[0] == i {
+			unmatched = unmatched[1:]
+			rest = append(rest, d)
+			continue
+		}
+		matched = append(matched, d)
+	}
+
+	switch policy {
+	case v1beta1.UnmatchedSkip:
+		for _, d := range rest {
+			u := unstructured.Unstructured{Object: d}
+			output.warnings = append(output.warnings, fmt.Sprintf("skipped unmatched resource \"%s:%s\"", u.GetName(), u.GetKind()))
+		}
+	case v1beta1.UnmatchedCreate:
+		conf := addResourcesConf{
+			basename:     s.in.Name,
+			data:         rest,
+			overwrite:    s.in.Export.Overwrite,
+			owner:        owner(s.in),
+			propagated:   propagatedMetadata(s.in.Export.Options.PropagateMetadata, s.oxr),
+			externalName: newExternalNamer(s.in.Export.Options.ExternalName, s.oxr),
+			defaults:     newResourceDefaults(s.in.Export.Options.Defaults),
+			namespace:    newXRNamespace(s.oxr),
+		}
+		if err := s.addResources(s.desired, conf); err != nil {
+			return nil, errors.Wrap(err, "cannot add unmatched resources to DesiredComposed")
+		}
+		output.created = rest
+	}
+	return matched, nil
+}
+
+// matchesDesired returns whether the document matches the desired resource on
+// all of the matchBy keys
+func matchesDesired(u unstructured.Unstructured, resourceName string, name resource.Name, dcd *resource.DesiredComposed, matchBy []v1beta1.MatchKey) bool {
+	// subset returns whether every entry of sub is in m
+	subset := func(sub, m map[string]string) bool {
+		for k, v := range sub {
+			if mv, ok := m[k]; !ok || mv != v {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, k := range matchBy {
+		var ok bool
+		switch k {
+		case v1beta1.MatchAPIVersion:
+			ok = u.GetAPIVersion() == dcd.Resource.GetAPIVersion()
+		case v1beta1.MatchKind:
+			ok = u.GetKind() == dcd.Resource.GetKind()
+		case v1beta1.MatchName:
+			ok = u.GetName() == dcd.Resource.GetName()
+		case v1beta1.MatchLabels:
+			ok = subset(u.GetLabels(), dcd.Resource.GetLabels())
+		case v1beta1.MatchAnnotations:
+			ok = subset(u.GetAnnotations(), dcd.Resource.GetAnnotations())
+		case v1beta1.MatchResourceName:
+			ok = resourceName != "" && resource.Name(resourceName) == name
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
 }
 
 type successOutput struct {
 	target   v1beta1.Target
 	object   any
 	msgCount int
-	msgs     []string
+	results  []objectResult
+	// bases are the results of the bases of the PatchResources target named
+	// after their resource
+	bases []objectResult
+	// mode determines the normal results returned for the objects
+	mode v1beta1.ResultsMode
+	// resultsTarget determines the objects the results are surfaced on
+	resultsTarget v1beta1.ResultsTarget
+	// created are the unmatched documents created as new resources
+	created []map[string]interface{}
+	// warnings are returned as warning results, such as skipped documents
+	warnings []string
 }
 
-// setSuccessMsgs generates the success messages for the input data
-func (output *successOutput) setSuccessMsgs() {
-	output.msgs = make([]string, output.msgCount)
-	switch output.target {
-	case v1beta1.Resources:
-		desired := output.object.([]map[string]interface{})
-		j := 0
-		for _, d := range desired {
+// setSuccessResults generates the success results for the input data
+func (output *successOutput) setSuccessResults() {
+	output.results = make([]objectResult, 0, output.msgCount)
+	// documents adds the results of the documents
+	documents := func(action resultAction, data []map[string]interface{}) {
+		for _, d := range data {
 			u := unstructured.Unstructured{Object: d}
-			output.msgs[j] = fmt.Sprintf("created resource \"%s:%s\"", u.GetName(), u.GetKind())
-			j++
-		}
-	case v1beta1.PatchDesired:
-		desired := output.object.([]map[string]interface{})
-		j := 0
-		for _, d := range desired {
-			u := unstructured.Unstructured{Object: d}
-			output.msgs[j] = fmt.Sprintf("updated resource \"%s:%s\"", u.GetName(), u.GetKind())
-			j++
+			output.results = append(output.results, objectResult{
+				action:     action,
+				object:     "resource",
+				name:       u.GetName(),
+				kind:       u.GetKind(),
+				apiVersion: u.GetAPIVersion(),
+			})
 		}
+	}
+	// composite adds the result of the XR
+	composite := func(object string, o *resource.Composite) {
+		output.results = append(output.results, objectResult{
+			action:     actionUpdated,
+			object:     object,
+			name:       o.Resource.GetName(),
+			kind:       o.Resource.GetKind(),
+			apiVersion: o.Resource.GetAPIVersion(),
+		})
+	}
+	switch output.target {
 	case v1beta1.PatchResources:
-		desired := output.object.([]map[string]interface{})
-		j := 0
-		for _, d := range desired {
-			u := unstructured.Unstructured{Object: d}
-			output.msgs[j] = fmt.Sprintf("created resource \"%s:%s\"", u.GetName(), u.GetKind())
-			j++
+		if output.bases != nil {
+			output.results = append(output.results, output.bases...)
+			break
 		}
+		documents(actionCreated, output.object.([]map[string]interface{}))
+	case v1beta1.Resources:
+		documents(actionCreated, output.object.([]map[string]interface{}))
+	case v1beta1.PatchDesired:
+		documents(actionUpdated, output.object.([]map[string]interface{}))
 	case v1beta1.XR:
-		o := output.object.(*resource.Composite)
-		output.msgs[0] = fmt.Sprintf("updated xr \"%s:%s\"", o.Resource.GetName(), o.Resource.GetKind())
+		composite("xr", output.object.(*resource.Composite))
+	case v1beta1.XRStatus:
+		composite("xr status", output.object.(*resource.Composite))
+	case v1beta1.Context:
+		output.results = append(output.results, objectResult{
+			action: actionUpdated,
+			object: "context key",
+			name:   output.object.(string),
+		})
+	}
+	documents(actionCreated, output.created)
+	sort.SliceStable(output.results, func(i, j int) bool {
+		return output.results[i].message() < output.results[j].message()
+	})
+}
+
+// successResults returns the normal results of the objects for the results
+// mode of the export
+func (output *successOutput) successResults() []*fnv1beta1.Result {
+	switch output.mode {
+	case v1beta1.ResultsNone:
+		return nil
+	case v1beta1.ResultsSummary:
+		return targetResults(summaryResults(output.results), output.resultsTarget)
 	}
-	sort.Strings(output.msgs)
+	out := make([]*fnv1beta1.Result, 0, len(output.results))
+	for _, r := range output.results {
+		out = append(out, r.toResult())
+	}
+	return targetResults(out, output.resultsTarget)
+}
+
+// warningResults returns the warning results of the output, such as the
+// skipped documents
+func (output *successOutput) warningResults() []*fnv1beta1.Result {
+	out := make([]*fnv1beta1.Result, 0, len(output.warnings))
+	for _, msg := range output.warnings {
+		out = append(out, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+			Message:  msg,
+		})
+	}
+	return targetResults(out, output.resultsTarget)
 }
 
 type addResourcesConf struct {
 	basename  string
 	data      []map[string]interface{}
 	overwrite bool
+	// owner annotates the resources added to the desired composed resources
+	// as created by the input, so they can be pruned
+	owner string
+	// strategy merges the data into matched desired resources
+	strategy v1beta1.MergeStrategy
+	// lists merges the lists of the data into the lists of matched desired
+	// resources and the XR
+	lists listMerge
+	// propagated is the metadata of the XR merged onto the resources added
+	// to the desired composed resources
+	propagated propagated
+	// externalName names the resources added to the desired composed
+	// resources
+	externalName *externalNamer
+	// defaults are defaulted into the managed resources added to the desired
+	// composed resources
+	defaults resourceDefaults
+	// namespace is the namespace of a namespaced XR set on the namespaced
+	// resources added to the desired composed resources
+	namespace xrNamespace
 }
 
 // addResourcesTo adds the given data to any allowed object passed
@@ -392,16 +1384,30 @@ func addResourcesTo(o any, conf addResourcesConf) error {
 			if len(conf.data) > 1 {
 				name = resource.Name(fmt.Sprintf("%s-%s", conf.basename, u.GetName()))
 			}
+			// The composition resource name annotation names the resource
+			// explicitly, like it does in function-go-templating
+			if n := takeCompositionResourceName(&u); n != "" {
+				name = resource.Name(n)
+			}
 			// If the value exists, merge its existing value with the patches
 			if v, ok := desired[name]; ok {
 				mergedData := merged(d, v)
 				u = unstructured.Unstructured{Object: mergedData}
 			}
+			conf.propagated.apply(&u)
+			conf.namespace.apply(&u)
+			conf.defaults.apply(&u)
+			if err := conf.externalName.apply(&u); err != nil {
+				return err
+			}
 			desired[name] = &resource.DesiredComposed{
 				Resource: &composed.Unstructured{
 					Unstructured: u,
 				},
 			}
+			if conf.owner != "" {
+				setOwner(desired[name], conf.owner)
+			}
 		}
 	case desiredMatch:
 		// PatchDesired
@@ -410,7 +1416,7 @@ func addResourcesTo(o any, conf addResourcesConf) error {
 		for obj, matchData := range matches {
 			// There may be multiple data patches to the DesiredComposed object
 			for _, d := range matchData {
-				if err := setData(d, "", obj, conf.overwrite); err != nil {
+				if err := mergeResource(d, obj, conf.strategy, conf.overwrite, conf.lists); err != nil {
 					return errors.Wrap(err, "cannot set data existing desired composed object")
 				}
 			}
@@ -418,107 +1424,136 @@ func addResourcesTo(o any, conf addResourcesConf) error {
 	case *resource.Composite:
 		// XR
 		for _, d := range conf.data {
-			if err := setData(d, "", o, conf.overwrite); err != nil {
+			if err := setData(d, nil, o, conf.overwrite, conf.lists); err != nil {
 				return errors.Wrap(err, "cannot set data on xr")
 			}
 		}
+	case *compositeStatus:
+		// XRStatus
+		for _, d := range conf.data {
+			if err := setData(d, nil, o, conf.overwrite, conf.lists); err != nil {
+				return errors.Wrap(err, "cannot set data on xr status")
+			}
+		}
 	default:
 		return fmt.Errorf("cannot add configuration to %T: invalid type for obj", o)
 	}
 	return nil
 }
 
-var (
-	errNoSuchField = "no such field"
-)
+// compositeStatus is the XR of the XRStatus target, only its status is set
+type compositeStatus struct {
+	*resource.Composite
+}
+
+// compositionResourceNameAnnotation names the desired composed resource a
+// document generated for the Resources target is added as
+const compositionResourceNameAnnotation = "crossplane.io/composition-resource-name"
 
-// setData is a recursive function that is intended to build a kube fieldpath valid
-// JSONPath(s) of the given object, it will then copy from 'data' at the given path
-// to the passed o object - at the same path, overwrite defines if this function should
-// be allowed to overwrite values or not, if not return cue like conflicting value error
+// takeCompositionResourceName returns the composition resource name annotated on
+// the document and removes the annotation
+func takeCompositionResourceName(u *unstructured.Unstructured) string {
+	annotations := u.GetAnnotations()
+	n, ok := annotations[compositionResourceNameAnnotation]
+	if !ok {
+		return ""
+	}
+	delete(annotations, compositionResourceNameAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	u.SetAnnotations(annotations)
+	return n
+}
+
+// setData is a recursive function that is intended to build the fieldpath segments of
+// the given object, it will then copy from 'data' at the given path to the passed o
+// object - at the same path, overwrite defines if this function should be allowed to
+// overwrite values or not, if not return cue like conflicting value error
 //
 // If the resource to write to 'o' contains a nil .Resource, setData will return an error
 // It is expected that the resource is created via composed.New() or composite.New() prior
 // to calling setData
-func setData(data any, path string, o any, overwrite bool) error {
+//
+// Lists are merged into the lists the object already sets with the list merge, item by
+// item at the same index by default
+func setData(data any, path fieldpath.Segments, o any, overwrite bool, lists listMerge) error {
 	switch val := data.(type) {
 	case map[string]interface{}:
-		// Check if the parent field is annotations or labels
-		// if so wrap the key in [] instead of . prefix
-		//
-		// Check if the suffix for validation, this is because there may be metadata annotations on deeper level items
-		isWrapped := false
-		if strings.HasSuffix(path, ".metadata.annotations") || strings.HasSuffix(path, ".metadata.labels") {
-			isWrapped = true
-		}
-
+		// Each key is a segment of its own, so keys holding periods, slashes or
+		// brackets, such as the keys of labels and annotations, are set as is
 		for key, value := range val {
-			var newKey string
-			if isWrapped {
-				newKey = fmt.Sprintf("%s[%s]", path, key)
-			} else {
-				newKey = fmt.Sprintf("%s.%v", path, key)
-			}
-			if err := setData(value, newKey, o, overwrite); err != nil {
+			if err := setData(value, childPath(path, fieldSegment(key)), o, overwrite, lists); err != nil {
 				return err
 			}
 		}
 	case []interface{}:
-		for i, value := range val {
-			newPath := fmt.Sprintf("%s[%d]", path, i)
-			if err := setData(value, newPath, o, overwrite); err != nil {
-				return err
-			}
-		}
+		return lists.setList(val, path, o, overwrite)
 	default:
-		// Reached a leaf node, add the JSON path to the desired resource
-		switch o.(type) {
-		case *resource.DesiredComposed:
-			path = strings.TrimPrefix(path, ".")
-
-			// Because we match on gvk+name, there is no need to set this
-			// ignore setting these again because this will conflict with the overwrite settings
-			if path == "apiVersion" || path == "kind" || path == "metadata.name" {
-				return nil
-			}
-
-			r := o.(*resource.DesiredComposed).Resource
-			if r == nil {
-				return errors.New("cannot set data on a nil DesiredComposed resource")
-			}
-
-			if curVal, err := r.GetValue(path); err != nil && !strings.Contains(err.Error(), errNoSuchField) {
-				return errors.Wrapf(err, "getting %s:%s in xr failed", path, data)
-			} else if curVal != nil && !overwrite {
-				return fmt.Errorf("%s: conflicting values %q and %q", path, curVal, data)
-			}
+		// Reached a leaf node, add the value at the path to the desired resource
+		return setLeaf(data, path, o, overwrite)
+	}
+	return nil
+}
 
-			if err := r.SetValue(path, data); err != nil {
-				return errors.Wrapf(err, "setting %s:%s in dxr failed", path, data)
-			}
-		case *resource.Composite:
-			path = strings.TrimPrefix(path, ".")
+// setLeaf sets the value at the path of the object, the value conflicts with a
+// different value the object already sets unless overwrite is set
+func setLeaf(data any, path fieldpath.Segments, o any, overwrite bool) error {
+	switch o.(type) {
+	case *resource.DesiredComposed:
+		// Because we match on gvk+name, there is no need to set this
+		// ignore setting these again because this will conflict with the overwrite settings
+		p := path.String()
+		if p == "apiVersion" || p == "kind" || p == "metadata.name" {
+			return nil
+		}
 
-			// The composite does not do any matching to update so there is no need to skip here
-			// on apiVersion, kind or metadata.name
+		r := o.(*resource.DesiredComposed).Resource
+		if r == nil {
+			return errors.New("cannot set data on a nil DesiredComposed resource")
+		}
+		// A cluster scoped resource has no namespace, setting one would
+		// clobber the resource when it is applied
+		if p == "metadata.namespace" && clusterScoped(&r.Unstructured) {
+			return nil
+		}
+		return setValue(content(&r.Unstructured), data, path, overwrite)
+	case *resource.Composite:
+		// The composite does not do any matching to update so there is no need to skip here
+		// on apiVersion, kind or metadata.name
 
-			r := o.(*resource.Composite).Resource
-			if r == nil {
-				return fmt.Errorf("cannot set data on a nil XR")
-			}
+		r := o.(*resource.Composite).Resource
+		if r == nil {
+			return fmt.Errorf("cannot set data on a nil XR")
+		}
+		return setValue(content(&r.Unstructured), data, path, overwrite)
+	case *compositeStatus:
+		// Only the status subtree of the XR can be set
+		if len(path) == 0 || path[0].Type != fieldpath.SegmentField || path[0].Field != "status" {
+			return fmt.Errorf("%s: the XRStatus target can only set the status of the XR", path)
+		}
+		return setLeaf(data, path, o.(*compositeStatus).Composite, overwrite)
+	default:
+		return fmt.Errorf("cannot set data on %T: invalid type for obj", o)
+	}
+}
 
-			if curVal, err := r.GetValue(path); err != nil && !strings.Contains(err.Error(), errNoSuchField) {
-				return errors.Wrapf(err, "getting %s:%s in xr failed", path, data)
-			} else if curVal != nil && !overwrite {
-				return fmt.Errorf("%s: conflicting values %q and %q", path, curVal, data)
-			}
+// setValue sets the value at the path of the content of an object, the value
+// conflicts with a different value the object already sets unless overwrite
+// is set
+func setValue(obj map[string]interface{}, data any, path fieldpath.Segments, overwrite bool) error {
+	data = typedValue(data)
+	if curVal, err := getPath(obj, path); err != nil {
+		return errors.Wrapf(err, "getting %s:%s failed", path, data)
+	} else if curVal != nil && sameValue(curVal, data) {
+		// The value is unchanged, keep its current representation
+		return nil
+	} else if curVal != nil && !overwrite {
+		return fmt.Errorf("%s: conflicting values %q and %q", path, curVal, data)
+	}
 
-			if err := r.SetValue(path, data); err != nil {
-				return errors.Wrapf(err, "setting %s:%s in dxr failed", path, data)
-			}
-		default:
-			return fmt.Errorf("cannot set data on %T: invalid type for obj", o)
-		}
+	if err := setPath(obj, path, data); err != nil {
+		return errors.Wrapf(err, "setting %s:%s failed", path, data)
 	}
 	return nil
 }
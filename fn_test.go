@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
 	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
 	"github.com/crossplane/function-sdk-go/resource"
@@ -15,6 +18,7 @@ import (
 
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
@@ -61,10 +65,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"basic:Generated\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -79,6 +83,54 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
+		"ValueLines": {
+			reason: "The Function should join a value given as a list of lines with newlines",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "lines"
+						},
+						"export": {
+							"target": "Resources",
+							"value": [
+								"apiVersion: \"example.org/v1\"",
+								"kind: \"Generated\"",
+								"metadata: name: \"lines\""
+							]
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"lines:Generated\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"lines": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"Generated","metadata":{"name":"lines"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
 		"Conditionals": {
 			reason: "Cue Conditionals should work",
 			args: args{
@@ -105,10 +157,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"TestNodepool:XNodepool\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -167,10 +219,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"echoserver:Deployment\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -246,14 +298,14 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-cluster:Cluster\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-nodepool:Nodepool\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -314,14 +366,14 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-cluster:Cluster\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-nodepool:Nodepool\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -384,18 +436,18 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-cluster:Cluster\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-nodepool:Nodepool\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-vpc:Vpc\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -465,26 +517,26 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-cluster:Cluster\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-nodepool:Nodepool\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-rds:Rds\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-subnet:Subnet\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example-vpc:Vpc\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -541,6 +593,88 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
+		"CompositionResourceName": {
+			reason: "The composition resource name annotation should name the desired resource and be removed",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "named"
+						},
+						"export": {
+							"options": {
+								"expressions": [
+									"yaml.MarshalStream(output)"
+								]
+							},
+							"target": "Resources",
+							"value": "output: [\n\t{\n\t\tapiVersion: \"nobu.dev/v1\"\n\t\tkind:       \"Cluster\"\n\t\tmetadata: {\n\t\t\tname: \"example-cluster\"\n\t\t\tannotations: \"crossplane.io/composition-resource-name\": \"cluster\"\n\t\t}\n\t},\n\t{\n\t\tapiVersion: \"nobu.dev/v1\"\n\t\tkind:       \"Vpc\"\n\t\tmetadata: {\n\t\t\tname: \"example-vpc\"\n\t\t\tannotations: {\n\t\t\t\t\"crossplane.io/composition-resource-name\": \"network\"\n\t\t\t\t\"example.org/team\": \"platform\"\n\t\t\t}\n\t\t}\n\t},\n\t{\n\t\tapiVersion: \"nobu.dev/v1\"\n\t\tkind:       \"Subnet\"\n\t\tmetadata: name: \"example-subnet\"\n\t},\n]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-cluster:Cluster\"",
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-subnet:Subnet\"",
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-vpc:Vpc\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"cluster": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "Cluster",
+									"metadata": {
+									    "name": "example-cluster"
+									}
+								}`),
+							},
+							"network": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "Vpc",
+									"metadata": {
+									    "name": "example-vpc",
+									    "annotations": {"example.org/team": "platform"}
+									}
+								}`),
+							},
+							"named-example-subnet": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "Subnet",
+									"metadata": {
+									    "name": "example-subnet"
+									}
+								}`),
+							},
+						},
+					},
+				},
+			},
+		},
 		"ExpressionIdentification": {
 			reason: "CUE Identifiers should work",
 			args: args{
@@ -572,10 +706,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"echoserver:Deployment\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -658,10 +792,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example:Cluster\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -736,10 +870,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"example:Cluster\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -768,6 +902,130 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
+		"ObservedResources": {
+			reason: "Observed composed resources should be available to the template in #observed.resources",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "nodepool"
+						},
+						"export": {
+							"target": "Resources",
+							"value": "apiVersion: \"eks.nobu.dev/v1\"\nkind: \"Nodepool\"\nmetadata: name: \"example\"\nspec: clusterId: #observed.resources.cluster.status.atProvider.id\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"cluster": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "eks.nobu.dev/v1",
+									"kind": "Cluster",
+									"metadata": {
+										"name": "example"
+									},
+									"status": {
+										"atProvider": {
+											"id": "cluster-1234"
+										}
+									}
+								}`),
+							},
+						},
+					},
+					Desired: &fnv1beta1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example:Nodepool\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"nodepool": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "eks.nobu.dev/v1",
+									"kind": "Nodepool",
+									"metadata": {
+										"name": "example"
+									},
+									"spec": {
+										"clusterId": "cluster-1234"
+									}
+								}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"DesiredResources": {
+			reason: "Resources desired by previous functions should be available to the template in #desired.resources",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "policy"
+						},
+						"export": {
+							"target": "Resources",
+							"value": "apiVersion: \"s3.nobu.dev/v1\"\nkind: \"BucketPolicy\"\nmetadata: name: \"\\(#desired.resources.bucket.metadata.name)-policy\"\nspec: region: #desired.resources.bucket.spec.region\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Resources: map[string]*fnv1beta1.Resource{
+							"bucket": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"s3.nobu.dev/v1","kind":"Bucket","metadata":{"name":"example"},"spec":{"region":"eu-west-1"}}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-policy:BucketPolicy\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"bucket": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"s3.nobu.dev/v1","kind":"Bucket","metadata":{"name":"example"},"spec":{"region":"eu-west-1"}}`),
+							},
+							"policy": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"s3.nobu.dev/v1","kind":"BucketPolicy","metadata":{"name":"example-policy"},"spec":{"region":"eu-west-1"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
 		"XRTargetting": {
 			reason: "XR Targetting should work",
 			args: args{
@@ -785,7 +1043,7 @@ func TestRunFunction(t *testing.T) {
 					}`),
 					Observed: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
-							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
 						},
 					},
 					Desired: &fnv1beta1.State{
@@ -799,10 +1057,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "updated xr \"example:XR\"",
-						},
+						}, string(actionUpdated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -824,8 +1082,8 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-		"PatchXRKind": {
-			reason: "XR Targetting should work",
+		"IgnoreXRKind": {
+			reason: "Changes to the immutable fields of the XR should be dropped with the Ignore policy",
 			args: args{
 				req: &fnv1beta1.RunFunctionRequest{
 					Input: resource.MustStructJSON(`{
@@ -836,13 +1094,14 @@ func TestRunFunction(t *testing.T) {
 						},
 						"export": {
 							"target": "XR",
+							"immutableFields": "Ignore",
 							"overwrite": true,
 							"value": "kind: \"Overwrite\"\nmetadata: name: \"example\"\n"
 						}
 					}`),
 					Observed: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
-							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
 						},
 					},
 					Desired: &fnv1beta1.State{
@@ -856,40 +1115,744 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
-							Message:  "updated xr \"example:Overwrite\"",
-						},
+							Message:  "updated xr \"example:XR\"",
+						}, string(actionUpdated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
-							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"Overwrite","metadata":{"name":"example"}}`),
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
 						},
 						Resources: map[string]*fnv1beta1.Resource{},
 					},
 				},
 			},
 		},
-		"PatchDesiredComposed": {
-			reason: "PatchDesired Resource should work",
+		"RoutedTargets": {
+			reason: "Documents matching a route should be applied to the route target and the rest to the default target",
 			args: args{
 				req: &fnv1beta1.RunFunctionRequest{
 					Input: resource.MustStructJSON(`{
 						"apiVersion": "dummy.fn.crossplane.io",
 						"kind": "dummy",
 						"metadata": {
-							"name": "patch-existing"
+							"name": "routes"
 						},
 						"export": {
-							"target": "PatchDesired",
-							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"findme\"\nmetadata: name: \"testname\"\nspec: forProvider: router: \"somerouter\"\nspec: forProvider: region: \"ap-northeast-1\"\n"
-						}
-					}`),
-					Observed: &fnv1beta1.State{
-						Composite: &fnv1beta1.Resource{
-							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
-						},
-					},
+							"options": {
+								"expressions": [
+									"json.MarshalStream(output)"
+								]
+							},
+							"overwrite": true,
+							"routes": [
+								{
+									"match": {
+										"apiVersion": "example.org/v1",
+										"kind": "XR"
+									},
+									"target": "XR"
+								}
+							],
+							"target": "Resources",
+							"value": "output: [\n\t{\n\t\tapiVersion: \"example.org/v1\"\n\t\tkind:       \"XR\"\n\t\tmetadata: name: \"example\"\n\t\tmetadata: labels: app: \"example\"\n\t},\n\t{\n\t\tapiVersion: \"nobu.dev/v1\"\n\t\tkind:       \"Cluster\"\n\t\tmetadata: name: \"example-cluster\"\n\t},\n]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated xr \"example:XR\"",
+						}, string(actionUpdated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-cluster:Cluster\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {
+									"name": "example",
+									"labels": {
+										"app": "example"
+									}
+								}
+							}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"routes": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Cluster","metadata":{"name":"example-cluster"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"DocumentTargets": {
+			reason: "Documents wrapped with or annotated with a target should be applied to it in a single evaluation",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "targets"
+						},
+						"export": {
+							"target": "Resources",
+							"value": "[\n\t{target: \"XR\", resource: status: ready: true},\n\t{\n\t\tapiVersion: \"nobu.dev/v1\"\n\t\tkind:       \"findme\"\n\t\tmetadata: name: \"testname\"\n\t\tmetadata: annotations: \"function-cue.fn/target\": \"PatchDesired\"\n\t\tspec: region: \"eu-west-1\"\n\t},\n\t{\n\t\tapiVersion: \"nobu.dev/v1\"\n\t\tkind:       \"Cluster\"\n\t\tmetadata: name: \"example-cluster\"\n\t},\n]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"existing": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"findme","metadata":{"name":"testname"}}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-cluster:Cluster\"",
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated xr \"example:XR\"",
+						}, string(actionUpdated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated resource \"testname:findme\"",
+						}, string(actionUpdated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"},"status":{"ready":true}}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"existing": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"findme","metadata":{"name":"testname"},"spec":{"region":"eu-west-1"}}`),
+							},
+							"targets": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Cluster","metadata":{"name":"example-cluster"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"ExpressionTargets": {
+			reason: "Each expression should be applied to its own target in a single evaluation",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "expressions"
+						},
+						"export": {
+							"target": "Resources",
+							"expressions": [
+								{"expr": "xrPatch", "target": "XR"},
+								{"expr": "resources"}
+							],
+							"value": "xrPatch: status: ready: true\nresources: [{apiVersion: \"nobu.dev/v1\", kind: \"Cluster\", metadata: name: \"example-cluster\"}]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-cluster:Cluster\"",
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated xr \"example:XR\"",
+						}, string(actionUpdated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"},"status":{"ready":true}}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"expressions": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Cluster","metadata":{"name":"example-cluster"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"NamedExpressions": {
+			reason: "Each named expression should report the documents it exported",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "expressions"
+						},
+						"export": {
+							"target": "Resources",
+							"expressions": [
+								{"name": "status", "expr": "xrPatch", "target": "XR"},
+								{"name": "clusters", "expr": "resources"}
+							],
+							"value": "xrPatch: status: ready: true\nresources: [{apiVersion: \"nobu.dev/v1\", kind: \"Cluster\", metadata: name: \"example-cluster\"}]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"example-cluster:Cluster\"",
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated xr \"example:XR\"",
+						}, string(actionUpdated)),
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "exported 1 document(s) from expression \"status\" to XR",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "exported 1 document(s) from expression \"clusters\"",
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"},"status":{"ready":true}}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"expressions": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Cluster","metadata":{"name":"example-cluster"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"NamedExpressionError": {
+			reason: "The error of a named expression should name it",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "expressions"
+						},
+						"export": {
+							"target": "Resources",
+							"expressions": [
+								{"name": "clusters", "expr": "resources"}
+							],
+							"value": "resources: [{apiVersion: \"nobu.dev/v1\", kind: \"Cluster\", metadata: name: string}]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "failed compiling cue template: expression \"clusters\":\nexport.value:1:74: resources.0.metadata.name: incomplete value string\n   1 | resources: [{apiVersion: \"nobu.dev/v1\", kind: \"Cluster\", metadata: name: string}]\n     |                                                                          ^",
+						},
+					},
+				},
+			},
+		},
+		"XRStatusTarget": {
+			reason: "The XRStatus target should set the status of the XR",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "xr-status"
+						},
+						"export": {
+							"target": "XRStatus",
+							"value": "status: replicas: #observed.composite.spec.replicas\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"},"spec":{"replicas":3}}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"}}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated xr status \"example:XR\"",
+						}, string(actionUpdated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"example"},"status":{"replicas":3}}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{},
+					},
+				},
+			},
+		},
+		"UnmatchedSkip": {
+			reason: "Documents that match no desired resource should be skipped with a warning with the skip policy",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "unmatched"
+						},
+						"export": {
+							"target": "PatchDesired",
+							"options": {
+								"unmatchedPolicy": "skip"
+							},
+							"value": "[\n\t{apiVersion: \"nobu.dev/v1\", kind: \"findme\", metadata: name: \"testname\", spec: region: \"eu-west-1\"},\n\t{apiVersion: \"nobu.dev/v1\", kind: \"missing\", metadata: name: \"other\"},\n]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"existing": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"findme","metadata":{"name":"testname"}}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated resource \"testname:findme\"",
+						}, string(actionUpdated)),
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "skipped unmatched resource \"other:missing\"",
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"existing": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"findme","metadata":{"name":"testname"},"spec":{"region":"eu-west-1"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"UnmatchedCreate": {
+			reason: "Documents that match no desired resource should be created with the create policy",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "unmatched"
+						},
+						"export": {
+							"target": "PatchDesired",
+							"options": {
+								"unmatchedPolicy": "create"
+							},
+							"value": "[\n\t{apiVersion: \"nobu.dev/v1\", kind: \"findme\", metadata: name: \"testname\", spec: region: \"eu-west-1\"},\n\t{apiVersion: \"nobu.dev/v1\", kind: \"missing\", metadata: name: \"other\"},\n]\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"existing": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"findme","metadata":{"name":"testname"}}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"other:missing\"",
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated resource \"testname:findme\"",
+						}, string(actionUpdated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"existing": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"findme","metadata":{"name":"testname"},"spec":{"region":"eu-west-1"}}`),
+							},
+							"unmatched": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"missing","metadata":{"name":"other"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"Prune": {
+			reason: "Resources created by the input in an earlier reconcile that it no longer creates should be pruned",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "prune"
+						},
+						"export": {
+							"target": "Resources",
+							"prune": true,
+							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"Bucket\"\nmetadata: name: \"bucket\"\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"queue": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Queue","metadata":{"name":"queue","annotations":{"function-cue.fn/owner":"prune"}}}`),
+							},
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"queue": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Queue","metadata":{"name":"queue"}}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"bucket:Bucket\"",
+						}, string(actionCreated)),
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "pruned resource \"queue\"",
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"prune": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"nobu.dev/v1","kind":"Bucket","metadata":{"name":"bucket","annotations":{"function-cue.fn/owner":"prune"}}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"Diff": {
+			reason: "An export in diff mode should report its changes as results and leave the desired state as it was",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "diff"
+						},
+						"export": {
+							"target": "Resources",
+							"options": {
+								"diff": true
+							},
+							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"Bucket\"\nmetadata: name: \"bucket\"\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "diff of resource \"diff\":\n+ .: {\"apiVersion\":\"nobu.dev/v1\",\"kind\":\"Bucket\",\"metadata\":{\"name\":\"bucket\"}}",
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{},
+					},
+				},
+			},
+		},
+		"PatchDesiredComposed": {
+			reason: "PatchDesired Resource should work",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "patch-existing"
+						},
+						"export": {
+							"target": "PatchDesired",
+							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"findme\"\nmetadata: name: \"testname\"\nspec: forProvider: router: \"somerouter\"\nspec: forProvider: region: \"ap-northeast-1\"\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"patch-existing": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "findme",
+									"metadata": {
+										"name": "testname"
+									}
+								}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated resource \"testname:findme\"",
+						}, string(actionUpdated)),
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"patch-existing": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "findme",
+									"metadata": {
+										"name": "testname"
+									},
+									"spec": {
+										"forProvider": {
+											"region": "ap-northeast-1",
+											"router": "somerouter"
+										}
+									}
+								}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"PatchDesiredComposedTargetCorrectly": {
+			reason: "PatchDesired Resource targeting should work",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "patch-existing"
+						},
+						"export": {
+							"target": "PatchDesired",
+							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"findme\"\nmetadata: name: \"testname\"\nspec: forProvider: router: \"somerouter\"\nspec: forProvider: region: \"ap-northeast-1\"\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"patch-existing": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "findme",
+									"metadata": {
+										"name": "testname"
+									}
+								}`),
+							},
+							"dont-patch-existing-kind-mismatch": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "notme",
+									"metadata": {
+										"name": "testname"
+									}
+								}`),
+							},
+							"dont-patch-existing-name-mismatch": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "findme",
+									"metadata": {
+										"name": "notthisone"
+									}
+								}`),
+							},
+							"dont-patch-otherone": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "anotherone",
+									"metadata": {
+										"name": "somethingsomething"
+									}
+								}`),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "updated resource \"testname:findme\"",
+						}, string(actionUpdated)),
+					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
 							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
@@ -901,6 +1864,39 @@ func TestRunFunction(t *testing.T) {
 									"kind": "findme",
 									"metadata": {
 										"name": "testname"
+									},
+									"spec": {
+										"forProvider": {
+											"region": "ap-northeast-1",
+											"router": "somerouter"
+										}
+									}
+								}`),
+							},
+							"dont-patch-existing-kind-mismatch": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "notme",
+									"metadata": {
+										"name": "testname"
+									}
+								}`),
+							},
+							"dont-patch-existing-name-mismatch": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "findme",
+									"metadata": {
+										"name": "notthisone"
+									}
+								}`),
+							},
+							"dont-patch-otherone": {
+								Resource: resource.MustStructJSON(`{
+									"apiVersion": "nobu.dev/v1",
+									"kind": "anotherone",
+									"metadata": {
+										"name": "somethingsomething"
 									}
 								}`),
 							},
@@ -908,21 +1904,57 @@ func TestRunFunction(t *testing.T) {
 					},
 				},
 			},
+		},
+		"PatchResourcesSingular": {
+			reason: "PatchResources targeting should work",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "patch-existing"
+						},
+						"export": {
+							"target": "PatchResources",
+							"resources": [
+								{
+									"name": "example-cluster",
+									"base": {
+										"apiVersion": "nobu.dev/v1",
+										"kind": "findme",
+										"metadata": {
+											"name": "testname"
+										}
+									}
+								}
+							],
+							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"findme\"\nmetadata: name: \"testname\"\nspec: forProvider: router: \"somerouter\"\nspec: forProvider: region: \"ap-northeast-1\"\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{},
+				},
+			},
 			want: want{
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
-							Message:  "updated resource \"testname:findme\"",
-						},
+							Message:  "created resource \"testname:findme\"",
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
 							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
 						},
 						Resources: map[string]*fnv1beta1.Resource{
-							"patch-existing": {
+							"testname": {
 								Resource: resource.MustStructJSON(`{
 									"apiVersion": "nobu.dev/v1",
 									"kind": "findme",
@@ -942,8 +1974,8 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-		"PatchDesiredComposedTargetCorrectly": {
-			reason: "PatchDesired Resource targeting should work",
+		"PatchResourcesYAMLBase": {
+			reason: "PatchResources should accept a base authored as a YAML string",
 			args: args{
 				req: &fnv1beta1.RunFunctionRequest{
 					Input: resource.MustStructJSON(`{
@@ -953,7 +1985,13 @@ func TestRunFunction(t *testing.T) {
 							"name": "patch-existing"
 						},
 						"export": {
-							"target": "PatchDesired",
+							"target": "PatchResources",
+							"resources": [
+								{
+									"name": "example-cluster",
+									"base": "apiVersion: nobu.dev/v1\nkind: findme\nmetadata:\n  name: testname\n"
+								}
+							],
 							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"findme\"\nmetadata: name: \"testname\"\nspec: forProvider: router: \"somerouter\"\nspec: forProvider: region: \"ap-northeast-1\"\n"
 						}
 					}`),
@@ -962,66 +2000,24 @@ func TestRunFunction(t *testing.T) {
 							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
 						},
 					},
-					Desired: &fnv1beta1.State{
-						Composite: &fnv1beta1.Resource{
-							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
-						},
-						Resources: map[string]*fnv1beta1.Resource{
-							"patch-existing": {
-								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "findme",
-									"metadata": {
-										"name": "testname"
-									}
-								}`),
-							},
-							"dont-patch-existing-kind-mismatch": {
-								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "notme",
-									"metadata": {
-										"name": "testname"
-									}
-								}`),
-							},
-							"dont-patch-existing-name-mismatch": {
-								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "findme",
-									"metadata": {
-										"name": "notthisone"
-									}
-								}`),
-							},
-							"dont-patch-otherone": {
-								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "anotherone",
-									"metadata": {
-										"name": "somethingsomething"
-									}
-								}`),
-							},
-						},
-					},
+					Desired: &fnv1beta1.State{},
 				},
 			},
 			want: want{
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
-							Message:  "updated resource \"testname:findme\"",
-						},
+							Message:  "created resource \"testname:findme\"",
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
 							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
 						},
 						Resources: map[string]*fnv1beta1.Resource{
-							"patch-existing": {
+							"testname": {
 								Resource: resource.MustStructJSON(`{
 									"apiVersion": "nobu.dev/v1",
 									"kind": "findme",
@@ -1036,30 +2032,60 @@ func TestRunFunction(t *testing.T) {
 									}
 								}`),
 							},
-							"dont-patch-existing-kind-mismatch": {
-								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "notme",
-									"metadata": {
-										"name": "testname"
-									}
-								}`),
-							},
-							"dont-patch-existing-name-mismatch": {
-								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "findme",
-									"metadata": {
-										"name": "notthisone"
+						},
+					},
+				},
+			},
+		},
+		"PatchResourcesNoDocuments": {
+			reason: "PatchResources should add the bases of its resources when the value compiles to no documents",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "patch-empty"
+						},
+						"export": {
+							"target": "PatchResources",
+							"resources": [
+								{
+									"name": "bkt",
+									"base": {
+										"apiVersion": "s3.aws.upbound.io/v1beta1",
+										"kind": "Bucket",
+										"metadata": {
+											"name": "bkt"
+										}
 									}
-								}`),
-							},
-							"dont-patch-otherone": {
+								}
+							],
+							"value": "[]"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+						Resources: map[string]*fnv1beta1.Resource{
+							"bkt": {
 								Resource: resource.MustStructJSON(`{
-									"apiVersion": "nobu.dev/v1",
-									"kind": "anotherone",
+									"apiVersion": "s3.aws.upbound.io/v1beta1",
+									"kind": "Bucket",
 									"metadata": {
-										"name": "somethingsomething"
+										"name": "bkt"
 									}
 								}`),
 							},
@@ -1068,8 +2094,8 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-		"PatchResourcesSingular": {
-			reason: "PatchResources targeting should work",
+		"PatchResourcesResourceKey": {
+			reason: "PatchResources should add bases as the name of their resource with the name resource key",
 			args: args{
 				req: &fnv1beta1.RunFunctionRequest{
 					Input: resource.MustStructJSON(`{
@@ -1080,19 +2106,23 @@ func TestRunFunction(t *testing.T) {
 						},
 						"export": {
 							"target": "PatchResources",
+							"options": {
+								"resourceKey": "name"
+							},
 							"resources": [
 								{
-									"name": "example-cluster",
+									"name": "bucket",
 									"base": {
 										"apiVersion": "nobu.dev/v1",
-										"kind": "findme",
-										"metadata": {
-											"name": "testname"
-										}
+										"kind": "Bucket"
 									}
+								},
+								{
+									"name": "users",
+									"base": "apiVersion: nobu.dev/v1\nkind: User\n---\napiVersion: nobu.dev/v1\nkind: User\n"
 								}
 							],
-							"value": "apiVersion: \"nobu.dev/v1\"\nkind: \"findme\"\nmetadata: name: \"testname\"\nspec: forProvider: router: \"somerouter\"\nspec: forProvider: region: \"ap-northeast-1\"\n"
+							"value": "resourceName: \"users-1\"\nspec: forProvider: admin: true\n"
 						}
 					}`),
 					Observed: &fnv1beta1.State{
@@ -1107,27 +2137,29 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
-							Message:  "created resource \"testname:findme\"",
-						},
+							Message:  "created resource \"users-1:User\"",
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
 							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
 						},
 						Resources: map[string]*fnv1beta1.Resource{
-							"testname": {
+							"bucket": {
+								Resource: resource.MustStructJSON(`{"apiVersion": "nobu.dev/v1", "kind": "Bucket"}`),
+							},
+							"users-0": {
+								Resource: resource.MustStructJSON(`{"apiVersion": "nobu.dev/v1", "kind": "User"}`),
+							},
+							"users-1": {
 								Resource: resource.MustStructJSON(`{
 									"apiVersion": "nobu.dev/v1",
-									"kind": "findme",
-									"metadata": {
-										"name": "testname"
-									},
+									"kind": "User",
 									"spec": {
 										"forProvider": {
-											"region": "ap-northeast-1",
-											"router": "somerouter"
+											"admin": true
 										}
 									}
 								}`),
@@ -1180,10 +2212,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"testname:findme\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1253,10 +2285,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"testname:findme\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1325,10 +2357,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"testname:findme\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1419,18 +2451,18 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"test-bucket:Bucket\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"test-role:Role\"",
-						},
-						{
+						}, string(actionCreated)),
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"test-user:User\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1555,10 +2587,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"testname:findme\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1656,10 +2688,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"testname:findme\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1754,10 +2786,10 @@ func TestRunFunction(t *testing.T) {
 				rsp: &fnv1beta1.RunFunctionResponse{
 					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
 					Results: []*fnv1beta1.Result{
-						{
+						withReason(&fnv1beta1.Result{
 							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
 							Message:  "created resource \"testname:findme\"",
-						},
+						}, string(actionCreated)),
 					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
@@ -1790,7 +2822,12 @@ func TestRunFunction(t *testing.T) {
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
 			f := &Function{log: logging.NewNopLogger()}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+			// The evaluation of the templates is bound to the context of the request
+			ctx := tc.args.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			rsp, err := f.RunFunction(ctx, tc.args.req)
 
 			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
 				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
@@ -1822,7 +2859,142 @@ func TestRunFunctionFailures(t *testing.T) {
 		"NoInput": {
 			reason: "The Function should return a fatal result if no input was specified",
 			args: args{
-				req: &fnv1beta1.RunFunctionRequest{},
+				req: &fnv1beta1.RunFunctionRequest{},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid function input: [value cannot be empty, type: Required value: invalid target ]",
+						},
+					},
+				},
+			},
+		},
+		"InvalidInput": {
+			reason: "The Function should return every violation of the input in a single fatal result",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "invalid"
+						},
+						"export": {
+							"target": "PatchResources",
+							"value": "a: 1",
+							"options": {
+								"expressions": ["a +"],
+								"inject": [{"name": "region", "path": "spec..region"}]
+							}
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid function input: [invalid options.expressions at index 0: expected operand, found 'EOF', invalid inject at index 0: invalid path \"spec..region\": unexpected '.' at position 5, resources: Required value: the PatchResources target requires resources]",
+						},
+					},
+				},
+			},
+		},
+		"ResourceWithoutBase": {
+			reason: "The Function should reject the input of a PatchResources resource without a base",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "no-base"
+						},
+						"export": {
+							"target": "PatchResources",
+							"resources": [{"name": "example"}],
+							"value": "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"example\"\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"my-xr"}}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid function input: resources[0].base: Required value: each resource requires a base",
+						},
+					},
+				},
+			},
+		},
+		"ModuleWithoutModuleFile": {
+			reason: "The Function should return a fatal result if the module does not declare itself",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "module"
+						},
+						"export": {
+							"target": "Resources",
+							"module": {
+								"files": {
+									"bucket.cue": "kind: \"Bucket\""
+								}
+							}
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid function input: module requires a cue.mod/module.cue file",
+						},
+					},
+				},
+			},
+		},
+		"ModuleFileOutsideModule": {
+			reason: "The Function should return a fatal result if a module file is outside the module",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "module"
+						},
+						"export": {
+							"target": "Resources",
+							"module": {
+								"files": {
+									"cue.mod/module.cue": "module: \"example.org/platform\"",
+									"../bucket.cue": "kind: \"Bucket\""
+								}
+							}
+						}
+					}`),
+				},
 			},
 			want: want{
 				rsp: &fnv1beta1.RunFunctionResponse{
@@ -1830,7 +3002,7 @@ func TestRunFunctionFailures(t *testing.T) {
 					Results: []*fnv1beta1.Result{
 						{
 							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
-							Message:  "invalid function input: value cannot be empty",
+							Message:  "invalid function input: invalid module file path \"../bucket.cue\": must be a clean relative path inside the module",
 						},
 					},
 				},
@@ -1942,8 +3114,8 @@ func TestRunFunctionFailures(t *testing.T) {
 				},
 			},
 		},
-		"ConflictingPatchXRKind": {
-			reason: "XR Targetting should work",
+		"ImmutableXRKind": {
+			reason: "The XR target should not change the immutable fields of the XR",
 			args: args{
 				req: &fnv1beta1.RunFunctionRequest{
 					Input: resource.MustStructJSON(`{
@@ -1975,7 +3147,7 @@ func TestRunFunctionFailures(t *testing.T) {
 					Results: []*fnv1beta1.Result{
 						{
 							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
-							Message:  "cannot add resources to XR: cannot set data on xr: kind: conflicting values \"XR\" and \"Overwrite\"",
+							Message:  "cannot add resources to XR: document at index 0 changes kind of the XR to Overwrite, the field is immutable: set immutableFields to Ignore to drop the change",
 						},
 					},
 					Desired: &fnv1beta1.State{
@@ -2165,12 +3337,53 @@ func TestRunFunctionFailures(t *testing.T) {
 				},
 			},
 		},
+		"XRStatusSpec": {
+			reason: "The XRStatus target should not set fields outside of the status of the XR",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "xr-status"
+						},
+						"export": {
+							"target": "XRStatus",
+							"value": "status: ready: true\nspec: replicas: 3\n"
+						}
+					}`),
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+						},
+					},
+					Desired: &fnv1beta1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "cannot add resources to XR status: cannot set data on xr status: spec.replicas: the XRStatus target can only set the status of the XR",
+						},
+					},
+					Desired: &fnv1beta1.State{},
+				},
+			},
+		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
 			f := &Function{log: logging.NewNopLogger()}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+			// The evaluation of the templates is bound to the context of the request
+			ctx := tc.args.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			rsp, err := f.RunFunction(ctx, tc.args.req)
 
 			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
 				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
@@ -2189,6 +3402,7 @@ func TestSetData(t *testing.T) {
 		data      map[string]interface{}
 		on        any
 		overwrite bool
+		lists     listMerge
 	}
 	type want struct {
 		err error
@@ -2242,6 +3456,48 @@ func TestSetData(t *testing.T) {
 				},
 			},
 		},
+		"DesiredComposedEscapedKeys": {
+			reason: "DesiredComposed should set keys holding periods, slashes, brackets or digits as is",
+			args: args{
+				data: map[string]interface{}{
+					"spec": map[string]interface{}{
+						"selector": map[string]interface{}{
+							"matchLabels": map[string]interface{}{
+								"app.kubernetes.io/name": "web",
+							},
+						},
+						"data": map[string]interface{}{
+							"config[prod].yaml": "a: b",
+							"80":                "http",
+						},
+					},
+				},
+				on: &resource.DesiredComposed{
+					Resource: composed.New(),
+				},
+			},
+			want: want{
+				out: &resource.DesiredComposed{
+					Resource: &composed.Unstructured{
+						Unstructured: unstructured.Unstructured{
+							Object: map[string]interface{}{
+								"spec": map[string]interface{}{
+									"selector": map[string]interface{}{
+										"matchLabels": map[string]interface{}{
+											"app.kubernetes.io/name": "web",
+										},
+									},
+									"data": map[string]interface{}{
+										"config[prod].yaml": "a: b",
+										"80":                "http",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 		"DesiredComposedDeeperCopies": {
 			reason: "DesiredComposed should be able to set basic data",
 			args: args{
@@ -2323,6 +3579,46 @@ func TestSetData(t *testing.T) {
 				},
 			},
 		},
+		"DesiredComposedClusterScoped": {
+			reason: "DesiredComposed should not set the namespace of a cluster scoped kind",
+			args: args{
+				data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"namespace": "team-a",
+						"labels": map[string]interface{}{
+							"app": "bucket",
+						},
+					},
+				},
+				on: &resource.DesiredComposed{
+					Resource: &composed.Unstructured{
+						Unstructured: unstructured.Unstructured{
+							Object: map[string]interface{}{
+								"apiVersion": "rbac.authorization.k8s.io/v1",
+								"kind":       "ClusterRole",
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				out: &resource.DesiredComposed{
+					Resource: &composed.Unstructured{
+						Unstructured: unstructured.Unstructured{
+							Object: map[string]interface{}{
+								"apiVersion": "rbac.authorization.k8s.io/v1",
+								"kind":       "ClusterRole",
+								"metadata": map[string]interface{}{
+									"labels": map[string]interface{}{
+										"app": "bucket",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 		"XRBasic": {
 			reason: "XR should be able to set basic data",
 			args: args{
@@ -2530,7 +3826,7 @@ func TestSetData(t *testing.T) {
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			err := setData(tc.args.data, "", tc.args.on, tc.args.overwrite)
+			err := setData(tc.args.data, nil, tc.args.on, tc.args.overwrite, tc.args.lists)
 
 			if diff := cmp.Diff(tc.want.out, tc.args.on, protocmp.Transform()); diff != "" {
 				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
@@ -2542,3 +3838,515 @@ func TestSetData(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchResources(t *testing.T) {
+	desiredResource := func(name, kind string, labels map[string]interface{}) *resource.DesiredComposed {
+		return &resource.DesiredComposed{Resource: &composed.Unstructured{Unstructured: unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "nobu.dev/v1",
+				"kind":       kind,
+				"metadata":   map[string]interface{}{"name": name, "labels": labels},
+			},
+		}}}
+	}
+	desired := map[resource.Name]*resource.DesiredComposed{
+		"subnet-a": desiredResource("generated-a", "Subnet", map[string]interface{}{"zone": "a", "tier": "private"}),
+		"subnet-b": desiredResource("generated-b", "Subnet", map[string]interface{}{"zone": "b", "tier": "private"}),
+		"vpc":      desiredResource("generated-vpc", "Vpc", map[string]interface{}{"tier": "private"}),
+	}
+
+	cases := map[string]struct {
+		reason  string
+		data    []map[string]interface{}
+		matchBy []v1beta1.MatchKey
+		want    []resource.Name
+		// wantUnmatched are the indexes of the unmatched documents
+		wantUnmatched []int
+	}{
+		"Default": {
+			reason: "Documents should be matched by apiVersion, kind and name by default",
+			data:   []map[string]interface{}{{"apiVersion": "nobu.dev/v1", "kind": "Subnet", "metadata": map[string]interface{}{"name": "generated-b"}}},
+			want:   []resource.Name{"subnet-b"},
+		},
+		"Labels": {
+			reason:  "A document should patch every resource with its labels",
+			data:    []map[string]interface{}{{"kind": "Subnet", "metadata": map[string]interface{}{"labels": map[string]interface{}{"tier": "private"}}}},
+			matchBy: []v1beta1.MatchKey{v1beta1.MatchKind, v1beta1.MatchLabels},
+			want:    []resource.Name{"subnet-a", "subnet-b"},
+		},
+		"ResourceName": {
+			reason: "A document should patch the resource named by its composition resource name annotation",
+			data: []map[string]interface{}{{"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{"crossplane.io/composition-resource-name": "vpc"},
+			}}},
+			matchBy: []v1beta1.MatchKey{v1beta1.MatchResourceName},
+			want:    []resource.Name{"vpc"},
+		},
+		"ResourceNameField": {
+			reason: "A document should only patch the resource keyed by its resourceName field, whatever the matchBy keys",
+			data:   []map[string]interface{}{{"resourceName": "subnet-a", "kind": "Subnet", "spec": map[string]interface{}{"cidr": "10.0.0.0/24"}}},
+			want:   []resource.Name{"subnet-a"},
+		},
+		"ResourceNameFieldNoMatch": {
+			reason:        "A document whose resourceName field names no resource should be unmatched",
+			data:          []map[string]interface{}{{"resourceName": "subnet-c", "apiVersion": "nobu.dev/v1", "kind": "Subnet", "metadata": map[string]interface{}{"name": "generated-a"}}},
+			wantUnmatched: []int{0},
+		},
+		"NoMatch": {
+			reason:        "A document that matches no resource should be unmatched",
+			data:          []map[string]interface{}{{"kind": "Subnet", "metadata": map[string]interface{}{"labels": map[string]interface{}{"zone": "c"}}}},
+			matchBy:       []v1beta1.MatchKey{v1beta1.MatchKind, v1beta1.MatchLabels},
+			wantUnmatched: []int{0},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			matches, unmatched := matchResources(desired, tc.data, tc.matchBy)
+			if diff := cmp.Diff(tc.wantUnmatched, unmatched); diff != "" {
+				t.Errorf("%s\nmatchResources(...): -want unmatched, +got unmatched:\n%s", tc.reason, diff)
+			}
+			var got []resource.Name
+			for name, dcd := range desired {
+				if _, ok := matches[dcd]; ok {
+					got = append(got, name)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.SortSlices(func(a, b resource.Name) bool { return a < b })); diff != "" {
+				t.Errorf("%s\nmatchResources(...): -want matched resources, +got matched resources:\n%s", tc.reason, diff)
+			}
+			for _, d := range tc.data {
+				u := unstructured.Unstructured{Object: d}
+				if _, ok := u.GetAnnotations()[compositionResourceNameAnnotation]; ok && len(tc.wantUnmatched) == 0 {
+					t.Errorf("%s\nmatchResources(...): the composition resource name annotation should be removed", tc.reason)
+				}
+				if _, ok := d[resourceNameField]; ok {
+					t.Errorf("%s\nmatchResources(...): the resourceName field should be removed", tc.reason)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFunctionExports(t *testing.T) {
+	cases := map[string]struct {
+		reason      string
+		input       string
+		wantXR      string
+		wantDesired map[string]*fnv1beta1.Resource
+		wantFatal   string
+	}{
+		"Exports": {
+			reason: "The exports should be applied in order, a later export should see the resources of an earlier one",
+			input: `{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind": "CUEInput",
+				"metadata": {"name": "exports"},
+				"exports": [
+					{
+						"target": "Resources",
+						"value": "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nmetadata: {\n\tname: \"my-bucket\"\n\tannotations: \"crossplane.io/composition-resource-name\": \"bucket\"\n}\n"
+					},
+					{
+						"target": "XR",
+						"value": "status: bucket: #desired.resources.bucket.metadata.name\n"
+					}
+				]
+			}`,
+			wantXR: `{"apiVersion": "example.org/v1", "kind": "XR", "status": {"bucket": "my-bucket"}}`,
+			wantDesired: map[string]*fnv1beta1.Resource{
+				"bucket": {Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": {"name": "my-bucket"}}`)},
+			},
+		},
+		"ExportAndExports": {
+			reason: "An input should not set both export and exports",
+			input: `{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind": "CUEInput",
+				"metadata": {"name": "exports"},
+				"export": {"target": "XR", "value": "status: ready: true\n"},
+				"exports": [{"target": "XR", "value": "status: ready: true\n"}]
+			}`,
+			wantFatal: "invalid function input: export and exports are mutually exclusive",
+		},
+		"InvalidExport": {
+			reason: "An invalid export should return its index",
+			input: `{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind": "CUEInput",
+				"metadata": {"name": "exports"},
+				"exports": [{"target": "XR", "value": "status: ready: true\n"}, {"target": "XR"}]
+			}`,
+			wantFatal: "invalid function input: invalid export at index 1: value cannot be empty",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(tc.input),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+					},
+				},
+			}
+
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			var fatal string
+			for _, r := range rsp.GetResults() {
+				if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+					fatal = r.GetMessage()
+				}
+			}
+			if diff := cmp.Diff(tc.wantFatal, fatal); diff != "" {
+				t.Fatalf("%s\nf.RunFunction(...): -want fatal result, +got fatal result:\n%s", tc.reason, diff)
+			}
+			if tc.wantFatal != "" {
+				return
+			}
+			if diff := cmp.Diff(resource.MustStructJSON(tc.wantXR), rsp.GetDesired().GetComposite().GetResource(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired XR, +got desired XR:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantDesired, rsp.GetDesired().GetResources(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired, +got desired:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionMeta(t *testing.T) {
+	value := "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nmetadata: {\n\tname: \"\\(#meta.claim.name)-bucket\"\n\tlabels: {\n\t\t\"crossplane.io/claim-name\":      #meta.claim.name\n\t\t\"crossplane.io/claim-namespace\": #meta.claim.namespace\n\t\t\"example.org/revision\":          #meta.compositionRevision\n\t\t\"example.org/tag\":               #meta.tag\n\t\t\"example.org/function\":          #meta.function\n\t\t\"example.org/ttl\":               #meta.ttl\n\t}\n}\n"
+	input, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "cue.fn.crossplane.io/v1beta1",
+		"kind":       "CUEInput",
+		"metadata":   map[string]interface{}{"name": "meta"},
+		"export":     map[string]interface{}{"target": "Resources", "value": value},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		reason     string
+		xr         string
+		name       string
+		wantLabels string
+	}{
+		"Claimed": {
+			reason:     "The claim and composition revision of the XR should be injected into #meta",
+			xr:         `{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}, "spec": {"claimRef": {"apiVersion": "example.org/v1", "kind": "Claim", "namespace": "team-a", "name": "my-claim"}, "compositionRevisionRef": {"name": "xr-abc123"}}}`,
+			name:       "function-cue-private",
+			wantLabels: `{"crossplane.io/claim-name": "my-claim", "crossplane.io/claim-namespace": "team-a", "example.org/revision": "xr-abc123", "example.org/tag": "hello", "example.org/function": "function-cue-private", "example.org/ttl": "1m0s"}`,
+		},
+		"Unclaimed": {
+			reason:     "The fields of #meta the XR does not have should be empty, and the function name should default",
+			xr:         `{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`,
+			wantLabels: `{"crossplane.io/claim-name": "", "crossplane.io/claim-namespace": "", "example.org/revision": "", "example.org/tag": "hello", "example.org/function": "function-cue", "example.org/ttl": "1m0s"}`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Meta:     &fnv1beta1.RequestMeta{Tag: "hello"},
+				Input:    resource.MustStructJSON(string(input)),
+				Observed: &fnv1beta1.State{Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(tc.xr)}},
+			}
+			rsp, err := (&Function{log: logging.NewNopLogger(), name: tc.name}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if err := fatalResult(rsp); err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected fatal result: %v", tc.reason, err)
+			}
+			var labels *structpb.Value
+			for _, r := range rsp.GetDesired().GetResources() {
+				labels = r.GetResource().GetFields()["metadata"].GetStructValue().GetFields()["labels"]
+			}
+			if diff := cmp.Diff(structpb.NewStructValue(resource.MustStructJSON(tc.wantLabels)), labels, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want labels, +got labels:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionWhen(t *testing.T) {
+	cases := map[string]struct {
+		reason        string
+		monitoring    string
+		when          string
+		wantResources int
+		wantMessage   string
+		wantFatal     bool
+	}{
+		"True": {
+			reason:        "An export whose when expression is true should run",
+			monitoring:    "true",
+			when:          `#observed.composite.spec.monitoring == true`,
+			wantResources: 1,
+		},
+		"False": {
+			reason:      "An export whose when expression is false should be skipped with a normal result",
+			monitoring:  "false",
+			when:        `#observed.composite.spec.monitoring && #meta.tag == "hello"`,
+			wantMessage: "skipped export to Resources: when evaluated to false",
+		},
+		"NotBool": {
+			reason:     "A when expression that does not evaluate to a bool should fail the step",
+			monitoring: "true",
+			when:       `#observed.composite.metadata.name`,
+			wantFatal:  true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			input, err := json.Marshal(map[string]interface{}{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind":       "CUEInput",
+				"metadata":   map[string]interface{}{"name": "monitoring"},
+				"export": map[string]interface{}{
+					"target": "Resources",
+					"when":   tc.when,
+					"value":  "apiVersion: \"example.org/v1\"\nkind: \"Dashboard\"\nmetadata: name: \"dashboard\"\n",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &fnv1beta1.RunFunctionRequest{
+				Meta:     &fnv1beta1.RequestMeta{Tag: "hello"},
+				Input:    resource.MustStructJSON(string(input)),
+				Observed: &fnv1beta1.State{Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}, "spec": {"monitoring": ` + tc.monitoring + `}}`)}},
+			}
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if err := fatalResult(rsp); (err != nil) != tc.wantFatal {
+				t.Fatalf("%s\nf.RunFunction(...): want fatal %t, got %v", tc.reason, tc.wantFatal, err)
+			}
+			if tc.wantFatal {
+				return
+			}
+			if diff := cmp.Diff(tc.wantResources, len(rsp.GetDesired().GetResources())); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+			if tc.wantMessage == "" {
+				return
+			}
+			var messages []string
+			for _, r := range rsp.GetResults() {
+				messages = append(messages, r.GetMessage())
+			}
+			if diff := cmp.Diff([]string{tc.wantMessage}, messages); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionCompositeReady(t *testing.T) {
+	deployment := func(available string) *fnv1beta1.Resource {
+		return &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{
+			"apiVersion": "apps/v1",
+			"kind": "Deployment",
+			"metadata": {"name": "app"},
+			"status": {"conditions": [{"type": "Available", "status": "` + available + `"}]}
+		}`)}
+	}
+	ready := `len([for r in #observed.resources if r.kind == "Deployment" && !list.Contains([for c in r.status.conditions if c.type == "Available" {c.status}], "True") {r}]) == 0`
+
+	cases := map[string]struct {
+		reason    string
+		expr      string
+		observed  map[string]*fnv1beta1.Resource
+		want      fnv1beta1.Ready
+		wantFatal bool
+	}{
+		"Unset": {
+			reason:   "The readiness of the composite should not be set without an expression",
+			observed: map[string]*fnv1beta1.Resource{"app": deployment("True")},
+			want:     fnv1beta1.Ready_READY_UNSPECIFIED,
+		},
+		"Ready": {
+			reason:   "The composite should be ready when the expression is true",
+			expr:     ready,
+			observed: map[string]*fnv1beta1.Resource{"app": deployment("True")},
+			want:     fnv1beta1.Ready_READY_TRUE,
+		},
+		"NotReady": {
+			reason:   "The composite should not be ready when the expression is false",
+			expr:     ready,
+			observed: map[string]*fnv1beta1.Resource{"app": deployment("False")},
+			want:     fnv1beta1.Ready_READY_FALSE,
+		},
+		"NotBool": {
+			reason:    "An expression that does not evaluate to a bool should fail the step",
+			expr:      `#observed.composite.metadata.name`,
+			wantFatal: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			input, err := json.Marshal(map[string]interface{}{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind":       "CUEInput",
+				"metadata":   map[string]interface{}{"name": "ready"},
+				"export": map[string]interface{}{
+					"target":  "XRStatus",
+					"options": map[string]interface{}{"compositeReady": tc.expr},
+					"value":   "status: phase: \"Running\"\n",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(string(input)),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`)},
+					Resources: tc.observed,
+				},
+			}
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if err := fatalResult(rsp); (err != nil) != tc.wantFatal {
+				t.Fatalf("%s\nf.RunFunction(...): want fatal %t, got %v", tc.reason, tc.wantFatal, err)
+			}
+			if tc.wantFatal {
+				return
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetDesired().GetComposite().GetReady()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want ready, +got ready:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionAutoReady(t *testing.T) {
+	observed := func(name, status string) *fnv1beta1.Resource {
+		return &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{
+			"apiVersion": "example.org/v1",
+			"kind": "Bucket",
+			"metadata": {"name": "` + name + `"},
+			"status": {"conditions": [{"type": "Ready", "status": "` + status + `"}]}
+		}`)}
+	}
+
+	cases := map[string]struct {
+		reason    string
+		autoReady bool
+		observed  map[string]*fnv1beta1.Resource
+		want      map[string]fnv1beta1.Ready
+	}{
+		"Disabled": {
+			reason:   "A generated resource without readiness checks should not be ready without autoReady",
+			observed: map[string]*fnv1beta1.Resource{"generated": observed("generated", "True"), "existing": observed("existing", "True")},
+			want:     map[string]fnv1beta1.Ready{"generated": fnv1beta1.Ready_READY_UNSPECIFIED, "existing": fnv1beta1.Ready_READY_UNSPECIFIED},
+		},
+		"Ready": {
+			reason:    "A generated resource should be ready by its Ready condition, resources desired by earlier functions should be left",
+			autoReady: true,
+			observed:  map[string]*fnv1beta1.Resource{"generated": observed("generated", "True"), "existing": observed("existing", "True")},
+			want:      map[string]fnv1beta1.Ready{"generated": fnv1beta1.Ready_READY_TRUE, "existing": fnv1beta1.Ready_READY_UNSPECIFIED},
+		},
+		"NotReady": {
+			reason:    "A generated resource whose Ready condition is not true should not be ready",
+			autoReady: true,
+			observed:  map[string]*fnv1beta1.Resource{"generated": observed("generated", "False")},
+			want:      map[string]fnv1beta1.Ready{"generated": fnv1beta1.Ready_READY_UNSPECIFIED, "existing": fnv1beta1.Ready_READY_UNSPECIFIED},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			input, err := json.Marshal(map[string]interface{}{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind":       "CUEInput",
+				"metadata":   map[string]interface{}{"name": "generated"},
+				"export": map[string]interface{}{
+					"target":  "Resources",
+					"options": map[string]interface{}{"autoReady": tc.autoReady},
+					"value":   "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nmetadata: name: \"generated\"\n",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(string(input)),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`)},
+					Resources: tc.observed,
+				},
+				Desired: &fnv1beta1.State{
+					Resources: map[string]*fnv1beta1.Resource{
+						"existing": {Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": {"name": "existing"}}`)},
+					},
+				},
+			}
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if err := fatalResult(rsp); err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected fatal result: %v", tc.reason, err)
+			}
+			got := map[string]fnv1beta1.Ready{}
+			for name, r := range rsp.GetDesired().GetResources() {
+				got[name] = r.GetReady()
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want ready, +got ready:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// BenchmarkRunFunction measures a template fanning out into 500 composed
+// resources, run with -benchmem to compare the memory allocated per call
+func BenchmarkRunFunction(b *testing.B) {
+	value := "#documents: [for i in list.Range(0, 500, 1) {\n" +
+		"\tapiVersion: \"example.org/v1\"\n" +
+		"\tkind:       \"Bucket\"\n" +
+		"\tmetadata: {\n" +
+		"\t\tname: \"\\(#observed.composite.metadata.name)-\\(i)\"\n" +
+		"\t\tlabels: {\"example.org/index\": \"\\(i)\", \"example.org/xr\": #observed.composite.metadata.name}\n" +
+		"\t}\n" +
+		"\tspec: forProvider: {region: \"eu-west-1\", tags: {index: \"\\(i)\", owner: \"platform\", team: \"storage\"}}\n" +
+		"}]\n"
+	input, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "cue.fn.crossplane.io/v1beta1",
+		"kind":       "CUEInput",
+		"metadata":   map[string]interface{}{"name": "buckets"},
+		"export":     map[string]interface{}{"target": "Resources", "value": "import \"list\"\n\n" + value},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := &fnv1beta1.RunFunctionRequest{
+		Input:    resource.MustStructJSON(string(input)),
+		Observed: &fnv1beta1.State{Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`)}},
+	}
+	f := &Function{log: logging.NewNopLogger(), cache: newTemplateCache(1), sizeWarning: 1200000, limits: evalLimits{outputBytes: 33554432, resources: 1000}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsp, err := f.RunFunction(context.Background(), req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(rsp.GetDesired().GetResources()) != 500 {
+			b.Fatalf("want 500 desired resources, got %d", len(rsp.GetDesired().GetResources()))
+		}
+	}
+}
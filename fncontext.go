@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// environmentContextKey is the context key Crossplane puts the data of the
+// EnvironmentConfigs selected by the composition in
+const environmentContextKey = "apiextensions.crossplane.io/environment"
+
+// getContext returns the pipeline context of the request, an empty context is
+// returned when the request has none
+func getContext(req *fnv1beta1.RunFunctionRequest) (*structpb.Struct, error) {
+	ctx, err := unknownStruct(req, requestContextField)
+	return ctx, errors.Wrap(err, "cannot parse request context")
+}
+
+// setContext sets the pipeline context of the response, the context returned
+// by a function replaces the context of the pipeline so it must include the
+// context of the request, an empty context is not set
+func setContext(rsp *fnv1beta1.RunFunctionResponse, ctx *structpb.Struct) error {
+	if len(ctx.GetFields()) == 0 {
+		return nil
+	}
+	return errors.Wrap(setUnknownStruct(rsp, responseContextField, ctx), "cannot encode response context")
+}
+
+// contextValue converts the documents routed to the Context target to the
+// value written to the context key, a single document is written as is and
+// multiple documents as a list. The empty metadata a target annotation leaves
+// behind is dropped, since context values are not Kubernetes objects.
+func contextValue(data []map[string]interface{}) (*structpb.Value, error) {
+	for _, d := range data {
+		if m, ok := d["metadata"].(map[string]interface{}); ok && len(m) == 0 {
+			delete(d, "metadata")
+		}
+	}
+	if len(data) == 1 {
+		return structpb.NewValue(data[0])
+	}
+	docs := make([]interface{}, len(data))
+	for i, d := range data {
+		docs[i] = d
+	}
+	return structpb.NewValue(docs)
+}
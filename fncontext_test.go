@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRunFunctionContext(t *testing.T) {
+	input := func(target, value string) string {
+		return `{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "context"},
+			"export": {
+				"target": "` + target + `",
+				"contextKey": "apiextensions.crossplane.io/environment",
+				"value": "` + value + `"
+			}
+		}`
+	}
+
+	cases := map[string]struct {
+		reason  string
+		input   string
+		context *structpb.Struct
+		want    *structpb.Struct
+	}{
+		"Context": {
+			reason: "The compiled output should be written to the context key",
+			input:  input("Context", `region: \"eu-west-1\"\nzones: [\"a\", \"b\"]\n`),
+			want: resource.MustStructJSON(`{
+				"apiextensions.crossplane.io/environment": {"region": "eu-west-1", "zones": ["a", "b"]}
+			}`),
+		},
+		"ExpressionContext": {
+			reason: "The documents of an expression targeting the context should be written to the context key without metadata",
+			input: `{
+				"apiVersion": "dummy.fn.crossplane.io",
+				"kind": "dummy",
+				"metadata": {"name": "context"},
+				"export": {
+					"target": "Resources",
+					"contextKey": "apiextensions.crossplane.io/environment",
+					"expressions": [{"expr": "environment", "target": "Context"}],
+					"value": "environment: region: \"eu-west-1\"\n"
+				}
+			}`,
+			want: resource.MustStructJSON(`{
+				"apiextensions.crossplane.io/environment": {"region": "eu-west-1"}
+			}`),
+		},
+		"KeepContext": {
+			reason: "The context of previous functions should be kept when writing the context key",
+			input:  input("Context", `region: \"eu-west-1\"\n`),
+			context: resource.MustStructJSON(`{
+				"apiextensions.crossplane.io/environment": {"region": "us-east-1", "team": "platform"},
+				"example.org/previous": "value"
+			}`),
+			want: resource.MustStructJSON(`{
+				"apiextensions.crossplane.io/environment": {"region": "eu-west-1"},
+				"example.org/previous": "value"
+			}`),
+		},
+		"ReadContext": {
+			reason: "The context should be available to the template in #context",
+			input:  input("Context", `zone: \"\\(#context[\"apiextensions.crossplane.io/environment\"].region)a\"\n`),
+			context: resource.MustStructJSON(`{
+				"apiextensions.crossplane.io/environment": {"region": "us-east-1"}
+			}`),
+			want: resource.MustStructJSON(`{
+				"apiextensions.crossplane.io/environment": {"zone": "us-east-1a"}
+			}`),
+		},
+		"PassContext": {
+			reason:  "The context should be passed on unchanged by other targets",
+			input:   input("Resources", `apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n`),
+			context: resource.MustStructJSON(`{"example.org/previous": "value"}`),
+			want:    resource.MustStructJSON(`{"example.org/previous": "value"}`),
+		},
+		"NoContext": {
+			reason: "A request without a context should not return one",
+			input:  input("Resources", `apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n`),
+			want:   &structpb.Struct{Fields: map[string]*structpb.Value{}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(tc.input),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+					},
+				},
+			}
+			if tc.context != nil {
+				if err := setUnknownStruct(req, requestContextField, tc.context); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			for _, r := range rsp.GetResults() {
+				if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+					t.Fatalf("%s\nf.RunFunction(...): unexpected fatal result: %s", tc.reason, r.GetMessage())
+				}
+			}
+			got, err := unknownStruct(rsp, responseContextField)
+			if err != nil {
+				t.Fatalf("%s\nunknownStruct(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want context, +got context:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
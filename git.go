@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1" //nolint:gosec // git names its objects by their sha1
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+const (
+	// maxGitPackBytes is the largest packfile fetched from a git repository
+	maxGitPackBytes = 64 << 20
+	// maxGitObjectBytes is the largest object inflated from a packfile or
+	// produced by a delta
+	maxGitObjectBytes = maxGitPackBytes
+	// maxGitInflatedBytes is the largest total size of the objects inflated
+	// from a packfile, so that a small packfile cannot expand without bound
+	maxGitInflatedBytes = 4 * maxGitPackBytes
+	// gitTimeout is the timeout of each request to a git repository
+	gitTimeout = 30 * time.Second
+	// gitCacheSize is the number of files of git repositories cached
+	gitCacheSize = 64
+)
+
+// Types of the objects of a packfile
+const (
+	gitCommit   = 1
+	gitTree     = 2
+	gitBlob     = 3
+	gitTag      = 4
+	gitOfsDelta = 6
+	gitRefDelta = 7
+)
+
+// gitValues fetches the values of exports from files of git repositories over
+// the smart HTTP protocol. The commit of a branch or tag is resolved again once
+// it is older than the refresh interval, the files of a commit are immutable
+// and cached until they are evicted from a full cache. When the repository
+// cannot be reached the file of the commit the revision last resolved to is
+// served stale while it is cached.
+type gitValues struct {
+	client *http.Client
+	// credentialsDir holds a directory of username and password files for
+	// each credentials reference
+	credentialsDir string
+	refresh        time.Duration
+	now            func() time.Time
+
+	mu    sync.Mutex
+	refs  map[string]resolvedRef
+	files map[string]string
+	// order of the cached files, the oldest first
+	order []string
+}
+
+// resolvedRef is the commit a revision resolved to and the time it resolved
+type resolvedRef struct {
+	commit   string
+	resolved time.Time
+}
+
+// newGitValues returns the values of the files of git repositories, reading
+// their credentials from dir
+func newGitValues(credentialsDir string, refresh time.Duration) *gitValues {
+	return &gitValues{
+		client:         &http.Client{Timeout: gitTimeout},
+		credentialsDir: credentialsDir,
+		refresh:        refresh,
+		now:            time.Now,
+		refs:           map[string]resolvedRef{},
+		files:          map[string]string{},
+	}
+}
+
+// Resolve returns the content of the referenced file, and whether it is served
+// stale
+func (g *gitValues) Resolve(ctx context.Context, ref v1beta1.GitRef) (string, *staleValue, error) {
+	url := strings.TrimSuffix(ref.URL, "/")
+	content, err := g.resolve(ctx, url, ref)
+	if err == nil {
+		return content, nil, nil
+	}
+	if !errors.As(err, &unavailableError{}) {
+		return "", nil, err
+	}
+
+	// The file of the commit the revision last resolved to is served stale
+	g.mu.Lock()
+	r, ok := g.refs[url+"@"+ref.Revision]
+	if ok {
+		content, ok = g.files[fmt.Sprintf("%s@%s:%s", url, r.commit, ref.Path)]
+	}
+	g.mu.Unlock()
+	if !ok {
+		return "", nil, err
+	}
+	source := fmt.Sprintf("%s at revision %q of %s", ref.Path, ref.Revision, ref.URL)
+	return content, &staleValue{source: source, age: g.now().Sub(r.resolved), err: err}, nil
+}
+
+// resolve returns the content of the referenced file of the repository at the
+// url, the errors of the requests to the repository are unavailableErrors
+func (g *gitValues) resolve(ctx context.Context, url string, ref v1beta1.GitRef) (string, error) {
+	c := &gitClient{client: g.client, url: url}
+	if cr := ref.CredentialsRef; cr != nil {
+		if g.credentialsDir == "" {
+			return "", errors.Errorf("cannot read credentials %q: no git credentials directory is configured", cr.Name)
+		}
+		var err error
+		if c.username, c.password, err = readCredentials(g.credentialsDir, cr.Name); err != nil {
+			return "", err
+		}
+	}
+
+	commit, resolved, err := g.commit(ctx, c, ref.Revision)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot resolve revision %q of %s", ref.Revision, ref.URL)
+	}
+	key := fmt.Sprintf("%s@%s:%s", c.url, commit, ref.Path)
+	g.mu.Lock()
+	content, ok := g.files[key]
+	g.mu.Unlock()
+	if !ok {
+		pack, err := c.fetchPack(ctx, commit)
+		if err != nil {
+			return "", unavailableError{errors.Wrapf(err, "cannot fetch commit %s of %s", commit, ref.URL)}
+		}
+		objects, err := parsePack(pack)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot parse packfile of commit %s of %s", commit, ref.URL)
+		}
+		if content, err = objects.file(commit, ref.Path); err != nil {
+			return "", errors.Wrapf(err, "cannot read %s at commit %s of %s", ref.Path, commit, ref.URL)
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.files[key]; !ok {
+		if len(g.order) >= gitCacheSize {
+			delete(g.files, g.order[0])
+			g.order = g.order[1:]
+		}
+		g.order = append(g.order, key)
+		g.files[key] = content
+	}
+	// The revision resolves to the commit once its file is read, so that a
+	// file that cannot be fetched keeps the file of the previous commit
+	if resolved != nil {
+		g.refs[c.url+"@"+ref.Revision] = *resolved
+	}
+	return content, nil
+}
+
+// commit returns the commit the revision resolves to, a full commit SHA is
+// used as is. A revision resolved again is returned along with its commit.
+func (g *gitValues) commit(ctx context.Context, c *gitClient, revision string) (string, *resolvedRef, error) {
+	if isCommitSHA(revision) {
+		return strings.ToLower(revision), nil, nil
+	}
+	g.mu.Lock()
+	r, ok := g.refs[c.url+"@"+revision]
+	g.mu.Unlock()
+	if ok && g.now().Sub(r.resolved) < g.refresh {
+		return r.commit, nil, nil
+	}
+
+	refs, err := c.refs(ctx)
+	if err != nil {
+		return "", nil, unavailableError{err}
+	}
+	commit, err := matchRevision(refs, revision)
+	if err != nil {
+		return "", nil, err
+	}
+	return commit, &resolvedRef{commit: commit, resolved: g.now()}, nil
+}
+
+// isCommitSHA returns whether the revision is a full commit SHA
+func isCommitSHA(revision string) bool {
+	if len(revision) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(revision)
+	return err == nil
+}
+
+// matchRevision returns the commit of the revision from the advertised refs,
+// an empty revision is the HEAD of the repository. A revision is matched as a
+// full ref name, then as a tag, peeled to its commit, then as a branch.
+func matchRevision(refs map[string]string, revision string) (string, error) {
+	if revision == "" {
+		revision = "HEAD"
+	}
+	for _, name := range []string{
+		revision,
+		"refs/tags/" + revision + "^{}",
+		"refs/tags/" + revision,
+		"refs/heads/" + revision,
+	} {
+		if commit, ok := refs[name]; ok {
+			return commit, nil
+		}
+	}
+	return "", errors.New("no branch or tag matches the revision")
+}
+
+// gitClient speaks the smart HTTP protocol of git to a repository
+type gitClient struct {
+	client   *http.Client
+	url      string
+	username string
+	password string
+}
+
+// refs returns the refs advertised by the repository, keyed by name. Peeled
+// tags are keyed by their name suffixed with ^{}.
+func (c *gitClient) refs(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(b))
+	refs := map[string]string{}
+	for {
+		line, flush, err := readPktLine(r)
+		if errors.Is(err, io.EOF) {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse advertised refs")
+		}
+		if flush || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The first ref is followed by the capabilities of the server
+		line, _, _ = strings.Cut(strings.TrimSuffix(line, "\n"), "\x00")
+		commit, name, ok := strings.Cut(line, " ")
+		if !ok || !isCommitSHA(commit) {
+			return nil, errors.Errorf("cannot parse advertised ref %q", line)
+		}
+		refs[name] = commit
+	}
+}
+
+// fetchPack fetches the packfile of the commit and its tree, without its
+// history
+func (c *gitClient) fetchPack(ctx context.Context, commit string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(pktLine(fmt.Sprintf("want %s ofs-delta shallow no-progress\n", commit)))
+	body.WriteString(pktLine("deepen 1\n"))
+	body.WriteString("0000")
+	body.WriteString(pktLine("done\n"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/git-upload-pack", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	b, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The packfile follows the shallow lines and the NAK of the negotiation
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse negotiation")
+		}
+		switch {
+		case flush, strings.HasPrefix(line, "shallow "):
+			continue
+		case strings.HasPrefix(line, "ERR "):
+			return nil, errors.New(strings.TrimSpace(strings.TrimPrefix(line, "ERR ")))
+		case strings.HasPrefix(line, "NAK"), strings.HasPrefix(line, "ACK"):
+			return io.ReadAll(r)
+		}
+		return nil, errors.Errorf("unexpected negotiation line %q", line)
+	}
+}
+
+func (c *gitClient) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("User-Agent", "git/function-cue")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close() //nolint:errcheck // nothing to do with the error
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s from %s", rsp.Status, req.URL.Path)
+	}
+	b, err := io.ReadAll(io.LimitReader(rsp.Body, maxGitPackBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxGitPackBytes {
+		return nil, errors.Errorf("response of %s exceeds %d bytes", req.URL.Path, maxGitPackBytes)
+	}
+	return b, nil
+}
+
+// pktLine encodes the line in the pkt-line format of git
+func pktLine(line string) string {
+	return fmt.Sprintf("%04x%s", len(line)+4, line)
+}
+
+// readPktLine reads a line in the pkt-line format of git, a flush packet is
+// returned as an empty flushed line
+func readPktLine(r *bufio.Reader) (string, bool, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", false, err
+	}
+	n, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		return "", false, errors.Errorf("invalid pkt-line length %q", head)
+	}
+	if n == 0 {
+		return "", true, nil
+	}
+	if n < 4 {
+		return "", false, errors.Errorf("invalid pkt-line length %d", n)
+	}
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return "", false, err
+	}
+	return string(line), false, nil
+}
+
+// gitObject is an object of a packfile, deltas are resolved against their base
+type gitObject struct {
+	typ  int
+	data []byte
+}
+
+// gitObjects are the objects of a packfile keyed by their hex sha1
+type gitObjects map[string]gitObject
+
+// parsePack returns the objects of the packfile with their deltas resolved
+func parsePack(pack []byte) (gitObjects, error) {
+	if len(pack) < 12 || string(pack[:4]) != "PACK" {
+		return nil, errors.New("missing packfile signature")
+	}
+	if v := binary.BigEndian.Uint32(pack[4:8]); v != 2 && v != 3 {
+		return nil, errors.Errorf("unsupported packfile version %d", v)
+	}
+	count := binary.BigEndian.Uint32(pack[8:12])
+	// Each object takes several bytes of the packfile
+	if uint64(count) > uint64(len(pack)) {
+		return nil, errors.Errorf("packfile of %d bytes cannot hold %d objects", len(pack), count)
+	}
+
+	// entry is a packed object, a delta until it is resolved
+	type entry struct {
+		typ    int
+		data   []byte
+		base   int64
+		baseID string
+	}
+	entries := make(map[int64]*entry, count)
+	offsets := make([]int64, 0, count)
+	r := bytes.NewReader(pack)
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return nil, err
+	}
+	inflated := 0
+	for i := uint32(0); i < count; i++ {
+		offset := int64(len(pack) - r.Len())
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read object at offset %d", offset)
+		}
+		e := &entry{typ: int(c>>4) & 7}
+		// The size of the inflated object is not needed, zlib knows it
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return nil, errors.Wrapf(err, "cannot read object at offset %d", offset)
+			}
+		}
+		switch e.typ {
+		case gitOfsDelta:
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot read delta at offset %d", offset)
+			}
+			rel := int64(c & 0x7f)
+			for c&0x80 != 0 {
+				if c, err = r.ReadByte(); err != nil {
+					return nil, errors.Wrapf(err, "cannot read delta at offset %d", offset)
+				}
+				rel = ((rel + 1) << 7) | int64(c&0x7f)
+			}
+			e.base = offset - rel
+		case gitRefDelta:
+			id := make([]byte, sha1.Size)
+			if _, err := io.ReadFull(r, id); err != nil {
+				return nil, errors.Wrapf(err, "cannot read delta at offset %d", offset)
+			}
+			e.baseID = hex.EncodeToString(id)
+		case gitCommit, gitTree, gitBlob, gitTag:
+		default:
+			return nil, errors.Errorf("unknown object type %d at offset %d", e.typ, offset)
+		}
+		// bytes.Reader is an io.ByteReader, so zlib reads no further than
+		// the end of the object
+		z, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot inflate object at offset %d", offset)
+		}
+		if e.data, err = io.ReadAll(io.LimitReader(z, maxGitObjectBytes+1)); err != nil {
+			return nil, errors.Wrapf(err, "cannot inflate object at offset %d", offset)
+		}
+		if len(e.data) > maxGitObjectBytes {
+			return nil, errors.Errorf("object at offset %d exceeds %d bytes", offset, maxGitObjectBytes)
+		}
+		if inflated += len(e.data); inflated > maxGitInflatedBytes {
+			return nil, errors.Errorf("objects of the packfile exceed %d bytes", maxGitInflatedBytes)
+		}
+		entries[offset] = e
+		offsets = append(offsets, offset)
+	}
+
+	objects := gitObjects{}
+	resolved := map[int64]gitObject{}
+	var resolve func(offset int64, depth int) (gitObject, error)
+	resolve = func(offset int64, depth int) (gitObject, error) {
+		if o, ok := resolved[offset]; ok {
+			return o, nil
+		}
+		e, ok := entries[offset]
+		if !ok {
+			return gitObject{}, errors.Errorf("no object at offset %d", offset)
+		}
+		if depth > 50 {
+			return gitObject{}, errors.Errorf("delta chain of object at offset %d is too long", offset)
+		}
+		var base gitObject
+		switch e.typ {
+		case gitOfsDelta:
+			b, err := resolve(e.base, depth+1)
+			if err != nil {
+				return gitObject{}, err
+			}
+			base = b
+		case gitRefDelta:
+			b, ok := objects[e.baseID]
+			if !ok {
+				// The base may be later in the pack
+				for _, o := range offsets {
+					if entries[o].typ == gitOfsDelta || entries[o].typ == gitRefDelta {
+						continue
+					}
+					if _, err := resolve(o, depth+1); err != nil {
+						return gitObject{}, err
+					}
+				}
+				if b, ok = objects[e.baseID]; !ok {
+					return gitObject{}, errors.Errorf("missing base %s of object at offset %d", e.baseID, offset)
+				}
+			}
+			base = b
+		default:
+			o := gitObject{typ: e.typ, data: e.data}
+			resolved[offset] = o
+			objects[objectID(o)] = o
+			return o, nil
+		}
+		data, err := applyDelta(base.data, e.data)
+		if err != nil {
+			return gitObject{}, errors.Wrapf(err, "cannot apply delta at offset %d", offset)
+		}
+		if inflated += len(data); inflated > maxGitInflatedBytes {
+			return gitObject{}, errors.Errorf("objects of the packfile exceed %d bytes", maxGitInflatedBytes)
+		}
+		o := gitObject{typ: base.typ, data: data}
+		resolved[offset] = o
+		objects[objectID(o)] = o
+		return o, nil
+	}
+	for _, offset := range offsets {
+		if _, err := resolve(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// objectID returns the hex sha1 git names the object by
+func objectID(o gitObject) string {
+	name := map[int]string{gitCommit: "commit", gitTree: "tree", gitBlob: "blob", gitTag: "tag"}[o.typ]
+	h := sha1.New() //nolint:gosec // git names its objects by their sha1
+	fmt.Fprintf(h, "%s %d\x00", name, len(o.data))
+	h.Write(o.data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// applyDelta applies the delta instructions to the base
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	size := func() (uint64, error) {
+		return binary.ReadUvarint(r)
+	}
+	baseSize, err := size()
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, errors.Errorf("base size %d does not match the delta size %d", len(base), baseSize)
+	}
+	targetSize, err := size()
+	if err != nil {
+		return nil, err
+	}
+	// The target size is read from the packfile, it is not trusted
+	if targetSize > maxGitObjectBytes {
+		return nil, errors.Errorf("target size %d exceeds %d bytes", targetSize, maxGitObjectBytes)
+	}
+	out := make([]byte, 0, targetSize)
+	for r.Len() > 0 {
+		cmd, _ := r.ReadByte()
+		if cmd&0x80 == 0 {
+			if cmd == 0 {
+				return nil, errors.New("invalid delta instruction 0")
+			}
+			insert := make([]byte, cmd)
+			if _, err := io.ReadFull(r, insert); err != nil {
+				return nil, err
+			}
+			if out = append(out, insert...); uint64(len(out)) > targetSize {
+				return nil, errors.Errorf("delta produces more than %d bytes", targetSize)
+			}
+			continue
+		}
+		// The offset and size of a copy are little endian, with a byte for
+		// each of their bits set in the instruction
+		var offset, n uint64
+		for i := uint(0); i < 7; i++ {
+			if cmd&(1<<i) == 0 {
+				continue
+			}
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if i < 4 {
+				offset |= uint64(b) << (8 * i)
+			} else {
+				n |= uint64(b) << (8 * (i - 4))
+			}
+		}
+		if n == 0 {
+			n = 0x10000
+		}
+		if offset+n > uint64(len(base)) {
+			return nil, errors.Errorf("copy of %d bytes at offset %d exceeds the base", n, offset)
+		}
+		if out = append(out, base[offset:offset+n]...); uint64(len(out)) > targetSize {
+			return nil, errors.Errorf("delta produces more than %d bytes", targetSize)
+		}
+	}
+	if uint64(len(out)) != targetSize {
+		return nil, errors.Errorf("delta produced %d bytes instead of %d", len(out), targetSize)
+	}
+	return out, nil
+}
+
+// file returns the content of the file at the slash separated path of the
+// tree of the commit
+func (objects gitObjects) file(commit, path string) (string, error) {
+	o, ok := objects[commit]
+	// An annotated tag is peeled to its commit
+	for ok && o.typ == gitTag {
+		id, found := objectHeader(o.data, "object")
+		if !found {
+			return "", errors.Errorf("tag %s has no object", commit)
+		}
+		o, ok = objects[id]
+	}
+	if !ok || o.typ != gitCommit {
+		return "", errors.Errorf("commit %s is not in the packfile", commit)
+	}
+	id, found := objectHeader(o.data, "tree")
+	if !found {
+		return "", errors.Errorf("commit %s has no tree", commit)
+	}
+
+	parts := strings.Split(path, "/")
+	for i, name := range parts {
+		tree, ok := objects[id]
+		if !ok || tree.typ != gitTree {
+			return "", errors.Errorf("%s is not a directory", strings.Join(parts[:i], "/"))
+		}
+		if id, found = treeEntry(tree.data, name); !found {
+			return "", errors.Errorf("%s is not found", strings.Join(parts[:i+1], "/"))
+		}
+	}
+	blob, ok := objects[id]
+	if !ok || blob.typ != gitBlob {
+		return "", errors.Errorf("%s is not a file", path)
+	}
+	return string(blob.data), nil
+}
+
+// objectHeader returns the value of the header of a commit or tag object
+func objectHeader(data []byte, header string) (string, bool) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, header+" "); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// treeEntry returns the id of the named entry of a tree object, each entry is
+// its mode and name separated by a space, a NUL and its binary sha1
+func treeEntry(data []byte, name string) (string, bool) {
+	for len(data) > 0 {
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || len(data) < nul+1+sha1.Size {
+			return "", false
+		}
+		_, entry, _ := strings.Cut(string(data[:nul]), " ")
+		id := hex.EncodeToString(data[nul+1 : nul+1+sha1.Size])
+		if entry == name {
+			return id, true
+		}
+		data = data[nul+1+sha1.Size:]
+	}
+	return "", false
+}
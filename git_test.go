@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// gitRepository creates a repository with a v1 tag and a newer main branch,
+// and returns a handler serving it at /templates.git over the smart HTTP
+// protocol with git http-backend, along with the commit of the tag.
+func gitRepository(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	dir := filepath.Join(root, "templates.git")
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command(gitBin, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.org",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.org",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+root,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	run("init", "--quiet", "--initial-branch=main")
+	write("templates/bucket.cue", "name: \"v1\"\n")
+	write("README.md", "templates\n")
+	run("add", "-A")
+	run("commit", "--quiet", "-m", "v1")
+	run("tag", "-a", "v1", "-m", "v1")
+	tagged := run("rev-parse", "HEAD")
+	write("templates/bucket.cue", "name: \"main\"\n")
+	run("add", "-A")
+	run("commit", "--quiet", "-m", "main")
+
+	return &cgi.Handler{
+		Path: gitBin,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}, tagged
+}
+
+func TestGitValues(t *testing.T) {
+	h, tagged := gitRepository(t)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	url := srv.URL + "/templates.git"
+
+	cases := map[string]struct {
+		reason  string
+		ref     v1beta1.GitRef
+		want    string
+		wantErr bool
+	}{
+		"DefaultBranch": {
+			reason: "An empty revision should resolve the default branch",
+			ref:    v1beta1.GitRef{URL: url, Path: "templates/bucket.cue"},
+			want:   "name: \"main\"\n",
+		},
+		"Branch": {
+			reason: "A branch should resolve its latest commit",
+			ref:    v1beta1.GitRef{URL: url, Revision: "main", Path: "templates/bucket.cue"},
+			want:   "name: \"main\"\n",
+		},
+		"Tag": {
+			reason: "An annotated tag should resolve the commit it tags",
+			ref:    v1beta1.GitRef{URL: url, Revision: "v1", Path: "templates/bucket.cue"},
+			want:   "name: \"v1\"\n",
+		},
+		"Commit": {
+			reason: "A full commit SHA should be fetched as is",
+			ref:    v1beta1.GitRef{URL: url, Revision: tagged, Path: "templates/bucket.cue"},
+			want:   "name: \"v1\"\n",
+		},
+		"MissingRevision": {
+			reason:  "A revision that matches no branch or tag should return an error",
+			ref:     v1beta1.GitRef{URL: url, Revision: "v2", Path: "templates/bucket.cue"},
+			wantErr: true,
+		},
+		"MissingPath": {
+			reason:  "A path missing from the commit should return an error",
+			ref:     v1beta1.GitRef{URL: url, Revision: "main", Path: "templates/missing.cue"},
+			wantErr: true,
+		},
+		"Directory": {
+			reason:  "A path of a directory should return an error",
+			ref:     v1beta1.GitRef{URL: url, Revision: "main", Path: "templates"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			g := newGitValues("", time.Minute)
+			got, _, err := g.Resolve(context.Background(), tc.ref)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\nResolve(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nResolve(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nResolve(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGitValuesCredentials(t *testing.T) {
+	h, _ := gitRepository(t)
+
+	// The repository requires basic auth
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		auth = append(auth, user+":"+pass)
+		if !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	creds := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(creds, "git"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{"username": "user", "password": "secret"} {
+		if err := os.WriteFile(filepath.Join(creds, "git", file), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ref := v1beta1.GitRef{URL: srv.URL + "/templates.git", Revision: "main", Path: "templates/bucket.cue"}
+	if _, _, err := newGitValues(creds, time.Minute).Resolve(context.Background(), ref); err == nil {
+		t.Errorf("Resolve(...): want error without credentials, got none")
+	}
+	ref.CredentialsRef = &v1beta1.CredentialsRef{Name: "git"}
+	got, _, err := newGitValues(creds, time.Minute).Resolve(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Resolve(...): unexpected error: %v", err)
+	}
+	if diff := cmp.Diff("name: \"main\"\n", got); diff != "" {
+		t.Errorf("Resolve(...): -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{":", "user:secret", "user:secret"}, auth); diff != "" {
+		t.Errorf("Resolve(...): -want auth, +got auth:\n%s", diff)
+	}
+}
+
+func TestGitValuesStale(t *testing.T) {
+	h, _ := gitRepository(t)
+
+	// The repository becomes unavailable after the first resolution
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	start := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	g := newGitValues("", time.Minute)
+	g.now = func() time.Time { return now }
+	ref := v1beta1.GitRef{URL: srv.URL + "/templates.git", Revision: "main", Path: "templates/bucket.cue"}
+	if _, _, err := g.Resolve(context.Background(), ref); err != nil {
+		t.Fatalf("Resolve(...): unexpected error: %v", err)
+	}
+
+	down.Store(true)
+	now = start.Add(2 * time.Minute)
+	got, stale, err := g.Resolve(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Resolve(...): want the stale file, got error: %v", err)
+	}
+	if diff := cmp.Diff("name: \"main\"\n", got); diff != "" {
+		t.Errorf("Resolve(...): -want, +got:\n%s", diff)
+	}
+	if stale == nil || stale.age != 2*time.Minute {
+		t.Errorf("Resolve(...): want the file served stale for 2m, got %+v", stale)
+	}
+
+	// A revision that was never resolved has no stale file
+	ref.Revision = "v1"
+	if _, _, err := g.Resolve(context.Background(), ref); err == nil {
+		t.Errorf("Resolve(...): want error for a revision never resolved, got none")
+	}
+}
+
+// packObject returns the header and deflated data of an object of a packfile
+func packObject(t *testing.T, typ int, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	// The size is not used, a single byte header is enough
+	b.WriteByte(byte(typ << 4))
+	z := zlib.NewWriter(&b)
+	if _, err := z.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// pack returns a packfile of the objects
+func pack(count uint32, objects ...[]byte) []byte {
+	b := []byte("PACK\x00\x00\x00\x02")
+	b = binary.BigEndian.AppendUint32(b, count)
+	for _, o := range objects {
+		b = append(b, o...)
+	}
+	return b
+}
+
+func TestParsePack(t *testing.T) {
+	blob := []byte("name: \"v1\"\n")
+	cases := map[string]struct {
+		reason  string
+		pack    func(t *testing.T) []byte
+		wantErr bool
+	}{
+		"Blob": {
+			reason: "A packfile of a blob should be parsed",
+			pack: func(t *testing.T) []byte {
+				return pack(1, packObject(t, gitBlob, blob))
+			},
+		},
+		"TooManyObjects": {
+			reason: "A packfile that claims more objects than it can hold should return an error instead of allocating them",
+			pack: func(t *testing.T) []byte {
+				return pack(math.MaxUint32, packObject(t, gitBlob, blob))
+			},
+			wantErr: true,
+		},
+		"ZipBomb": {
+			reason: "An object that inflates beyond the object limit should return an error instead of exhausting memory",
+			pack: func(t *testing.T) []byte {
+				return pack(1, packObject(t, gitBlob, make([]byte, maxGitObjectBytes+1)))
+			},
+			wantErr: true,
+		},
+		"CorruptDelta": {
+			reason: "A delta with a target size beyond the object limit should return an error instead of panicking",
+			pack: func(t *testing.T) []byte {
+				delta := binary.AppendUvarint(nil, uint64(len(blob)))
+				delta = binary.AppendUvarint(delta, math.MaxUint64)
+				base := packObject(t, gitBlob, blob)
+				// The base is the object right before the delta
+				ofs := []byte{byte(gitOfsDelta << 4), byte(len(base))}
+				z := packObject(t, gitBlob, delta)[1:]
+				return pack(2, base, append(ofs, z...))
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := parsePack(tc.pack(t))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\nparsePack(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("%s\nparsePack(...): unexpected error: %v", tc.reason, err)
+			}
+		})
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello")
+	header := func(target uint64) []byte {
+		return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(len(base))), target)
+	}
+	cases := map[string]struct {
+		reason  string
+		delta   []byte
+		want    []byte
+		wantErr bool
+	}{
+		"CopyAndInsert": {
+			reason: "A delta should copy from the base and insert its data",
+			// Copy 4 bytes at offset 0, then insert "p"
+			delta: append(header(5), 0x90, 4, 1, 'p'),
+			want:  []byte("hellp"),
+		},
+		"HugeTargetSize": {
+			reason:  "A target size beyond the object limit should return an error instead of allocating it",
+			delta:   header(math.MaxUint64),
+			wantErr: true,
+		},
+		"Overflow": {
+			reason:  "A delta producing more than its target size should return an error",
+			delta:   append(header(1), 0x90, 5),
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := applyDelta(base, tc.delta)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\napplyDelta(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\napplyDelta(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\napplyDelta(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -5,12 +5,19 @@
 package v1beta1
 
 import (
+	"encoding/json"
 	"fmt"
+	"path"
+	"strings"
 
+	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/parser"
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
@@ -23,27 +30,389 @@ type CUEInput struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
 	// Export is the input data for the cue export command
-	Export Export `json:"export,required"`
+	// +optional
+	Export Export `json:"export,omitempty"`
+	// Exports are compiled and applied in order in place of Export, each
+	// export sees the desired state and the context of the exports before it
+	// +optional
+	Exports []Export `json:"exports,omitempty"`
 }
 
+// Validate the export of the input, or each of its exports, the error lists
+// every violation of the input
 func (in CUEInput) Validate() error {
-	if in.Export.Value == "" {
-		return errors.New("value cannot be empty")
+	if len(in.Exports) == 0 {
+		return in.Export.Validate()
+	}
+	var errs []error
+	if in.Export.Value != "" || in.Export.TemplateRef != nil || in.Export.ValueFrom != nil || in.Export.Module != nil {
+		errs = append(errs, errors.New("export and exports are mutually exclusive"))
+	}
+	for i, e := range in.Exports {
+		for _, err := range e.validate() {
+			errs = append(errs, fmt.Errorf("invalid export at index %d: %w", i, err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// Inputs returns an input for each export of the input, in order
+func (in CUEInput) Inputs() []CUEInput {
+	if len(in.Exports) == 0 {
+		return []CUEInput{in}
+	}
+	out := make([]CUEInput, len(in.Exports))
+	for i, e := range in.Exports {
+		out[i] = CUEInput{TypeMeta: in.TypeMeta, ObjectMeta: in.ObjectMeta, Export: e}
+	}
+	return out
+}
+
+// Validate the export, the error lists every violation of the export
+func (e Export) Validate() error {
+	return kerrors.NewAggregate(e.validate())
+}
+
+// validate returns the violations of the export
+func (e Export) validate() []error {
+	var errs []error
+	if e.Module != nil {
+		if e.Value != "" || e.TemplateRef != nil || e.ValueFrom != nil {
+			errs = append(errs, errors.New("module is mutually exclusive with value, valueFrom and templateRef"))
+		}
+		if len(e.Libraries) != 0 {
+			errs = append(errs, errors.New("libraries cannot be used with a module, add them to the files of the module"))
+		}
+		if err := e.Module.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	} else if len(e.Options.Registries) != 0 {
+		errs = append(errs, errors.New("registries require a module"))
+	} else if e.ValueFrom != nil {
+		if e.Value != "" || e.TemplateRef != nil {
+			errs = append(errs, errors.New("valueFrom is mutually exclusive with value and templateRef"))
+		}
+		if err := e.ValueFrom.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	} else if e.TemplateRef != nil {
+		if e.Value != "" {
+			errs = append(errs, errors.New("value and templateRef are mutually exclusive"))
+		}
+		if e.TemplateRef.Name == "" || e.TemplateRef.Version == "" {
+			errs = append(errs, field.Required(field.NewPath("templateRef"), "templateRef requires a name and version"))
+		}
+		if d := e.TemplateRef.Digest; d != "" && !isDigest(d) {
+			errs = append(errs, fmt.Errorf("invalid templateRef digest %q: must be sha256:<hex>", d))
+		}
+	} else if e.Value == "" {
+		errs = append(errs, errors.New("value cannot be empty"))
+	}
+
+	if len(e.Expressions) != 0 && len(e.Options.Expressions) != 0 {
+		errs = append(errs, errors.New("expressions and options.expressions are mutually exclusive"))
+	}
+	names := map[string]bool{}
+	for i, x := range e.Expressions {
+		if x.Name != "" {
+			if names[x.Name] {
+				errs = append(errs, fmt.Errorf("invalid expression at index %d: duplicate name %q", i, x.Name))
+			}
+			names[x.Name] = true
+		}
+		if x.Expr == "" {
+			errs = append(errs, fmt.Errorf("invalid expression at index %d: expr cannot be empty", i))
+		} else if _, err := parser.ParseExpr("expressions", x.Expr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid expression at index %d: %w", i, err))
+		}
+	}
+	for i, x := range e.Options.Expressions {
+		if x == "" {
+			continue
+		}
+		if _, err := parser.ParseExpr("expressions", x); err != nil {
+			errs = append(errs, fmt.Errorf("invalid options.expressions at index %d: %w", i, err))
+		}
+	}
+
+	if e.When != "" {
+		if _, err := parser.ParseExpr("when", e.When); err != nil {
+			errs = append(errs, fmt.Errorf("invalid when expression: %w", err))
+		}
+	}
+
+	if e.Options.CompositeReady != "" {
+		if _, err := parser.ParseExpr("compositeReady", e.Options.CompositeReady); err != nil {
+			errs = append(errs, fmt.Errorf("invalid compositeReady expression: %w", err))
+		}
+	}
+
+	for name := range e.Libraries {
+		if !isRelativePath(name) || strings.Contains(name, "/") || path.Ext(name) != ".cue" {
+			errs = append(errs, fmt.Errorf("invalid library name %q: must be a file name ending in .cue", name))
+		}
+	}
+
+	for i, r := range e.Options.Registries {
+		if r.URL == "" {
+			errs = append(errs, fmt.Errorf("invalid registry at index %d: url is required", i))
+		}
+		if r.CredentialsRef != nil && (r.CredentialsRef.Name == "" || strings.ContainsAny(r.CredentialsRef.Name, `/\`) || strings.HasPrefix(r.CredentialsRef.Name, ".")) {
+			errs = append(errs, fmt.Errorf("invalid registry at index %d: invalid credentialsRef name %q", i, r.CredentialsRef.Name))
+		}
+	}
+
+	for i, k := range e.Options.MatchBy {
+		switch k {
+		case MatchAPIVersion, MatchKind, MatchName, MatchLabels, MatchAnnotations, MatchResourceName:
+		default:
+			errs = append(errs, fmt.Errorf("invalid matchBy at index %d: unknown key %q", i, k))
+		}
+	}
+
+	if e.Options.Path != "" {
+		if err := cue.ParsePath(e.Options.Path).Err(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid path %q: %w", e.Options.Path, err))
+		}
+	}
+
+	if o := e.Options.KubernetesObject; o != nil {
+		if err := o.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid kubernetesObject: %w", err))
+		}
+	}
+
+	if d := e.Options.Defaults; d != nil {
+		if err := d.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid defaults: %w", err))
+		}
+	}
+
+	if n := e.Options.ExternalName; n != nil {
+		if n.Template == "" {
+			errs = append(errs, errors.New("invalid externalName: template cannot be empty"))
+		} else if _, err := parser.ParseExpr("externalName.template", n.Template); err != nil {
+			errs = append(errs, fmt.Errorf("invalid externalName template: %w", err))
+		}
+	}
+
+	if p := e.Options.PropagateMetadata; p != nil {
+		if err := p.Labels.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid propagateMetadata labels: %w", err))
+		}
+		if err := p.Annotations.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid propagateMetadata annotations: %w", err))
+		}
+	}
+
+	if v := e.Options.Values; v != nil && len(v.Raw) != 0 {
+		var values map[string]interface{}
+		if err := json.Unmarshal(v.Raw, &values); err != nil {
+			errs = append(errs, fmt.Errorf("invalid values: must be an object: %w", err))
+		}
+	}
+
+	if e.Options.Timeout != nil && e.Options.Timeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("invalid timeout %s: must be positive", e.Options.Timeout.Duration))
+	}
+	if e.Options.TTL != nil && e.Options.TTL.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("invalid ttl %s: must be positive", e.Options.TTL.Duration))
 	}
 
-	switch in.Export.Target {
+	switch e.Options.MergeStrategy {
+	case "", MergeLeaf, MergeStrategic, MergeJSONPatch, MergeReplace:
+	default:
+		errs = append(errs, fmt.Errorf("invalid mergeStrategy %q", e.Options.MergeStrategy))
+	}
+
+	if l := e.Options.ListMerge; l != nil {
+		switch l.Strategy {
+		case "", ListMergeIndex, ListMergeReplace, ListMergeKey, ListMergeAppend:
+		default:
+			errs = append(errs, fmt.Errorf("invalid listMerge strategy %q", l.Strategy))
+		}
+		if l.Key != "" && l.Strategy != ListMergeKey {
+			errs = append(errs, fmt.Errorf("invalid listMerge key %q: only used by the %s strategy", l.Key, ListMergeKey))
+		}
+	}
+
+	switch e.Options.UnmatchedPolicy {
+	case "", UnmatchedError, UnmatchedSkip, UnmatchedCreate:
+	default:
+		errs = append(errs, fmt.Errorf("invalid unmatchedPolicy %q", e.Options.UnmatchedPolicy))
+	}
+
+	switch e.Options.ResultsMode {
+	case "", ResultsPerResource, ResultsSummary, ResultsNone:
+	default:
+		errs = append(errs, fmt.Errorf("invalid resultsMode %q: must be perResource, summary or none", e.Options.ResultsMode))
+	}
+
+	switch e.Options.ResultsTarget {
+	case "", ResultsTargetComposite, ResultsTargetCompositeAndClaim:
+	default:
+		errs = append(errs, fmt.Errorf("invalid resultsTarget %q: must be Composite or CompositeAndClaim", e.Options.ResultsTarget))
+	}
+
+	switch e.Options.Evaluator {
+	case "", EvaluatorV2:
+	default:
+		errs = append(errs, fmt.Errorf("invalid evaluator %q: must be v2", e.Options.Evaluator))
+	}
+
+	switch e.Options.ValidationPolicy {
+	case "", SchemaValidationWarning, SchemaValidationFatal, SchemaValidationIgnore:
+	default:
+		errs = append(errs, fmt.Errorf("invalid validationPolicy %q: must be Warning, Fatal or Ignore", e.Options.ValidationPolicy))
+	}
+
+	switch e.Options.Format {
+	case "", ExportFormatObject, ExportFormatList, ExportFormatFields, ExportFormatStream:
+	default:
+		errs = append(errs, fmt.Errorf("invalid format %q: must be object, list, fields or stream", e.Options.Format))
+	}
+
+	for i, t := range e.Options.Inject {
+		if (t.Path == "") == (t.CEL == "") {
+			errs = append(errs, fmt.Errorf("invalid inject at index %d: exactly one of path or cel is required", i))
+		} else if t.Path != "" {
+			if _, err := fieldpath.Parse(t.Path); err != nil {
+				errs = append(errs, fmt.Errorf("invalid inject at index %d: invalid path %q: %w", i, t.Path, err))
+			}
+		}
+		switch t.Source {
+		case "", TagSourceXR, TagSourceContext, TagSourceEnvironment:
+		case TagSourceResource:
+			if t.ResourceName == "" {
+				errs = append(errs, fmt.Errorf("invalid inject at index %d: the resource source requires a resourceName", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("invalid inject at index %d: unknown source %q", i, t.Source))
+		}
+		if t.ResourceName != "" && t.Source != TagSourceResource {
+			errs = append(errs, fmt.Errorf("invalid inject at index %d: resourceName is only supported with the resource source", i))
+		}
+		switch t.Type {
+		case "", TagTypeString, TagTypeInt, TagTypeBool, TagTypeNumber, TagTypeJSON:
+		default:
+			errs = append(errs, fmt.Errorf("invalid inject at index %d: unknown type %q", i, t.Type))
+		}
+	}
+
+	if e.Target == Validate {
+		if err := e.validateValidation(); err != nil {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+	if err := validateTarget(e.Target); err != nil {
+		errs = append(errs, err)
+	}
+	switch e.ImmutableFields {
+	case "", ImmutableFieldsReject, ImmutableFieldsIgnore:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("immutableFields"), e.ImmutableFields, []string{string(ImmutableFieldsReject), string(ImmutableFieldsIgnore)}))
+	}
+	contextTarget := e.Target == Context
+	for i, r := range e.Routes {
+		if err := validateTarget(r.Target); err != nil {
+			errs = append(errs, fmt.Errorf("invalid route at index %d: %w", i, err))
+		}
+		contextTarget = contextTarget || r.Target == Context
+	}
+	for i, x := range e.Expressions {
+		if x.Target == "" {
+			continue
+		}
+		if err := validateTarget(x.Target); err != nil {
+			errs = append(errs, fmt.Errorf("invalid expression at index %d: %w", i, err))
+		}
+		contextTarget = contextTarget || x.Target == Context
+	}
+	if contextTarget && e.ContextKey == "" {
+		errs = append(errs, field.Required(field.NewPath("contextKey"), "the Context target requires a contextKey"))
+	}
+	if e.patchesResources() && len(e.Resources) == 0 {
+		errs = append(errs, field.Required(field.NewPath("resources"), "the PatchResources target requires resources"))
+	}
+	for i, r := range e.Resources {
+		if r.Base == nil || len(r.Base.Raw) == 0 {
+			errs = append(errs, field.Required(field.NewPath("resources").Index(i).Child("base"), "each resource requires a base"))
+		}
+	}
+	switch e.Options.ResourceKey {
+	case "", ResourceKeyMetadataName:
+	case ResourceKeyName:
+		names := make(map[string]bool, len(e.Resources))
+		for i, r := range e.Resources {
+			p := field.NewPath("resources").Index(i).Child("name")
+			switch {
+			case r.Name == "":
+				errs = append(errs, field.Required(p, "the name resource key requires the name of each resource"))
+			case names[r.Name]:
+				errs = append(errs, field.Duplicate(p, r.Name))
+			}
+			names[r.Name] = true
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid resourceKey %q", e.Options.ResourceKey))
+	}
+
+	return errs
+}
+
+// patchesResources returns whether the export, one of its routes or one of
+// its expressions targets PatchResources
+func (e Export) patchesResources() bool {
+	if e.Target == PatchResources {
+		return true
+	}
+	for _, r := range e.Routes {
+		if r.Target == PatchResources {
+			return true
+		}
+	}
+	for _, x := range e.Expressions {
+		if x.Target == PatchResources {
+			return true
+		}
+	}
+	return false
+}
+
+func validateTarget(t Target) error {
+	switch t {
 	// Allowed targets
-	case PatchDesired, PatchResources, Resources, XR:
+	case Context, PatchDesired, PatchResources, Resources, XR, XRStatus:
 	default:
-		return field.Required(field.NewPath("type"), fmt.Sprintf("invalid target %s", in.Export.Target))
+		return field.Required(field.NewPath("type"), fmt.Sprintf("invalid target %s", t))
 	}
+	return nil
+}
 
+// validateValidation checks the input of the Validate target, the schema
+// cannot be a module and its documents cannot be routed
+func (e Export) validateValidation() error {
+	if e.Module != nil {
+		return errors.New("the Validate target requires a value or templateRef")
+	}
+	if len(e.Routes) != 0 {
+		return errors.New("the Validate target does not support routes")
+	}
+	switch e.ValidationSeverity {
+	case "", ValidationFatal, ValidationWarning:
+	default:
+		return field.NotSupported(field.NewPath("validationSeverity"), e.ValidationSeverity, []string{string(ValidationFatal), string(ValidationWarning)})
+	}
 	return nil
 }
 
 type Target string
 
 const (
+	// Context writes the compiled output into the function pipeline context
+	// under CUEInput.Export.ContextKey
+	Context Target = "Context"
 	// PatchDesired targets existing Resources on the Desired XR
 	PatchDesired Target = "PatchDesired"
 	// PatchResources targets existing CUEInput.Export.Resources
@@ -53,43 +422,417 @@ const (
 	Resources Target = "Resources"
 	// XR targets the existing Observed XR itself
 	XR Target = "XR"
+	// XRStatus targets the status of the XR, the documents cannot set any
+	// other field of the XR
+	XRStatus Target = "XRStatus"
+	// Validate unifies the Observed XR with the cue value as a schema and
+	// returns its violations as results, without changing the desired state
+	Validate Target = "Validate"
+)
+
+// ValidationSeverity is the severity of the results returned for the
+// violations of the Validate target
+type ValidationSeverity string
+
+const (
+	// ValidationFatal violations fail the pipeline
+	ValidationFatal ValidationSeverity = "Fatal"
+	// ValidationWarning violations are returned as warnings
+	ValidationWarning ValidationSeverity = "Warning"
+)
+
+// ImmutableFieldsPolicy determines how changes to the immutable fields of the
+// XR are handled
+type ImmutableFieldsPolicy string
+
+const (
+	// ImmutableFieldsReject fails the function when a document changes an
+	// immutable field of the XR
+	ImmutableFieldsReject ImmutableFieldsPolicy = "Reject"
+	// ImmutableFieldsIgnore drops the changes to the immutable fields of the
+	// XR from the documents
+	ImmutableFieldsIgnore ImmutableFieldsPolicy = "Ignore"
 )
 
 // Export contains the export data
 type Export struct {
+	// ContextKey is the key of the pipeline context the compiled output is
+	// written to, this is required when a Target is set to Context
+	// +optional
+	ContextKey string `json:"contextKey,omitempty"`
+	// Expressions are exported in place of options.expressions, each to a
+	// target of its own, so one evaluation of the template can patch the XR
+	// and create resources
+	// +optional
+	Expressions []Expression `json:"expressions,omitempty"`
+	// ImmutableFields determines how the documents of the XR target changing
+	// the apiVersion, kind, metadata.name, spec.resourceRefs or spec.claimRef
+	// of the XR are handled
+	// +kubebuilder:default:=Reject
+	// +kubebuilder:validation:Enum:=Reject;Ignore
+	// +optional
+	ImmutableFields ImmutableFieldsPolicy `json:"immutableFields,omitempty"`
 	// Options for `cue export`
 	Options ExportOptions `json:"options,omitempty"`
+	// Overrides are unified with the compiled documents they match before
+	// the documents are applied to their target
+	// +optional
+	Overrides []Override `json:"overrides,omitempty"`
 	// Overwrite determines if the output should attempt to overwrite existing value
 	// +kubebuilder:default:=false
 	Overwrite bool `json:"overwrite,omitempty"`
+	// Prune deletes the desired composed resources created by this input in
+	// an earlier reconcile that the template no longer generates, the
+	// resources the input creates are annotated with its name to track them
+	// +optional
+	Prune bool `json:"prune,omitempty"`
 	// Resources is a list of resources to patch and create
 	// This is utilized when a Target is set to PatchResources
 	Resources ResourceList `json:"resources,omitempty"`
+	// Routes send the compiled documents they match to their own target
+	// Documents that match no route are sent to Target
+	// +optional
+	Routes []Route `json:"routes,omitempty"`
 	// Target determines what object the export output should be applied to
 	// +kubebuilder:default:=Resources
-	// +kubebuilder:validation:Enum:=PatchDesired;PatchResources;Resources;XR
+	// +kubebuilder:validation:Enum:=Context;PatchDesired;PatchResources;Resources;Validate;XR;XRStatus
 	Target Target `json:"target,required"`
+	// Transform is a CUE expression evaluated against the compiled documents
+	// before overrides and targeting, the documents are available as #documents
+	// and the expression must evaluate to a list of documents
+	// +optional
+	Transform string `json:"transform,omitempty"`
+	// When is a CUE expression evaluated against the observed state, the
+	// pipeline context and the request metadata, available as #observed,
+	// #context and #meta, the export only runs when it evaluates to true
+	// +optional
+	When string `json:"when,omitempty"`
+	// TemplateRef references a named template registered with the function
+	// This is used in place of Value
+	// +optional
+	TemplateRef *TemplateRef `json:"templateRef,omitempty"`
+	// ValueFrom references the source of the cue value in a ConfigMap or a
+	// git repository
+	// This is used in place of Value
+	// +optional
+	ValueFrom *ValueFrom `json:"valueFrom,omitempty"`
+	// Module is a CUE module with multiple files and imports
+	// This is used in place of Value
+	// +optional
+	Module *Module `json:"module,omitempty"`
+	// Libraries are CUE files keyed by their file name, such as helpers.cue,
+	// compiled alongside the value or the referenced template in the same
+	// package, so that shared definitions can be factored out of the value
+	// +optional
+	Libraries map[string]string `json:"libraries,omitempty"`
+	// ValidationSeverity is the severity of the results returned for the
+	// violations of the Validate target
+	// +kubebuilder:default:=Fatal
+	// +kubebuilder:validation:Enum:=Fatal;Warning
+	// +optional
+	ValidationSeverity ValidationSeverity `json:"validationSeverity,omitempty"`
 	// Value is the string representation of the cue value to run `cue export` against
-	Value string `json:"value,required"`
+	// It may also be a list of lines which are joined with newlines
+	// +optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Value Value `json:"value,omitempty"`
+}
+
+// Module is a CUE module compiled in place of an inline value
+type Module struct {
+	// Files of the module keyed by their slash separated path relative to the
+	// module root, they must include cue.mod/module.cue
+	Files map[string]string `json:"files"`
+	// Package is the directory of the package to export relative to the module root
+	// The package at the module root is exported by default
+	// +optional
+	Package string `json:"package,omitempty"`
+	// Digests pins the module zips of the dependencies fetched from the
+	// registries, keyed by module path and version such as
+	// example.org/schemas@v0.2.0, to their sha256:<hex> digest
+	// +optional
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// moduleFile is the file declaring a CUE module
+const moduleFile = "cue.mod/module.cue"
+
+// Validate the module files and package
+func (m Module) Validate() error {
+	if _, ok := m.Files[moduleFile]; !ok {
+		return fmt.Errorf("module requires a %s file", moduleFile)
+	}
+	for p := range m.Files {
+		if !isRelativePath(p) {
+			return fmt.Errorf("invalid module file path %q: must be a clean relative path inside the module", p)
+		}
+	}
+	if m.Package != "" && !isRelativePath(m.Package) {
+		return fmt.Errorf("invalid module package %q: must be a clean relative path inside the module", m.Package)
+	}
+	for dep, digest := range m.Digests {
+		if modPath, version, ok := strings.Cut(dep, "@"); !ok || modPath == "" || version == "" {
+			return fmt.Errorf("invalid module digest key %q: must be a module path and version such as example.org/schemas@v0.2.0", dep)
+		}
+		if !isDigest(digest) {
+			return fmt.Errorf("invalid digest %q of module %s: must be sha256:<hex>", digest, dep)
+		}
+	}
+	return nil
+}
+
+// isRelativePath returns whether p is a clean slash separated path that stays
+// inside the directory it is relative to
+func isRelativePath(p string) bool {
+	return p != "" && !path.IsAbs(p) && path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// isDigest returns whether d is a sha256 digest in sha256:<hex> form
+func isDigest(d string) bool {
+	sum, ok := strings.CutPrefix(d, "sha256:")
+	if !ok || len(sum) != 64 {
+		return false
+	}
+	for _, c := range sum {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Value is a cue value, in yaml it is either a single string or a list of lines
+// which is easier to maintain and review than one long escaped string
+type Value string
+
+// UnmarshalJSON unmarshals either a string or a list of lines joined with newlines
+func (v *Value) UnmarshalJSON(b []byte) error {
+	var lines []string
+	if err := json.Unmarshal(b, &lines); err == nil {
+		*v = Value(strings.Join(lines, "\n"))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("value must be a string or a list of strings: %w", err)
+	}
+	*v = Value(s)
+	return nil
+}
+
+// Override is a CUE or JSON value unified with the compiled documents it matches
+type Override struct {
+	// Match selects the documents the override is unified with
+	// +optional
+	Match RouteMatch `json:"match,omitempty"`
+	// Value is the CUE or JSON value to unify with the matched documents
+	Value string `json:"value"`
+}
+
+// Expression is an expression of the template exported to a target of its own
+type Expression struct {
+	// Name of the expression, used in the results and errors of its
+	// documents, names are unique within the export
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Expr is the CUE expression, such as the name of a field of the template
+	Expr string `json:"expr"`
+	// Target the documents of the expression are applied to, the documents
+	// are sent to the routes and the target of the export when it is not set
+	// +kubebuilder:validation:Enum:=Context;PatchDesired;PatchResources;Resources;XR;XRStatus
+	// +optional
+	Target Target `json:"target,omitempty"`
+}
+
+// Route sends the compiled documents it matches to a target
+type Route struct {
+	// Match selects the documents sent to Target
+	Match RouteMatch `json:"match"`
+	// Target the matched documents are applied to
+	// +kubebuilder:validation:Enum:=Context;PatchDesired;PatchResources;Resources;XR;XRStatus
+	Target Target `json:"target"`
+}
+
+// RouteMatch selects compiled documents, empty fields match any value
+type RouteMatch struct {
+	// APIVersion of the document
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Kind of the document
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// Name of the document
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// Matches returns true if the document apiVersion, kind and name match
+func (m RouteMatch) Matches(apiVersion, kind, name string) bool {
+	return (m.APIVersion == "" || m.APIVersion == apiVersion) &&
+		(m.Kind == "" || m.Kind == kind) &&
+		(m.Name == "" || m.Name == name)
+}
+
+// TemplateRef references a named template version registered with the function at startup
+type TemplateRef struct {
+	// Name of the registered template
+	Name string `json:"name"`
+	// Version of the registered template
+	Version string `json:"version"`
+	// Digest pins the template to the sha256:<hex> digest of its content, a
+	// template that does not match is not compiled
+	// +optional
+	Digest string `json:"digest,omitempty"`
+}
+
+// ValueFrom references the source of the cue value of an export, exactly one
+// source is set
+type ValueFrom struct {
+	// ConfigMapRef references a key of a ConfigMap holding the cue value
+	// +optional
+	ConfigMapRef *ConfigMapKeyRef `json:"configMapRef,omitempty"`
+	// Git references a file of a git repository holding the cue value
+	// +optional
+	Git *GitRef `json:"git,omitempty"`
+	// Digest pins the referenced value to its sha256:<hex> digest, a value
+	// that does not match is not compiled
+	// +optional
+	Digest string `json:"digest,omitempty"`
+}
+
+// Validate the reference of the value
+func (v ValueFrom) Validate() error {
+	if (v.ConfigMapRef == nil) == (v.Git == nil) {
+		return field.Required(field.NewPath("valueFrom"), "valueFrom requires exactly one of configMapRef or git")
+	}
+	if r := v.ConfigMapRef; r != nil && (r.Namespace == "" || r.Name == "" || r.Key == "") {
+		return field.Required(field.NewPath("valueFrom", "configMapRef"), "configMapRef requires a namespace, name and key")
+	}
+	if g := v.Git; g != nil {
+		if g.URL == "" || g.Path == "" {
+			return field.Required(field.NewPath("valueFrom", "git"), "git requires a url and path")
+		}
+		if !isRelativePath(g.Path) {
+			return fmt.Errorf("invalid git path %q: must be a clean relative path inside the repository", g.Path)
+		}
+	}
+	if v.Digest != "" && !isDigest(v.Digest) {
+		return fmt.Errorf("invalid valueFrom digest %q: must be sha256:<hex>", v.Digest)
+	}
+	return nil
+}
+
+// GitRef references a file of a git repository
+type GitRef struct {
+	// URL of the repository, fetched over the smart HTTP protocol, e.g.
+	// https://github.com/example/templates.git
+	URL string `json:"url"`
+	// Revision of the repository, a branch, a tag or a full commit SHA
+	// The default branch of the repository is used by default
+	// +optional
+	Revision string `json:"revision,omitempty"`
+	// Path of the file relative to the root of the repository
+	Path string `json:"path"`
+	// CredentialsRef references the credentials for the repository
+	// +optional
+	CredentialsRef *CredentialsRef `json:"credentialsRef,omitempty"`
+}
+
+// ConfigMapKeyRef references a key of a ConfigMap
+type ConfigMapKeyRef struct {
+	// Namespace of the ConfigMap
+	Namespace string `json:"namespace"`
+	// Name of the ConfigMap
+	Name string `json:"name"`
+	// Key of the ConfigMap data holding the cue value
+	Key string `json:"key"`
 }
 
 type ExportOptions struct {
+	// AllowIncomplete skips the documents holding non-concrete values with a
+	// warning listing their non-concrete paths instead of failing the
+	// compilation
+	// +optional
+	AllowIncomplete bool `json:"allowIncomplete,omitempty"`
+	// AutoReady marks the composed resources the export adds to the desired
+	// state ready when their observed resource has a true Ready condition,
+	// resources with readiness checks are only ready when the checks pass
+	// +optional
+	AutoReady bool `json:"autoReady,omitempty"`
+	// CompositeReady is a CUE expression evaluated against the observed
+	// state, the pipeline context and the request metadata, available as
+	// #observed, #context and #meta, its bool value sets the readiness of the
+	// composite resource
+	// +optional
+	CompositeReady string `json:"compositeReady,omitempty"`
+	// Defaults are defaulted into the managed resources the export
+	// generates, the fields a resource sets keep their values
+	// +optional
+	Defaults *ResourceDefaults `json:"defaults,omitempty"`
+	// Diff reports the changes the export makes to the desired state as
+	// results instead of applying them, the desired state is passed on as it
+	// was
+	// +optional
+	Diff bool `json:"diff,omitempty"`
+	// Evaluator is the CUE evaluator the template is evaluated with, so a
+	// template can be pinned to an evaluator before the default changes. The
+	// function is built with CUE v0.6, which only has the v2 evaluator
+	// +optional
+	Evaluator CUEEvaluator `json:"evaluator,omitempty"`
 	// Escape use HTML escaping
 	Escape bool `json:"escape,omitempty"`
 	// Expression export only this expression
 	// +kubebuilder:default:=[]
 	Expressions []string `json:"expressions"`
+	// ExternalName sets the crossplane.io/external-name annotation of the
+	// composed resources the export generates, a resource that sets the
+	// annotation keeps its value
+	// +optional
+	ExternalName *ExternalName `json:"externalName,omitempty"`
 	// Force overwriting existing files
 	Force bool `json:"force,omitempty"`
+	// Format of the documents the expressions evaluate to, the documents are
+	// inferred from the kind of each value when it is not set
+	// +optional
+	Format ExportFormat `json:"format,omitempty"`
 	// Inject set the value of a tagged field
 	// +kubebuilder:default:=[]
 	Inject []Tag `json:"inject"`
+	// InjectNow inject the evaluation time into the #now definition as an RFC 3339 timestamp
+	InjectNow bool `json:"inject_now,omitempty"`
+	// InjectRequest inject the whole RunFunctionRequest, including its
+	// observed and desired state, context and input, into the #request
+	// definition as its json representation
+	// +optional
+	InjectRequest bool `json:"injectRequest,omitempty"`
 	// InjectVars inject system variables in tags
 	InjectVars []string `json:"inject_vars,omitempty"`
+	// KubernetesObject wraps the documents the export generates into
+	// provider-kubernetes Objects, so plain Kubernetes manifests can be
+	// composed
+	// +optional
+	KubernetesObject *KubernetesObject `json:"kubernetesObject,omitempty"`
 	// List concatenate multiple objects into a list
 	List bool `json:"list,omitempty"`
+	// ListMerge determines how the lists of the documents are merged into
+	// the lists the desired resources and the XR already set, with the leaf
+	// merge strategy and the XR and XRStatus targets
+	// +optional
+	ListMerge *ListMerge `json:"listMerge,omitempty"`
+	// MatchBy are the keys the documents of the PatchDesired and
+	// PatchResources targets are matched to desired resources by, a document
+	// patches every desired resource it matches on all of the keys
+	// Documents are matched by APIVersion, Kind and Name by default
+	// +optional
+	MatchBy []MatchKey `json:"matchBy,omitempty"`
 	// Merge non-CUE files (default true)
 	Merge bool `json:"merge,omitempty"`
+	// MergeStrategy determines how the documents of the PatchDesired and
+	// PatchResources targets are merged into the desired resources they match
+	// +kubebuilder:default:=leaf
+	// +optional
+	MergeStrategy MergeStrategy `json:"mergeStrategy,omitempty"`
 	// Name glob filter for non-CUE file names in directories
 	Name string `json:"name,omitempty"`
 	// Out output format (see cue filetypes) for more information
@@ -98,25 +841,516 @@ type ExportOptions struct {
 	Outfile string `json:"outfile,omitempty"`
 	// Package name for non-CUE files
 	Package string `json:"package,omitempty"`
-	// Path CUE expression for single path component
-	Path []string `json:"path,omitempty"`
+	// Path of the sub-value of the template to export, such as
+	// resources.storage, so that a template shared by several pipeline steps
+	// exports a different subtree in each step. Expressions are evaluated in
+	// the scope of the sub-value
+	// +optional
+	Path string `json:"path,omitempty"`
+	// PropagateMetadata copies the labels and annotations of the observed XR
+	// onto the composed resources the export generates, a label or
+	// annotation the resource sets keeps its value
+	// +optional
+	PropagateMetadata *PropagateMetadata `json:"propagateMetadata,omitempty"`
 	// ProtoEnum mode for rendering enums (int|json)
 	ProtoEnum string `json:"proto_enum,omitempty"`
 	// ProtoPath paths in which to search for imports
 	ProtoPath []string `json:"proto_path,omitempty"`
+	// Registries are the OCI registries the dependencies declared in the
+	// cue.mod/module.cue of Module are fetched from
+	// +optional
+	Registries []Registry `json:"registries,omitempty"`
+	// ResourceKey determines the names the bases of the PatchResources target
+	// are added to the desired resources as, their metadata.name by default
+	// or the name of their resource like the resources of a Composition
+	// +kubebuilder:default:=metadataName
+	// +optional
+	ResourceKey ResourceKey `json:"resourceKey,omitempty"`
+	// ResultsMode determines the normal results returned for the objects the
+	// export creates or updates, one per object, a summary of each action or
+	// none
+	// +kubebuilder:default:=perResource
+	// +optional
+	ResultsMode ResultsMode `json:"resultsMode,omitempty"`
+	// ResultsTarget determines whether the results of the export are
+	// surfaced on the composite resource only or on its claim too, so that
+	// the warnings of a template reach the teams using the claim
+	// +kubebuilder:default:=Composite
+	// +optional
+	ResultsTarget ResultsTarget `json:"resultsTarget,omitempty"`
 	// Schema expression to select schema for evaluating values in non-CUE files
 	Schema string `json:"schema,omitempty"`
+	// Timeout of the evaluation of the template, it can only shorten the
+	// --cue-eval-timeout of the function
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// TTL is how long Crossplane may cache the response of the function, the
+	// shortest TTL of the exports of an input is used
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// UnmatchedPolicy determines how the documents of the PatchDesired and
+	// PatchResources targets that match no desired resource are handled
+	// +kubebuilder:default:=error
+	// +optional
+	UnmatchedPolicy UnmatchedPolicy `json:"unmatchedPolicy,omitempty"`
+	// Validate is CUE source declaring definitions the generated documents are
+	// vetted against, a document is vetted against the definition named after
+	// its kind, e.g. #Deployment, and documents of other kinds are not vetted
+	// +optional
+	Validate string `json:"validate,omitempty"`
+	// ValidationPolicy determines how the generated resources violating the
+	// schemas of the CRDs loaded by the function are reported, as warnings,
+	// as a fatal result or not at all
+	// +kubebuilder:default:=Warning
+	// +optional
+	ValidationPolicy SchemaValidationPolicy `json:"validationPolicy,omitempty"`
+	// Values is an object unified into the #values definition of the
+	// template, so a shared template can be customized by each composition
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +optional
+	Values *runtime.RawExtension `json:"values,omitempty"`
 	// WithContext import as object with contextual data
 	WithContext bool `json:"with_context,omitempty"`
 }
 
+// KubernetesObject configures the provider-kubernetes Objects the generated
+// documents are wrapped into
+type KubernetesObject struct {
+	// Match selects the wrapped documents, every document by default
+	// +optional
+	Match RouteMatch `json:"match,omitempty"`
+	// ProviderConfigRef of the Objects
+	// +optional
+	ProviderConfigRef *ProviderConfigRef `json:"providerConfigRef,omitempty"`
+	// ReadinessPolicy of the Objects, the policy of provider-kubernetes by
+	// default
+	// +kubebuilder:validation:Enum:=SuccessfulCreate;DeriveFromObject;AllTrue
+	// +optional
+	ReadinessPolicy string `json:"readinessPolicy,omitempty"`
+}
+
+// Validate the Object options
+func (o KubernetesObject) Validate() error {
+	switch o.ReadinessPolicy {
+	case "", "SuccessfulCreate", "DeriveFromObject", "AllTrue":
+	default:
+		return fmt.Errorf("unknown readinessPolicy %q", o.ReadinessPolicy)
+	}
+	if o.ProviderConfigRef != nil && o.ProviderConfigRef.Name == "" {
+		return errors.New("providerConfigRef name cannot be empty")
+	}
+	return nil
+}
+
+// ResourceDefaults are the policies defaulted into the generated managed
+// resources, resources holding a spec.forProvider
+type ResourceDefaults struct {
+	// DeletionPolicy of the managed resources
+	// +kubebuilder:validation:Enum:=Delete;Orphan
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// ManagementPolicies of the managed resources
+	// +optional
+	ManagementPolicies []ManagementAction `json:"managementPolicies,omitempty"`
+	// ProviderConfigRef of the managed resources
+	// +optional
+	ProviderConfigRef *ProviderConfigRef `json:"providerConfigRef,omitempty"`
+}
+
+// Validate the policies of the defaults
+func (d ResourceDefaults) Validate() error {
+	switch d.DeletionPolicy {
+	case "", "Delete", "Orphan":
+	default:
+		return fmt.Errorf("unknown deletionPolicy %q", d.DeletionPolicy)
+	}
+	for i, a := range d.ManagementPolicies {
+		switch a {
+		case ManagementAll, ManagementObserve, ManagementCreate, ManagementUpdate, ManagementDelete, ManagementLateInitialize:
+		default:
+			return fmt.Errorf("unknown managementPolicies action %q at index %d", a, i)
+		}
+	}
+	if d.ProviderConfigRef != nil && d.ProviderConfigRef.Name == "" {
+		return errors.New("providerConfigRef name cannot be empty")
+	}
+	return nil
+}
+
+// ManagementAction is an action a managed resource is allowed to take
+// +kubebuilder:validation:Enum:=Observe;Create;Update;Delete;LateInitialize;*
+type ManagementAction string
+
+const (
+	// ManagementAll allows every action
+	ManagementAll ManagementAction = "*"
+	// ManagementObserve allows observing the external resource
+	ManagementObserve ManagementAction = "Observe"
+	// ManagementCreate allows creating the external resource
+	ManagementCreate ManagementAction = "Create"
+	// ManagementUpdate allows updating the external resource
+	ManagementUpdate ManagementAction = "Update"
+	// ManagementDelete allows deleting the external resource
+	ManagementDelete ManagementAction = "Delete"
+	// ManagementLateInitialize allows late initializing the managed resource
+	ManagementLateInitialize ManagementAction = "LateInitialize"
+)
+
+// ProviderConfigRef references the ProviderConfig of a managed resource
+type ProviderConfigRef struct {
+	// Name of the ProviderConfig
+	Name string `json:"name"`
+}
+
+// ExternalName templates the external name of the generated composed resources
+type ExternalName struct {
+	// Template is a CUE expression evaluating to the external name, such as
+	// "\(xr.metadata.name)-\(resource.metadata.name)". The observed XR is in
+	// scope as xr and the generated resource as resource
+	Template string `json:"template"`
+}
+
+// PropagateMetadata selects the labels and annotations of the XR that are
+// propagated onto the generated composed resources
+type PropagateMetadata struct {
+	// Labels selects the propagated labels, every label by default
+	// +optional
+	Labels MetadataFilter `json:"labels,omitempty"`
+	// Annotations selects the propagated annotations, every annotation by
+	// default
+	// +optional
+	Annotations MetadataFilter `json:"annotations,omitempty"`
+}
+
+// MetadataFilter selects label or annotation keys by patterns in which *
+// matches any characters, such as example.org/*
+type MetadataFilter struct {
+	// Include are the patterns of the selected keys, every key is selected
+	// when it is empty
+	// +optional
+	Include []string `json:"include,omitempty"`
+	// Exclude are the patterns of the keys that are not selected even when
+	// they are included
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Validate the patterns of the filter
+func (f MetadataFilter) Validate() error {
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if p == "" {
+			return errors.New("patterns cannot be empty")
+		}
+	}
+	return nil
+}
+
+// MatchKey is a key documents are matched to desired resources by
+// +kubebuilder:validation:Enum:=APIVersion;Kind;Name;Labels;Annotations;ResourceName
+type MatchKey string
+
+const (
+	// MatchAPIVersion matches the apiVersion of the document
+	MatchAPIVersion MatchKey = "APIVersion"
+	// MatchKind matches the kind of the document
+	MatchKind MatchKey = "Kind"
+	// MatchName matches the metadata.name of the document
+	MatchName MatchKey = "Name"
+	// MatchLabels matches resources with every label of the document
+	MatchLabels MatchKey = "Labels"
+	// MatchAnnotations matches resources with every annotation of the document
+	MatchAnnotations MatchKey = "Annotations"
+	// MatchResourceName matches the resource named by the
+	// crossplane.io/composition-resource-name annotation of the document
+	MatchResourceName MatchKey = "ResourceName"
+)
+
+// DefaultMatchBy are the keys documents are matched by when MatchBy is not set
+var DefaultMatchBy = []MatchKey{MatchAPIVersion, MatchKind, MatchName}
+
+// ExportFormat is the format of the documents an expression evaluates to
+// +kubebuilder:validation:Enum:=object;list;fields;stream
+type ExportFormat string
+
+const (
+	// ExportFormatObject is a struct that is a single document
+	ExportFormatObject ExportFormat = "object"
+	// ExportFormatList is a list of documents
+	ExportFormatList ExportFormat = "list"
+	// ExportFormatFields is a struct holding a document per field
+	ExportFormatFields ExportFormat = "fields"
+	// ExportFormatStream is a string holding a stream of json or yaml
+	// documents, or a call of json.MarshalStream, yaml.MarshalStream,
+	// json.Marshal or yaml.Marshal whose value is decoded instead
+	ExportFormatStream ExportFormat = "stream"
+)
+
+// MergeStrategy is a strategy documents are merged into desired resources with
+// +kubebuilder:validation:Enum:=leaf;strategicMerge;jsonPatch;replace
+type MergeStrategy string
+
+const (
+	// MergeLeaf sets each leaf field of the document on the resource, a field
+	// the resource already sets to another value conflicts unless Overwrite
+	// is set
+	MergeLeaf MergeStrategy = "leaf"
+	// MergeStrategic merges objects recursively and lists of objects by their
+	// name field, a null value of the document deletes the field of the
+	// resource and other values replace those of the resource
+	MergeStrategic MergeStrategy = "strategicMerge"
+	// MergeJSONPatch applies the RFC 6902 JSON patch in the jsonPatch field of
+	// the document to the resource
+	MergeJSONPatch MergeStrategy = "jsonPatch"
+	// MergeReplace replaces the resource with the document
+	MergeReplace MergeStrategy = "replace"
+)
+
+// ListMerge determines how a list of a document is merged into the list an
+// object already sets at the same path
+type ListMerge struct {
+	// Strategy is the strategy lists are merged with
+	// +kubebuilder:default:=index
+	// +optional
+	Strategy ListMergeStrategy `json:"strategy,omitempty"`
+	// Key is the field the items of lists are matched by with the key
+	// strategy, name by default
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// ListMergeStrategy is a strategy lists are merged into existing lists with
+// +kubebuilder:validation:Enum:=index;replace;key;append
+type ListMergeStrategy string
+
+const (
+	// ListMergeIndex sets each item of the list on the item of the existing
+	// list at the same index, items of a longer existing list are kept
+	ListMergeIndex ListMergeStrategy = "index"
+	// ListMergeReplace sets the list as a whole, like a leaf value
+	ListMergeReplace ListMergeStrategy = "replace"
+	// ListMergeKey merges the objects of the list into the objects of the
+	// existing list with the same key field, objects without a match are
+	// appended
+	ListMergeKey ListMergeStrategy = "key"
+	// ListMergeAppend appends the items of the list the existing list does not
+	// already hold
+	ListMergeAppend ListMergeStrategy = "append"
+)
+
+// UnmatchedPolicy determines how documents that match no desired resource are
+// handled
+// +kubebuilder:validation:Enum:=error;skip;create
+type UnmatchedPolicy string
+
+const (
+	// UnmatchedError fails the function when a document matches no desired
+	// resource
+	UnmatchedError UnmatchedPolicy = "error"
+	// UnmatchedSkip skips the unmatched documents with a warning
+	UnmatchedSkip UnmatchedPolicy = "skip"
+	// UnmatchedCreate adds the unmatched documents as new resources, like the
+	// Resources target does
+	UnmatchedCreate UnmatchedPolicy = "create"
+)
+
+// ResourceKey determines the names the bases of the PatchResources target are
+// added to the desired resources as
+// +kubebuilder:validation:Enum:=metadataName;name
+type ResourceKey string
+
+const (
+	// ResourceKeyMetadataName adds a base as its metadata.name
+	ResourceKeyMetadataName ResourceKey = "metadataName"
+	// ResourceKeyName adds a base as the name of its resource, the bases of a
+	// resource rendering several are suffixed with their index, such as
+	// bucket-0 and bucket-1
+	ResourceKeyName ResourceKey = "name"
+)
+
+// ResultsMode determines the normal results returned for the objects an export
+// creates or updates
+// +kubebuilder:validation:Enum:=perResource;summary;none
+type ResultsMode string
+
+const (
+	// ResultsPerResource returns a result for each object
+	ResultsPerResource ResultsMode = "perResource"
+	// ResultsSummary returns a result counting the resources of each action,
+	// such as created 42 resources
+	ResultsSummary ResultsMode = "summary"
+	// ResultsNone returns no normal results, warnings are still returned
+	ResultsNone ResultsMode = "none"
+)
+
+// ResultsTarget determines the objects the results of an export are surfaced on
+// +kubebuilder:validation:Enum:=Composite;CompositeAndClaim
+type ResultsTarget string
+
+const (
+	// ResultsTargetComposite surfaces the results on the composite resource
+	ResultsTargetComposite ResultsTarget = "Composite"
+	// ResultsTargetCompositeAndClaim surfaces the results on the composite
+	// resource and on its claim
+	ResultsTargetCompositeAndClaim ResultsTarget = "CompositeAndClaim"
+)
+
+// SchemaValidationPolicy determines how the violations of the CRD schemas by
+// the generated resources are reported
+// +kubebuilder:validation:Enum:=Warning;Fatal;Ignore
+type SchemaValidationPolicy string
+
+const (
+	// SchemaValidationWarning returns a warning for each violation
+	SchemaValidationWarning SchemaValidationPolicy = "Warning"
+	// SchemaValidationFatal fails the pipeline with the violations
+	SchemaValidationFatal SchemaValidationPolicy = "Fatal"
+	// SchemaValidationIgnore does not validate the generated resources
+	SchemaValidationIgnore SchemaValidationPolicy = "Ignore"
+)
+
+// CUEEvaluator is a version of the CUE evaluator
+// +kubebuilder:validation:Enum:=v2
+type CUEEvaluator string
+
+const (
+	// EvaluatorV2 is the evaluator of CUE up to v0.12
+	EvaluatorV2 CUEEvaluator = "v2"
+)
+
+// Registry is an OCI registry CUE modules are fetched from
+type Registry struct {
+	// ModulePrefix selects the module paths fetched from this registry
+	// The registry with the longest matching prefix is used, an empty prefix matches every module
+	// +optional
+	ModulePrefix string `json:"modulePrefix,omitempty"`
+	// URL of the registry host with an optional repository prefix, e.g. registry.example.org/cue
+	URL string `json:"url"`
+	// Insecure fetches from the registry over plain HTTP
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+	// CredentialsRef references the credentials for the registry
+	// +optional
+	CredentialsRef *CredentialsRef `json:"credentialsRef,omitempty"`
+}
+
+// CredentialsRef references credentials mounted into the function pod
+type CredentialsRef struct {
+	// Name of the directory under the function's --registry-credentials-dir,
+	// or --git-credentials-dir for git repositories, holding username and
+	// password files, e.g. a mounted basic-auth Secret
+	Name string `json:"name"`
+}
+
 type Tag struct {
 	// Name of the tag
 	// Left side of '=' in `cue export --inject`
 	Name string `json:"name"`
-	// Path of the tag on the XR to inject from
+	// Source is the object Path and CEL are evaluated against
+	// +kubebuilder:default:=xr
+	// +optional
+	Source TagSource `json:"source,omitempty"`
+	// ResourceName is the name of the observed composed resource the
+	// resource source reads from
+	// +optional
+	ResourceName string `json:"resourceName,omitempty"`
+	// Path of the tag on the source to inject from, any field of the XR such as
+	// status.atProvider.id, metadata.uid or metadata.labels[example.org/team]
 	// Evaluates to the Right side of '=' in `cue export --inject`
-	Path string `json:"path"`
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Default is injected when Path does not exist on the source
+	// +optional
+	Default *string `json:"default,omitempty"`
+	// CEL expression computing the value to inject instead of Path
+	// The source is available to the expression as xr, context, environment
+	// or resource
+	// +optional
+	CEL string `json:"cel,omitempty"`
+	// Transforms are applied in order to the value before it is injected
+	// +optional
+	Transforms []TagTransform `json:"transforms,omitempty"`
+	// Type the value is injected as, values of other types than string are
+	// unified into the tagged field instead of being passed as cue tags
+	// +kubebuilder:default:=string
+	// +optional
+	Type TagType `json:"type,omitempty"`
+}
+
+// TagSource is the object the value of a tag is read from
+// +kubebuilder:validation:Enum:=xr;context;environment;resource
+type TagSource string
+
+const (
+	// TagSourceXR reads the value from the observed XR
+	TagSourceXR TagSource = "xr"
+	// TagSourceContext reads the value from the pipeline context, whose keys
+	// contain dots and are quoted in paths, e.g.
+	// [example.org/settings].region
+	TagSourceContext TagSource = "context"
+	// TagSourceEnvironment reads the value from the EnvironmentConfig data
+	// Crossplane puts in the apiextensions.crossplane.io/environment key of
+	// the pipeline context
+	TagSourceEnvironment TagSource = "environment"
+	// TagSourceResource reads the value from the observed composed resource
+	// named by Tag.ResourceName
+	TagSourceResource TagSource = "resource"
+)
+
+// TagType is the type the value of a tag is injected as
+// +kubebuilder:validation:Enum:=string;int;bool;number;json
+type TagType string
+
+const (
+	// TagTypeString injects the value as a string
+	TagTypeString TagType = "string"
+	// TagTypeInt parses the value as an integer
+	TagTypeInt TagType = "int"
+	// TagTypeBool parses the value as a boolean
+	TagTypeBool TagType = "bool"
+	// TagTypeNumber parses the value as a floating point number
+	TagTypeNumber TagType = "number"
+	// TagTypeJSON parses the value as JSON, maps and lists are injected as is
+	TagTypeJSON TagType = "json"
+)
+
+type TagTransformType string
+
+const (
+	// ToLower lowercases the value
+	ToLower TagTransformType = "ToLower"
+	// ToUpper uppercases the value
+	ToUpper TagTransformType = "ToUpper"
+	// TrimPrefix removes TagTransform.Value from the start of the value
+	TrimPrefix TagTransformType = "TrimPrefix"
+	// TrimSuffix removes TagTransform.Value from the end of the value
+	TrimSuffix TagTransformType = "TrimSuffix"
+	// Truncate shortens the value to TagTransform.Length
+	Truncate TagTransformType = "Truncate"
+	// Replace replaces all matches of TagTransform.Regex with TagTransform.Replacement
+	Replace TagTransformType = "Replace"
+)
+
+// TagTransform normalizes a tag value pulled from the XR
+type TagTransform struct {
+	// Type of the transform
+	// +kubebuilder:validation:Enum:=ToLower;ToUpper;TrimPrefix;TrimSuffix;Truncate;Replace
+	Type TagTransformType `json:"type"`
+	// Value is the prefix or suffix to remove for TrimPrefix and TrimSuffix
+	// +optional
+	Value string `json:"value,omitempty"`
+	// Length is the maximum length of the value for Truncate, in characters
+	// +optional
+	Length int `json:"length,omitempty"`
+	// Hash suffixes truncated values with a short hash of the full value
+	// so that truncated values remain unique
+	// +optional
+	Hash bool `json:"hash,omitempty"`
+	// Regex to match for Replace
+	// +optional
+	Regex string `json:"regex,omitempty"`
+	// Replacement for matches of Regex, supports $1 style capture group references
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
 }
 
 type ResourceList []Resource
@@ -127,8 +1361,10 @@ type Resource struct {
 	// Base of the composed resource that patches will be applied to.
 	// According to the patches and transforms functions, this may be ommited on
 	// occassion by a previous pipeline
+	// The base is an object, or a string of YAML documents that each render a
+	// composed resource
 	// +kubebuilder:pruning:PreserveUnknownFields
 	// +kubebuilder:validation:EmbeddedResource
 	// +optional
 	Base *runtime.RawExtension `json:"base,omitempty"`
-}
\ No newline at end of file
+}
@@ -5,6 +5,7 @@
 package v1beta1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -14,6 +15,13 @@ func (in *CUEInput) DeepCopyInto(out *CUEInput) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Export.DeepCopyInto(&out.Export)
+	if in.Exports != nil {
+		in, out := &in.Exports, &out.Exports
+		*out = make([]Export, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CUEInput.
@@ -34,10 +42,50 @@ func (in *CUEInput) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigMapKeyRef) DeepCopyInto(out *ConfigMapKeyRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigMapKeyRef.
+func (in *ConfigMapKeyRef) DeepCopy() *ConfigMapKeyRef {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigMapKeyRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialsRef) DeepCopyInto(out *CredentialsRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialsRef.
+func (in *CredentialsRef) DeepCopy() *CredentialsRef {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialsRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Export) DeepCopyInto(out *Export) {
 	*out = *in
+	if in.Expressions != nil {
+		in, out := &in.Expressions, &out.Expressions
+		*out = make([]Expression, len(*in))
+		copy(*out, *in)
+	}
 	in.Options.DeepCopyInto(&out.Options)
+	if in.Overrides != nil {
+		in, out := &in.Overrides, &out.Overrides
+		*out = make([]Override, len(*in))
+		copy(*out, *in)
+	}
 	if in.Resources != nil {
 		in, out := &in.Resources, &out.Resources
 		*out = make(ResourceList, len(*in))
@@ -45,6 +93,33 @@ func (in *Export) DeepCopyInto(out *Export) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Routes != nil {
+		in, out := &in.Routes, &out.Routes
+		*out = make([]Route, len(*in))
+		copy(*out, *in)
+	}
+	if in.TemplateRef != nil {
+		in, out := &in.TemplateRef, &out.TemplateRef
+		*out = new(TemplateRef)
+		**out = **in
+	}
+	if in.ValueFrom != nil {
+		in, out := &in.ValueFrom, &out.ValueFrom
+		*out = new(ValueFrom)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Module != nil {
+		in, out := &in.Module, &out.Module
+		*out = new(Module)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Libraries != nil {
+		in, out := &in.Libraries, &out.Libraries
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Export.
@@ -60,31 +135,80 @@ func (in *Export) DeepCopy() *Export {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ExportOptions) DeepCopyInto(out *ExportOptions) {
 	*out = *in
+	if in.Defaults != nil {
+		in, out := &in.Defaults, &out.Defaults
+		*out = new(ResourceDefaults)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Expressions != nil {
 		in, out := &in.Expressions, &out.Expressions
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.ExternalName != nil {
+		in, out := &in.ExternalName, &out.ExternalName
+		*out = new(ExternalName)
+		**out = **in
+	}
 	if in.Inject != nil {
 		in, out := &in.Inject, &out.Inject
 		*out = make([]Tag, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	if in.InjectVars != nil {
 		in, out := &in.InjectVars, &out.InjectVars
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
-	if in.Path != nil {
-		in, out := &in.Path, &out.Path
-		*out = make([]string, len(*in))
+	if in.KubernetesObject != nil {
+		in, out := &in.KubernetesObject, &out.KubernetesObject
+		*out = new(KubernetesObject)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ListMerge != nil {
+		in, out := &in.ListMerge, &out.ListMerge
+		*out = new(ListMerge)
+		**out = **in
+	}
+	if in.MatchBy != nil {
+		in, out := &in.MatchBy, &out.MatchBy
+		*out = make([]MatchKey, len(*in))
 		copy(*out, *in)
 	}
+	if in.PropagateMetadata != nil {
+		in, out := &in.PropagateMetadata, &out.PropagateMetadata
+		*out = new(PropagateMetadata)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ProtoPath != nil {
 		in, out := &in.ProtoPath, &out.ProtoPath
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Registries != nil {
+		in, out := &in.Registries, &out.Registries
+		*out = make([]Registry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExportOptions.
@@ -97,6 +221,214 @@ func (in *ExportOptions) DeepCopy() *ExportOptions {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Expression) DeepCopyInto(out *Expression) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Expression.
+func (in *Expression) DeepCopy() *Expression {
+	if in == nil {
+		return nil
+	}
+	out := new(Expression)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalName) DeepCopyInto(out *ExternalName) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalName.
+func (in *ExternalName) DeepCopy() *ExternalName {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalName)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitRef) DeepCopyInto(out *GitRef) {
+	*out = *in
+	if in.CredentialsRef != nil {
+		in, out := &in.CredentialsRef, &out.CredentialsRef
+		*out = new(CredentialsRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitRef.
+func (in *GitRef) DeepCopy() *GitRef {
+	if in == nil {
+		return nil
+	}
+	out := new(GitRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KubernetesObject) DeepCopyInto(out *KubernetesObject) {
+	*out = *in
+	out.Match = in.Match
+	if in.ProviderConfigRef != nil {
+		in, out := &in.ProviderConfigRef, &out.ProviderConfigRef
+		*out = new(ProviderConfigRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KubernetesObject.
+func (in *KubernetesObject) DeepCopy() *KubernetesObject {
+	if in == nil {
+		return nil
+	}
+	out := new(KubernetesObject)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ListMerge) DeepCopyInto(out *ListMerge) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ListMerge.
+func (in *ListMerge) DeepCopy() *ListMerge {
+	if in == nil {
+		return nil
+	}
+	out := new(ListMerge)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetadataFilter) DeepCopyInto(out *MetadataFilter) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetadataFilter.
+func (in *MetadataFilter) DeepCopy() *MetadataFilter {
+	if in == nil {
+		return nil
+	}
+	out := new(MetadataFilter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Module) DeepCopyInto(out *Module) {
+	*out = *in
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Digests != nil {
+		in, out := &in.Digests, &out.Digests
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Module.
+func (in *Module) DeepCopy() *Module {
+	if in == nil {
+		return nil
+	}
+	out := new(Module)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Override) DeepCopyInto(out *Override) {
+	*out = *in
+	out.Match = in.Match
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Override.
+func (in *Override) DeepCopy() *Override {
+	if in == nil {
+		return nil
+	}
+	out := new(Override)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PropagateMetadata) DeepCopyInto(out *PropagateMetadata) {
+	*out = *in
+	in.Labels.DeepCopyInto(&out.Labels)
+	in.Annotations.DeepCopyInto(&out.Annotations)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PropagateMetadata.
+func (in *PropagateMetadata) DeepCopy() *PropagateMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(PropagateMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProviderConfigRef) DeepCopyInto(out *ProviderConfigRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProviderConfigRef.
+func (in *ProviderConfigRef) DeepCopy() *ProviderConfigRef {
+	if in == nil {
+		return nil
+	}
+	out := new(ProviderConfigRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Registry) DeepCopyInto(out *Registry) {
+	*out = *in
+	if in.CredentialsRef != nil {
+		in, out := &in.CredentialsRef, &out.CredentialsRef
+		*out = new(CredentialsRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Registry.
+func (in *Registry) DeepCopy() *Registry {
+	if in == nil {
+		return nil
+	}
+	out := new(Registry)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Resource) DeepCopyInto(out *Resource) {
 	*out = *in
@@ -117,6 +449,31 @@ func (in *Resource) DeepCopy() *Resource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ResourceDefaults) DeepCopyInto(out *ResourceDefaults) {
+	*out = *in
+	if in.ManagementPolicies != nil {
+		in, out := &in.ManagementPolicies, &out.ManagementPolicies
+		*out = make([]ManagementAction, len(*in))
+		copy(*out, *in)
+	}
+	if in.ProviderConfigRef != nil {
+		in, out := &in.ProviderConfigRef, &out.ProviderConfigRef
+		*out = new(ProviderConfigRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResourceDefaults.
+func (in *ResourceDefaults) DeepCopy() *ResourceDefaults {
+	if in == nil {
+		return nil
+	}
+	out := new(ResourceDefaults)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in ResourceList) DeepCopyInto(out *ResourceList) {
 	{
@@ -138,9 +495,50 @@ func (in ResourceList) DeepCopy() ResourceList {
 	return *out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Route) DeepCopyInto(out *Route) {
+	*out = *in
+	out.Match = in.Match
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Route.
+func (in *Route) DeepCopy() *Route {
+	if in == nil {
+		return nil
+	}
+	out := new(Route)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RouteMatch) DeepCopyInto(out *RouteMatch) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RouteMatch.
+func (in *RouteMatch) DeepCopy() *RouteMatch {
+	if in == nil {
+		return nil
+	}
+	out := new(RouteMatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Tag) DeepCopyInto(out *Tag) {
 	*out = *in
+	if in.Default != nil {
+		in, out := &in.Default, &out.Default
+		*out = new(string)
+		**out = **in
+	}
+	if in.Transforms != nil {
+		in, out := &in.Transforms, &out.Transforms
+		*out = make([]TagTransform, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Tag.
@@ -152,3 +550,58 @@ func (in *Tag) DeepCopy() *Tag {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagTransform) DeepCopyInto(out *TagTransform) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagTransform.
+func (in *TagTransform) DeepCopy() *TagTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(TagTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TemplateRef) DeepCopyInto(out *TemplateRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TemplateRef.
+func (in *TemplateRef) DeepCopy() *TemplateRef {
+	if in == nil {
+		return nil
+	}
+	out := new(TemplateRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ValueFrom) DeepCopyInto(out *ValueFrom) {
+	*out = *in
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(ConfigMapKeyRef)
+		**out = **in
+	}
+	if in.Git != nil {
+		in, out := &in.Git, &out.Git
+		*out = new(GitRef)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ValueFrom.
+func (in *ValueFrom) DeepCopy() *ValueFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(ValueFrom)
+	in.DeepCopyInto(out)
+	return out
+}
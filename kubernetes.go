@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+const (
+	// objectAPIVersion and objectKind are the provider-kubernetes Object the
+	// documents are wrapped into
+	objectAPIVersion = "kubernetes.crossplane.io/v1alpha2"
+	objectKind       = "Object"
+)
+
+// wrapObjects replaces the documents the option matches by provider-kubernetes
+// Objects holding them as their manifest. The composition resource name and
+// target annotations of a document move to its Object, an Object is named by
+// the kind, namespace and name of its manifest when the document does not
+// name it. Documents that already are Objects are not wrapped
+func wrapObjects(o *v1beta1.KubernetesObject, data []map[string]interface{}) []map[string]interface{} {
+	if o == nil {
+		return data
+	}
+	for i, d := range data {
+		u := unstructured.Unstructured{Object: d}
+		if u.GetKind() == objectKind && strings.HasPrefix(u.GetAPIVersion(), "kubernetes.crossplane.io/") {
+			continue
+		}
+		if !o.Match.Matches(u.GetAPIVersion(), u.GetKind(), u.GetName()) {
+			continue
+		}
+
+		annotations := map[string]string{}
+		manifest := u.GetAnnotations()
+		for _, k := range []string{compositionResourceNameAnnotation, targetAnnotation} {
+			if v, ok := manifest[k]; ok {
+				annotations[k] = v
+				delete(manifest, k)
+			}
+		}
+		if len(manifest) == 0 {
+			manifest = nil
+		}
+		u.SetAnnotations(manifest)
+		if _, ok := annotations[compositionResourceNameAnnotation]; !ok {
+			annotations[compositionResourceNameAnnotation] = objectResourceName(u)
+		}
+
+		spec := map[string]interface{}{
+			"forProvider": map[string]interface{}{"manifest": u.Object},
+		}
+		if o.ProviderConfigRef != nil {
+			spec["providerConfigRef"] = map[string]interface{}{"name": o.ProviderConfigRef.Name}
+		}
+		if o.ReadinessPolicy != "" {
+			spec["readiness"] = map[string]interface{}{"policy": o.ReadinessPolicy}
+		}
+		obj := unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		obj.SetAPIVersion(objectAPIVersion)
+		obj.SetKind(objectKind)
+		obj.SetAnnotations(annotations)
+		data[i] = obj.Object
+	}
+	return data
+}
+
+// objectResourceName names the Object of the manifest by its kind, namespace
+// and name, such as configmap-default-settings
+func objectResourceName(u unstructured.Unstructured) string {
+	parts := []string{strings.ToLower(u.GetKind())}
+	if ns := u.GetNamespace(); ns != "" {
+		parts = append(parts, ns)
+	}
+	parts = append(parts, u.GetName())
+	return strings.Join(parts, "-")
+}
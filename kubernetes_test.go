@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestWrapObjects(t *testing.T) {
+	configMap := func() map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "settings", "namespace": "default"},
+			"data":       map[string]interface{}{"key": "value"},
+		}
+	}
+
+	cases := map[string]struct {
+		reason string
+		option *v1beta1.KubernetesObject
+		data   []map[string]interface{}
+		want   []map[string]interface{}
+	}{
+		"Disabled": {
+			reason: "Nothing should be wrapped without the option",
+			data:   []map[string]interface{}{configMap()},
+			want:   []map[string]interface{}{configMap()},
+		},
+		"Wrapped": {
+			reason: "A manifest should be wrapped into an Object named after it",
+			option: &v1beta1.KubernetesObject{
+				ProviderConfigRef: &v1beta1.ProviderConfigRef{Name: "in-cluster"},
+				ReadinessPolicy:   "DeriveFromObject",
+			},
+			data: []map[string]interface{}{configMap()},
+			want: []map[string]interface{}{{
+				"apiVersion": "kubernetes.crossplane.io/v1alpha2",
+				"kind":       "Object",
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{compositionResourceNameAnnotation: "configmap-default-settings"},
+				},
+				"spec": map[string]interface{}{
+					"forProvider":       map[string]interface{}{"manifest": configMap()},
+					"providerConfigRef": map[string]interface{}{"name": "in-cluster"},
+					"readiness":         map[string]interface{}{"policy": "DeriveFromObject"},
+				},
+			}},
+		},
+		"Annotations": {
+			reason: "The composition resource name and target annotations should move to the Object",
+			option: &v1beta1.KubernetesObject{},
+			data: []map[string]interface{}{{
+				"apiVersion": "v1",
+				"kind":       "Namespace",
+				"metadata": map[string]interface{}{
+					"name": "team-a",
+					"annotations": map[string]interface{}{
+						compositionResourceNameAnnotation: "namespace",
+						targetAnnotation:                  "Resources",
+						"example.org/owner":               "alice",
+					},
+				},
+			}},
+			want: []map[string]interface{}{{
+				"apiVersion": "kubernetes.crossplane.io/v1alpha2",
+				"kind":       "Object",
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						compositionResourceNameAnnotation: "namespace",
+						targetAnnotation:                  "Resources",
+					},
+				},
+				"spec": map[string]interface{}{
+					"forProvider": map[string]interface{}{"manifest": map[string]interface{}{
+						"apiVersion": "v1",
+						"kind":       "Namespace",
+						"metadata": map[string]interface{}{
+							"name":        "team-a",
+							"annotations": map[string]interface{}{"example.org/owner": "alice"},
+						},
+					}},
+				},
+			}},
+		},
+		"Unmatched": {
+			reason: "Documents the option does not match and Objects should not be wrapped",
+			option: &v1beta1.KubernetesObject{Match: v1beta1.RouteMatch{Kind: "Secret"}},
+			data: []map[string]interface{}{
+				configMap(),
+				{"apiVersion": "kubernetes.crossplane.io/v1alpha2", "kind": "Object"},
+			},
+			want: []map[string]interface{}{
+				configMap(),
+				{"apiVersion": "kubernetes.crossplane.io/v1alpha2", "kind": "Object"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := wrapObjects(tc.option, tc.data)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nwrapObjects(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
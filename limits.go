@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"cuelang.org/go/cue"
+)
+
+// evalLimits bound what a cue evaluation generates, so that a runaway template
+// fails its step instead of exhausting the memory of the function, a zero limit
+// is not enforced
+type evalLimits struct {
+	// outputBytes is the maximum size of the output in bytes, decoded
+	// documents are measured as json
+	outputBytes int
+	// resources is the maximum number of decoded documents
+	resources int
+	// steps is the maximum number of values of the evaluated template, every
+	// field and list element is a step
+	steps int
+}
+
+// countSteps adds the values of the evaluated value to steps, the walk stops
+// descending once the limit is exceeded
+func (l evalLimits) countSteps(v cue.Value, steps *int) error {
+	if l.steps == 0 {
+		return nil
+	}
+	v.Walk(func(cue.Value) bool {
+		*steps++
+		return *steps <= l.steps
+	}, nil)
+	if *steps > l.steps {
+		return fmt.Errorf("cue evaluation exceeded its limit of %d steps", l.steps)
+	}
+	return nil
+}
+
+// checkOutput checks the output of the compilation is within the limits
+func (l evalLimits) checkOutput(output compileOutput, parseData bool) error {
+	if l.resources > 0 && len(output.data) > l.resources {
+		return fmt.Errorf("cue evaluation generated %d resources, exceeding its limit of %d", len(output.data), l.resources)
+	}
+	if l.outputBytes == 0 {
+		return nil
+	}
+	size := len(output.string)
+	if parseData {
+		size = 0
+		for _, d := range output.data {
+			n, err := jsonSize(d)
+			if err != nil {
+				return fmt.Errorf("failed measuring cue output: %w", err)
+			}
+			size += n
+			if size > l.outputBytes {
+				break
+			}
+		}
+	}
+	if size > l.outputBytes {
+		return fmt.Errorf("cue evaluation output exceeded its limit of %d bytes", l.outputBytes)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestCUECompileLimits(t *testing.T) {
+	// resources generates n resources from a list comprehension
+	resources := `import "list"
+[for i in list.Range(0, 3, 1) {apiVersion: "v1", kind: "ConfigMap", metadata: name: "cm-\(i)"}]
+`
+
+	cases := map[string]struct {
+		reason    string
+		value     string
+		parseData bool
+		limits    evalLimits
+		want      string
+	}{
+		"WithinLimits": {
+			reason:    "A template within its limits should compile",
+			value:     resources,
+			parseData: true,
+			limits:    evalLimits{outputBytes: 1024, resources: 3, steps: 100},
+		},
+		"Unlimited": {
+			reason:    "Zero limits should not be enforced",
+			value:     resources,
+			parseData: true,
+		},
+		"Resources": {
+			reason:    "A template generating more resources than its limit should fail",
+			value:     resources,
+			parseData: true,
+			limits:    evalLimits{resources: 2},
+			want:      "cue evaluation generated 3 resources, exceeding its limit of 2",
+		},
+		"OutputBytes": {
+			reason:    "Decoded documents larger than the limit should fail",
+			value:     resources,
+			parseData: true,
+			limits:    evalLimits{outputBytes: 100},
+			want:      "cue evaluation output exceeded its limit of 100 bytes",
+		},
+		"OutputBytesEncoded": {
+			reason: "Encoded output larger than the limit should fail",
+			value:  resources,
+			limits: evalLimits{outputBytes: 100},
+			want:   "cue evaluation output exceeded its limit of 100 bytes",
+		},
+		"Steps": {
+			reason:    "A template evaluating more values than its limit should fail",
+			value:     `import "list"` + "\n" + `[for i in list.Range(0, 2000, 1) {n: i}]` + "\n",
+			parseData: true,
+			limits:    evalLimits{steps: 1000},
+			want:      "cue evaluation exceeded its limit of 1000 steps",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{Export: v1beta1.Export{Value: v1beta1.Value(tc.value)}}
+			_, err := cueCompile(outputJSON, in, compileOpts{parseData: tc.parseData, limits: tc.limits})
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ncueCompile(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// defaultListMergeKey is the field the items of lists are matched by with the
+// key list merge strategy by default
+const defaultListMergeKey = "name"
+
+// listMerge merges the lists of the documents setData sets into the lists the
+// object already sets at the same path, the zero value merges lists by index
+type listMerge struct {
+	strategy v1beta1.ListMergeStrategy
+	key      string
+}
+
+// newListMerge returns the list merge of the listMerge option of the export
+func newListMerge(l *v1beta1.ListMerge) listMerge {
+	if l == nil {
+		return listMerge{}
+	}
+	m := listMerge{strategy: l.Strategy, key: l.Key}
+	if m.key == "" {
+		m.key = defaultListMergeKey
+	}
+	return m
+}
+
+// setList sets the list at the JSON path of the object with the strategy of
+// the list merge
+func (m listMerge) setList(list []interface{}, path fieldpath.Segments, o any, overwrite bool) error {
+	switch m.strategy {
+	case v1beta1.ListMergeReplace:
+		return setLeaf(list, path, o, overwrite)
+	case v1beta1.ListMergeAppend:
+		cur, ok, err := currentList(path, o)
+		if err != nil || !ok {
+			return m.setNonList(list, path, o, overwrite, err)
+		}
+		out := append([]interface{}{}, cur...)
+		for _, item := range list {
+			if !containsValue(out, item) {
+				out = append(out, item)
+			}
+		}
+		// Appending keeps every item of the list, so it never overwrites it
+		return setLeaf(out, path, o, true)
+	case v1beta1.ListMergeKey:
+		return m.mergeByKey(list, path, o, overwrite)
+	default:
+		for i, value := range list {
+			if err := setData(value, childPath(path, indexSegment(i)), o, overwrite, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeByKey merges the objects of the list into the objects of the existing
+// list with the same key, objects without a match are appended
+func (m listMerge) mergeByKey(list []interface{}, path fieldpath.Segments, o any, overwrite bool) error {
+	cur, ok, err := currentList(path, o)
+	if err != nil || !ok {
+		return m.setNonList(list, path, o, overwrite, err)
+	}
+	index := make(map[string]int, len(cur))
+	for i, item := range cur {
+		if k, ok := m.itemKey(item); ok {
+			index[k] = i
+		}
+	}
+	out := append([]interface{}{}, cur...)
+	matched := map[int][]interface{}{}
+	for i, item := range list {
+		k, ok := m.itemKey(item)
+		if !ok {
+			return fmt.Errorf("%s: list item has no %s key", childPath(path, indexSegment(i)), m.key)
+		}
+		if j, ok := index[k]; ok {
+			matched[j] = append(matched[j], item)
+			continue
+		}
+		index[k] = len(out)
+		out = append(out, item)
+	}
+	if len(out) != len(cur) {
+		// Appending keeps every item of the list, so it never overwrites it
+		if err := setLeaf(out, path, o, true); err != nil {
+			return err
+		}
+	}
+	for j := range cur {
+		for _, item := range matched[j] {
+			if err := setData(item, childPath(path, indexSegment(j)), o, overwrite, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setNonList sets the list at a path that holds no list, as a leaf value
+func (m listMerge) setNonList(list []interface{}, path fieldpath.Segments, o any, overwrite bool, err error) error {
+	if err != nil {
+		return errors.Wrapf(err, "getting %s failed", path)
+	}
+	return setLeaf(list, path, o, overwrite)
+}
+
+// itemKey returns the key of the item of a list, only objects have a key
+func (m listMerge) itemKey(item interface{}) (string, bool) {
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	k, ok := obj[m.key]
+	if !ok || k == nil {
+		return "", false
+	}
+	return fmt.Sprint(k), true
+}
+
+// currentList returns the list the object sets at the path, and whether the
+// path holds a list. A path that is not set holds an empty list.
+func currentList(path fieldpath.Segments, o any) ([]interface{}, bool, error) {
+	var u *unstructured.Unstructured
+	switch o := o.(type) {
+	case *resource.DesiredComposed:
+		if o.Resource == nil {
+			return nil, false, errors.New("cannot set data on a nil DesiredComposed resource")
+		}
+		u = &o.Resource.Unstructured
+	case *resource.Composite:
+		if o.Resource == nil {
+			return nil, false, errors.New("cannot set data on a nil XR")
+		}
+		u = &o.Resource.Unstructured
+	case *compositeStatus:
+		return currentList(path, o.Composite)
+	default:
+		return nil, false, fmt.Errorf("cannot set data on %T: invalid type for obj", o)
+	}
+	v, err := getPath(content(u), path)
+	if err != nil {
+		return nil, false, err
+	}
+	if v == nil {
+		return nil, true, nil
+	}
+	l, ok := v.([]interface{})
+	return l, ok, nil
+}
+
+// containsValue returns whether the list holds an item that is the same as the
+// value
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if sameValue(item, v) {
+			return true
+		}
+	}
+	return false
+}
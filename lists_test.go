@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestSetDataListMerge(t *testing.T) {
+	existing := func() map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"ports": []interface{}{
+					map[string]interface{}{"name": "http", "port": int64(80)},
+					map[string]interface{}{"name": "https", "port": int64(443)},
+					map[string]interface{}{"name": "metrics", "port": int64(9090)},
+				},
+			},
+		}
+	}
+	data := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"ports": []interface{}{
+				map[string]interface{}{"name": "https", "protocol": "TCP"},
+				map[string]interface{}{"name": "grpc", "port": 9000.0},
+			},
+		},
+	}
+
+	cases := map[string]struct {
+		reason    string
+		lists     *v1beta1.ListMerge
+		overwrite bool
+		data      map[string]interface{}
+		want      []interface{}
+		wantErr   bool
+	}{
+		"Index": {
+			reason:    "Lists should be merged item by item at the same index by default, keeping the items of a longer list",
+			overwrite: true,
+			data:      data,
+			want: []interface{}{
+				map[string]interface{}{"name": "https", "port": int64(80), "protocol": "TCP"},
+				map[string]interface{}{"name": "grpc", "port": int64(9000)},
+				map[string]interface{}{"name": "metrics", "port": int64(9090)},
+			},
+		},
+		"Replace": {
+			reason:    "The replace strategy should set the list as a whole",
+			lists:     &v1beta1.ListMerge{Strategy: v1beta1.ListMergeReplace},
+			overwrite: true,
+			data:      data,
+			want: []interface{}{
+				map[string]interface{}{"name": "https", "protocol": "TCP"},
+				map[string]interface{}{"name": "grpc", "port": int64(9000)},
+			},
+		},
+		"ReplaceConflict": {
+			reason:  "The replace strategy should conflict with a different list without overwrite",
+			lists:   &v1beta1.ListMerge{Strategy: v1beta1.ListMergeReplace},
+			data:    data,
+			wantErr: true,
+		},
+		"Key": {
+			reason: "The key strategy should merge the items with the same key and append the others",
+			lists:  &v1beta1.ListMerge{Strategy: v1beta1.ListMergeKey},
+			data:   data,
+			want: []interface{}{
+				map[string]interface{}{"name": "http", "port": int64(80)},
+				map[string]interface{}{"name": "https", "port": int64(443), "protocol": "TCP"},
+				map[string]interface{}{"name": "metrics", "port": int64(9090)},
+				map[string]interface{}{"name": "grpc", "port": int64(9000)},
+			},
+		},
+		"KeyField": {
+			reason: "The key strategy should match the items by the configured key",
+			lists:  &v1beta1.ListMerge{Strategy: v1beta1.ListMergeKey, Key: "port"},
+			data: map[string]interface{}{"spec": map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": 443.0, "protocol": "TCP"},
+			}}},
+			want: []interface{}{
+				map[string]interface{}{"name": "http", "port": int64(80)},
+				map[string]interface{}{"name": "https", "port": int64(443), "protocol": "TCP"},
+				map[string]interface{}{"name": "metrics", "port": int64(9090)},
+			},
+		},
+		"KeyMissing": {
+			reason: "The key strategy should return an error for an item without the key",
+			lists:  &v1beta1.ListMerge{Strategy: v1beta1.ListMergeKey},
+			data: map[string]interface{}{"spec": map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": 8080.0},
+			}}},
+			wantErr: true,
+		},
+		"Append": {
+			reason: "The append strategy should append the items the list does not already hold",
+			lists:  &v1beta1.ListMerge{Strategy: v1beta1.ListMergeAppend},
+			data: map[string]interface{}{"spec": map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"name": "http", "port": 80.0},
+				map[string]interface{}{"name": "grpc", "port": 9000.0},
+			}}},
+			want: []interface{}{
+				map[string]interface{}{"name": "http", "port": int64(80)},
+				map[string]interface{}{"name": "https", "port": int64(443)},
+				map[string]interface{}{"name": "metrics", "port": int64(9090)},
+				map[string]interface{}{"name": "grpc", "port": int64(9000)},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dcd := &resource.DesiredComposed{Resource: &composed.Unstructured{Unstructured: unstructured.Unstructured{Object: existing()}}}
+			err := setData(tc.data, nil, dcd, tc.overwrite, newListMerge(tc.lists))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s\nsetData(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			got, _, _ := unstructured.NestedSlice(dcd.Resource.Object, "spec", "ports")
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nsetData(...): -want ports, +got ports:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -2,28 +2,137 @@
 package main
 
 import (
+	"os"
+	"time"
+
 	"github.com/alecthomas/kong"
 	"github.com/crossplane/function-sdk-go"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // CLI of this Function.
 type CLI struct {
+	Serve   ServeCmd   `cmd:"" default:"withargs" help:"Serve the Function."`
+	Profile ProfileCmd `cmd:"" help:"Evaluate a CUE template and report its most expensive fields."`
+	Migrate MigrateCmd `cmd:"" help:"Convert a go-templating or patch and transform pipeline step into a CUEInput."`
+	Render  RenderCmd  `cmd:"" help:"Render manifests from a CUE package, or the desired state of a pipeline step, to stdout or files."`
+	Worker  WorkerCmd  `cmd:"" hidden:"" help:"Evaluate a CUE template read from stdin, used by --isolate."`
+}
+
+// ServeCmd serves this Function.
+type ServeCmd struct {
 	Debug bool `short:"d" help:"Emit debug logs in addition to info logs."`
 
 	Network     string `help:"Network on which to listen for gRPC connections." default:"tcp"`
 	Address     string `help:"Address at which to listen for gRPC connections." default:":9443"`
 	TLSCertsDir string `help:"Directory containing server certs (tls.key, tls.crt) and the CA used to verify client certificates (ca.crt)" env:"TLS_SERVER_CERTS_DIR"`
-	Insecure    bool   `help:"Run without mTLS credentials. If you supply this flag --tls-server-certs-dir will be ignored."`
+	Insecure    bool   `help:"Run without mTLS credentials. If you supply this flag --tls-certs-dir will be ignored."`
+
+	MaxRecvMsgSize int `help:"Maximum size in bytes of a gRPC message the function receives, raise it for RunFunctionRequests holding observed states over the 4MB default." default:"4194304" env:"MAX_RECV_MSG_SIZE"`
+
+	MetricsAddress string `help:"Address at which to serve prometheus metrics at /metrics, an empty address disables the metrics." default:":8080" env:"METRICS_ADDRESS"`
+
+	LogCompileOutput bool     `help:"Log the rendered output of each CUE compilation at debug level, the values of the keys matching --redact-keys are masked." env:"LOG_COMPILE_OUTPUT"`
+	RedactKeys       string   `help:"Regular expression of the keys whose values are masked in the logged compile output and in results, matched case insensitively. An empty expression disables redaction." default:"password|token|secret" env:"REDACT_KEYS"`
+	RedactPaths      []string `help:"Globs of the field paths whose values are masked in the logged compile output and in results, optionally prefixed with the kind of the resources they apply to, such as Secret:data.*. A metadata.name glob masks the names of the resources in success results." default:"Secret:data.*,Secret:stringData.*" env:"REDACT_PATHS"`
+
+	DebugArtifacts string `help:"Capture the input, injected tags and raw CUE output of failed compilations and matches as json, to stdout or to <id>.json files of this directory. The fatal result references the artifact id." env:"DEBUG_ARTIFACTS"`
+
+	SpanLog string `help:"Append the spans of each RunFunction call as json lines to this file, or write them to stdout when -. The spans continue the W3C traceparent of the request. Spans are not exported with OTLP." env:"SPAN_LOG"`
+
+	GracePeriod time.Duration `help:"Time to drain in-flight RunFunction calls on SIGTERM before they are cancelled, 0 stops immediately." default:"25s" env:"GRACE_PERIOD"`
+
+	Mode                   string        `help:"Crossplane function semantics to run with, composition or operation." enum:"composition,operation" default:"composition" env:"FUNCTION_MODE"`
+	FunctionName           string        `help:"Name of the function package, injected into #meta.function." default:"function-cue" env:"FUNCTION_NAME"`
+	ConfigMapRefresh       time.Duration `help:"Interval at which the ConfigMaps referenced by valueFrom are fetched again." default:"1m" env:"CONFIGMAP_REFRESH"`
+	TemplatesDir           string        `help:"Directory containing named CUE templates laid out as <name>/<version>.cue." env:"TEMPLATES_DIR"`
+	TemplateSources        []string      `help:"Additional sources of named CUE templates in <kind>:<location> form, such as oci:registry.example.org/templates, resolved in order after --templates-dir." env:"TEMPLATE_SOURCES"`
+	RegistryCredentialsDir string        `help:"Directory containing a directory of username and password files for each registry credentialsRef." env:"REGISTRY_CREDENTIALS_DIR"`
+	GitCredentialsDir      string        `help:"Directory containing a directory of username and password files for each git credentialsRef." env:"GIT_CREDENTIALS_DIR"`
+	GitRefresh             time.Duration `help:"Interval at which the branches and tags referenced by valueFrom are resolved again." default:"1m" env:"GIT_REFRESH"`
+	FreezeTime             time.Time     `help:"Inject this RFC 3339 time as #now instead of the current time." env:"FREEZE_TIME"`
+	DefaultInput           string        `help:"CUEInput YAML file whose export is merged under every export of the function inputs, such as the options every composition sets." env:"DEFAULT_INPUT"`
+	CRDsDir                string        `name:"crds-dir" help:"Directory containing the CRDs of the providers, the generated resources of their kinds are validated against their schemas." env:"CRDS_DIR"`
+
+	Isolate       bool          `help:"Run each CUE evaluation in a resource limited worker subprocess." env:"ISOLATE"`
+	WorkerMemory  uint64        `help:"Maximum data segment size of an isolated worker in bytes, 0 is unlimited." default:"1073741824" env:"WORKER_MEMORY"`
+	WorkerCPU     uint64        `help:"Maximum CPU seconds of an isolated worker, 0 is unlimited." default:"10" env:"WORKER_CPU"`
+	WorkerTimeout time.Duration `help:"Maximum wall clock time of an isolated worker, 0 is unlimited." default:"30s" env:"WORKER_TIMEOUT"`
+
+	CUEEvalTimeout    time.Duration `name:"cue-eval-timeout" help:"Maximum time of a CUE evaluation, 0 is unlimited. An evaluation that times out fails the step, it runs on in the background unless its isolated worker is killed." default:"30s" env:"CUE_EVAL_TIMEOUT"`
+	MaxAbandonedEvals int           `help:"Maximum number of CUE evaluations abandoned after their timeout that run on in the background, further evaluations fail until one of them finishes. 0 is unlimited." default:"4" env:"MAX_ABANDONED_EVALS"`
+
+	MaxOutputBytes int `help:"Maximum size in bytes of the output of a CUE evaluation, 0 is unlimited." default:"33554432" env:"MAX_OUTPUT_BYTES"`
+	MaxResources   int `help:"Maximum number of resources a CUE evaluation generates, 0 is unlimited." default:"1000" env:"MAX_RESOURCES"`
+	MaxEvalSteps   int `help:"Maximum number of values of an evaluated CUE template, 0 is unlimited." default:"1000000" env:"MAX_EVAL_STEPS"`
+
+	MaxConcurrentEvals int `help:"Maximum number of concurrent CUE evaluations, further requests wait for an evaluation to finish. 0 is the number of CPUs." default:"0" env:"MAX_CONCURRENT_EVALS"`
+
+	SizeWarningBytes int `help:"Warn when a desired resource serializes to at least this many bytes, 0 disables the warning." default:"1200000" env:"SIZE_WARNING_BYTES"`
+
+	TemplateCacheSize int `help:"Number of built CUE templates cached by their source, 0 disables the cache. Isolated workers do not cache templates." default:"256" env:"TEMPLATE_CACHE_SIZE"`
 }
 
 // Run this Function.
-func (c *CLI) Run() error {
+func (c *ServeCmd) Run() error {
 	log, err := function.NewLogger(c.Debug)
 	if err != nil {
 		return err
 	}
 
-	return function.Serve(&Function{log: log},
+	// The templates directory is resolved before the other sources
+	templates, err := newTemplateSources(append([]string{"dir:" + c.TemplatesDir}, c.TemplateSources...))
+	if err != nil {
+		return err
+	}
+
+	f := &Function{
+		log:         log,
+		mode:        runMode(c.Mode),
+		name:        c.FunctionName,
+		templates:   templates,
+		modules:     newModuleFetcher(c.RegistryCredentialsDir),
+		configMaps:  newConfigMapValues(inClusterConfigMaps(), c.ConfigMapRefresh, configMapCacheSize),
+		git:         newGitValues(c.GitCredentialsDir, c.GitRefresh),
+		sizeWarning: c.SizeWarningBytes,
+		pool:        newEvalPool(c.MaxConcurrentEvals),
+		cache:       newTemplateCache(c.TemplateCacheSize),
+		timeout:     c.CUEEvalTimeout,
+		abandoned:   newAbandonedEvals(c.MaxAbandonedEvals),
+		limits:      evalLimits{outputBytes: c.MaxOutputBytes, resources: c.MaxResources, steps: c.MaxEvalSteps},
+
+		logCompileOutput: c.LogCompileOutput,
+	}
+	if f.redactor, err = newRedactor(c.RedactKeys, c.RedactPaths); err != nil {
+		return err
+	}
+	if f.defaults, err = loadDefaultInput(c.DefaultInput); err != nil {
+		return err
+	}
+	if f.schemas, err = loadCRDSchemas(c.CRDsDir); err != nil {
+		return err
+	}
+	if !c.FreezeTime.IsZero() {
+		f.now = func() time.Time { return c.FreezeTime }
+	}
+	if f.artifacts, err = newArtifactSink(c.DebugArtifacts, f.redactor); err != nil {
+		return err
+	}
+	if f.tracer, err = newTracer(c.SpanLog, os.Stdout); err != nil {
+		return err
+	}
+	if c.MetricsAddress != "" {
+		reg := prometheus.NewRegistry()
+		f.metrics = newMetrics(reg, f.cache)
+		if err := serveMetrics(c.MetricsAddress, reg); err != nil {
+			return err
+		}
+	}
+	if c.Isolate {
+		f.isolation = &workerLimits{memory: c.WorkerMemory, cpu: c.WorkerCPU, timeout: c.WorkerTimeout}
+	}
+
+	return serve(log, f, c.GracePeriod, c.MaxRecvMsgSize,
 		function.Listen(c.Network, c.Address),
 		function.MTLSCertificates(c.TLSCertsDir),
 		function.Insecure(c.Insecure))
@@ -32,4 +141,4 @@ func (c *CLI) Run() error {
 func main() {
 	ctx := kong.Parse(&CLI{}, kong.Description("A CUE implementation for Crossplane's Composition Function."))
 	ctx.FatalIfErrorf(ctx.Run())
-}
\ No newline at end of file
+}
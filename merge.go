@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// jsonPatchField is the field of a document holding the JSON patch applied to
+// the resource it matches with the jsonPatch merge strategy
+const jsonPatchField = "jsonPatch"
+
+// mergeResource merges the document into the desired resource with the merge
+// strategy, the leaf strategy is used by default and merges lists with the list
+// merge
+func mergeResource(data map[string]interface{}, dcd *resource.DesiredComposed, strategy v1beta1.MergeStrategy, overwrite bool, lists listMerge) error {
+	switch strategy {
+	case v1beta1.MergeLeaf, "":
+		return setData(data, nil, dcd, overwrite, lists)
+	case v1beta1.MergeStrategic:
+		dcd.Resource.SetUnstructuredContent(strategicMerge(dcd.Resource.UnstructuredContent(), data))
+	case v1beta1.MergeJSONPatch:
+		return applyJSONPatch(data, dcd)
+	case v1beta1.MergeReplace:
+		dcd.Resource.SetUnstructuredContent(typedValue(data).(map[string]interface{}))
+	default:
+		return errors.Errorf("unknown merge strategy %q", strategy)
+	}
+	return nil
+}
+
+// strategicMerge merges the patch into the object, objects are merged
+// recursively and lists of objects are merged by their name field, a null
+// value of the patch deletes the field and any other value replaces it
+func strategicMerge(obj, patch map[string]interface{}) map[string]interface{} {
+	if obj == nil {
+		obj = map[string]interface{}{}
+	}
+	for k, pv := range patch {
+		switch pv := pv.(type) {
+		case nil:
+			delete(obj, k)
+			continue
+		case map[string]interface{}:
+			// Merging into an empty object drops the null values of a new object
+			ov, _ := obj[k].(map[string]interface{})
+			obj[k] = strategicMerge(ov, pv)
+			continue
+		case []interface{}:
+			if ov, ok := obj[k].([]interface{}); ok && namedList(ov) && namedList(pv) {
+				obj[k] = mergeNamedList(ov, pv)
+				continue
+			}
+		}
+		obj[k] = keepValue(obj[k], pv)
+	}
+	return obj
+}
+
+// namedList returns whether every item of the list is an object with a name
+func namedList(l []interface{}) bool {
+	for _, item := range l {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := m["name"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeNamedList merges the items of the patch into the items of the list with
+// the same name, items without a match are appended in the order of the patch
+func mergeNamedList(list, patch []interface{}) []interface{} {
+	index := make(map[string]int, len(list))
+	for i, item := range list {
+		index[item.(map[string]interface{})["name"].(string)] = i
+	}
+	for _, item := range patch {
+		m := item.(map[string]interface{})
+		if i, ok := index[m["name"].(string)]; ok {
+			list[i] = strategicMerge(list[i].(map[string]interface{}), m)
+			continue
+		}
+		list = append(list, strategicMerge(nil, m))
+	}
+	return list
+}
+
+// applyJSONPatch applies the JSON patch of the document to the desired resource
+func applyJSONPatch(data map[string]interface{}, dcd *resource.DesiredComposed) error {
+	ops, ok := data[jsonPatchField]
+	if !ok {
+		return errors.Errorf("document has no %s field", jsonPatchField)
+	}
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal JSON patch")
+	}
+	patch, err := jsonpatch.DecodePatch(b)
+	if err != nil {
+		return errors.Wrap(err, "cannot decode JSON patch")
+	}
+	obj, err := json.Marshal(dcd.Resource.UnstructuredContent())
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal desired resource")
+	}
+	patched, err := patch.Apply(obj)
+	if err != nil {
+		return errors.Wrap(err, "cannot apply JSON patch")
+	}
+	// The integers of the patched resource are decoded as int64 rather than
+	// float64, like those of the desired resource
+	out := map[string]interface{}{}
+	if err := utiljson.Unmarshal(patched, &out); err != nil {
+		return errors.Wrap(err, "cannot unmarshal patched desired resource")
+	}
+	dcd.Resource.SetUnstructuredContent(out)
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestMergeResource(t *testing.T) {
+	existing := func() map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "web"},
+			"spec": map[string]interface{}{
+				"replicas": 1.0,
+				"template": map[string]interface{}{"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "app", "image": "app:v1"},
+						map[string]interface{}{"name": "proxy", "image": "proxy:v1"},
+					},
+				}},
+				"args": []interface{}{"--a"},
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		reason   string
+		strategy v1beta1.MergeStrategy
+		data     map[string]interface{}
+		want     map[string]interface{}
+		wantErr  bool
+	}{
+		"LeafConflict": {
+			reason:   "The leaf strategy should not overwrite values by default",
+			strategy: v1beta1.MergeLeaf,
+			data:     map[string]interface{}{"spec": map[string]interface{}{"replicas": 3.0}},
+			wantErr:  true,
+		},
+		"LeafUnchanged": {
+			reason:   "Setting a number equal to the current value should keep it without a conflict",
+			strategy: v1beta1.MergeLeaf,
+			data:     map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}},
+			want:     existing(),
+		},
+		"StrategicMerge": {
+			reason:   "The strategic merge should merge lists of objects by name and replace other lists",
+			strategy: v1beta1.MergeStrategic,
+			data: map[string]interface{}{"spec": map[string]interface{}{
+				"replicas": 3.0,
+				"template": map[string]interface{}{"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "app", "image": "app:v2"},
+						map[string]interface{}{"name": "metrics", "image": "metrics:v1"},
+					},
+				}},
+				"args": []interface{}{"--b"},
+			}},
+			want: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"replicas": int64(3),
+					"template": map[string]interface{}{"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{"name": "app", "image": "app:v2"},
+							map[string]interface{}{"name": "proxy", "image": "proxy:v1"},
+							map[string]interface{}{"name": "metrics", "image": "metrics:v1"},
+						},
+					}},
+					"args": []interface{}{"--b"},
+				},
+			},
+		},
+		"StrategicMergeDelete": {
+			reason:   "A null value should delete the field from the resource, also inside a list of objects",
+			strategy: v1beta1.MergeStrategic,
+			data: map[string]interface{}{"spec": map[string]interface{}{
+				"args": nil,
+				"template": map[string]interface{}{"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "proxy", "image": nil},
+					},
+				}},
+				"paused": nil,
+			}},
+			want: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"replicas": 1.0,
+					"template": map[string]interface{}{"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{"name": "app", "image": "app:v1"},
+							map[string]interface{}{"name": "proxy"},
+						},
+					}},
+				},
+			},
+		},
+		"JSONPatch": {
+			reason:   "The JSON patch of the document should be applied",
+			strategy: v1beta1.MergeJSONPatch,
+			data: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"jsonPatch": []interface{}{
+					map[string]interface{}{"op": "remove", "path": "/spec/template/spec/containers/1"},
+					map[string]interface{}{"op": "replace", "path": "/spec/replicas", "value": 2},
+				},
+			},
+			want: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"replicas": int64(2),
+					"template": map[string]interface{}{"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{"name": "app", "image": "app:v1"},
+						},
+					}},
+					"args": []interface{}{"--a"},
+				},
+			},
+		},
+		"JSONPatchMissing": {
+			reason:   "A document without a JSON patch should return an error",
+			strategy: v1beta1.MergeJSONPatch,
+			data:     map[string]interface{}{"spec": map[string]interface{}{"replicas": 3.0}},
+			wantErr:  true,
+		},
+		"Replace": {
+			reason:   "The replace strategy should replace the resource with the document",
+			strategy: v1beta1.MergeReplace,
+			data:     map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": map[string]interface{}{"name": "web"}},
+			want:     map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": map[string]interface{}{"name": "web"}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dcd := &resource.DesiredComposed{Resource: &composed.Unstructured{Unstructured: unstructured.Unstructured{Object: existing()}}}
+			err := mergeResource(tc.data, dcd, tc.strategy, false, listMerge{})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s\nmergeResource(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tc.want, dcd.Resource.UnstructuredContent()); diff != "" {
+				t.Errorf("%s\nmergeResource(...): -want resource, +got resource:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionMergeStrategy(t *testing.T) {
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "merge"},
+			"export": {
+				"target": "PatchDesired",
+				"options": {"mergeStrategy": "strategicMerge"},
+				"value": "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nmetadata: name: \"bucket\"\nspec: forProvider: {region: \"eu-west-1\", acl: null}\n"
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+			},
+		},
+		Desired: &fnv1beta1.State{
+			Resources: map[string]*fnv1beta1.Resource{
+				"bucket": {Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": {"name": "bucket"}, "spec": {"forProvider": {"region": "us-east-1", "acl": "private"}}}`)},
+			},
+		},
+	}
+
+	rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*fnv1beta1.Resource{
+		"bucket": {Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": {"name": "bucket"}, "spec": {"forProvider": {"region": "eu-west-1"}}}`)},
+	}
+	if diff := cmp.Diff(want, rsp.GetDesired().GetResources(), protocmp.Transform()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want desired, +got desired:\n%s\nresults: %v", diff, rsp.GetResults())
+	}
+}
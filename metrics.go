@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// metricsNamespace prefixes the names of the metrics of the function
+const metricsNamespace = "function_cue"
+
+// metrics are the prometheus metrics of the function, a nil metrics records
+// nothing so that functions built without metrics, such as in tests and the
+// render command, need no registry
+type metrics struct {
+	runDuration     prometheus.Histogram
+	compileDuration prometheus.Histogram
+	results         *prometheus.CounterVec
+	targets         *prometheus.CounterVec
+	targetResources *prometheus.CounterVec
+	staleAge        *prometheus.GaugeVec
+}
+
+// newMetrics registers the metrics of the function and of its template cache,
+// which may be nil, with the registry
+func newMetrics(reg prometheus.Registerer, cache *templateCache) *metrics {
+	m := &metrics{
+		runDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_function_duration_seconds",
+			Help:      "Duration of RunFunction calls in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}),
+		compileDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "compile_duration_seconds",
+			Help:      "Duration of CUE compilations in seconds, excluding the wait for an evaluation worker.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}),
+		results: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "results_total",
+			Help:      "Results returned by RunFunction calls, by severity.",
+		}, []string{"severity"}),
+		targets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "target_applies_total",
+			Help:      "Documents routed to a target and applied, by target and outcome.",
+		}, []string{"target", "outcome"}),
+		targetResources: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "target_resources_total",
+			Help:      "Resources produced by the documents applied to a target, by target.",
+		}, []string{"target"}),
+		staleAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "stale_value_age_seconds",
+			Help:      "Age in seconds of the last value served stale because its remote source could not be refreshed, by source. It is reset to 0 once the source is refreshed.",
+		}, []string{"source"}),
+	}
+	reg.MustRegister(m.runDuration, m.compileDuration, m.results, m.targets, m.targetResources, m.staleAge)
+	if cache != nil {
+		for _, result := range []string{"hit", "miss"} {
+			result := result
+			reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   metricsNamespace,
+				Name:        "template_cache_requests_total",
+				Help:        "Requests of built templates from the template cache, by result.",
+				ConstLabels: prometheus.Labels{"result": result},
+			}, func() float64 {
+				hits, misses := cache.stats()
+				if result == "hit" {
+					return float64(hits)
+				}
+				return float64(misses)
+			}))
+		}
+	}
+	return m
+}
+
+// observeRun records the duration of a RunFunction call and its results
+func (m *metrics) observeRun(d time.Duration, rsp *fnv1beta1.RunFunctionResponse) {
+	if m == nil {
+		return
+	}
+	m.runDuration.Observe(d.Seconds())
+	for _, r := range rsp.GetResults() {
+		severity := strings.ToLower(strings.TrimPrefix(r.GetSeverity().String(), "SEVERITY_"))
+		m.results.WithLabelValues(severity).Inc()
+	}
+}
+
+// observeCompile records the duration of a cue compilation
+func (m *metrics) observeCompile(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.compileDuration.Observe(d.Seconds())
+}
+
+// observeTarget records the documents applied to a target, and the resources
+// they produced when they were applied
+func (m *metrics) observeTarget(target v1beta1.Target, resources int, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.targets.WithLabelValues(string(target), "failure").Inc()
+		return
+	}
+	m.targets.WithLabelValues(string(target), "success").Inc()
+	m.targetResources.WithLabelValues(string(target)).Add(float64(resources))
+}
+
+// observeStale records the age of a value of the kind of source served stale,
+// a value resolved fresh resets it
+func (m *metrics) observeStale(source string, stale *staleValue, err error) {
+	if m == nil || err != nil {
+		return
+	}
+	if stale == nil {
+		m.staleAge.WithLabelValues(source).Set(0)
+		return
+	}
+	m.staleAge.WithLabelValues(source).Set(stale.age.Seconds())
+}
+
+// serveMetrics serves the metrics of the registry, along with the go runtime
+// and process metrics, at /metrics of the address
+func serveMetrics(address string, reg *prometheus.Registry) error {
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen for metrics connections at address %q", address)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(lis) //nolint:errcheck // metrics are served for the lifetime of the function
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cache := newTemplateCache(1)
+	f := &Function{log: logging.NewNopLogger(), cache: cache, metrics: newMetrics(reg, cache)}
+
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "metrics"},
+			"export": {
+				"target": "Resources",
+				"value": "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n"
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+			},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := f.RunFunction(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `
+# HELP function_cue_results_total Results returned by RunFunction calls, by severity.
+# TYPE function_cue_results_total counter
+function_cue_results_total{severity="normal"} 2
+# HELP function_cue_target_applies_total Documents routed to a target and applied, by target and outcome.
+# TYPE function_cue_target_applies_total counter
+function_cue_target_applies_total{outcome="success",target="Resources"} 2
+# HELP function_cue_target_resources_total Resources produced by the documents applied to a target, by target.
+# TYPE function_cue_target_resources_total counter
+function_cue_target_resources_total{target="Resources"} 2
+# HELP function_cue_template_cache_requests_total Requests of built templates from the template cache, by result.
+# TYPE function_cue_template_cache_requests_total counter
+function_cue_template_cache_requests_total{result="hit"} 1
+function_cue_template_cache_requests_total{result="miss"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"function_cue_results_total",
+		"function_cue_target_applies_total",
+		"function_cue_target_resources_total",
+		"function_cue_template_cache_requests_total",
+	); err != nil {
+		t.Errorf("GatherAndCompare(...): %v", err)
+	}
+	if n := testutil.CollectAndCount(f.metrics.runDuration); n != 1 {
+		t.Errorf("CollectAndCount(runDuration): want 1 histogram, got %d", n)
+	}
+	if n := testutil.CollectAndCount(f.metrics.compileDuration); n != 1 {
+		t.Errorf("CollectAndCount(compileDuration): want 1 histogram, got %d", n)
+	}
+
+	// a nil metrics records nothing
+	var m *metrics
+	m.observeRun(time.Second, nil)
+	m.observeCompile(time.Second)
+	m.observeTarget("Resources", 1, nil)
+	m.observeStale("git", nil, nil)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cuelang.org/go/cue/format"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	// migrateTODO marks the parts of a migrated template that need review
+	migrateTODO = "// TODO(migrate):"
+
+	goTemplatingGroup      = "gotemplating.fn.crossplane.io"
+	patchAndTransformGroup = "pt.fn.crossplane.io"
+)
+
+var (
+	// xrFieldRef matches go template actions that only reference a field of the observed XR
+	xrFieldRef = regexp.MustCompile(`{{-?\s*\.observed\.composite\.resource\.([A-Za-z0-9_.]+)\s*(\|\s*quote\s*)?-?}}`)
+	// placeholderRef matches the placeholders substituted for XR field references
+	placeholderRef = regexp.MustCompile(`__fncue_tag_([A-Za-z0-9_]+)__`)
+	// cueIdent matches labels that do not need quoting in cue
+	cueIdent = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+)
+
+// MigrateCmd converts a function-go-templating or function-patch-and-transform
+// pipeline step into an equivalent CUEInput.
+type MigrateCmd struct {
+	File string `arg:"" help:"Pipeline step or function input to migrate." type:"existingfile"`
+}
+
+// Run the migrate command.
+func (c *MigrateCmd) Run() error {
+	b, err := os.ReadFile(c.File)
+	if err != nil {
+		return err
+	}
+	out, err := migrateStep(b)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// migration is a best-effort translation of a function input into a cue template
+// XR field references are replaced with placeholders that are rendered as references
+// to hidden fields injected from the XR
+type migration struct {
+	name  string
+	docs  []interface{}
+	todos []string
+	// tags maps the injected tag names to their XR field path
+	tags map[string]string
+}
+
+// migrateStep converts a pipeline step, or the bare input of one, into a CUEInput manifest
+// parts of the step that cannot be translated are marked with TODO comments in the template
+func migrateStep(b []byte) ([]byte, error) {
+	step := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &step); err != nil {
+		return nil, errors.Wrap(err, "cannot parse pipeline step")
+	}
+	name, _ := step["step"].(string)
+	in := step
+	if i, ok := step["input"].(map[string]interface{}); ok {
+		in = i
+	}
+
+	m := &migration{name: name, tags: map[string]string{}}
+	if m.name == "" {
+		m.name, _ = fieldpath.Pave(in).GetString("metadata.name")
+	}
+
+	apiVersion, _ := in["apiVersion"].(string)
+	switch group := strings.Split(apiVersion, "/")[0]; group {
+	case goTemplatingGroup:
+		if err := m.fromGoTemplate(in); err != nil {
+			return nil, err
+		}
+	case patchAndTransformGroup:
+		if err := m.fromPatchAndTransform(in); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("cannot migrate function input %q, only %s and %s inputs are supported", apiVersion, goTemplatingGroup, patchAndTransformGroup)
+	}
+
+	return m.manifest()
+}
+
+// fromGoTemplate translates the documents of an inline go template
+// documents that only reference fields of the observed XR are translated,
+// any other template actions leave the document for manual translation
+func (m *migration) fromGoTemplate(in map[string]interface{}) error {
+	p := fieldpath.Pave(in)
+	if src, _ := p.GetString("source"); src != "" && src != "Inline" {
+		return errors.Errorf("cannot migrate go template source %q, only Inline templates are supported", src)
+	}
+	tmpl, err := p.GetString("inline.template")
+	if err != nil {
+		return errors.Wrap(err, "cannot get inline template")
+	}
+
+	for _, doc := range regexp.MustCompile(`(?m)^---\s*$`).Split(tmpl, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		doc = strings.Trim(doc, "\n")
+		refs := []string{}
+		replaced := xrFieldRef.ReplaceAllStringFunc(doc, func(ref string) string {
+			path := xrFieldRef.FindStringSubmatch(ref)[1]
+			refs = append(refs, path)
+			return placeholder(path)
+		})
+		if strings.Contains(replaced, "{{") {
+			m.todo("translate the go template document below", doc)
+			continue
+		}
+		var d interface{}
+		if err := yaml.Unmarshal([]byte(replaced), &d); err != nil || d == nil {
+			m.todo("translate the go template document below, it is not valid yaml", doc)
+			continue
+		}
+		for _, path := range refs {
+			m.inject(path)
+		}
+		m.docs = append(m.docs, d)
+	}
+	return nil
+}
+
+// fromPatchAndTransform translates the bases of the resources of a patch and transform input
+// FromCompositeFieldPath patches without transforms are translated into injected values,
+// any other patches are left for manual translation
+func (m *migration) fromPatchAndTransform(in map[string]interface{}) error {
+	resources, _ := in["resources"].([]interface{})
+	for i, r := range resources {
+		res, ok := r.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("cannot migrate resource at index %d, it is not an object", i)
+		}
+		name, _ := res["name"].(string)
+		base, ok := res["base"].(map[string]interface{})
+		if !ok {
+			m.todo(fmt.Sprintf("resource %q has no base to migrate", name), "")
+			continue
+		}
+		p := fieldpath.Pave(base)
+
+		if n, _ := p.GetString("metadata.name"); n == "" && name != "" {
+			_ = p.SetValue("metadata.name", name)
+			m.todo(fmt.Sprintf("metadata.name of resource %q is set from its patch and transform name, function-cue derives composed resource names from it", name), "")
+		}
+
+		patches, _ := res["patches"].([]interface{})
+		for _, pt := range patches {
+			patch, _ := pt.(map[string]interface{})
+			from, to, ok := simplePatch(patch)
+			if !ok {
+				b, _ := json.Marshal(patch)
+				m.todo(fmt.Sprintf("translate the patch of resource %q below", name), string(b))
+				continue
+			}
+			if err := p.SetValue(to, placeholder(from)); err != nil {
+				return errors.Wrapf(err, "cannot migrate patch of resource %q to %q", name, to)
+			}
+			m.inject(from)
+		}
+		for _, field := range []string{"connectionDetails", "readinessChecks"} {
+			if v, ok := res[field]; ok {
+				b, _ := json.Marshal(v)
+				m.todo(fmt.Sprintf("translate the %s of resource %q below", field, name), string(b))
+			}
+		}
+
+		m.docs = append(m.docs, base)
+	}
+	return nil
+}
+
+// simplePatch returns the from and to field paths of a FromCompositeFieldPath patch
+// that copies the value unchanged
+func simplePatch(patch map[string]interface{}) (from, to string, ok bool) {
+	if t, _ := patch["type"].(string); t != "" && t != "FromCompositeFieldPath" {
+		return "", "", false
+	}
+	if _, ok := patch["transforms"]; ok {
+		return "", "", false
+	}
+	if _, ok := patch["policy"]; ok {
+		return "", "", false
+	}
+	from, _ = patch["fromFieldPath"].(string)
+	to, _ = patch["toFieldPath"].(string)
+	if to == "" {
+		to = from
+	}
+	return from, to, cueIdentPath(from)
+}
+
+// cueIdentPath reports whether the field path only has plain fields so it can be turned into a tag name
+func cueIdentPath(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, s := range strings.Split(path, ".") {
+		if !cueIdent.MatchString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagName returns the name of the tag the XR field path is injected into
+func tagName(path string) string {
+	return strings.ReplaceAll(path, ".", "_")
+}
+
+// placeholder returns the placeholder substituted for the XR field path
+func placeholder(path string) string {
+	return "__fncue_tag_" + tagName(path) + "__"
+}
+
+// inject registers the tag the XR field path is injected into
+func (m *migration) inject(path string) {
+	m.tags[tagName(path)] = path
+}
+
+// todo records a TODO marker followed by the commented out source
+func (m *migration) todo(msg, src string) {
+	lines := []string{migrateTODO + " " + msg}
+	if src != "" {
+		for _, l := range strings.Split(strings.TrimRight(src, "\n"), "\n") {
+			lines = append(lines, strings.TrimSpace("// "+l))
+		}
+	}
+	m.todos = append(m.todos, strings.Join(lines, "\n"))
+}
+
+// template renders the migrated cue template, a single document is rendered at the top level
+// and multiple documents are rendered into the output list
+func (m *migration) template() (string, error) {
+	var b strings.Builder
+	for _, t := range m.todos {
+		b.WriteString(t + "\n\n")
+	}
+
+	names := make([]string, 0, len(m.tags))
+	for n := range m.tags {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		b.WriteString("// Values injected from the composite resource, adjust their types if they are not strings\n")
+	}
+	for _, n := range names {
+		fmt.Fprintf(&b, "_%s: string @tag(%s)\n", n, n)
+	}
+	b.WriteString("\n")
+
+	if len(m.docs) == 1 {
+		if doc, ok := m.docs[0].(map[string]interface{}); ok {
+			writeFields(&b, doc)
+			return formatTemplate(b.String())
+		}
+	}
+	b.WriteString("output: [\n")
+	for _, d := range m.docs {
+		writeValue(&b, d)
+		b.WriteString(",\n")
+	}
+	b.WriteString("]\n")
+	return formatTemplate(b.String())
+}
+
+// formatTemplate formats the rendered template with the cue formatter
+func formatTemplate(src string) (string, error) {
+	b, err := format.Source([]byte(src))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot format migrated template")
+	}
+	return string(b), nil
+}
+
+// writeFields writes the fields of the object sorted by label with apiVersion, kind and metadata first
+func writeFields(b *strings.Builder, obj map[string]interface{}) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	first := map[string]int{"apiVersion": 0, "kind": 1, "metadata": 2}
+	sort.Slice(keys, func(i, j int) bool {
+		fi, iok := first[keys[i]]
+		fj, jok := first[keys[j]]
+		switch {
+		case iok && jok:
+			return fi < fj
+		case iok != jok:
+			return iok
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		label := k
+		if !cueIdent.MatchString(k) {
+			l, _ := json.Marshal(k)
+			label = string(l)
+		}
+		b.WriteString(label + ": ")
+		writeValue(b, obj[k])
+		b.WriteString("\n")
+	}
+}
+
+// writeValue writes the value as cue, placeholders are written as references to their injected field
+func writeValue(b *strings.Builder, v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		b.WriteString("{\n")
+		writeFields(b, x)
+		b.WriteString("}")
+	case []interface{}:
+		b.WriteString("[\n")
+		for _, e := range x {
+			writeValue(b, e)
+			b.WriteString(",\n")
+		}
+		b.WriteString("]")
+	case string:
+		if m := placeholderRef.FindStringSubmatch(x); m != nil && m[0] == x {
+			b.WriteString("_" + m[1])
+			return
+		}
+		s, _ := json.Marshal(x)
+		b.WriteString(placeholderRef.ReplaceAllString(string(s), `\(_$1)`))
+	default:
+		s, _ := json.Marshal(x)
+		b.Write(s)
+	}
+}
+
+// manifest renders the CUEInput for the migrated template, the template is written as a
+// list of lines so it stays readable in yaml
+func (m *migration) manifest() ([]byte, error) {
+	tmpl, err := m.template()
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, l := range strings.Split(strings.TrimRight(tmpl, "\n"), "\n") {
+		// yaml quotes lines starting with a tab, indent with spaces instead
+		trimmed := strings.TrimLeft(l, "\t")
+		lines = append(lines, strings.Repeat("  ", len(l)-len(trimmed))+trimmed)
+	}
+
+	options := map[string]interface{}{}
+	if len(m.tags) > 0 {
+		inject := []interface{}{}
+		names := make([]string, 0, len(m.tags))
+		for n := range m.tags {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			inject = append(inject, map[string]interface{}{"name": n, "path": m.tags[n]})
+		}
+		options["inject"] = inject
+	}
+	if len(m.docs) != 1 {
+		options["expressions"] = []interface{}{"yaml.MarshalStream(output)"}
+	}
+
+	export := map[string]interface{}{
+		"target": "Resources",
+		"value":  lines,
+	}
+	if len(options) > 0 {
+		export["options"] = options
+	}
+	in := map[string]interface{}{
+		"apiVersion": "cue.fn.crossplane.io/v1beta1",
+		"kind":       "CUEInput",
+		"metadata":   map[string]interface{}{"name": m.name},
+		"export":     export,
+	}
+	return yaml.Marshal(in)
+}
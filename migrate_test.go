@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/ghodss/yaml"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestMigrateStep(t *testing.T) {
+	type want struct {
+		out string
+		err string
+	}
+
+	cases := map[string]struct {
+		reason string
+		step   string
+		want   want
+	}{
+		"GoTemplate": {
+			reason: "Documents only referencing XR fields should be translated and others marked TODO",
+			step: `
+step: render
+input:
+  apiVersion: gotemplating.fn.crossplane.io/v1beta1
+  kind: GoTemplate
+  source: Inline
+  inline:
+    template: |
+      apiVersion: example.org/v1
+      kind: Bucket
+      metadata:
+        name: {{ .observed.composite.resource.metadata.name | quote }}
+      spec:
+        region: "{{ .observed.composite.resource.spec.region }}-1"
+      ---
+      {{ range $i := until 2 }}
+      kind: ConfigMap
+      {{ end }}
+`,
+			want: want{
+				out: `apiVersion: cue.fn.crossplane.io/v1beta1
+export:
+  options:
+    inject:
+    - name: metadata_name
+      path: metadata.name
+    - name: spec_region
+      path: spec.region
+  target: Resources
+  value:
+  - '// TODO(migrate): translate the go template document below'
+  - // {{ range $i := until 2 }}
+  - '// kind: ConfigMap'
+  - // {{ end }}
+  - ""
+  - // Values injected from the composite resource, adjust their types if they are
+    not strings
+  - '_metadata_name: string @tag(metadata_name)'
+  - '_spec_region:   string @tag(spec_region)'
+  - ""
+  - 'apiVersion: "example.org/v1"'
+  - 'kind:       "Bucket"'
+  - 'metadata: {'
+  - '  name: _metadata_name'
+  - '}'
+  - 'spec: {'
+  - '  region: "\(_spec_region)-1"'
+  - '}'
+kind: CUEInput
+metadata:
+  name: render
+`,
+			},
+		},
+		"PatchAndTransform": {
+			reason: "Bases and plain FromCompositeFieldPath patches should be translated and others marked TODO",
+			step: `
+apiVersion: pt.fn.crossplane.io/v1beta1
+kind: Resources
+metadata:
+  name: pt
+resources:
+- name: first
+  base:
+    apiVersion: example.org/v1
+    kind: Bucket
+    metadata:
+      name: first
+  patches:
+  - fromFieldPath: spec.region
+    toFieldPath: spec.forProvider.region
+  - type: ToCompositeFieldPath
+    fromFieldPath: status.id
+- name: second
+  base:
+    apiVersion: example.org/v1
+    kind: Bucket
+`,
+			want: want{
+				out: `apiVersion: cue.fn.crossplane.io/v1beta1
+export:
+  options:
+    expressions:
+    - yaml.MarshalStream(output)
+    inject:
+    - name: spec_region
+      path: spec.region
+  target: Resources
+  value:
+  - '// TODO(migrate): translate the patch of resource "first" below'
+  - // {"fromFieldPath":"status.id","type":"ToCompositeFieldPath"}
+  - ""
+  - '// TODO(migrate): metadata.name of resource "second" is set from its patch and
+    transform name, function-cue derives composed resource names from it'
+  - ""
+  - // Values injected from the composite resource, adjust their types if they are
+    not strings
+  - '_spec_region: string @tag(spec_region)'
+  - ""
+  - 'output: ['
+  - '  {'
+  - '    apiVersion: "example.org/v1"'
+  - '    kind:       "Bucket"'
+  - '    metadata: {'
+  - '      name: "first"'
+  - '    }'
+  - '    spec: {'
+  - '      forProvider: {'
+  - '        region: _spec_region'
+  - '      }'
+  - '    }'
+  - '  },'
+  - '  {'
+  - '    apiVersion: "example.org/v1"'
+  - '    kind:       "Bucket"'
+  - '    metadata: {'
+  - '      name: "second"'
+  - '    }'
+  - '  },'
+  - ']'
+kind: CUEInput
+metadata:
+  name: pt
+`,
+			},
+		},
+		"UnsupportedInput": {
+			reason: "Inputs of other functions should return an error",
+			step: `
+apiVersion: kcl.fn.crossplane.io/v1beta1
+kind: KCLInput
+`,
+			want: want{
+				err: `cannot migrate function input "kcl.fn.crossplane.io/v1beta1", only gotemplating.fn.crossplane.io and pt.fn.crossplane.io inputs are supported`,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			out, err := migrateStep([]byte(tc.step))
+
+			if diff := cmp.Diff(tc.want.out, string(out)); diff != "" {
+				t.Errorf("%s\nmigrateStep(...): -want out, +got out:\n%s", tc.reason, diff)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, gotErr); diff != "" {
+				t.Errorf("%s\nmigrateStep(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestMigratedStepRuns(t *testing.T) {
+	out, err := migrateStep([]byte(`
+apiVersion: pt.fn.crossplane.io/v1beta1
+kind: Resources
+metadata:
+  name: pt
+resources:
+- name: bucket
+  base:
+    apiVersion: example.org/v1
+    kind: Bucket
+  patches:
+  - fromFieldPath: spec.region
+    toFieldPath: spec.forProvider.region
+`))
+	if err != nil {
+		t.Fatalf("migrateStep(...): %v", err)
+	}
+	b, err := yaml.YAMLToJSON(out)
+	if err != nil {
+		t.Fatalf("yaml.YAMLToJSON(...): %v", err)
+	}
+
+	f := &Function{log: logging.NewNopLogger()}
+	rsp, err := f.RunFunction(context.Background(), &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(string(b)),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","spec":{"region":"eu-west-1"}}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("f.RunFunction(...): %v", err)
+	}
+
+	want := map[string]*fnv1beta1.Resource{
+		"pt": {
+			Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"Bucket","metadata":{"name":"bucket"},"spec":{"forProvider":{"region":"eu-west-1"}}}`),
+		},
+	}
+	if diff := cmp.Diff(want, rsp.GetDesired().GetResources(), protocmp.Transform()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want resources, +got resources:\n%s\nresults: %v", diff, rsp.GetResults())
+	}
+}
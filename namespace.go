@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// clusterScopedKinds are the well known kinds that are not namespaced, the
+// function has no discovery so any other kind is assumed to be namespaced
+var clusterScopedKinds = map[schema.GroupKind]bool{
+	{Group: "", Kind: "Namespace"}:                                                  true,
+	{Group: "", Kind: "Node"}:                                                       true,
+	{Group: "", Kind: "PersistentVolume"}:                                           true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"}:                       true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"}:                true,
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}:               true,
+	{Group: "apiregistration.k8s.io", Kind: "APIService"}:                           true,
+	{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration"}:   true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration"}: true,
+	{Group: "storage.k8s.io", Kind: "StorageClass"}:                                 true,
+	{Group: "storage.k8s.io", Kind: "CSIDriver"}:                                    true,
+	{Group: "storage.k8s.io", Kind: "VolumeAttachment"}:                             true,
+	{Group: "scheduling.k8s.io", Kind: "PriorityClass"}:                             true,
+	{Group: "networking.k8s.io", Kind: "IngressClass"}:                              true,
+	{Group: "node.k8s.io", Kind: "RuntimeClass"}:                                    true,
+	{Group: "apiextensions.crossplane.io", Kind: "CompositeResourceDefinition"}:     true,
+	{Group: "apiextensions.crossplane.io", Kind: "Composition"}:                     true,
+	{Group: "apiextensions.crossplane.io", Kind: "EnvironmentConfig"}:               true,
+	{Group: "pkg.crossplane.io", Kind: "Provider"}:                                  true,
+	{Group: "pkg.crossplane.io", Kind: "Function"}:                                  true,
+	{Group: "pkg.crossplane.io", Kind: "Configuration"}:                             true,
+	{Group: "pkg.crossplane.io", Kind: "DeploymentRuntimeConfig"}:                   true,
+	{Group: "protection.crossplane.io", Kind: "ClusterUsage"}:                       true,
+}
+
+// clusterScoped returns whether the resource is of a well known cluster scoped
+// kind
+func clusterScoped(u *unstructured.Unstructured) bool {
+	return clusterScopedKinds[u.GroupVersionKind().GroupKind()]
+}
+
+// xrNamespace is the namespace of a namespaced XR, Crossplane composes the
+// resources of a namespaced XR in its namespace
+type xrNamespace string
+
+// newXRNamespace returns the namespace of the XR, empty when the XR is cluster
+// scoped or there is no XR
+func newXRNamespace(xr *resource.Composite) xrNamespace {
+	if xr == nil || xr.Resource == nil {
+		return ""
+	}
+	return xrNamespace(xr.Resource.GetNamespace())
+}
+
+// apply sets the namespace of the XR on the resource when the resource does not
+// set one and is not of a cluster scoped kind
+func (ns xrNamespace) apply(u *unstructured.Unstructured) {
+	if ns == "" || u.GetNamespace() != "" || clusterScoped(u) {
+		return
+	}
+	u.SetNamespace(string(ns))
+}
+
+// compositeScope returns the content of the XR filled into the scope of the
+// template, its metadata.namespace is always set, empty when the XR is cluster
+// scoped, so that templates can reference it without defaults
+func compositeScope(xr *resource.Composite) map[string]interface{} {
+	content := xr.Resource.UnstructuredContent()
+	if meta, ok := content["metadata"].(map[string]interface{}); ok {
+		if _, ok := meta["namespace"]; ok {
+			return content
+		}
+	}
+	out := make(map[string]interface{}, len(content)+1)
+	for k, v := range content {
+		out[k] = v
+	}
+	meta := map[string]interface{}{"namespace": ""}
+	if m, ok := content["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			meta[k] = v
+		}
+	}
+	out["metadata"] = meta
+	return out
+}
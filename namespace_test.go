@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestXRNamespace(t *testing.T) {
+	namespaced := &resource.Composite{Resource: composite.New()}
+	namespaced.Resource.SetNamespace("team-a")
+
+	cases := map[string]struct {
+		reason string
+		xr     *resource.Composite
+		obj    map[string]interface{}
+		want   string
+	}{
+		"ClusterScopedXR": {
+			reason: "Nothing should be set for a cluster scoped XR",
+			xr:     &resource.Composite{Resource: composite.New()},
+			obj:    map[string]interface{}{"apiVersion": "s3.aws.m.upbound.io/v1beta1", "kind": "Bucket"},
+		},
+		"Namespaced": {
+			reason: "The namespace of the XR should be set on a namespaced resource",
+			xr:     namespaced,
+			obj:    map[string]interface{}{"apiVersion": "s3.aws.m.upbound.io/v1beta1", "kind": "Bucket"},
+			want:   "team-a",
+		},
+		"ResourceWins": {
+			reason: "The namespace the resource sets should keep its value",
+			xr:     namespaced,
+			obj: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"namespace": "team-b"},
+			},
+			want: "team-b",
+		},
+		"ClusterScopedKind": {
+			reason: "Nothing should be set on a cluster scoped kind",
+			xr:     namespaced,
+			obj:    map[string]interface{}{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRole"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			u := &unstructured.Unstructured{Object: tc.obj}
+			newXRNamespace(tc.xr).apply(u)
+			if diff := cmp.Diff(tc.want, u.GetNamespace()); diff != "" {
+				t.Errorf("%s\napply(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCompositeScope(t *testing.T) {
+	xr := &resource.Composite{Resource: composite.New()}
+	xr.Resource.SetName("my-xr")
+
+	got := compositeScope(xr)
+	want := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "my-xr", "namespace": ""},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("compositeScope(...): -want, +got:\n%s", diff)
+	}
+	if _, ok := xr.Resource.Object["metadata"].(map[string]interface{})["namespace"]; ok {
+		t.Errorf("compositeScope(...): the namespace should not be set on the XR")
+	}
+}
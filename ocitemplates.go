@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+const (
+	// defaultOCITemplateRefresh is the default interval at which the tags of
+	// the templates are resolved again
+	defaultOCITemplateRefresh = time.Minute
+	// ociTemplateCacheSize is the number of template manifests cached
+	ociTemplateCacheSize = 64
+)
+
+// ociTemplateSource resolves templates pushed to an OCI registry, a template
+// is fetched from the repository named after it under the location of the
+// source, tagged with its version or pinned by its manifest digest. The
+// template is the single .cue file at the root of the application/zip layer of
+// the artifact, the layout of a published CUE module. A tag resolves to the
+// digest of its manifest again once it is older than the refresh interval, the
+// templates of a manifest are immutable and cached until they are evicted from
+// a full cache. When the registry cannot be reached the template of the
+// manifest a tag last resolved to is served stale while it is cached.
+type ociTemplateSource struct {
+	client *http.Client
+	scheme string
+	host   string
+	// prefix is the repository prefix the repositories of the templates are
+	// named under
+	prefix   string
+	username string
+	password string
+	refresh  time.Duration
+	now      func() time.Time
+
+	mu   sync.Mutex
+	tags map[string]resolvedTag
+	// templates are keyed by the repository and digest of their manifest
+	templates map[string]string
+	// order of the cached templates, the oldest first
+	order []string
+}
+
+// resolvedTag is the manifest digest a tag resolved to and the time it resolved
+type resolvedTag struct {
+	digest   string
+	resolved time.Time
+}
+
+// newOCITemplateSource returns a template source for the registry location in
+// <host>[/<prefix>][?insecure=true][&credentials=<dir>][&refresh=<duration>]
+// form, the credentials directory holds the username and password files of
+// the registry
+func newOCITemplateSource(location string) (*ociTemplateSource, error) {
+	ref, rawQuery, _ := strings.Cut(location, "?")
+	if ref == "" {
+		return nil, errors.New("registry location is required")
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid options %q", rawQuery)
+	}
+	host, prefix := registryRepository(ref, "")
+	src := &ociTemplateSource{
+		client:    &http.Client{Timeout: registryTimeout},
+		scheme:    "https",
+		host:      host,
+		prefix:    prefix,
+		refresh:   defaultOCITemplateRefresh,
+		now:       time.Now,
+		tags:      map[string]resolvedTag{},
+		templates: map[string]string{},
+	}
+	for k := range query {
+		switch k {
+		case "insecure":
+			if query.Get(k) == "true" {
+				src.scheme = "http"
+			}
+		case "credentials":
+			dir := query.Get(k)
+			if src.username, src.password, err = readCredentials(filepath.Dir(dir), filepath.Base(dir)); err != nil {
+				return nil, err
+			}
+		case "refresh":
+			if src.refresh, err = time.ParseDuration(query.Get(k)); err != nil {
+				return nil, errors.Wrapf(err, "invalid refresh %q", query.Get(k))
+			}
+		default:
+			return nil, errors.Errorf("unknown option %q, supported options: credentials, insecure, refresh", k)
+		}
+	}
+	return src, nil
+}
+
+// Resolve returns the template referenced by ref, and whether it is served
+// stale. A registry that does not hold the repository or tag of the template
+// returns a templateNotFoundError. When the registry cannot be reached the
+// template of the manifest the tag last resolved to is served stale while it
+// is cached.
+func (s *ociTemplateSource) Resolve(ref v1beta1.TemplateRef) (string, *staleValue, error) {
+	repo := path.Join(s.prefix, ref.Name)
+	value, err := s.resolve(repo, ref)
+	if err == nil {
+		return value, nil, nil
+	}
+	if !isRegistryUnavailable(err) {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	t, ok := s.tags[s.tagKey(repo, ref.Version)]
+	if ok {
+		value, ok = s.templates[s.templateKey(repo, t.digest)]
+	}
+	s.mu.Unlock()
+	if !ok {
+		return "", nil, err
+	}
+	source := fmt.Sprintf("template %q version %q of registry %s", ref.Name, ref.Version, path.Join(s.host, s.prefix))
+	return value, &staleValue{source: source, age: s.now().Sub(t.resolved), err: err}, nil
+}
+
+// resolve returns the template referenced by ref from the repository
+func (s *ociTemplateSource) resolve(repo string, ref v1beta1.TemplateRef) (string, error) {
+	// A client is created for each fetch as it holds the token of the
+	// registry, templates are resolved concurrently
+	c := &registryClient{client: s.client, scheme: s.scheme, host: s.host, username: s.username, password: s.password}
+	notFound := templateNotFoundError{msg: fmt.Sprintf("template %q has no version %q in registry %s", ref.Name, ref.Version, path.Join(s.host, s.prefix))}
+	digest, m, resolved, err := s.digest(c, repo, ref.Version)
+	if isRegistryNotFound(err) {
+		return "", notFound
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot resolve template %q version %q", ref.Name, ref.Version)
+	}
+
+	key := s.templateKey(repo, digest)
+	s.mu.Lock()
+	value, ok := s.templates[key]
+	s.mu.Unlock()
+	if !ok {
+		if m == nil {
+			manifest, _, err := c.manifest(repo, digest)
+			if isRegistryNotFound(err) {
+				return "", notFound
+			}
+			if err != nil {
+				return "", errors.Wrapf(err, "cannot fetch template %q version %q", ref.Name, ref.Version)
+			}
+			m = &manifest
+		}
+		b, err := c.layerZip(repo, *m)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot fetch template %q version %q", ref.Name, ref.Version)
+		}
+		files, err := unzipModule(b)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot read template %q version %q", ref.Name, ref.Version)
+		}
+		if value, err = templateFile(files); err != nil {
+			return "", errors.Wrapf(err, "cannot read template %q version %q", ref.Name, ref.Version)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[key]; !ok {
+		if len(s.order) >= ociTemplateCacheSize {
+			delete(s.templates, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.order = append(s.order, key)
+		s.templates[key] = value
+	}
+	// The tag resolves to the digest once its template is read, so that a
+	// template that cannot be fetched keeps the template of the previous
+	// manifest
+	if resolved != nil {
+		s.tags[s.tagKey(repo, ref.Version)] = *resolved
+	}
+	return value, nil
+}
+
+// digest returns the manifest digest the version of the repository resolves
+// to, a digest is used as is. A tag resolved again is returned along with the
+// manifest fetched to resolve it.
+func (s *ociTemplateSource) digest(c *registryClient, repo, version string) (string, *ociManifest, *resolvedTag, error) {
+	if strings.HasPrefix(version, "sha256:") {
+		return version, nil, nil, nil
+	}
+	s.mu.Lock()
+	t, ok := s.tags[s.tagKey(repo, version)]
+	s.mu.Unlock()
+	if ok && s.now().Sub(t.resolved) < s.refresh {
+		return t.digest, nil, nil, nil
+	}
+
+	m, digest, err := c.manifest(repo, version)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return digest, &m, &resolvedTag{digest: digest, resolved: s.now()}, nil
+}
+
+// tagKey is the key of the tag of the repository in the resolved tags
+func (s *ociTemplateSource) tagKey(repo, tag string) string {
+	return fmt.Sprintf("%s/%s:%s", s.host, repo, tag)
+}
+
+// templateKey is the key of the template of the manifest of the repository in
+// the cached templates
+func (s *ociTemplateSource) templateKey(repo, digest string) string {
+	return fmt.Sprintf("%s/%s@%s", s.host, repo, digest)
+}
+
+// isRegistryUnavailable returns whether the registry could not be reached or
+// failed to serve a request, as opposed to not holding the requested manifest
+// or blob
+func isRegistryUnavailable(err error) bool {
+	se := registryStatusError{}
+	if errors.As(err, &se) {
+		return se.code != http.StatusNotFound
+	}
+	ue := &url.Error{}
+	return errors.As(err, &ue)
+}
+
+// templateFile returns the single .cue file at the root of the files of a
+// template artifact
+func templateFile(files map[string]string) (string, error) {
+	var names []string
+	for name := range files {
+		if !strings.Contains(name, "/") && path.Ext(name) == templateExt {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) != 1 {
+		return "", errors.Errorf("want a single %s file at the root of the artifact, found %d: %s", templateExt, len(names), strings.Join(names, ", "))
+	}
+	return files[names[0]], nil
+}
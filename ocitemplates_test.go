@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOCITemplateSource(t *testing.T) {
+	reg := &fakeRegistry{username: "robot", password: "hunter2", manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	reg.push(t, "templates/bucket", "v2", map[string]string{
+		"cue.mod/module.cue": "module: \"example.org/templates/bucket\"\n",
+		"bucket.cue":         "kind: \"Bucket\"\n",
+	})
+	reg.push(t, "templates/network", "v1", map[string]string{
+		"vpc.cue":    "kind: \"VPC\"\n",
+		"subnet.cue": "kind: \"Subnet\"\n",
+	})
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	creds := filepath.Join(t.TempDir(), "platform")
+	if err := os.MkdirAll(creds, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"username": "robot\n", "password": "hunter2\n"} {
+		if err := os.WriteFile(filepath.Join(creds, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := newOCITemplateSource(host + "/templates?insecure=true&credentials=" + creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketDigest := sha256Digest(reg.manifests["/v2/templates/bucket/manifests/v2"])
+	wrongDigest := "sha256:" + strings.Repeat("0", 64)
+
+	type want struct {
+		value string
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		ref    v1beta1.TemplateRef
+		want   want
+	}{
+		"Template": {
+			reason: "The template should be the .cue file at the root of the artifact tagged with its version",
+			ref:    v1beta1.TemplateRef{Name: "bucket", Version: "v2"},
+			want:   want{value: "kind: \"Bucket\"\n"},
+		},
+		"ManifestDigest": {
+			reason: "A version pinned by its manifest digest should be fetched by digest",
+			ref:    v1beta1.TemplateRef{Name: "bucket", Version: bucketDigest},
+			want:   want{value: "kind: \"Bucket\"\n"},
+		},
+		"UnknownManifestDigest": {
+			reason: "A manifest digest the registry does not hold should fall through to the next source",
+			ref:    v1beta1.TemplateRef{Name: "bucket", Version: wrongDigest},
+			want:   want{err: templateNotFoundError{msg: "template \"bucket\" has no version \"" + wrongDigest + "\" in registry " + host + "/templates"}},
+		},
+		"UnknownVersion": {
+			reason: "A version the registry does not hold should fall through to the next source",
+			ref:    v1beta1.TemplateRef{Name: "bucket", Version: "v3"},
+			want:   want{err: templateNotFoundError{msg: "template \"bucket\" has no version \"v3\" in registry " + host + "/templates"}},
+		},
+		"SeveralFiles": {
+			reason: "An artifact holding several .cue files should not be guessed from",
+			ref:    v1beta1.TemplateRef{Name: "network", Version: "v1"},
+			want:   want{err: errors.Wrap(errors.New("want a single .cue file at the root of the artifact, found 2: subnet.cue, vpc.cue"), "cannot read template \"network\" version \"v1\"")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			value, _, err := src.Resolve(tc.ref)
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nsrc.Resolve(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\nsrc.Resolve(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+		})
+	}
+
+	// A tag resolved within the refresh interval should be served from the cache
+	requests := reg.requests
+	if _, _, err := src.Resolve(v1beta1.TemplateRef{Name: "bucket", Version: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if reg.requests != requests {
+		t.Errorf("src.Resolve(...): want the cached template, got %d manifest requests", reg.requests-requests)
+	}
+}
+
+func TestOCITemplateSourceRefresh(t *testing.T) {
+	reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	reg.push(t, "bucket", "v1", map[string]string{"bucket.cue": "kind: \"Bucket\"\n"})
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+
+	src, err := newOCITemplateSource(strings.TrimPrefix(srv.URL, "http://") + "?insecure=true&refresh=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	src.now = func() time.Time { return now }
+	ref := v1beta1.TemplateRef{Name: "bucket", Version: "v1"}
+	if _, _, err := src.Resolve(ref); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag is moved to another manifest
+	reg.push(t, "bucket", "v1", map[string]string{"bucket.cue": "kind: \"BucketV2\"\n"})
+
+	cases := []struct {
+		reason string
+		after  time.Duration
+		want   string
+	}{
+		{
+			reason: "A tag resolved within the refresh interval should keep its manifest",
+			after:  30 * time.Second,
+			want:   "kind: \"Bucket\"\n",
+		},
+		{
+			reason: "A tag older than the refresh interval should resolve to the manifest it was moved to",
+			after:  90 * time.Second,
+			want:   "kind: \"BucketV2\"\n",
+		},
+	}
+	for _, tc := range cases {
+		now = start.Add(tc.after)
+		got, _, err := src.Resolve(ref)
+		if err != nil {
+			t.Fatalf("%s\nsrc.Resolve(...): unexpected error: %v", tc.reason, err)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s\nsrc.Resolve(...): -want, +got:\n%s", tc.reason, diff)
+		}
+	}
+}
+
+func TestRunFunctionStaleOCITemplate(t *testing.T) {
+	template := "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nmetadata: name: \"bucket\"\n"
+	reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	reg.push(t, "bucket", "v1", map[string]string{"bucket.cue": template})
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	src, err := newOCITemplateSource(host + "?insecure=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	src.now = func() time.Time { return now }
+	metrics := prometheus.NewRegistry()
+	f := &Function{log: logging.NewNopLogger(), templates: templateSources{src}, metrics: newMetrics(metrics, nil)}
+
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "bucket"},
+			"export": {
+				"target": "Resources",
+				"templateRef": {"name": "bucket", "version": "v1"}
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+			},
+		},
+	}
+	if _, err := f.RunFunction(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	reg.unavailable = true
+	now = start.Add(90 * time.Second)
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fatalResult(rsp); err != nil {
+		t.Fatalf("RunFunction(...): unexpected fatal result: %v", err)
+	}
+	if _, ok := rsp.GetDesired().GetResources()["bucket"]; !ok {
+		t.Errorf("RunFunction(...): want the resource rendered from the stale template, got %v", rsp.GetDesired().GetResources())
+	}
+	var warnings []string
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_WARNING {
+			warnings = append(warnings, r.GetMessage())
+		}
+	}
+	want := []string{"serving a stale copy of template \"bucket\" version \"v1\" of registry " + host + " fetched 1m30s ago: cannot refresh it: cannot resolve template \"bucket\" version \"v1\": cannot fetch manifest: unexpected status 503 Service Unavailable from /v2/bucket/manifests/v1"}
+	if diff := cmp.Diff(want, warnings); diff != "" {
+		t.Errorf("RunFunction(...): -want warnings, +got warnings:\n%s", diff)
+	}
+
+	wantMetrics := `
+# HELP function_cue_stale_value_age_seconds Age in seconds of the last value served stale because its remote source could not be refreshed, by source. It is reset to 0 once the source is refreshed.
+# TYPE function_cue_stale_value_age_seconds gauge
+function_cue_stale_value_age_seconds{source="template"} 90
+`
+	if err := testutil.GatherAndCompare(metrics, strings.NewReader(wantMetrics), "function_cue_stale_value_age_seconds"); err != nil {
+		t.Errorf("GatherAndCompare(...): %v", err)
+	}
+
+	// A template that was never fetched is not served stale
+	req.Input = resource.MustStructJSON(`{
+		"apiVersion": "cue.fn.crossplane.io/v1beta1",
+		"kind": "CUEInput",
+		"metadata": {"name": "bucket"},
+		"export": {
+			"target": "Resources",
+			"templateRef": {"name": "bucket", "version": "v2"}
+		}
+	}`)
+	rsp, err = f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fatalResult(rsp) == nil {
+		t.Errorf("RunFunction(...): want a fatal result for a template that cannot be fetched")
+	}
+}
+
+func TestRunFunctionOCITemplateDigest(t *testing.T) {
+	template := "apiVersion: \"example.org/v1\"\nkind: \"Bucket\"\nmetadata: name: \"bucket\"\n"
+	reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	reg.push(t, "bucket", "v1", map[string]string{"bucket.cue": template})
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	src, err := newOCITemplateSource(strings.TrimPrefix(srv.URL, "http://") + "?insecure=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongDigest := "sha256:" + strings.Repeat("0", 64)
+
+	cases := map[string]struct {
+		reason    string
+		digest    string
+		wantFatal string
+	}{
+		"Unpinned": {
+			reason: "A template without a digest should be compiled",
+		},
+		"Pinned": {
+			reason: "A template matching its pinned digest should be compiled",
+			digest: sha256Digest([]byte(template)),
+		},
+		"DigestMismatch": {
+			reason:    "A template not matching its pinned digest should fail the function",
+			digest:    wrongDigest,
+			wantFatal: "cannot verify template \"bucket\": digest " + sha256Digest([]byte(template)) + " does not match the pinned digest " + wrongDigest,
+		},
+		"InvalidDigest": {
+			reason:    "A digest that is not in sha256:<hex> form should be rejected",
+			digest:    "md5:0f1e",
+			wantFatal: "invalid function input: invalid templateRef digest \"md5:0f1e\": must be sha256:<hex>",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), templates: templateSources{src}}
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(`{
+					"apiVersion": "cue.fn.crossplane.io/v1beta1",
+					"kind": "CUEInput",
+					"metadata": {"name": "bucket"},
+					"export": {
+						"target": "Resources",
+						"templateRef": {"name": "bucket", "version": "v1", "digest": "` + tc.digest + `"}
+					}
+				}`),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if err := fatalResult(rsp); err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.wantFatal, got); diff != "" {
+				t.Errorf("%s\nRunFunction(...): -want fatal result, +got fatal result:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestNewOCITemplateSource(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		location string
+		want     *ociTemplateSource
+		err      error
+	}{
+		"Prefix": {
+			reason:   "The repositories of the templates should be named under the prefix of the location",
+			location: "registry.example.org/platform/templates/",
+			want:     &ociTemplateSource{scheme: "https", host: "registry.example.org", prefix: "platform/templates", refresh: defaultOCITemplateRefresh},
+		},
+		"Insecure": {
+			reason:   "An insecure registry should be fetched from over plain HTTP",
+			location: "localhost:5000?insecure=true",
+			want:     &ociTemplateSource{scheme: "http", host: "localhost:5000", refresh: defaultOCITemplateRefresh},
+		},
+		"Refresh": {
+			reason:   "The tags of the templates should be resolved again at the refresh interval of the location",
+			location: "registry.example.org?refresh=5m",
+			want:     &ociTemplateSource{scheme: "https", host: "registry.example.org", refresh: 5 * time.Minute},
+		},
+		"UnknownOption": {
+			reason:   "An unknown option should return an error",
+			location: "registry.example.org?tls=false",
+			err:      errors.New("unknown option \"tls\", supported options: credentials, insecure, refresh"),
+		},
+		"Empty": {
+			reason: "A location without a registry should return an error",
+			err:    errors.New("registry location is required"),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := newOCITemplateSource(tc.location)
+			if diff := cmp.Diff(tc.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nnewOCITemplateSource(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(ociTemplateSource{}), cmpopts.IgnoreFields(ociTemplateSource{}, "client", "now", "mu", "tags", "templates", "order")); diff != "" {
+				t.Errorf("%s\nnewOCITemplateSource(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
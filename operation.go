@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/response"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// runMode determines the Crossplane function semantics RunFunction follows
+type runMode string
+
+const (
+	// runModeComposition runs the function as a composition function
+	runModeComposition runMode = "composition"
+	// runModeOperation runs the function as an operation function
+	runModeOperation runMode = "operation"
+)
+
+// runOperation runs the function with operation function semantics
+//
+// Operations have no composite resource, so the cue template cannot inject
+// values from the XR or target it, and connection details and readiness are
+// not propagated. The compiled documents are added to the desired resources
+// that the operation applies.
+func (f *Function) runOperation(ctx context.Context, req *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
+	log := f.log.WithValues("tag", req.GetMeta().GetTag(), "mode", runModeOperation)
+	log.Info("Running Operation")
+
+	rsp := response.To(req, response.DefaultTTL)
+
+	var in *v1beta1.CUEInput
+	err := recoverPhase(log, requestIDs{tag: req.GetMeta().GetTag()}, "input", func() error {
+		var warnings []*fnv1beta1.Result
+		var err error
+		in, warnings, err = f.getInput(ctx, req)
+		rsp.Results = append(rsp.Results, warnings...)
+		return err
+	})
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	if err := validateOperationInput(in); err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "invalid operation input"))
+		return rsp, nil
+	}
+
+	// The resources desired by any previous Functions in the pipeline.
+	desired, err := request.GetDesiredComposedResources(req)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot get desired resources from %T", req))
+		return rsp, nil
+	}
+
+	ids := requestIDs{tag: req.GetMeta().GetTag()}
+
+	// The ttl of the export is the ttl of the response like in compositions
+	rsp.Meta.Ttl = durationpb.New(responseTTL(in))
+
+	fnctx, err := getContext(req)
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	meta := f.metaScope(req, rsp, nil)
+
+	// An export whose when expression is false is skipped, operations have
+	// no observed state so it is evaluated against the context and metadata
+	skipped, err := exportSkipped(in, map[string]interface{}{
+		contextDef: fnctx.AsMap(),
+		metaDef:    meta,
+	})
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	if skipped != nil {
+		log.Debug("Skipping export, when evaluated to false")
+		rsp.Results = append(rsp.Results, skipped)
+		return rsp, nil
+	}
+
+	opts := compileOpts{
+		parseData: true,
+		now:       f.injectedNow(in),
+		meta:      meta,
+	}
+	if in.Export.Options.InjectRequest {
+		if opts.request, err = requestScope(req); err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot inject request"))
+			return rsp, nil
+		}
+	}
+
+	log.Info("compiling cue template from input")
+	var cmpOut compileOutput
+	err = f.evaluate(ctx, in, func(ctx context.Context) error {
+		return recoverPhase(log, ids, "compile", func() error {
+			var err error
+			cmpOut, err = f.compile(ctx, outputJSON, *in, opts)
+			return err
+		})
+	})
+	if err != nil {
+		compileFailed(log, rsp, err)
+		f.artifacts.dump(log, rsp, ids, artifact{Phase: "compile", Input: *in})
+		return rsp, nil
+	}
+
+	// Results raised by the template, a fatal result fails the pipeline
+	// without changing the desired state
+	tmplResults, fatal, err := templateResults(cmpOut.results)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot get results from template"))
+		return rsp, nil
+	}
+	if fatal {
+		rsp.Results = append(rsp.Results, tmplResults...)
+		return rsp, nil
+	}
+
+	// The documents are shaped like in compositions, the connection details
+	// they are annotated with are dropped since there is no composite
+	if err := shapeDocuments(log, ids, in, &cmpOut); err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	routed, err := routeData(in.Export.Routes, in.Export.Target, cmpOut.data)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot route documents"))
+		return rsp, nil
+	}
+	var outputs []successOutput
+	for _, rd := range routed {
+		if err := operationTarget(rd.target); err != nil {
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+		violations, err := f.schemas.check(in.Export.Options.ValidationPolicy, rd.target, rd.data)
+		if err != nil {
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+		var output successOutput
+		err = recoverPhase(log, ids, "match", func() error {
+			var err error
+			output, err = applyTarget(rd.target, rd.data, targetState{
+				in:      in,
+				desired: desired,
+				ctx:     ctx,
+				tracer:  f.tracer,
+			})
+			return err
+		})
+		f.metrics.observeTarget(rd.target, len(rd.data), err)
+		if err != nil {
+			response.Fatal(rsp, err)
+			f.artifacts.dump(log, rsp, ids, artifact{Phase: "match", Input: *in, Output: f.redactor.render(cmpOut)})
+			return rsp, nil
+		}
+		output.warnings = append(output.warnings, violations...)
+		outputs = append(outputs, output)
+	}
+
+	if err := response.SetDesiredComposedResources(rsp, desired); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired resources in %T", rsp))
+		return rsp, nil
+	}
+	warnings, err := sizeWarnings(desired, f.sizeWarning)
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	for _, output := range outputs {
+		output.setSuccessResults()
+		f.redactor.objectResults(output.results)
+		rsp.Results = append(rsp.Results, output.successResults()...)
+		rsp.Results = append(rsp.Results, output.warningResults()...)
+	}
+	for _, msg := range warnings {
+		rsp.Results = append(rsp.Results, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+			Message:  msg,
+		})
+	}
+	rsp.Results = append(rsp.Results, tmplResults...)
+	rsp.Results = append(rsp.Results, incompleteResults(cmpOut.incomplete)...)
+	if in.Export.Options.ResultsMode != v1beta1.ResultsNone {
+		rsp.Results = append(rsp.Results, expressionResults(cmpOut.expressions)...)
+	}
+
+	log.Info("Successfully processed function-cue operation", "input", in.Name)
+
+	return rsp, nil
+}
+
+// validateOperationInput checks the input only uses features available to operations
+func validateOperationInput(in *v1beta1.CUEInput) error {
+	if len(in.Exports) != 0 {
+		return errors.New("exports are not supported by operations")
+	}
+	if len(in.Export.Options.Inject) != 0 {
+		return errors.New("inject is not supported without a composite resource")
+	}
+	if in.Export.Options.Diff {
+		return errors.New("diff is not supported without a composite resource")
+	}
+	if in.Export.Prune {
+		return errors.New("prune is not supported without a composite resource")
+	}
+	// The options reading or writing the composite resource are rejected
+	// rather than ignored
+	o := in.Export.Options
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"compositeReady", o.CompositeReady != ""},
+		{"autoReady", o.AutoReady},
+		{"propagateMetadata", o.PropagateMetadata != nil},
+		{"externalName", o.ExternalName != nil},
+		{"resultsTarget " + string(o.ResultsTarget), o.ResultsTarget == v1beta1.ResultsTargetCompositeAndClaim},
+	} {
+		if opt.set {
+			return fmt.Errorf("%s is not supported without a composite resource", opt.name)
+		}
+	}
+	targets := []v1beta1.Target{in.Export.Target}
+	for _, r := range in.Export.Routes {
+		targets = append(targets, r.Target)
+	}
+	for _, x := range in.Export.Expressions {
+		if x.Target != "" {
+			targets = append(targets, x.Target)
+		}
+	}
+	for _, t := range targets {
+		if err := operationTarget(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// operationTarget checks the target is available to operations, including the
+// targets documents are annotated with
+func operationTarget(t v1beta1.Target) error {
+	switch t {
+	case v1beta1.Resources, v1beta1.PatchDesired, v1beta1.PatchResources:
+	default:
+		return fmt.Errorf("target %s is not supported without a composite resource", t)
+	}
+	return nil
+}
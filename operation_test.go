@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestRunOperation(t *testing.T) {
+	frozen := time.Date(2023, time.September, 1, 10, 30, 0, 0, time.UTC)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1beta1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1beta1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ResourcesWithoutXR": {
+			reason: "The Function should create resources without an observed composite resource",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"target": "Resources",
+							"value": "apiVersion: \"example.org/v1\"\nkind: \"Rotation\"\nmetadata: name: \"rotate\""
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"rotate:Rotation\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Resources: map[string]*fnv1beta1.Resource{
+							"rotate": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"Rotation","metadata":{"name":"rotate"}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InjectFrozenTime": {
+			reason: "The Function should inject its frozen time as #now when the input opts in",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"options": {
+								"inject_now": true
+							},
+							"target": "Resources",
+							"value": "#now: string\napiVersion: \"example.org/v1\"\nkind: \"Rotation\"\nmetadata: name: \"rotate\"\nmetadata: annotations: \"example.org/rotated-at\": #now"
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \"rotate:Rotation\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Resources: map[string]*fnv1beta1.Resource{
+							"rotate": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"Rotation","metadata":{"name":"rotate","annotations":{"example.org/rotated-at":"2023-09-01T10:30:00Z"}}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"XRTargetUnsupported": {
+			reason: "The Function should return a fatal result when targeting the XR",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"target": "XR",
+							"value": "metadata: name: \"rotate\""
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid operation input: target XR is not supported without a composite resource",
+						},
+					},
+				},
+			},
+		},
+		"InjectUnsupported": {
+			reason: "The Function should return a fatal result when injecting tags",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"options": {
+								"inject": [
+									{
+										"name": "name",
+										"path": "metadata.name"
+									}
+								]
+							},
+							"target": "Resources",
+							"value": "name: string @tag(name)"
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid operation input: inject is not supported without a composite resource",
+						},
+					},
+				},
+			},
+		},
+		"WhenFalseWithTTL": {
+			reason: "The Function should skip an export whose when expression is false and keep its ttl",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "nightly"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"options": {
+								"ttl": "30s"
+							},
+							"target": "Resources",
+							"when": "#meta.tag == \"hourly\"",
+							"value": "apiVersion: \"example.org/v1\"\nkind: \"Rotation\"\nmetadata: name: \"rotate\""
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "nightly", Ttl: durationpb.New(30 * time.Second)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "skipped export to Resources: when evaluated to false",
+						},
+					},
+				},
+			},
+		},
+		"KubernetesObject": {
+			reason: "The Function should wrap the documents into provider-kubernetes Objects like in compositions",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"options": {
+								"kubernetesObject": {}
+							},
+							"target": "Resources",
+							"value": "apiVersion: \"v1\"\nkind: \"ConfigMap\"\nmetadata: name: \"rotate\""
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						withReason(&fnv1beta1.Result{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "created resource \":Object\"",
+						}, string(actionCreated)),
+					},
+					Desired: &fnv1beta1.State{
+						Resources: map[string]*fnv1beta1.Resource{
+							"configmap-rotate": {
+								Resource: resource.MustStructJSON(`{"apiVersion":"kubernetes.crossplane.io/v1alpha2","kind":"Object","metadata":{},"spec":{"forProvider":{"manifest":{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"rotate"}}}}}`),
+							},
+						},
+					},
+				},
+			},
+		},
+		"CompositeReadyUnsupported": {
+			reason: "The Function should return a fatal result rather than ignore compositeReady",
+			args: args{
+				req: &fnv1beta1.RunFunctionRequest{
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "dummy.fn.crossplane.io",
+						"kind": "dummy",
+						"metadata": {
+							"name": "rotate"
+						},
+						"export": {
+							"options": {
+								"compositeReady": "true"
+							},
+							"target": "Resources",
+							"value": "apiVersion: \"example.org/v1\"\nkind: \"Rotation\"\nmetadata: name: \"rotate\""
+						}
+					}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid operation input: compositeReady is not supported without a composite resource",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{
+				log:  logging.NewNopLogger(),
+				mode: runModeOperation,
+				now:  func() time.Time { return frozen },
+			}
+			// The evaluation of the templates is bound to the context of the request
+			ctx := tc.args.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			rsp, err := f.RunFunction(ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// applyOverrides unifies the overrides with the compiled documents they match
+// Overrides are applied in order, a document that conflicts with an override returns an error
+func applyOverrides(overrides []v1beta1.Override, data []map[string]interface{}) ([]map[string]interface{}, error) {
+	if len(overrides) == 0 {
+		return data, nil
+	}
+
+	ctx := cuecontext.New()
+	values := make([]cue.Value, len(overrides))
+	for i, o := range overrides {
+		values[i] = ctx.CompileString(o.Value, cue.Filename(fmt.Sprintf("overrides[%d]", i)))
+		if err := values[i].Err(); err != nil {
+			return data, errors.Wrapf(err, "cannot compile override at index %d", i)
+		}
+	}
+
+	out := make([]map[string]interface{}, len(data))
+	for i, d := range data {
+		u := unstructured.Unstructured{Object: d}
+		v := ctx.Encode(d)
+		for j, o := range overrides {
+			if !o.Match.Matches(u.GetAPIVersion(), u.GetKind(), u.GetName()) {
+				continue
+			}
+			v = v.Unify(values[j])
+			if err := v.Validate(cue.Concrete(true)); err != nil {
+				return data, errors.Wrapf(err, "cannot apply override at index %d to %q", j, u.GetName())
+			}
+		}
+
+		out[i] = map[string]interface{}{}
+		if err := v.Decode(&out[i]); err != nil {
+			return data, errors.Wrapf(err, "cannot decode overridden document %q", u.GetName())
+		}
+	}
+	return out, nil
+}
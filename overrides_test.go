@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	type args struct {
+		overrides []v1beta1.Override
+		data      []map[string]interface{}
+	}
+	type want struct {
+		data []map[string]interface{}
+		err  string
+	}
+
+	data := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{
+				"apiVersion": "nobu.dev/v1",
+				"kind":       "Cluster",
+				"metadata":   map[string]interface{}{"name": "cluster"},
+				"spec":       map[string]interface{}{"replicas": float64(1)},
+			},
+			{
+				"apiVersion": "nobu.dev/v1",
+				"kind":       "Nodepool",
+				"metadata":   map[string]interface{}{"name": "nodepool"},
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NoOverrides": {
+			reason: "The data should be returned unchanged without overrides",
+			args:   args{data: data()},
+			want:   want{data: data()},
+		},
+		"MatchedDocuments": {
+			reason: "Overrides should only be unified with the documents they match",
+			args: args{
+				overrides: []v1beta1.Override{
+					{
+						Match: v1beta1.RouteMatch{Kind: "Nodepool"},
+						Value: "spec: region: \"us-east-2\"",
+					},
+					{
+						Value: `{"metadata": {"labels": {"team": "platform"}}}`,
+					},
+				},
+				data: data(),
+			},
+			want: want{
+				data: []map[string]interface{}{
+					{
+						"apiVersion": "nobu.dev/v1",
+						"kind":       "Cluster",
+						"metadata": map[string]interface{}{
+							"name":   "cluster",
+							"labels": map[string]interface{}{"team": "platform"},
+						},
+						"spec": map[string]interface{}{"replicas": float64(1)},
+					},
+					{
+						"apiVersion": "nobu.dev/v1",
+						"kind":       "Nodepool",
+						"metadata": map[string]interface{}{
+							"name":   "nodepool",
+							"labels": map[string]interface{}{"team": "platform"},
+						},
+						"spec": map[string]interface{}{"region": "us-east-2"},
+					},
+				},
+			},
+		},
+		"Constraint": {
+			reason: "Overrides may constrain existing values",
+			args: args{
+				overrides: []v1beta1.Override{{Value: "spec: replicas: >=1"}},
+				data:      data()[:1],
+			},
+			want: want{data: data()[:1]},
+		},
+		"Conflict": {
+			reason: "Overrides that conflict with a document should return an error",
+			args: args{
+				overrides: []v1beta1.Override{{Value: "spec: replicas: >1"}},
+				data:      data(),
+			},
+			want: want{
+				data: data(),
+				err:  "cannot apply override at index 0 to \"cluster\": spec.replicas: invalid value 1 (out of bound >1)",
+			},
+		},
+		"InvalidValue": {
+			reason: "Overrides that cannot be compiled should return an error",
+			args: args{
+				overrides: []v1beta1.Override{{Value: "spec: {"}},
+				data:      data(),
+			},
+			want: want{
+				data: data(),
+				err:  "cannot compile override at index 0: expected '}', found 'EOF'",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := applyOverrides(tc.args.overrides, tc.args.data)
+
+			if diff := cmp.Diff(tc.want.data, got); diff != "" {
+				t.Errorf("%s\napplyOverrides(...): -want data, +got data:\n%s", tc.reason, diff)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, gotErr); diff != "" {
+				t.Errorf("%s\napplyOverrides(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
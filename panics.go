@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// maxPanicFrames is the number of stack frames kept in the fatal result of a
+// recovered panic, the full stack trace is logged
+const maxPanicFrames = 8
+
+// requestIDs identify the request a panic was recovered from
+type requestIDs struct {
+	// tag is the tag of the RunFunctionRequest
+	tag string
+	// xr is the kind and name of the observed XR, empty for operations
+	xr string
+}
+
+func (ids requestIDs) String() string {
+	if ids.xr == "" {
+		return fmt.Sprintf("request %q", ids.tag)
+	}
+	return fmt.Sprintf("request %q for xr %q", ids.tag, ids.xr)
+}
+
+// panicError is a panic recovered from a phase of the function
+type panicError struct {
+	phase string
+	ids   requestIDs
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic during %s of %s: %v\n%s", e.phase, e.ids, e.value, trimStack(e.stack, maxPanicFrames))
+}
+
+// recoverPhase runs a phase of the function and converts a panic into a
+// *panicError, so that a bug fails the request with a fatal result instead of
+// crashing the function pod and every request it is serving
+func recoverPhase(log logging.Logger, ids requestIDs, phase string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe := &panicError{phase: phase, ids: ids, value: r, stack: debug.Stack()}
+			log.Info("Recovered from panic", "phase", phase, "panic", fmt.Sprintf("%v", r), "stack", string(pe.stack))
+			err = pe
+		}
+	}()
+	return fn()
+}
+
+// trimStack drops the goroutine header and the frames of the panic machinery
+// from a stack trace and keeps at most max frames of the code that panicked
+func trimStack(stack []byte, max int) string {
+	lines := strings.Split(strings.TrimSpace(string(stack)), "\n")
+	if len(lines) != 0 && strings.HasPrefix(lines[0], "goroutine ") {
+		lines = lines[1:]
+	}
+
+	// Each frame is a function line followed by its indented file:line
+	frames := make([]string, 0, len(lines)/2)
+	for i := 0; i+1 < len(lines); i += 2 {
+		frames = append(frames, lines[i]+"\n"+lines[i+1])
+	}
+	// Everything up to the runtime panic call is the recovery itself, the
+	// runtime frames after it raise panics such as nil pointer dereferences
+	for i, f := range frames {
+		if strings.HasPrefix(f, "panic(") {
+			frames = frames[i+1:]
+			break
+		}
+	}
+	for len(frames) != 0 && strings.HasPrefix(frames[0], "runtime.") {
+		frames = frames[1:]
+	}
+
+	if len(frames) > max {
+		frames = append(frames[:max], "...")
+	}
+	return strings.Join(frames, "\n")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverPhase(t *testing.T) {
+	ids := requestIDs{tag: "req-1", xr: "XR/my-xr"}
+
+	cases := map[string]struct {
+		reason string
+		phase  func() error
+		// wantErr is the start of the error, the stack trace follows it
+		wantErr string
+		// wantFrame is a frame expected in the trimmed stack trace
+		wantFrame string
+	}{
+		"NoPanic": {
+			reason:  "An error returned by the phase should be passed through",
+			phase:   func() error { return errors.New("boom") },
+			wantErr: "boom",
+		},
+		"NilDesiredComposed": {
+			reason: "A nil DesiredComposed in setData should be recovered",
+			phase: func() error {
+				var dc *resource.DesiredComposed
+				return setData(map[string]interface{}{"spec": "value"}, nil, dc, false, listMerge{})
+			},
+			wantErr:   `panic during match of request "req-1" for xr "XR/my-xr": runtime error: invalid memory address or nil pointer dereference`,
+			wantFrame: ".setLeaf(",
+		},
+		"NilComposite": {
+			reason: "A nil Composite in setData should be recovered",
+			phase: func() error {
+				var xr *resource.Composite
+				return setData(map[string]interface{}{"spec": "value"}, nil, xr, false, listMerge{})
+			},
+			wantErr:   `panic during match of request "req-1" for xr "XR/my-xr": runtime error: invalid memory address or nil pointer dereference`,
+			wantFrame: ".setLeaf(",
+		},
+		"TypeAssertion": {
+			reason: "A failed type assertion on the object of a success output should be recovered",
+			phase: func() error {
+				output := successOutput{target: v1beta1.XR, object: []map[string]interface{}{}, msgCount: 1}
+				output.setSuccessResults()
+				return nil
+			},
+			wantErr:   `panic during match of request "req-1" for xr "XR/my-xr": interface conversion: interface {} is []map[string]interface {}, not *resource.Composite`,
+			wantFrame: ".(*successOutput).setSuccessResults(",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := recoverPhase(logging.NewNopLogger(), ids, "match", tc.phase)
+			assert.NotNil(t, err, "%s: expected an error", tc.reason)
+			msg, stack, _ := strings.Cut(err.Error(), "\n")
+			assert.Equal(t, tc.wantErr, msg, "%s", tc.reason)
+			if tc.wantFrame == "" {
+				return
+			}
+			frame, _, _ := strings.Cut(stack, "\n")
+			assert.Contains(t, frame, tc.wantFrame, "%s: expected the stack trace to start at the panic", tc.reason)
+			assert.NotContains(t, stack, "runtime/debug.Stack", "%s: the recovery frames should be trimmed", tc.reason)
+			assert.LessOrEqual(t, strings.Count(stack, "\n\t"), maxPanicFrames, "%s: the stack trace should be trimmed", tc.reason)
+		})
+	}
+}
+
+// panickingSource is a template source that panics resolving any template
+type panickingSource struct{}
+
+func (panickingSource) Resolve(_ v1beta1.TemplateRef) (string, *staleValue, error) {
+	panic("injected panic")
+}
+
+func TestRunFunctionRecoversPanic(t *testing.T) {
+	req := &fnv1beta1.RunFunctionRequest{
+		Meta: &fnv1beta1.RequestMeta{Tag: "req-1"},
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "panic"},
+			"export": {
+				"target": "Resources",
+				"templateRef": {"name": "example", "version": "v1"}
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{
+					"apiVersion": "example.org/v1",
+					"kind": "XR",
+					"metadata": {"name": "my-xr"}
+				}`),
+			},
+		},
+	}
+
+	f := &Function{log: logging.NewNopLogger(), templates: templateSources{panickingSource{}}}
+	rsp, err := f.RunFunction(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, rsp.GetResults(), 1)
+
+	result := rsp.GetResults()[0]
+	assert.Equal(t, fnv1beta1.Severity_SEVERITY_FATAL, result.GetSeverity())
+	msg, stack, _ := strings.Cut(result.GetMessage(), "\n")
+	assert.Equal(t, `panic during input of request "req-1": injected panic`, msg)
+	frame, _, _ := strings.Cut(stack, "\n")
+	assert.Contains(t, frame, "panickingSource.Resolve(", "expected the stack trace to start at the panic")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"runtime"
+
+	"cuelang.org/go/cue/cuecontext"
+)
+
+// evalPool is a bounded pool of evaluation workers shared by the concurrent
+// requests to the function, so that a burst of requests queues for a worker
+// instead of thrashing the CPU. Each worker owns the cue context the templates
+// it compiles are built in.
+type evalPool struct {
+	workers chan *cueContext
+}
+
+// newEvalPool returns a pool of size workers, a size of 0 sizes the pool to
+// the number of CPUs
+func newEvalPool(size int) *evalPool {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	p := &evalPool{workers: make(chan *cueContext, size)}
+	for i := 0; i < size; i++ {
+		p.workers <- &cueContext{Context: cuecontext.New()}
+	}
+	return p
+}
+
+// acquire waits for an idle worker until the context is done
+func (p *evalPool) acquire(ctx context.Context) (*cueContext, error) {
+	select {
+	case w := <-p.workers:
+		return w, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release returns the worker to the pool, the context of a worker that built
+// its maximum number of templates is replaced by a new one
+func (p *evalPool) release(w *cueContext) {
+	if w.builds >= maxContextBuilds {
+		w = &cueContext{Context: cuecontext.New()}
+	}
+	p.workers <- w
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEvalPool(t *testing.T) {
+	p := newEvalPool(1)
+	w, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("p.acquire(...): unexpected error: %v", err)
+	}
+
+	// The only worker is in use, so acquiring another should wait until the
+	// context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("p.acquire(...): want %v while the pool is exhausted, got %v", context.DeadlineExceeded, err)
+	}
+
+	// A retired worker should be replaced by a new context
+	w.builds = maxContextBuilds
+	p.release(w)
+	got, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("p.acquire(...): unexpected error: %v", err)
+	}
+	if got == w || got.builds != 0 {
+		t.Errorf("p.acquire(...): want a new context once the worker is retired, got %d builds", got.builds)
+	}
+}
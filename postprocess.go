@@ -0,0 +1,50 @@
+package main
+
+import (
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/parser"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// documentsDef is the definition the compiled documents are bound to in the
+// transform expression, and the documents of a template are exported from
+const documentsDef = "documents"
+
+// postProcess evaluates the transform expression against the compiled documents
+// The documents are available to the expression as the #documents list and the
+// expression must evaluate to a list of documents, for example
+//
+//	[ for d in #documents if d.kind != "Bucket" {d}]
+func postProcess(transform string, data []map[string]interface{}) ([]map[string]interface{}, error) {
+	if transform == "" {
+		return data, nil
+	}
+
+	expr, err := parser.ParseExpr("transform", transform)
+	if err != nil {
+		return data, errors.Wrap(err, "cannot parse transform expression")
+	}
+
+	ctx := cuecontext.New()
+	docs := []interface{}{}
+	for _, d := range data {
+		docs = append(docs, d)
+	}
+	scope := ctx.CompileString("_").FillPath(cue.MakePath(cue.Def(documentsDef)), docs)
+
+	v := ctx.BuildExpr(expr, cue.Scope(scope), cue.InferBuiltins(true))
+	if err := v.Validate(cue.Concrete(true)); err != nil {
+		return data, errors.Wrap(err, "cannot evaluate transform expression")
+	}
+	if v.Kind() != cue.ListKind {
+		return data, errors.Errorf("transform expression must evaluate to a list of documents, got %s", v.Kind())
+	}
+
+	out := []map[string]interface{}{}
+	if err := v.Decode(&out); err != nil {
+		return data, errors.Wrap(err, "cannot decode transformed documents")
+	}
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPostProcess(t *testing.T) {
+	type args struct {
+		transform string
+		data      []map[string]interface{}
+	}
+	type want struct {
+		data []map[string]interface{}
+		err  string
+	}
+
+	data := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{
+				"apiVersion": "nobu.dev/v1",
+				"kind":       "Cluster",
+				"metadata":   map[string]interface{}{"name": "cluster"},
+			},
+			{
+				"apiVersion": "nobu.dev/v1",
+				"kind":       "Bucket",
+				"metadata":   map[string]interface{}{"name": "bucket"},
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NoTransform": {
+			reason: "The data should be returned unchanged without a transform",
+			args:   args{data: data()},
+			want:   want{data: data()},
+		},
+		"Filter": {
+			reason: "The transform should be able to drop documents",
+			args: args{
+				transform: `[ for d in #documents if d.kind != "Bucket" {d}]`,
+				data:      data(),
+			},
+			want: want{data: data()[:1]},
+		},
+		"Reshape": {
+			reason: "The transform should be able to rename and reshape documents",
+			args: args{
+				transform: `[ for d in #documents {d & {metadata: labels: "nobu.dev/name": strings.ToUpper(d.metadata.name)}}]`,
+				data:      data()[1:],
+			},
+			want: want{
+				data: []map[string]interface{}{
+					{
+						"apiVersion": "nobu.dev/v1",
+						"kind":       "Bucket",
+						"metadata": map[string]interface{}{
+							"name":   "bucket",
+							"labels": map[string]interface{}{"nobu.dev/name": "BUCKET"},
+						},
+					},
+				},
+			},
+		},
+		"NotAList": {
+			reason: "A transform that does not produce a list should return an error",
+			args: args{
+				transform: `#documents[0]`,
+				data:      data(),
+			},
+			want: want{
+				data: data(),
+				err:  "transform expression must evaluate to a list of documents, got struct",
+			},
+		},
+		"InvalidExpression": {
+			reason: "A transform that cannot be parsed should return an error",
+			args: args{
+				transform: `[ for d in #documents {d}`,
+				data:      data(),
+			},
+			want: want{
+				data: data(),
+				err:  "cannot parse transform expression: expected ']', found 'EOF'",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := postProcess(tc.args.transform, tc.args.data)
+
+			if diff := cmp.Diff(tc.want.data, got); diff != "" {
+				t.Errorf("%s\npostProcess(...): -want data, +got data:\n%s", tc.reason, diff)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, gotErr); diff != "" {
+				t.Errorf("%s\npostProcess(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+)
+
+// ProfileCmd evaluates a CUE template and reports its most expensive fields.
+type ProfileCmd struct {
+	File   string   `arg:"" help:"CUE template to profile." type:"existingfile"`
+	Depth  int      `help:"Depth of the fields to profile." default:"2"`
+	Top    int      `help:"Number of hotspots to report." default:"10"`
+	Inject []string `short:"t" help:"Tags to inject into the template in name=value form."`
+}
+
+// Help explains how the cost of the fields is measured.
+func (c *ProfileCmd) Help() string {
+	return `The cost of a field is measured by ablation: the field is replaced with top (_) and the template is evaluated
+again, the duration of the field is how much faster the template evaluates without it. Each variant is evaluated
+` + fmt.Sprint(profileRuns) + ` times and the fastest run is kept. The comprehensions and disjunctions are counted in the source of
+the field, they are not counts of the evaluation.
+
+The duration includes the fields only the field references, and a template that fails to evaluate without the
+field is timed until it fails. CUE v0.6 does not expose its evaluation counters outside of its internal packages,
+so they are not reported.`
+}
+
+// Run the profile command.
+func (c *ProfileCmd) Run() error {
+	b, err := os.ReadFile(c.File)
+	if err != nil {
+		return err
+	}
+
+	total, hotspots, err := profileTemplate(string(b), c.Inject, c.Depth)
+	if err != nil {
+		return err
+	}
+	return writeHotspots(os.Stdout, total, hotspots, c.Top)
+}
+
+// hotspot is the evaluation cost of a field in the template
+type hotspot struct {
+	path           string
+	duration       time.Duration
+	comprehensions int
+	disjunctions   int
+}
+
+// profileRuns is the number of times each variant of the template is evaluated,
+// the fastest run is kept to reduce noise
+const profileRuns = 3
+
+// profileTemplate evaluates the template and returns the total evaluation time
+// and the fields up to depth sorted from most to least expensive
+//
+// cue evaluates the whole template when it is built, so the cost of a field is
+// measured by replacing its value with top and timing how much faster the
+// template evaluates without it. The cost of a field includes the cost of the
+// fields that only it references.
+func profileTemplate(input string, tags []string, depth int) (time.Duration, []hotspot, error) {
+	f, err := parser.ParseFile("-", input, parser.ParseComments)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to parse: %w", err)
+	}
+	total, err := evalDuration(input, tags)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hotspots := []hotspot{}
+	for _, pf := range profiledFields(f.Decls, "", 1, depth) {
+		orig := pf.field.Value
+		pf.field.Value = ast.NewIdent("_")
+		src, err := format.Node(f)
+		pf.field.Value = orig
+		if err != nil {
+			return 0, nil, fmt.Errorf("cannot format template without %s: %w", pf.path, err)
+		}
+
+		// the template may fail to evaluate without the field, the time
+		// taken to fail still bounds the cost of the field
+		d, _ := evalDuration(string(src), tags)
+		h := hotspot{path: pf.path}
+		if d < total {
+			h.duration = total - d
+		}
+		h.comprehensions, h.disjunctions = countExpensiveNodes(orig)
+		hotspots = append(hotspots, h)
+	}
+
+	sort.SliceStable(hotspots, func(i, j int) bool {
+		return hotspots[i].duration > hotspots[j].duration
+	})
+	return total, hotspots, nil
+}
+
+// profiledField is a field declared in the template source
+type profiledField struct {
+	path  string
+	field *ast.Field
+}
+
+// profiledFields returns the fields declared in decls and their nested structs up to depth
+func profiledFields(decls []ast.Decl, prefix string, d, depth int) []profiledField {
+	if d > depth {
+		return nil
+	}
+	var fields []profiledField
+	for _, decl := range decls {
+		field, ok := decl.(*ast.Field)
+		if !ok {
+			continue
+		}
+		name, _, err := ast.LabelName(field.Label)
+		if err != nil {
+			// skip pattern constraints and dynamic fields
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		fields = append(fields, profiledField{path: path, field: field})
+		if s, ok := field.Value.(*ast.StructLit); ok {
+			fields = append(fields, profiledFields(s.Elts, path, d+1, depth)...)
+		}
+	}
+	return fields
+}
+
+// evalDuration returns the fastest of profileRuns full evaluations of the template
+func evalDuration(input string, tags []string) (time.Duration, error) {
+	ctx := acquireCUEContext()
+	defer releaseCUEContext(ctx)
+	var fastest time.Duration
+	for i := 0; i < profileRuns; i++ {
+		start := time.Now()
+		ctx.builds++
+		v, err := loadValue(ctx.Context, input, inputCUE, nil, tags)
+		if err != nil {
+			return time.Since(start), err
+		}
+		if err := v.Validate(); err != nil {
+			return time.Since(start), fmt.Errorf("failed to validate: %w", err)
+		}
+		if d := time.Since(start); i == 0 || d < fastest {
+			fastest = d
+		}
+	}
+	return fastest, nil
+}
+
+// countExpensiveNodes counts the comprehensions and disjunctions in the source of a field
+func countExpensiveNodes(n ast.Node) (comprehensions, disjunctions int) {
+	if n == nil {
+		return 0, 0
+	}
+	ast.Walk(n, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.Comprehension:
+			comprehensions++
+		case *ast.BinaryExpr:
+			if x.Op == token.OR {
+				disjunctions++
+			}
+		}
+		return true
+	}, nil)
+	return comprehensions, disjunctions
+}
+
+// writeHotspots writes the top hotspots as a table
+func writeHotspots(w io.Writer, total time.Duration, hotspots []hotspot, top int) error {
+	if top > 0 && len(hotspots) > top {
+		hotspots = hotspots[:top]
+	}
+	fmt.Fprintf(w, "Total evaluation: %s\n\n", total)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tDURATION\tCOMPREHENSIONS\tDISJUNCTIONS")
+	for _, h := range hotspots {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", h.path, h.duration, h.comprehensions, h.disjunctions)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestProfileTemplate(t *testing.T) {
+	type want struct {
+		paths []string
+		nodes map[string][2]int
+		err   string
+	}
+
+	cases := map[string]struct {
+		reason string
+		input  string
+		depth  int
+		want   want
+	}{
+		"Depth": {
+			reason: "Fields nested deeper than depth should not be profiled",
+			input: `
+a: [for x in [1, 2, 3] {x * 2}]
+b: *"x" | "y" | "z"
+c: d: e: 1
+`,
+			depth: 2,
+			want: want{
+				paths: []string{"a", "b", "c", "c.d"},
+				nodes: map[string][2]int{
+					"a":   {1, 0},
+					"b":   {0, 2},
+					"c":   {0, 0},
+					"c.d": {0, 0},
+				},
+			},
+		},
+		"SkipPatterns": {
+			reason: "Pattern constraints have no path and should not be profiled",
+			input: `
+[string]: int
+a: 1
+`,
+			depth: 1,
+			want: want{
+				paths: []string{"a"},
+				nodes: map[string][2]int{"a": {0, 0}},
+			},
+		},
+		"InvalidTemplate": {
+			reason: "A template that does not evaluate should return an error",
+			input:  `a: 1 & 2`,
+			depth:  1,
+			want: want{
+				err: "failed to validate: a: conflicting values 2 and 1",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, hotspots, err := profileTemplate(tc.input, nil, tc.depth)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, gotErr); diff != "" {
+				t.Errorf("%s\nprofileTemplate(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+
+			// durations vary between runs so only the profiled fields are compared
+			var paths []string
+			nodes := map[string][2]int{}
+			for _, h := range hotspots {
+				paths = append(paths, h.path)
+				nodes[h.path] = [2]int{h.comprehensions, h.disjunctions}
+			}
+			if tc.want.nodes == nil {
+				tc.want.nodes = map[string][2]int{}
+			}
+			if diff := cmp.Diff(tc.want.paths, paths, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("%s\nprofileTemplate(...): -want paths, +got paths:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.nodes, nodes); diff != "" {
+				t.Errorf("%s\nprofileTemplate(...): -want nodes, +got nodes:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestWriteHotspots(t *testing.T) {
+	hotspots := []hotspot{
+		{path: "a", duration: 20 * time.Millisecond, comprehensions: 1},
+		{path: "b.c", duration: time.Millisecond, disjunctions: 2},
+	}
+
+	want := `Total evaluation: 30ms
+
+PATH  DURATION  COMPREHENSIONS  DISJUNCTIONS
+a     20ms      1               0
+`
+	var b bytes.Buffer
+	if err := writeHotspots(&b, 30*time.Millisecond, hotspots, 1); err != nil {
+		t.Fatalf("writeHotspots(...): %v", err)
+	}
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("writeHotspots(...): -want, +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// unpropagatedAnnotations are never propagated from the XR, because they
+// describe the XR itself rather than the resources composed from it
+var unpropagatedAnnotations = map[string]bool{
+	"crossplane.io/external-name":                      true,
+	"crossplane.io/composition-resource-name":          true,
+	"kubectl.kubernetes.io/last-applied-configuration": true,
+}
+
+// propagated is the metadata of the XR propagated onto the generated composed
+// resources
+type propagated struct {
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// propagatedMetadata returns the labels and annotations of the XR selected by
+// the propagateMetadata option, nothing is propagated without the option or
+// without an XR
+func propagatedMetadata(p *v1beta1.PropagateMetadata, xr *resource.Composite) propagated {
+	if p == nil || xr == nil {
+		return propagated{}
+	}
+	annotations := filterMetadata(p.Annotations, xr.Resource.GetAnnotations())
+	for k := range annotations {
+		if unpropagatedAnnotations[k] {
+			delete(annotations, k)
+		}
+	}
+	return propagated{
+		labels:      filterMetadata(p.Labels, xr.Resource.GetLabels()),
+		annotations: annotations,
+	}
+}
+
+// filterMetadata returns the entries whose key the filter selects
+func filterMetadata(f v1beta1.MetadataFilter, in map[string]string) map[string]string {
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		if (len(f.Include) == 0 || matchesAny(f.Include, k)) && !matchesAny(f.Exclude, k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// matchesAny returns whether the key matches any of the patterns, * in a
+// pattern matches any characters including /
+func matchesAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		re := "^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$"
+		if ok, _ := regexp.MatchString(re, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply merges the propagated labels and annotations onto the resource, those
+// the resource already sets keep their values
+func (p propagated) apply(u *unstructured.Unstructured) {
+	if len(p.labels) != 0 {
+		u.SetLabels(mergeMissing(u.GetLabels(), p.labels))
+	}
+	if len(p.annotations) != 0 {
+		u.SetAnnotations(mergeMissing(u.GetAnnotations(), p.annotations))
+	}
+}
+
+// mergeMissing adds the entries of from that are missing from into
+func mergeMissing(into, from map[string]string) map[string]string {
+	if into == nil {
+		into = make(map[string]string, len(from))
+	}
+	for k, v := range from {
+		if _, ok := into[k]; !ok {
+			into[k] = v
+		}
+	}
+	return into
+}
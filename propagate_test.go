@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestPropagateMetadata(t *testing.T) {
+	xr := &resource.Composite{Resource: composite.New()}
+	xr.Resource.SetLabels(map[string]string{
+		"example.org/team":         "platform",
+		"example.org/cost-center":  "1234",
+		"crossplane.io/claim-name": "my-claim",
+	})
+	xr.Resource.SetAnnotations(map[string]string{
+		"example.org/owner":           "alice",
+		"crossplane.io/external-name": "my-xr",
+	})
+
+	cases := map[string]struct {
+		reason          string
+		propagate       *v1beta1.PropagateMetadata
+		labels          map[string]string
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+	}{
+		"Disabled": {
+			reason:     "Nothing should be propagated without the option",
+			labels:     map[string]string{"app": "bucket"},
+			wantLabels: map[string]string{"app": "bucket"},
+		},
+		"Everything": {
+			reason:    "Every label and annotation should be propagated by default, except the external name",
+			propagate: &v1beta1.PropagateMetadata{},
+			wantLabels: map[string]string{
+				"example.org/team":         "platform",
+				"example.org/cost-center":  "1234",
+				"crossplane.io/claim-name": "my-claim",
+			},
+			wantAnnotations: map[string]string{"example.org/owner": "alice"},
+		},
+		"IncludeExclude": {
+			reason: "Only the included keys that are not excluded should be propagated",
+			propagate: &v1beta1.PropagateMetadata{
+				Labels:      v1beta1.MetadataFilter{Include: []string{"example.org/*"}, Exclude: []string{"*cost*"}},
+				Annotations: v1beta1.MetadataFilter{Exclude: []string{"*"}},
+			},
+			wantLabels: map[string]string{"example.org/team": "platform"},
+		},
+		"ResourceWins": {
+			reason:    "A label the resource sets should keep its value",
+			propagate: &v1beta1.PropagateMetadata{Labels: v1beta1.MetadataFilter{Include: []string{"example.org/team"}}},
+			labels:    map[string]string{"example.org/team": "storage", "app": "bucket"},
+			wantLabels: map[string]string{
+				"example.org/team": "storage",
+				"app":              "bucket",
+			},
+			wantAnnotations: map[string]string{"example.org/owner": "alice"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			u := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "example.org/v1", "kind": "Bucket"}}
+			if tc.labels != nil {
+				u.SetLabels(tc.labels)
+			}
+			propagatedMetadata(tc.propagate, xr).apply(u)
+			if diff := cmp.Diff(tc.wantLabels, u.GetLabels()); diff != "" {
+				t.Errorf("%s\napply(...): -want labels, +got labels:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantAnnotations, u.GetAnnotations()); diff != "" {
+				t.Errorf("%s\napply(...): -want annotations, +got annotations:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
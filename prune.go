@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// ownerAnnotation records the input that created a composed resource, so that
+// a later reconcile can prune the resources the input no longer creates
+const ownerAnnotation = "function-cue.fn/owner"
+
+// owner returns the owner the resources created by the input are annotated
+// with, resources are only annotated when the input prunes them
+func owner(in *v1beta1.CUEInput) string {
+	if !in.Export.Prune {
+		return ""
+	}
+	return in.Name
+}
+
+// setOwner annotates the composed resource as created by the owner
+func setOwner(dcd *resource.DesiredComposed, owner string) {
+	annotations := dcd.Resource.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ownerAnnotation] = owner
+	dcd.Resource.SetAnnotations(annotations)
+}
+
+// pruneResources deletes the desired composed resources that the owner created
+// in an earlier reconcile but no longer creates. A resource is pruned when its
+// observed resource is annotated with the owner while its desired resource is
+// not, because the desired resource was left by another function. The names of
+// the pruned resources are returned sorted.
+func pruneResources(owner string, observed map[resource.Name]resource.ObservedComposed, desired map[resource.Name]*resource.DesiredComposed) []resource.Name {
+	var pruned []resource.Name
+	for name, ocd := range observed {
+		if ocd.Resource == nil || ocd.Resource.GetAnnotations()[ownerAnnotation] != owner {
+			continue
+		}
+		dcd, ok := desired[name]
+		if !ok || dcd.Resource.GetAnnotations()[ownerAnnotation] == owner {
+			continue
+		}
+		delete(desired, name)
+		pruned = append(pruned, name)
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i] < pruned[j] })
+	return pruned
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestPruneResources(t *testing.T) {
+	annotated := func(owner string) *composed.Unstructured {
+		r := composed.New()
+		if owner != "" {
+			r.SetAnnotations(map[string]string{ownerAnnotation: owner})
+		}
+		return r
+	}
+
+	cases := map[string]struct {
+		reason   string
+		observed map[resource.Name]resource.ObservedComposed
+		desired  map[resource.Name]*resource.DesiredComposed
+		want     []resource.Name
+		wantLeft []resource.Name
+	}{
+		"Stale": {
+			reason: "A resource the input created before but no longer creates should be pruned",
+			observed: map[resource.Name]resource.ObservedComposed{
+				"stale": {Resource: annotated("input")},
+			},
+			desired: map[resource.Name]*resource.DesiredComposed{
+				"stale": {Resource: annotated("")},
+			},
+			want: []resource.Name{"stale"},
+		},
+		"Created": {
+			reason: "A resource the input still creates should be kept",
+			observed: map[resource.Name]resource.ObservedComposed{
+				"bucket": {Resource: annotated("input")},
+			},
+			desired: map[resource.Name]*resource.DesiredComposed{
+				"bucket": {Resource: annotated("input")},
+			},
+			wantLeft: []resource.Name{"bucket"},
+		},
+		"OtherOwner": {
+			reason: "A resource created by another input should be kept",
+			observed: map[resource.Name]resource.ObservedComposed{
+				"other": {Resource: annotated("other")},
+			},
+			desired: map[resource.Name]*resource.DesiredComposed{
+				"other": {Resource: annotated("")},
+			},
+			wantLeft: []resource.Name{"other"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := pruneResources("input", tc.observed, tc.desired)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\npruneResources(...): -want pruned, +got pruned:\n%s", tc.reason, diff)
+			}
+			var left []resource.Name
+			for name := range tc.desired {
+				left = append(left, name)
+			}
+			if diff := cmp.Diff(tc.wantLeft, left, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\npruneResources(...): -want desired, +got desired:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
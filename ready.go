@@ -67,7 +67,8 @@ const (
 
 // reconcileReadiness compares the observed map names to the desired map names and reconcicles the desired with observed health
 // it then checks the passed readinessChecks against the observed map and propagates this information to the xr
-func reconcileReadiness(observed map[rresource.Name]rresource.ObservedComposed, desired map[rresource.Name]*rresource.DesiredComposed, data []readinessCheck) error {
+// A resource without readiness checks is only ready by its Ready condition when it is in auto
+func reconcileReadiness(observed map[rresource.Name]rresource.ObservedComposed, desired map[rresource.Name]*rresource.DesiredComposed, data []readinessCheck, auto map[rresource.Name]bool) error {
 	filter := func(ocd rresource.ObservedComposed, data []readinessCheck) []readinessCheck {
 		rc := []readinessCheck{}
 		for _, d := range data {
@@ -85,6 +86,9 @@ func reconcileReadiness(observed map[rresource.Name]rresource.ObservedComposed,
 			continue
 		}
 		rc := filter(ocd, data)
+		if len(rc) == 0 && !auto[name] {
+			continue
+		}
 
 		ready, err := IsReady(context.Background(), ocd.Resource, rc...)
 		if err != nil {
@@ -98,6 +102,34 @@ func reconcileReadiness(observed map[rresource.Name]rresource.ObservedComposed,
 	return nil
 }
 
+// readyAnnotation sets the readiness of a composed resource rendered by the
+// template, it is removed from the resource before the resource is desired
+const readyAnnotation = "function-cue.fn/ready"
+
+// applyReadyAnnotations sets the readiness of the desired composed resources
+// annotated with readyAnnotation, it takes precedence over readiness checks
+func applyReadyAnnotations(desired map[rresource.Name]*rresource.DesiredComposed) error {
+	for name, dcd := range desired {
+		annotations := dcd.Resource.GetAnnotations()
+		v, ok := annotations[readyAnnotation]
+		if !ok {
+			continue
+		}
+		switch ready := rresource.Ready(v); ready {
+		case rresource.ReadyTrue, rresource.ReadyFalse, rresource.ReadyUnspecified:
+			dcd.Ready = ready
+		default:
+			return errors.Errorf("invalid %s annotation %q of resource %q: must be True, False or Unspecified", readyAnnotation, v, name)
+		}
+		delete(annotations, readyAnnotation)
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		dcd.Resource.SetAnnotations(annotations)
+	}
+	return nil
+}
+
 // A ReadinessChecker checks whether a composed resource is ready or not.
 type ReadinessChecker interface {
 	IsReady(ctx context.Context, o ConditionedObject, rc ...readinessCheck) (ready bool, err error)
@@ -9,9 +9,12 @@ import (
 	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
 	"github.com/crossplane/crossplane-runtime/pkg/resource/unstructured/composed"
 	"github.com/crossplane/crossplane-runtime/pkg/test"
+	rresource "github.com/crossplane/function-sdk-go/resource"
+	fcomposed "github.com/crossplane/function-sdk-go/resource/composed"
 	"github.com/google/go-cmp/cmp"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/utils/pointer"
 )
 
@@ -365,3 +368,66 @@ func TestIsReady(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyReadyAnnotations(t *testing.T) {
+	desired := func(annotations map[string]interface{}) *rresource.DesiredComposed {
+		metadata := map[string]interface{}{"name": "bucket"}
+		if annotations != nil {
+			metadata["annotations"] = annotations
+		}
+		return &rresource.DesiredComposed{Resource: &fcomposed.Unstructured{Unstructured: unstructured.Unstructured{
+			Object: map[string]interface{}{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": metadata},
+		}}}
+	}
+
+	cases := map[string]struct {
+		reason  string
+		desired *rresource.DesiredComposed
+		want    *rresource.DesiredComposed
+		wantErr error
+	}{
+		"True": {
+			reason:  "A resource annotated True should be ready and the annotation removed",
+			desired: desired(map[string]interface{}{readyAnnotation: "True"}),
+			want: func() *rresource.DesiredComposed {
+				d := desired(nil)
+				d.Ready = rresource.ReadyTrue
+				return d
+			}(),
+		},
+		"False": {
+			reason:  "A resource annotated False should not be ready and its other annotations kept",
+			desired: desired(map[string]interface{}{readyAnnotation: "False", "example.org/keep": "true"}),
+			want: func() *rresource.DesiredComposed {
+				d := desired(map[string]interface{}{"example.org/keep": "true"})
+				d.Ready = rresource.ReadyFalse
+				return d
+			}(),
+		},
+		"NotAnnotated": {
+			reason:  "A resource without the annotation should be left unchanged",
+			desired: desired(nil),
+			want:    desired(nil),
+		},
+		"Invalid": {
+			reason:  "An invalid readiness should return an error",
+			desired: desired(map[string]interface{}{readyAnnotation: "Yes"}),
+			wantErr: errors.Errorf("invalid %s annotation %q of resource %q: must be True, False or Unspecified", readyAnnotation, "Yes", "bucket"),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d := map[rresource.Name]*rresource.DesiredComposed{"bucket": tc.desired}
+			err := applyReadyAnnotations(d)
+			if diff := cmp.Diff(tc.wantErr, err, test.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\napplyReadyAnnotations(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want, d["bucket"]); diff != "" {
+				t.Errorf("\n%s\napplyReadyAnnotations(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
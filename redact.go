@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// redacted replaces the values the redactor masks
+const redacted = "<redacted>"
+
+// redactor masks the values of the fields whose key matches its pattern, such
+// as secrets injected through tags, in the compile output the function logs and
+// in the messages of its results. Only scalar values are masked, the fields of
+// an object whose key matches are masked by their own keys.
+//
+// The values at the sensitive paths of the documents, such as the data of a
+// Secret, are masked whatever their keys, objects and lists included.
+type redactor struct {
+	keys *regexp.Regexp
+	// text matches a key followed by its scalar value in json or yaml text
+	text *regexp.Regexp
+	// paths are the globs of the sensitive field paths
+	paths []pathGlob
+}
+
+// newRedactor returns a redactor of the keys matching the pattern case
+// insensitively and of the field paths matching the globs, an empty pattern
+// without globs disables redaction
+func newRedactor(pattern string, paths []string) (*redactor, error) {
+	if pattern == "" && len(paths) == 0 {
+		return nil, nil
+	}
+	r := &redactor{}
+	for _, p := range paths {
+		g, err := parsePathGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		r.paths = append(r.paths, g)
+	}
+	if pattern == "" {
+		return r, nil
+	}
+	var err error
+	r.keys, err = regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction pattern: %w", err)
+	}
+	r.text, err = regexp.Compile(`(?i)("?[\w.-]*(?:` + pattern + `)[\w.-]*"?\s*[:=]\s*)("(?:[^"\\]|\\.)*"|[^\s"{\[,}\]][^\s,}\]]*)`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction pattern: %w", err)
+	}
+	return r, nil
+}
+
+// pathGlob matches the field paths of the documents of a kind, or of every
+// document without a kind, such as Secret:data.* or spec.**.password. Each
+// segment of a path is matched like a file name, a ** segment matches any
+// number of segments and the items of lists are segments of their index.
+type pathGlob struct {
+	kind     string
+	segments []string
+}
+
+// parsePathGlob parses a glob of field paths optionally prefixed with a kind
+func parsePathGlob(s string) (pathGlob, error) {
+	g := pathGlob{}
+	p := s
+	if i := strings.Index(p, ":"); i >= 0 {
+		g.kind, p = p[:i], p[i+1:]
+	}
+	if p == "" {
+		return g, fmt.Errorf("invalid redaction path %q: empty path", s)
+	}
+	g.segments = strings.Split(p, ".")
+	for _, seg := range g.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return g, fmt.Errorf("invalid redaction path %q: %w", s, err)
+		}
+	}
+	return g, nil
+}
+
+// match returns whether the glob matches the field path of a document of the
+// kind
+func (g pathGlob) match(kind string, p []string) bool {
+	if g.kind != "" && g.kind != kind {
+		return false
+	}
+	return matchSegments(g.segments, p)
+}
+
+// matchSegments returns whether the segments of a glob match the path
+func matchSegments(glob, p []string) bool {
+	if len(glob) == 0 {
+		return len(p) == 0
+	}
+	if glob[0] == "**" {
+		for i := 0; i <= len(p); i++ {
+			if matchSegments(glob[1:], p[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p) == 0 {
+		return false
+	}
+	ok, _ := path.Match(glob[0], p[0])
+	return ok && matchSegments(glob[1:], p[1:])
+}
+
+// sensitive returns whether the field path of a document of the kind matches
+// a glob
+func (r *redactor) sensitive(kind string, p []string) bool {
+	for _, g := range r.paths {
+		if g.match(kind, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns a copy of the decoded value with the matching fields masked,
+// the sensitive paths are matched from the root of the value
+func (r *redactor) value(v interface{}) interface{} {
+	if r == nil {
+		return v
+	}
+	kind := ""
+	if m, ok := v.(map[string]interface{}); ok {
+		kind, _ = m["kind"].(string)
+	}
+	return r.mask(v, kind, nil)
+}
+
+// mask returns a copy of the value at the field path of a document of the kind
+// with the matching fields masked
+func (r *redactor) mask(v interface{}, kind string, p []string) interface{} {
+	// field masks the field at the path
+	field := func(f interface{}, fp []string, key string) interface{} {
+		switch {
+		case f == nil:
+			return f
+		case r.sensitive(kind, fp):
+			return redacted
+		}
+		switch f.(type) {
+		case map[string]interface{}, []interface{}:
+			return r.mask(f, kind, fp)
+		}
+		if r.keys != nil && key != "" && r.keys.MatchString(key) {
+			return redacted
+		}
+		return f
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, f := range v {
+			out[k] = field(f, append(p[:len(p):len(p)], k), k)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = field(e, append(p[:len(p):len(p)], strconv.Itoa(i)), "")
+		}
+		return out
+	}
+	return v
+}
+
+// objectResults masks the names of the resources of the success results whose
+// metadata.name is a sensitive path
+func (r *redactor) objectResults(rs []objectResult) {
+	if r == nil {
+		return
+	}
+	for i := range rs {
+		if rs[i].object == "resource" && r.sensitive(rs[i].kind, []string{"metadata", "name"}) {
+			rs[i].name = redacted
+		}
+	}
+}
+
+// message returns the text with the values of the matching keys masked
+func (r *redactor) message(s string) string {
+	if r == nil || r.text == nil {
+		return s
+	}
+	return r.text.ReplaceAllStringFunc(s, func(m string) string {
+		sub := r.text.FindStringSubmatch(m)
+		if strings.HasPrefix(sub[2], `"`) {
+			return sub[1] + `"` + redacted + `"`
+		}
+		return sub[1] + redacted
+	})
+}
+
+// results masks the messages of the results
+func (r *redactor) results(rs []*fnv1beta1.Result) {
+	if r == nil {
+		return
+	}
+	for _, res := range rs {
+		res.Message = r.message(res.GetMessage())
+	}
+}
+
+// render returns the compile output as text with the matching fields of the
+// decoded documents masked
+func (r *redactor) render(o compileOutput) string {
+	if r == nil || len(o.data) == 0 {
+		return r.message(o.rendered())
+	}
+	data := make([]map[string]interface{}, len(o.data))
+	for i, d := range o.data {
+		data[i], _ = r.value(d).(map[string]interface{})
+	}
+	o.data = data
+	return o.rendered()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRedactorValue(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		pattern string
+		paths   []string
+		value   interface{}
+		want    interface{}
+	}{
+		"Disabled": {
+			reason: "Nothing should be masked without a pattern",
+			value:  map[string]interface{}{"password": "hunter2"},
+			want:   map[string]interface{}{"password": "hunter2"},
+		},
+		"Nested": {
+			reason:  "The scalar values of the matching keys should be masked at any depth",
+			pattern: "password|token|secret",
+			value: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"forProvider": map[string]interface{}{
+						"masterPassword": "hunter2",
+						"apiToken":       float64(1234),
+						"region":         "us-east-1",
+					},
+					"users": []interface{}{map[string]interface{}{"name": "admin", "SECRET": "s3cr3t"}},
+				},
+			},
+			want: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"forProvider": map[string]interface{}{
+						"masterPassword": redacted,
+						"apiToken":       redacted,
+						"region":         "us-east-1",
+					},
+					"users": []interface{}{map[string]interface{}{"name": "admin", "SECRET": redacted}},
+				},
+			},
+		},
+		"Objects": {
+			reason:  "The fields of an object whose key matches should only be masked by their own keys",
+			pattern: "secret",
+			value: map[string]interface{}{
+				"writeConnectionSecretToRef": map[string]interface{}{"name": "db-conn", "namespace": "default"},
+			},
+			want: map[string]interface{}{
+				"writeConnectionSecretToRef": map[string]interface{}{"name": "db-conn", "namespace": "default"},
+			},
+		},
+		"Paths": {
+			reason: "The values at the sensitive paths of the documents of their kind should be masked, objects included",
+			paths:  []string{"Secret:data.*", "spec.**.connection"},
+			value: map[string]interface{}{
+				"kind": "Secret",
+				"data": map[string]interface{}{"username": "admin", "config": map[string]interface{}{"a": "b"}},
+				"spec": map[string]interface{}{
+					"items": []interface{}{map[string]interface{}{"connection": map[string]interface{}{"url": "db:5432"}}},
+				},
+			},
+			want: map[string]interface{}{
+				"kind": "Secret",
+				"data": map[string]interface{}{"username": redacted, "config": redacted},
+				"spec": map[string]interface{}{
+					"items": []interface{}{map[string]interface{}{"connection": redacted}},
+				},
+			},
+		},
+		"PathsOtherKind": {
+			reason: "The paths of a kind should not mask the documents of other kinds",
+			paths:  []string{"Secret:data.*"},
+			value:  map[string]interface{}{"kind": "ConfigMap", "data": map[string]interface{}{"username": "admin"}},
+			want:   map[string]interface{}{"kind": "ConfigMap", "data": map[string]interface{}{"username": "admin"}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := newRedactor(tc.pattern, tc.paths)
+			if err != nil {
+				t.Fatalf("%s\nnewRedactor(...): unexpected error: %v", tc.reason, err)
+			}
+			got := r.value(tc.value)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nvalue(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRedactorMessage(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		message string
+		want    string
+	}{
+		"JSON": {
+			reason:  "The quoted values of the matching keys should be masked",
+			message: `{"user": "admin", "password": "hun\"ter2", "apiToken": 1234}`,
+			want:    `{"user": "admin", "password": "<redacted>", "apiToken": <redacted>}`,
+		},
+		"YAML": {
+			reason:  "The plain values of the matching keys should be masked",
+			message: "user: admin\nclientSecret: s3cr3t\n",
+			want:    "user: admin\nclientSecret: <redacted>\n",
+		},
+		"Objects": {
+			reason:  "Objects of the matching keys should not be masked",
+			message: `secretRef: {name: db-conn}`,
+			want:    `secretRef: {name: db-conn}`,
+		},
+		"Unmatched": {
+			reason:  "Messages without matching keys should not change",
+			message: "created 3 resources",
+			want:    "created 3 resources",
+		},
+	}
+
+	r, err := newRedactor("password|token|secret", nil)
+	if err != nil {
+		t.Fatalf("newRedactor(...): unexpected error: %v", err)
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := r.message(tc.message)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nmessage(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRedactorObjectResults(t *testing.T) {
+	r, err := newRedactor("", []string{"Secret:metadata.name"})
+	if err != nil {
+		t.Fatalf("newRedactor(...): unexpected error: %v", err)
+	}
+	rs := []objectResult{
+		{action: actionCreated, object: "resource", name: "db-credentials", kind: "Secret"},
+		{action: actionCreated, object: "resource", name: "db", kind: "Instance"},
+		{action: actionUpdated, object: "context key", name: "example.org/network"},
+	}
+	r.objectResults(rs)
+	want := []string{
+		`created resource "<redacted>:Secret"`,
+		`created resource "db:Instance"`,
+		`updated context key "example.org/network"`,
+	}
+	got := make([]string, len(rs))
+	for i, res := range rs {
+		got[i] = res.message()
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("objectResults(...): -want, +got:\n%s", diff)
+	}
+}
+
+func TestParsePathGlob(t *testing.T) {
+	if _, err := parsePathGlob("Secret:data.[a"); err == nil {
+		t.Errorf("parsePathGlob(...): want error for a malformed segment")
+	}
+	if _, err := parsePathGlob("Secret:"); err == nil {
+		t.Errorf("parsePathGlob(...): want error for an empty path")
+	}
+}
+
+func TestRedactorDiff(t *testing.T) {
+	r, err := newRedactor("password", []string{"Secret:data.*"})
+	if err != nil {
+		t.Fatalf("newRedactor(...): unexpected error: %v", err)
+	}
+	f := &Function{log: logging.NewNopLogger(), redactor: r}
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "diff"},
+			"export": {
+				"target": "Resources",
+				"options": {"diff": true},
+				"value": "apiVersion: \"v1\"\nkind: \"Secret\"\nmetadata: name: \"credentials\"\ndata: key: \"c3VwZXJzZWNyZXQ=\"\nstringData: password: \"hunter2\"\n"
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR"}`),
+			},
+		},
+	}
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"diff of resource \"diff\":\n+ .: {\"apiVersion\":\"v1\",\"data\":{\"key\":\"<redacted>\"},\"kind\":\"Secret\",\"metadata\":{\"name\":\"credentials\"},\"stringData\":{\"password\":\"<redacted>\"}}",
+	}
+	got := make([]string, 0, len(rsp.GetResults()))
+	for _, res := range rsp.GetResults() {
+		got = append(got, res.GetMessage())
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RunFunction(...): diff results: -want, +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"golang.org/x/mod/semver"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+const (
+	// moduleFilePath is the file declaring a CUE module and its dependencies
+	moduleFilePath = "cue.mod/module.cue"
+	// modulePkgDir is the directory of a module the loader resolves the
+	// imports of other modules from
+	modulePkgDir = "cue.mod/pkg"
+
+	// mediaTypeOCIManifest is the media type of the manifest of a CUE module
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	// mediaTypeModuleZip is the media type of the layer holding the files of
+	// a CUE module
+	mediaTypeModuleZip = "application/zip"
+
+	// maxModuleBytes is the largest module zip fetched from a registry
+	maxModuleBytes = 16 << 20
+	// registryTimeout is the timeout of each request to a registry
+	registryTimeout = 30 * time.Second
+)
+
+// moduleFetcher fetches the dependencies of CUE modules from OCI registries
+// Fetched modules are cached by repository and version, they are immutable
+type moduleFetcher struct {
+	client *http.Client
+	// credentialsDir holds a directory of username and password files for each
+	// credentials reference
+	credentialsDir string
+
+	mu    sync.Mutex
+	cache map[string]fetchedModule
+}
+
+// fetchedModule is the files of a fetched module and the digest of its zip
+type fetchedModule struct {
+	files  map[string]string
+	digest string
+}
+
+// newModuleFetcher returns a fetcher reading registry credentials from dir
+func newModuleFetcher(credentialsDir string) *moduleFetcher {
+	return &moduleFetcher{
+		client:         &http.Client{Timeout: registryTimeout},
+		credentialsDir: credentialsDir,
+		cache:          map[string]fetchedModule{},
+	}
+}
+
+// moduleDep is a module dependency at a version
+type moduleDep struct {
+	path    string
+	version string
+}
+
+// fetchDeps adds the files of the dependencies declared in the module.cue of
+// the module, and of their dependencies, under cue.mod/pkg of the module so
+// that the loader resolves their imports. The zip of a dependency pinned by the
+// digests of the module must match its digest.
+func (f *moduleFetcher) fetchDeps(m *v1beta1.Module, registries []v1beta1.Registry) error {
+	deps, err := moduleDeps(m.Files[moduleFilePath])
+	if err != nil {
+		return errors.Wrapf(err, "cannot read dependencies from %s", moduleFilePath)
+	}
+
+	// Each module is resolved at the highest version required of it
+	selected := map[string]string{}
+	fetched := map[string]map[string]string{}
+	for len(deps) != 0 {
+		d := deps[0]
+		deps = deps[1:]
+		if v, ok := selected[d.path]; ok && semver.Compare(v, d.version) >= 0 {
+			continue
+		}
+		selected[d.path] = d.version
+
+		mod, err := f.fetch(d, registries)
+		if err != nil {
+			return errors.Wrapf(err, "cannot fetch module %s@%s", d.path, d.version)
+		}
+		if pinned, ok := m.Digests[d.path+"@"+d.version]; ok && mod.digest != pinned {
+			return errors.Errorf("cannot verify module %s@%s: digest %s does not match the pinned digest %s", d.path, d.version, mod.digest, pinned)
+		}
+		fetched[d.path] = mod.files
+
+		transitive, err := moduleDeps(mod.files[moduleFilePath])
+		if err != nil {
+			return errors.Wrapf(err, "cannot read dependencies of module %s@%s", d.path, d.version)
+		}
+		deps = append(deps, transitive...)
+	}
+
+	for modPath, files := range fetched {
+		for p, content := range files {
+			if strings.HasPrefix(p, "cue.mod/") {
+				continue
+			}
+			m.Files[path.Join(modulePkgDir, modPath, p)] = content
+		}
+	}
+	return nil
+}
+
+// fetch returns the module from the registry serving it
+func (f *moduleFetcher) fetch(d moduleDep, registries []v1beta1.Registry) (fetchedModule, error) {
+	reg, ok := registryFor(d.path, registries)
+	if !ok {
+		return fetchedModule{}, errors.Errorf("no registry serves module %q", d.path)
+	}
+	host, repo := registryRepository(reg.URL, d.path)
+	key := fmt.Sprintf("%s/%s:%s", host, repo, d.version)
+
+	f.mu.Lock()
+	mod, ok := f.cache[key]
+	f.mu.Unlock()
+	if ok {
+		return mod, nil
+	}
+
+	c := &registryClient{client: f.client, scheme: "https", host: host}
+	if reg.Insecure {
+		c.scheme = "http"
+	}
+	if ref := reg.CredentialsRef; ref != nil {
+		var err error
+		c.username, c.password, err = readCredentials(f.credentialsDir, ref.Name)
+		if err != nil {
+			return fetchedModule{}, err
+		}
+	}
+	b, err := c.moduleZip(repo, d.version)
+	if err != nil {
+		return fetchedModule{}, err
+	}
+	files, err := unzipModule(b)
+	if err != nil {
+		return fetchedModule{}, err
+	}
+
+	mod = fetchedModule{files: files, digest: sha256Digest(b)}
+	f.mu.Lock()
+	f.cache[key] = mod
+	f.mu.Unlock()
+	return mod, nil
+}
+
+// moduleDeps returns the dependencies declared in the deps field of a
+// module.cue, keyed by the module path and major version
+func moduleDeps(src string) ([]moduleDep, error) {
+	if src == "" {
+		return nil, nil
+	}
+	v := cuecontext.New().CompileString(src)
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+	deps := v.LookupPath(cue.ParsePath("deps"))
+	if !deps.Exists() {
+		return nil, nil
+	}
+	it, err := deps.Fields()
+	if err != nil {
+		return nil, err
+	}
+	out := []moduleDep{}
+	for it.Next() {
+		label := it.Selector().Unquoted()
+		modPath, _, _ := strings.Cut(label, "@")
+		version, err := it.Value().LookupPath(cue.ParsePath("v")).String()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get version of dependency %q", label)
+		}
+		if !semver.IsValid(version) {
+			return nil, errors.Errorf("invalid version %q of dependency %q", version, label)
+		}
+		out = append(out, moduleDep{path: modPath, version: version})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].path < out[j].path })
+	return out, nil
+}
+
+// registryFor returns the registry with the longest module prefix matching the
+// module path
+func registryFor(modPath string, registries []v1beta1.Registry) (v1beta1.Registry, bool) {
+	var (
+		match v1beta1.Registry
+		found bool
+	)
+	for _, r := range registries {
+		if r.ModulePrefix != "" && modPath != r.ModulePrefix && !strings.HasPrefix(modPath, r.ModulePrefix+"/") {
+			continue
+		}
+		if !found || len(r.ModulePrefix) > len(match.ModulePrefix) {
+			match, found = r, true
+		}
+	}
+	return match, found
+}
+
+// registryRepository returns the registry host and the repository of the
+// module, the module path is appended to the repository prefix of the url
+func registryRepository(registryURL, modPath string) (string, string) {
+	host, prefix, _ := strings.Cut(strings.TrimSuffix(registryURL, "/"), "/")
+	return host, path.Join(prefix, modPath)
+}
+
+// readCredentials reads the username and password files of the named
+// credentials, for example from a mounted kubernetes.io/basic-auth Secret
+func readCredentials(dir, name string) (string, string, error) {
+	if dir == "" {
+		return "", "", errors.Errorf("cannot read credentials %q: no registry credentials directory is configured", name)
+	}
+	username, err := os.ReadFile(filepath.Join(dir, name, "username"))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "cannot read username of credentials %q", name)
+	}
+	password, err := os.ReadFile(filepath.Join(dir, name, "password"))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "cannot read password of credentials %q", name)
+	}
+	return strings.TrimSpace(string(username)), strings.TrimSpace(string(password)), nil
+}
+
+// unzipModule returns the files of a module zip keyed by their path
+func unzipModule(b []byte) (map[string]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read module zip")
+	}
+	files := map[string]string{}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !isCleanRelativePath(zf.Name) {
+			return nil, errors.Errorf("invalid module file path %q", zf.Name)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot open module file %q", zf.Name)
+		}
+		content, err := io.ReadAll(io.LimitReader(rc, maxModuleBytes))
+		_ = rc.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read module file %q", zf.Name)
+		}
+		files[zf.Name] = string(content)
+	}
+	return files, nil
+}
+
+// isCleanRelativePath returns whether p is a clean slash separated path that
+// stays inside the directory it is relative to
+func isCleanRelativePath(p string) bool {
+	return p != "" && !path.IsAbs(p) && path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// registryClient fetches CUE modules with the OCI distribution API
+type registryClient struct {
+	client   *http.Client
+	scheme   string
+	host     string
+	username string
+	password string
+	// token is the bearer token issued by the registry's token service
+	token string
+}
+
+// ociManifest is the subset of an OCI image manifest used to find the
+// module zip
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// moduleZip returns the module zip of the repository tagged with the version
+func (c *registryClient) moduleZip(repo, version string) ([]byte, error) {
+	m, _, err := c.manifest(repo, version)
+	if err != nil {
+		return nil, err
+	}
+	return c.layerZip(repo, m)
+}
+
+// manifest returns the manifest of the repository the reference, a tag or a
+// digest, points at along with the digest of the manifest. A manifest fetched
+// by digest is verified against it.
+func (c *registryClient) manifest(repo, reference string) (ociManifest, string, error) {
+	b, err := c.get(fmt.Sprintf("/v2/%s/manifests/%s", repo, reference), mediaTypeOCIManifest, maxModuleBytes)
+	if err != nil {
+		return ociManifest{}, "", errors.Wrap(err, "cannot fetch manifest")
+	}
+	digest := sha256Digest(b)
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return ociManifest{}, "", errors.Errorf("manifest digest %s does not match %s", digest, reference)
+	}
+	m := ociManifest{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return ociManifest{}, "", errors.Wrap(err, "cannot parse manifest")
+	}
+	return m, digest, nil
+}
+
+// layerZip returns the module zip layer of the manifest of the repository
+func (c *registryClient) layerZip(repo string, m ociManifest) ([]byte, error) {
+	for _, l := range m.Layers {
+		if l.MediaType != mediaTypeModuleZip {
+			continue
+		}
+		if l.Size > maxModuleBytes {
+			return nil, errors.Errorf("module zip is %d bytes, larger than the %d byte limit", l.Size, maxModuleBytes)
+		}
+		b, err := c.get(fmt.Sprintf("/v2/%s/blobs/%s", repo, l.Digest), "", maxModuleBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot fetch module zip")
+		}
+		if want := sha256Digest(b); l.Digest != want {
+			return nil, errors.Errorf("module zip digest %s does not match %s", want, l.Digest)
+		}
+		return b, nil
+	}
+	return nil, errors.Errorf("manifest has no %s layer", mediaTypeModuleZip)
+}
+
+// get returns the body of the registry API path, authenticating with the
+// scheme the registry challenges for
+func (c *registryClient) get(apiPath, accept string, limit int64) ([]byte, error) {
+	rsp, err := c.do(apiPath, accept)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusUnauthorized {
+		challenge := rsp.Header.Get("WWW-Authenticate")
+		_ = rsp.Body.Close()
+		if err := c.authenticate(challenge); err != nil {
+			return nil, err
+		}
+		if rsp, err = c.do(apiPath, accept); err != nil {
+			return nil, err
+		}
+	}
+	defer rsp.Body.Close() //nolint:errcheck // nothing to do with the error
+	if rsp.StatusCode != http.StatusOK {
+		return nil, registryStatusError{code: rsp.StatusCode, status: rsp.Status, path: apiPath}
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, limit))
+}
+
+// registryStatusError is an unexpected status of a registry API response
+type registryStatusError struct {
+	code   int
+	status string
+	path   string
+}
+
+func (e registryStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s from %s", e.status, e.path)
+}
+
+// isRegistryNotFound returns whether the registry does not hold the requested
+// manifest or blob
+func isRegistryNotFound(err error) bool {
+	se := registryStatusError{}
+	return errors.As(err, &se) && se.code == http.StatusNotFound
+}
+
+func (c *registryClient) do(apiPath, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s%s", c.scheme, c.host, apiPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.client.Do(req)
+}
+
+// authenticate answers the WWW-Authenticate challenge of the registry, a
+// bearer challenge is exchanged for a token from the registry's token service
+func (c *registryClient) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		if c.username == "" {
+			return errors.New("registry requires credentials")
+		}
+		// Basic credentials are already sent with every request
+		return errors.New("registry rejected the credentials")
+	}
+
+	p := parseChallengeParams(params)
+	realm, err := url.Parse(p["realm"])
+	if err != nil || p["realm"] == "" {
+		return errors.Errorf("invalid bearer challenge %q", challenge)
+	}
+	q := realm.Query()
+	for _, k := range []string{"service", "scope"} {
+		if p[k] != "" {
+			q.Set(k, p[k])
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "cannot request registry token")
+	}
+	defer rsp.Body.Close() //nolint:errcheck // nothing to do with the error
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %s requesting registry token", rsp.Status)
+	}
+	t := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(rsp.Body).Decode(&t); err != nil {
+		return errors.Wrap(err, "cannot parse registry token")
+	}
+	c.token = t.Token
+	if c.token == "" {
+		c.token = t.AccessToken
+	}
+	if c.token == "" {
+		return errors.New("registry token service returned no token")
+	}
+	return nil
+}
+
+// parseChallengeParams parses the comma separated key="value" parameters of
+// a WWW-Authenticate challenge
+func parseChallengeParams(s string) map[string]string {
+	out := map[string]string{}
+	for s != "" {
+		var kv string
+		// values are quoted and may contain commas, e.g. in scopes
+		if i := strings.Index(s, `",`); i >= 0 {
+			kv, s = s[:i+1], strings.TrimSpace(s[i+2:])
+		} else {
+			kv, s = s, ""
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		out[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return out
+}
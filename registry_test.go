@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRegistry serves CUE modules with the OCI distribution API, requiring a
+// bearer token issued for the username and password when they are set
+type fakeRegistry struct {
+	username, password string
+	// manifests and blobs are keyed by their API path
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	// requests counts the manifest requests
+	requests int
+	// unavailable fails every request with a 503 status when set
+	unavailable bool
+}
+
+// push serves the module zip of the files tagged with the version and by the
+// digest of its manifest, and returns the digest of the module zip
+func (r *fakeRegistry) push(t *testing.T, repo, version string, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	m, err := json.Marshal(ociManifest{Layers: []ociDescriptor{
+		{MediaType: mediaTypeModuleZip, Digest: digest, Size: int64(buf.Len())},
+		{MediaType: "application/vnd.cue.modulefile.v1", Digest: "sha256:unused"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.manifests[fmt.Sprintf("/v2/%s/manifests/%s", repo, version)] = m
+	r.manifests[fmt.Sprintf("/v2/%s/manifests/%s", repo, sha256Digest(m))] = m
+	r.blobs[fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)] = buf.Bytes()
+	return digest
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if req.URL.Path == "/token" {
+		if u, p, _ := req.BasicAuth(); u != r.username || p != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token": "secret-token"}`))
+		return
+	}
+	if r.username != "" && req.Header.Get("Authorization") != "Bearer secret-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake",scope="repository:platform/example.org/schemas:pull"`, req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if m, ok := r.manifests[req.URL.Path]; ok {
+		r.requests++
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		_, _ = w.Write(m)
+		return
+	}
+	if b, ok := r.blobs[req.URL.Path]; ok {
+		_, _ = w.Write(b)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func TestFetchModuleDeps(t *testing.T) {
+	reg := &fakeRegistry{username: "robot", password: "hunter2", manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	schemasDigest := reg.push(t, "platform/example.org/schemas", "v0.2.0", map[string]string{
+		"cue.mod/module.cue": "module: \"example.org/schemas@v0\"\ndeps: \"example.org/labels@v0\": v: \"v0.1.0\"\n",
+		"bucket.cue":         "package schemas\n\nimport lbl \"example.org/labels\"\n\n#Bucket: {\n\tkind: \"Bucket\"\n\tmetadata: {\n\t\tname:   string\n\t\tlabels: lbl.#Standard\n\t}\n}\n",
+	})
+	reg.push(t, "platform/example.org/schemas", "v0.1.0", map[string]string{
+		"cue.mod/module.cue": "module: \"example.org/schemas@v0\"\n",
+		"bucket.cue":         "package schemas\n\n#Bucket: {\n\tkind: \"OldBucket\"\n\tmetadata: name: string\n}\n",
+	})
+	reg.push(t, "platform/example.org/labels", "v0.1.0", map[string]string{
+		"cue.mod/module.cue": "module: \"example.org/labels@v0\"\n",
+		"labels.cue":         "package labels\n\n#Standard: team: \"platform\"\n",
+	})
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	creds := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(creds, "platform"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"username": "robot\n", "password": "hunter2\n"} {
+		if err := os.WriteFile(filepath.Join(creds, "platform", name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	module := func(version string) v1beta1.Module {
+		return v1beta1.Module{Files: map[string]string{
+			"cue.mod/module.cue": "module: \"example.org/app\"\ndeps: \"example.org/schemas@v0\": v: \"" + version + "\"\n",
+			"app.cue":            "package app\n\nimport \"example.org/schemas\"\n\nschemas.#Bucket & {metadata: name: \"bucket\"}\n",
+		}}
+	}
+	pinned := func(digest string) v1beta1.Module {
+		m := module("v0.2.0")
+		m.Digests = map[string]string{"example.org/schemas@v0.2.0": digest}
+		return m
+	}
+	wrongDigest := "sha256:" + strings.Repeat("0", 64)
+	registries := []v1beta1.Registry{{
+		URL:            host + "/platform",
+		Insecure:       true,
+		CredentialsRef: &v1beta1.CredentialsRef{Name: "platform"},
+	}}
+
+	cases := map[string]struct {
+		reason     string
+		module     v1beta1.Module
+		registries []v1beta1.Registry
+		creds      string
+		want       string
+		wantErr    string
+	}{
+		"Transitive": {
+			reason:     "Dependencies and their dependencies should be fetched so that imports resolve",
+			module:     module("v0.2.0"),
+			registries: registries,
+			creds:      creds,
+			want:       "{\n    \"kind\": \"Bucket\",\n    \"metadata\": {\n        \"name\": \"bucket\",\n        \"labels\": {\n            \"team\": \"platform\"\n        }\n    }\n}\n",
+		},
+		"Version": {
+			reason:     "The version declared in module.cue should be fetched",
+			module:     module("v0.1.0"),
+			registries: registries,
+			creds:      creds,
+			want:       "{\n    \"kind\": \"OldBucket\",\n    \"metadata\": {\n        \"name\": \"bucket\"\n    }\n}\n",
+		},
+		"Pinned": {
+			reason:     "A dependency matching its pinned digest should be fetched",
+			module:     pinned(schemasDigest),
+			registries: registries,
+			creds:      creds,
+			want:       "{\n    \"kind\": \"Bucket\",\n    \"metadata\": {\n        \"name\": \"bucket\",\n        \"labels\": {\n            \"team\": \"platform\"\n        }\n    }\n}\n",
+		},
+		"DigestMismatch": {
+			reason:     "A dependency not matching its pinned digest should return an error",
+			module:     pinned(wrongDigest),
+			registries: registries,
+			creds:      creds,
+			wantErr:    "cannot verify module example.org/schemas@v0.2.0: digest " + schemasDigest + " does not match the pinned digest " + wrongDigest,
+		},
+		"UnknownVersion": {
+			reason:     "A version missing from the registry should return an error",
+			module:     module("v0.3.0"),
+			registries: registries,
+			creds:      creds,
+			wantErr:    "cannot fetch module example.org/schemas@v0.3.0: cannot fetch manifest: unexpected status 404 Not Found from /v2/platform/example.org/schemas/manifests/v0.3.0",
+		},
+		"NoCredentials": {
+			reason:     "A registry requiring credentials should return an error without them",
+			module:     module("v0.2.0"),
+			registries: []v1beta1.Registry{{URL: host + "/platform", Insecure: true}},
+			wantErr:    "cannot fetch module example.org/schemas@v0.2.0: cannot fetch manifest: unexpected status 401 Unauthorized requesting registry token",
+		},
+		"NoMatchingRegistry": {
+			reason:     "A module without a registry serving its prefix should return an error",
+			module:     module("v0.2.0"),
+			registries: []v1beta1.Registry{{ModulePrefix: "example.com", URL: host, Insecure: true}},
+			wantErr:    "cannot fetch module example.org/schemas@v0.2.0: no registry serves module \"example.org/schemas\"",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := tc.module
+			err := newModuleFetcher(tc.creds).fetchDeps(&m, tc.registries)
+			if tc.wantErr != "" {
+				assert.NotNil(t, err, "%s: expected an error", tc.reason)
+				if err != nil {
+					assert.Equal(t, tc.wantErr, err.Error(), "%s", tc.reason)
+				}
+				return
+			}
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+
+			out, err := cueCompile(outputJSON, v1beta1.CUEInput{Export: v1beta1.Export{Module: &m}}, compileOpts{})
+			assert.Nil(t, err, "%s: received unexpected error", tc.reason)
+			assert.Equal(t, tc.want, out.string, "%s", tc.reason)
+		})
+	}
+}
+
+func TestFetchModuleDepsCached(t *testing.T) {
+	reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	reg.push(t, "example.org/schemas", "v0.1.0", map[string]string{
+		"cue.mod/module.cue": "module: \"example.org/schemas@v0\"\n",
+		"bucket.cue":         "package schemas\n\n#Bucket: kind: \"Bucket\"\n",
+	})
+	srv := httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+
+	f := newModuleFetcher("")
+	registries := []v1beta1.Registry{{URL: strings.TrimPrefix(srv.URL, "http://"), Insecure: true}}
+	for i := 0; i < 2; i++ {
+		m := v1beta1.Module{Files: map[string]string{
+			"cue.mod/module.cue": "module: \"example.org/app\"\ndeps: \"example.org/schemas@v0\": v: \"v0.1.0\"\n",
+		}}
+		if err := f.fetchDeps(&m, registries); err != nil {
+			t.Fatalf("fetchDeps(...): unexpected error: %v", err)
+		}
+		assert.Equal(t, "package schemas\n\n#Bucket: kind: \"Bucket\"\n", m.Files["cue.mod/pkg/example.org/schemas/bucket.cue"])
+	}
+	assert.Equal(t, 1, reg.requests, "a fetched module version should be served from the cache")
+}
+
+func TestRegistryFor(t *testing.T) {
+	registries := []v1beta1.Registry{
+		{URL: "registry.example.org"},
+		{ModulePrefix: "example.org/platform", URL: "platform.example.org/cue"},
+		{ModulePrefix: "example.org/platform/internal", URL: "internal.example.org"},
+	}
+
+	cases := map[string]struct {
+		reason string
+		module string
+		want   string
+	}{
+		"Default": {
+			reason: "A module matching no prefix should be fetched from the registry without a prefix",
+			module: "example.org/schemas",
+			want:   "registry.example.org",
+		},
+		"Prefix": {
+			reason: "A module matching a prefix should be fetched from its registry",
+			module: "example.org/platform/schemas",
+			want:   "platform.example.org/cue",
+		},
+		"LongestPrefix": {
+			reason: "The registry with the longest matching prefix should be used",
+			module: "example.org/platform/internal/secrets",
+			want:   "internal.example.org",
+		},
+		"PartialElement": {
+			reason: "A prefix should only match whole path elements",
+			module: "example.org/platformer",
+			want:   "registry.example.org",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := registryFor(tc.module, registries)
+			assert.True(t, ok, "%s", tc.reason)
+			assert.Equal(t, tc.want, got.URL, "%s", tc.reason)
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/ghodss/yaml"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// RenderCmd renders arbitrary manifests from a CUE package with the same
+// evaluator and injection as the function, for bootstrapping a platform. With
+// --input it runs a pipeline step of the function against an observed XR
+// instead, and renders the desired state it returns.
+type RenderCmd struct {
+	Path       string    `arg:"" optional:"" help:"CUE package directory or file to render." type:"existingpath"`
+	Expression []string  `short:"e" help:"Render only this expression, yaml.MarshalStream(objects) renders a list of manifests."`
+	Inject     []string  `short:"t" help:"Tags to inject into the template in name=value form."`
+	Values     string    `help:"YAML file of structured values to fill into the @tag(name) fields matching their name." type:"existingfile"`
+	Now        bool      `help:"Inject the current time into #now."`
+	FreezeTime time.Time `help:"Inject this RFC 3339 time into #now instead of the current time."`
+	OutDir     string    `short:"o" help:"Write each manifest to its own file in this directory instead of stdout."`
+
+	Input    string `help:"YAML file of the CUEInput of a pipeline step, renders the desired state the step returns for --xr instead of manifests." type:"existingfile"`
+	XR       string `help:"YAML file of the observed composite resource of the pipeline step." type:"existingfile"`
+	Observed string `help:"Directory of YAML files of the observed composed resources of the pipeline step, named by their crossplane.io/composition-resource-name annotation or else their metadata.name." type:"existingdir"`
+}
+
+// Run the render command.
+func (c *RenderCmd) Run() error {
+	if c.Input != "" {
+		return c.renderPipeline(context.Background(), os.Stdout, os.Stderr)
+	}
+	if c.Path == "" {
+		return errors.New("a CUE package directory or file, or --input, is required")
+	}
+	opts := compileOpts{parseData: true, tags: c.Inject}
+	if c.Values != "" {
+		b, err := os.ReadFile(c.Values)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, &opts.values); err != nil {
+			return errors.Wrapf(err, "cannot parse values %q", c.Values)
+		}
+	}
+	switch {
+	case !c.FreezeTime.IsZero():
+		opts.now = c.FreezeTime
+	case c.Now:
+		opts.now = time.Now()
+	}
+
+	in := v1beta1.CUEInput{}
+	in.Export.Options.Expressions = c.Expression
+	if fi, err := os.Stat(c.Path); err == nil && fi.IsDir() {
+		opts.dir = c.Path
+	} else {
+		b, err := os.ReadFile(c.Path)
+		if err != nil {
+			return err
+		}
+		in.Export.Value = v1beta1.Value(b)
+	}
+
+	docs, err := renderManifests(in, opts)
+	if err != nil {
+		return err
+	}
+	if c.OutDir != "" {
+		return writeManifestFiles(c.OutDir, docs)
+	}
+	return writeManifests(os.Stdout, docs)
+}
+
+// renderManifests compiles the template into its manifests
+func renderManifests(in v1beta1.CUEInput, opts compileOpts) ([]map[string]interface{}, error) {
+	out, err := cueCompile(outputJSON, in, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed compiling cue template")
+	}
+	return out.data, nil
+}
+
+// writeManifests writes the manifests as a stream of yaml documents
+func writeManifests(w io.Writer, docs []map[string]interface{}) error {
+	for i, d := range docs {
+		b, err := yaml.Marshal(d)
+		if err != nil {
+			return errors.Wrapf(err, "cannot marshal manifest at index %d", i)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifestFiles writes each manifest to dir in a file named after its
+// namespace, kind and name
+func writeManifestFiles(dir string, docs []map[string]interface{}) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrapf(err, "cannot create output directory %q", dir)
+	}
+	written := map[string]bool{}
+	for i, d := range docs {
+		var b bytes.Buffer
+		if err := writeManifests(&b, []map[string]interface{}{d}); err != nil {
+			return errors.Wrapf(err, "cannot marshal manifest at index %d", i)
+		}
+		name := manifestFileName(d)
+		if name == "" {
+			return errors.Errorf("cannot name manifest at index %d, it has no kind and metadata.name", i)
+		}
+		if written[name] {
+			return errors.Errorf("cannot write manifest at index %d, %q is already written", i, name)
+		}
+		written[name] = true
+		if err := os.WriteFile(filepath.Join(dir, name), b.Bytes(), 0o644); err != nil { //nolint:gosec // manifests are not secret
+			return errors.Wrapf(err, "cannot write manifest %q", name)
+		}
+	}
+	return nil
+}
+
+// manifestFileName returns the file name of the manifest, <namespace>_<kind>_<name>.yaml
+// without a namespace for cluster scoped manifests
+func manifestFileName(doc map[string]interface{}) string {
+	kind, _ := doc["kind"].(string)
+	meta, _ := doc["metadata"].(map[string]interface{})
+	name, _ := meta["name"].(string)
+	if kind == "" || name == "" {
+		return ""
+	}
+	parts := []string{kind, name}
+	if ns, _ := meta["namespace"].(string); ns != "" {
+		parts = append([]string{ns}, parts...)
+	}
+	return fmt.Sprintf("%s.yaml", strings.ToLower(strings.Join(parts, "_")))
+}
+
+// renderPipeline runs the pipeline step of the input against the observed
+// state, writes the desired state it returns to out as a stream of yaml
+// documents and its results to log. A fatal result fails the render.
+func (c *RenderCmd) renderPipeline(ctx context.Context, out, log io.Writer) error {
+	if c.XR == "" {
+		return errors.New("--xr is required with --input")
+	}
+	if c.Path != "" || len(c.Expression) != 0 || len(c.Inject) != 0 || c.Values != "" || c.OutDir != "" {
+		return errors.New("--input renders the CUE template of the input, it cannot be used with a path, --expression, --inject, --values or --out-dir")
+	}
+	req, err := renderRequest(c.XR, c.Input, c.Observed)
+	if err != nil {
+		return err
+	}
+
+	f := &Function{log: logging.NewNopLogger()}
+	switch {
+	case !c.FreezeTime.IsZero():
+		f.now = func() time.Time { return c.FreezeTime }
+	case c.Now:
+		f.now = time.Now
+	}
+	rsp, err := f.RunFunction(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "cannot run function")
+	}
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+			return errors.New(r.GetMessage())
+		}
+		severity := strings.TrimPrefix(r.GetSeverity().String(), "SEVERITY_")
+		if _, err := fmt.Fprintf(log, "%s: %s\n", severity, r.GetMessage()); err != nil {
+			return err
+		}
+	}
+	return writeManifests(out, desiredManifests(rsp))
+}
+
+// renderRequest builds the request of a pipeline step from the files of its
+// input, its observed XR and the directory of its observed composed resources
+func renderRequest(xr, input, observed string) (*fnv1beta1.RunFunctionRequest, error) {
+	readObject := func(path string) (*structpb.Struct, error) {
+		docs, err := readManifests(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) != 1 {
+			return nil, errors.Errorf("%s must hold a single document, it holds %d", path, len(docs))
+		}
+		return structpb.NewStruct(docs[0])
+	}
+
+	in, err := readObject(input)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read input")
+	}
+	oxr, err := readObject(xr)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read XR")
+	}
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: in,
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{Resource: oxr},
+			Resources: map[string]*fnv1beta1.Resource{},
+		},
+	}
+	if observed == "" {
+		return req, nil
+	}
+
+	entries, err := os.ReadDir(observed)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read observed resources")
+	}
+	for _, e := range entries {
+		if e.IsDir() || !isManifestFile(e.Name()) {
+			continue
+		}
+		docs, err := readManifests(filepath.Join(observed, e.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read observed resources")
+		}
+		for _, d := range docs {
+			name := compositionResourceName(d)
+			if name == "" {
+				return nil, errors.Errorf("cannot name observed resource of %s, it has no %s annotation or metadata.name", e.Name(), compositionResourceNameAnnotation)
+			}
+			if _, ok := req.Observed.Resources[name]; ok {
+				return nil, errors.Errorf("observed resource %q of %s is already read", name, e.Name())
+			}
+			s, err := structpb.NewStruct(d)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot convert observed resource %q", name)
+			}
+			req.Observed.Resources[name] = &fnv1beta1.Resource{Resource: s}
+		}
+	}
+	return req, nil
+}
+
+// readManifests reads the stream of yaml or json documents of the file
+func readManifests(path string) ([]map[string]interface{}, error) {
+	b, err := os.ReadFile(path) //nolint:gosec // the file is named by the user
+	if err != nil {
+		return nil, err
+	}
+	docs, err := parseStream(string(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s", path)
+	}
+	return dropEmpty(docs), nil
+}
+
+// isManifestFile returns whether the file name has a yaml or json extension
+func isManifestFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// compositionResourceName returns the name of the composed resource in the
+// pipeline, its composition resource name annotation or else its metadata.name
+func compositionResourceName(doc map[string]interface{}) string {
+	meta, _ := doc["metadata"].(map[string]interface{})
+	annotations, _ := meta["annotations"].(map[string]interface{})
+	if n, _ := annotations[compositionResourceNameAnnotation].(string); n != "" {
+		return n
+	}
+	name, _ := meta["name"].(string)
+	return name
+}
+
+// desiredManifests returns the desired XR of the response followed by its
+// desired composed resources sorted by name, each annotated with its name
+func desiredManifests(rsp *fnv1beta1.RunFunctionResponse) []map[string]interface{} {
+	var docs []map[string]interface{}
+	if xr := rsp.GetDesired().GetComposite().GetResource(); xr != nil {
+		docs = append(docs, xr.AsMap())
+	}
+	resources := rsp.GetDesired().GetResources()
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := resources[name].GetResource().AsMap()
+		meta, _ := d["metadata"].(map[string]interface{})
+		if meta == nil {
+			meta = map[string]interface{}{}
+			d["metadata"] = meta
+		}
+		annotations, _ := meta["annotations"].(map[string]interface{})
+		if annotations == nil {
+			annotations = map[string]interface{}{}
+			meta["annotations"] = annotations
+		}
+		annotations[compositionResourceNameAnnotation] = name
+		docs = append(docs, d)
+	}
+	return docs
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderManifests(t *testing.T) {
+	// a cue module with a package importing another package of the module
+	dir := t.TempDir()
+	files := map[string]string{
+		"cue.mod/module.cue":   `module: "example.org/boot"`,
+		"lib/lib.cue":          "package lib\n\ngroup: \"example.org\"\n",
+		"platform/objects.cue": "package platform\n\nimport \"example.org/boot/lib\"\n\nenv: string @tag(env)\nproviders: [...string] @tag(providers)\n#now: string\n\nobjects: [\n\t{apiVersion: \"apiextensions.crossplane.io/v1\", kind: \"CompositeResourceDefinition\", metadata: {name: \"xbuckets.\\(lib.group)\", annotations: rendered: #now}},\n\tfor p in providers {apiVersion: \"pkg.crossplane.io/v1\", kind: \"Provider\", metadata: name: \"\\(p)-\\(env)\"},\n]\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := v1beta1.CUEInput{}
+	in.Export.Options.Expressions = []string{"yaml.MarshalStream(objects)"}
+	docs, err := renderManifests(in, compileOpts{
+		parseData: true,
+		dir:       filepath.Join(dir, "platform"),
+		tags:      []string{"env=dev"},
+		values:    map[string]interface{}{"providers": []interface{}{"provider-aws"}},
+		now:       time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("renderManifests(...): %v", err)
+	}
+
+	want := []map[string]interface{}{
+		{
+			"apiVersion": "apiextensions.crossplane.io/v1",
+			"kind":       "CompositeResourceDefinition",
+			"metadata": map[string]interface{}{
+				"name":        "xbuckets.example.org",
+				"annotations": map[string]interface{}{"rendered": "2023-09-01T00:00:00Z"},
+			},
+		},
+		{
+			"apiVersion": "pkg.crossplane.io/v1",
+			"kind":       "Provider",
+			"metadata":   map[string]interface{}{"name": "provider-aws-dev"},
+		},
+	}
+	if diff := cmp.Diff(want, docs); diff != "" {
+		t.Errorf("renderManifests(...): -want, +got:\n%s", diff)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := writeManifestFiles(out, docs); err != nil {
+		t.Fatalf("writeManifestFiles(...): %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "provider_provider-aws-dev.yaml"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(...): %v", err)
+	}
+	if diff := cmp.Diff("apiVersion: pkg.crossplane.io/v1\nkind: Provider\nmetadata:\n  name: provider-aws-dev\n", string(b)); diff != "" {
+		t.Errorf("writeManifestFiles(...): -want, +got:\n%s", diff)
+	}
+}
+
+func TestRenderPipeline(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"input.yaml":          "apiVersion: cue.fn.crossplane.io/v1beta1\nkind: CUEInput\nmetadata:\n  name: render\nexport:\n  target: Resources\n  value: |\n    apiVersion: \"example.org/v1\"\n    kind: \"Bucket\"\n    metadata: name: \"bucket\"\n",
+		"xr.yaml":             "apiVersion: example.org/v1\nkind: XR\nmetadata:\n  name: example\n",
+		"observed/queue.yaml": "apiVersion: example.org/v1\nkind: Queue\nmetadata:\n  name: queue-abc\n  annotations:\n    crossplane.io/composition-resource-name: queue\n",
+		"observed/README.md":  "not a manifest",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := renderRequest(filepath.Join(dir, "xr.yaml"), filepath.Join(dir, "input.yaml"), filepath.Join(dir, "observed"))
+	if err != nil {
+		t.Fatalf("renderRequest(...): %v", err)
+	}
+	if _, ok := req.GetObserved().GetResources()["queue"]; !ok || len(req.GetObserved().GetResources()) != 1 {
+		t.Errorf("renderRequest(...): want the observed resource queue, got %v", req.GetObserved().GetResources())
+	}
+
+	c := &RenderCmd{XR: filepath.Join(dir, "xr.yaml"), Input: filepath.Join(dir, "input.yaml"), Observed: filepath.Join(dir, "observed")}
+	out, log := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := c.renderPipeline(context.Background(), out, log); err != nil {
+		t.Fatalf("renderPipeline(...): %v", err)
+	}
+	want := "apiVersion: example.org/v1\nkind: XR\n---\napiVersion: example.org/v1\nkind: Bucket\nmetadata:\n  annotations:\n    crossplane.io/composition-resource-name: render\n  name: bucket\n"
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Errorf("renderPipeline(...): -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff("NORMAL: created resource \"bucket:Bucket\"\n", log.String()); diff != "" {
+		t.Errorf("renderPipeline(...): results -want, +got:\n%s", diff)
+	}
+}
+
+func TestManifestFileName(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		doc    map[string]interface{}
+		want   string
+	}{
+		"ClusterScoped": {
+			reason: "Cluster scoped manifests should be named after their kind and name",
+			doc:    map[string]interface{}{"kind": "Provider", "metadata": map[string]interface{}{"name": "provider-aws"}},
+			want:   "provider_provider-aws.yaml",
+		},
+		"Namespaced": {
+			reason: "Namespaced manifests should be prefixed with their namespace",
+			doc:    map[string]interface{}{"kind": "ConfigMap", "metadata": map[string]interface{}{"name": "cfg", "namespace": "crossplane-system"}},
+			want:   "crossplane-system_configmap_cfg.yaml",
+		},
+		"Unnamed": {
+			reason: "Manifests without a name cannot be named",
+			doc:    map[string]interface{}{"kind": "ConfigMap"},
+			want:   "",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, manifestFileName(tc.doc)); diff != "" {
+				t.Errorf("%s\nmanifestFileName(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// requestDef is the definition the RunFunctionRequest is injected into for an
+// export that sets injectRequest
+const requestDef = "request"
+
+// requestScope returns the value filled into #request, the json representation
+// of the request. The pipeline context and the extra resources are not fields
+// of the v1beta1 request of the function SDK, they are added as the context
+// and extraResources fields.
+func requestScope(req *fnv1beta1.RunFunctionRequest) (map[string]interface{}, error) {
+	b, err := protojson.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode request")
+	}
+	scope := map[string]interface{}{}
+	if err := json.Unmarshal(b, &scope); err != nil {
+		return nil, errors.Wrap(err, "cannot decode request")
+	}
+	ctx, err := getContext(req)
+	if err != nil {
+		return nil, err
+	}
+	scope["context"] = ctx.AsMap()
+	if scope["extraResources"], err = getExtraResources(req); err != nil {
+		return nil, err
+	}
+	return scope, nil
+}
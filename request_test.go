@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRunFunctionInjectRequest(t *testing.T) {
+	cases := map[string]struct {
+		reason    string
+		inject    bool
+		want      map[string]interface{}
+		wantFatal bool
+	}{
+		"Injected": {
+			reason: "The whole request should be available in #request",
+			inject: true,
+			want: map[string]interface{}{
+				"tag":     "hello",
+				"input":   "request",
+				"xr":      "my-xr",
+				"desired": []interface{}{"bucket"},
+				"context": "eu-west-1",
+			},
+		},
+		"NotInjected": {
+			reason:    "#request should not be declared without injectRequest",
+			wantFatal: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			input := resource.MustStructJSON(`{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind": "CUEInput",
+				"metadata": {"name": "request"},
+				"export": {
+					"target": "Context",
+					"contextKey": "example.org/request",
+					"value": "tag: #request.meta.tag\ninput: #request.input.metadata.name\nxr: #request.observed.composite.resource.metadata.name\ndesired: [for k, _ in #request.desired.resources {k}]\ncontext: #request.context[\"example.org/network\"].region\n"
+				}
+			}`)
+			input.GetFields()["export"].GetStructValue().GetFields()["options"] = structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+				"injectRequest": structpb.NewBoolValue(tc.inject),
+			}})
+			req := &fnv1beta1.RunFunctionRequest{
+				Meta:  &fnv1beta1.RequestMeta{Tag: "hello"},
+				Input: input,
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`)},
+				},
+				Desired: &fnv1beta1.State{
+					Resources: map[string]*fnv1beta1.Resource{
+						"bucket": {Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Bucket"}`)},
+					},
+				},
+			}
+			ctx := &structpb.Struct{Fields: map[string]*structpb.Value{
+				"example.org/network": structpb.NewStructValue(resource.MustStructJSON(`{"region": "eu-west-1"}`)),
+			}}
+			if err := setUnknownStruct(req, requestContextField, ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if err := fatalResult(rsp); (err != nil) != tc.wantFatal {
+				t.Fatalf("%s\nf.RunFunction(...): want fatal %t, got %v", tc.reason, tc.wantFatal, err)
+			}
+			if tc.wantFatal {
+				return
+			}
+			got, err := unknownStruct(rsp, responseContextField)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got.AsMap()["example.org/request"]); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// resultTargetCompositeAndClaim is the value of the TARGET_COMPOSITE_AND_CLAIM
+// result target
+const resultTargetCompositeAndClaim = 2
+
+// resultSeverity is the severity of a result raised by the template
+type resultSeverity string
+
+const (
+	// severityNormal results are informational
+	severityNormal resultSeverity = "normal"
+	// severityWarning results are surfaced as warning events
+	severityWarning resultSeverity = "warning"
+	// severityFatal results fail the pipeline
+	severityFatal resultSeverity = "fatal"
+)
+
+// result is a result raised by the template in #results
+type result struct {
+	// Severity of the result, one of normal, warning or fatal, it defaults
+	// to normal
+	Severity resultSeverity `json:"severity,omitempty"`
+	// Message of the result
+	Message string `json:"message"`
+}
+
+// toResult converts the result raised by the template to a function result
+func (r result) toResult() (*fnv1beta1.Result, error) {
+	if r.Message == "" {
+		return nil, errors.New("message is required")
+	}
+	var severity fnv1beta1.Severity
+	switch r.Severity {
+	case severityNormal, "":
+		severity = fnv1beta1.Severity_SEVERITY_NORMAL
+	case severityWarning:
+		severity = fnv1beta1.Severity_SEVERITY_WARNING
+	case severityFatal:
+		severity = fnv1beta1.Severity_SEVERITY_FATAL
+	default:
+		return nil, errors.Errorf("invalid severity %q: must be normal, warning or fatal", r.Severity)
+	}
+	return &fnv1beta1.Result{Severity: severity, Message: r.Message}, nil
+}
+
+// templateResults converts the results raised by the template to function
+// results and reports whether any of them is fatal
+func templateResults(results []result) ([]*fnv1beta1.Result, bool, error) {
+	out := make([]*fnv1beta1.Result, 0, len(results))
+	fatal := false
+	for i, r := range results {
+		res, err := r.toResult()
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "invalid result at index %d", i)
+		}
+		fatal = fatal || res.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL
+		out = append(out, res)
+	}
+	return out, fatal, nil
+}
+
+// incompleteResults returns a warning for each document skipped for holding
+// non-concrete values, listing the paths of the values
+func incompleteResults(incomplete []incompleteDocument) []*fnv1beta1.Result {
+	out := make([]*fnv1beta1.Result, 0, len(incomplete))
+	for _, d := range incomplete {
+		paths := make([]string, 0, len(d.Paths))
+		for _, p := range d.Paths {
+			if p == "" {
+				p = "."
+			}
+			paths = append(paths, p)
+		}
+		out = append(out, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+			Message:  fmt.Sprintf("skipped incomplete document at index %d: non-concrete values at %s", d.Index, strings.Join(paths, ", ")),
+		})
+	}
+	return out
+}
+
+// expressionResults returns a normal result for each named expression with
+// the number of documents it exported
+func expressionResults(expressions []expressionOutput) []*fnv1beta1.Result {
+	out := make([]*fnv1beta1.Result, 0, len(expressions))
+	for _, x := range expressions {
+		msg := fmt.Sprintf("exported %d document(s) from expression %q", x.Documents, x.Name)
+		if x.Target != "" {
+			msg += " to " + string(x.Target)
+		}
+		out = append(out, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+			Message:  msg,
+		})
+	}
+	return out
+}
+
+// resultAction is what the function did to the object of a success result, it
+// is set as the reason of the result
+type resultAction string
+
+const (
+	// actionCreated results are returned for the resources the function added
+	// to the desired composed resources
+	actionCreated resultAction = "Created"
+	// actionUpdated results are returned for the objects the function patched
+	actionUpdated resultAction = "Updated"
+)
+
+// objectResult is the success result of an object the function created or
+// updated
+type objectResult struct {
+	action resultAction
+	// object describes the object in the message, such as resource or xr
+	object     string
+	name       string
+	kind       string
+	apiVersion string
+}
+
+// message returns the message of the result
+func (r objectResult) message() string {
+	if r.kind == "" {
+		return fmt.Sprintf("%s %s %q", strings.ToLower(string(r.action)), r.object, r.name)
+	}
+	return fmt.Sprintf("%s %s \"%s:%s\"", strings.ToLower(string(r.action)), r.object, r.name, r.kind)
+}
+
+// toResult converts the success result to a normal function result whose
+// reason is the action
+func (r objectResult) toResult() *fnv1beta1.Result {
+	return withReason(&fnv1beta1.Result{
+		Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+		Message:  r.message(),
+	}, string(r.action))
+}
+
+// summaryResults returns a result counting the resources of each action, the
+// results of the other objects, such as the XR, are kept
+func summaryResults(results []objectResult) []*fnv1beta1.Result {
+	counts := map[resultAction]int{}
+	var out []*fnv1beta1.Result
+	for _, r := range results {
+		if r.object != "resource" {
+			out = append(out, r.toResult())
+			continue
+		}
+		counts[r.action]++
+	}
+	for _, a := range []resultAction{actionCreated, actionUpdated} {
+		n := counts[a]
+		if n == 0 {
+			continue
+		}
+		object := "resources"
+		if n == 1 {
+			object = "resource"
+		}
+		out = append(out, withReason(&fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+			Message:  fmt.Sprintf("%s %d %s", strings.ToLower(string(a)), n, object),
+		}, string(a)))
+	}
+	return out
+}
+
+// withReason sets the reason of the result and returns it
+func withReason(r *fnv1beta1.Result, reason string) *fnv1beta1.Result {
+	setUnknownBytes(r, resultReasonField, []byte(reason))
+	return r
+}
+
+// targetResults sets the target of the results, results targeting only the
+// composite resource are left as they are as it is the default target
+func targetResults(rs []*fnv1beta1.Result, target v1beta1.ResultsTarget) []*fnv1beta1.Result {
+	if target != v1beta1.ResultsTargetCompositeAndClaim {
+		return rs
+	}
+	for _, r := range rs {
+		setUnknownVarint(r, resultTargetField, resultTargetCompositeAndClaim)
+	}
+	return rs
+}
+
+// resultReason returns the reason of the result, or an empty string
+func resultReason(r *fnv1beta1.Result) string {
+	values, err := unknownBytes(r, resultReasonField)
+	if err != nil || len(values) == 0 {
+		return ""
+	}
+	return string(values[len(values)-1])
+}
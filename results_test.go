@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestRunFunctionResults(t *testing.T) {
+	input := func(value string) string {
+		return `{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "results"},
+			"export": {
+				"target": "Resources",
+				"value": "` + value + `"
+			}
+		}`
+	}
+	resourceTemplate := `apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n`
+
+	cases := map[string]struct {
+		reason      string
+		input       string
+		want        []*fnv1beta1.Result
+		wantDesired bool
+	}{
+		"Warning": {
+			reason: "A warning result should be returned after the success message",
+			input: input(`#results: [{severity: \"warning\", message: \"replicas is \\(#observed.composite.spec.replicas), use at least 3\"}]\n` +
+				`if #observed.composite.spec.replicas < 3 {\n` + resourceTemplate + `}\n`),
+			want: []*fnv1beta1.Result{
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `created resource "generated:Generated"`}, string(actionCreated)),
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "replicas is 1, use at least 3"},
+			},
+			wantDesired: true,
+		},
+		"DefaultSeverity": {
+			reason: "A result without a severity should be normal",
+			input:  input(`#results: [{message: \"hello\"}]\n` + resourceTemplate),
+			want: []*fnv1beta1.Result{
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `created resource "generated:Generated"`}, string(actionCreated)),
+				{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: "hello"},
+			},
+			wantDesired: true,
+		},
+		"Fatal": {
+			reason: "A fatal result should fail the pipeline without desired resources",
+			input:  input(`#results: [{severity: \"warning\", message: \"deprecated\"}, {severity: \"fatal\", message: \"replicas must be at least 3\"}]\n` + resourceTemplate),
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "deprecated"},
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "replicas must be at least 3"},
+			},
+		},
+		"Incomplete": {
+			reason: "A document holding non-concrete values should be skipped with a warning when the export allows incomplete values",
+			input: `{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind": "CUEInput",
+				"metadata": {"name": "results"},
+				"export": {
+					"target": "Resources",
+					"options": {"allowIncomplete": true},
+					"value": "` + resourceTemplate + `spec: region: string | #observed.composite.spec.region\n"
+				}
+			}`,
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "skipped incomplete document at index 0: non-concrete values at spec.region"},
+			},
+		},
+		"CompositeAndClaim": {
+			reason: "The results of an export should target the claim too when the export sets it",
+			input: `{
+				"apiVersion": "cue.fn.crossplane.io/v1beta1",
+				"kind": "CUEInput",
+				"metadata": {"name": "results"},
+				"export": {
+					"target": "Resources",
+					"options": {"resultsTarget": "CompositeAndClaim"},
+					"value": "#results: [{severity: \"warning\", message: \"use at least 3 replicas\"}]\n` + resourceTemplate + `"
+				}
+			}`,
+			want: targetResults([]*fnv1beta1.Result{
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `created resource "generated:Generated"`}, string(actionCreated)),
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "use at least 3 replicas"},
+			}, v1beta1.ResultsTargetCompositeAndClaim),
+			wantDesired: true,
+		},
+		"InvalidSeverity": {
+			reason: "A result with an unknown severity should return a fatal result",
+			input:  input(`#results: [{severity: \"error\", message: \"broken\"}]\n` + resourceTemplate),
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `cannot get results from template: invalid result at index 0: invalid severity "error": must be normal, warning or fatal`},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(tc.input),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}, "spec": {"replicas": 1}}`),
+					},
+				},
+			}
+
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if got := len(rsp.GetDesired().GetResources()) != 0; got != tc.wantDesired {
+				t.Errorf("%s\nf.RunFunction(...): want desired resources %t, got %t", tc.reason, tc.wantDesired, got)
+			}
+		})
+	}
+}
+
+func TestObjectResult(t *testing.T) {
+	cases := map[string]struct {
+		reason      string
+		result      objectResult
+		wantMessage string
+		wantReason  string
+	}{
+		"Resource": {
+			reason:      "A resource should be named by its name and kind",
+			result:      objectResult{action: actionCreated, object: "resource", name: "bucket", kind: "Bucket", apiVersion: "example.org/v1"},
+			wantMessage: `created resource "bucket:Bucket"`,
+			wantReason:  "Created",
+		},
+		"ContextKey": {
+			reason:      "A context key should be quoted",
+			result:      objectResult{action: actionUpdated, object: "context key", name: "example.org/network"},
+			wantMessage: `updated context key "example.org/network"`,
+			wantReason:  "Updated",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := tc.result.toResult()
+			if diff := cmp.Diff(tc.wantMessage, r.GetMessage()); diff != "" {
+				t.Errorf("%s\ntoResult(...): -want message, +got message:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantReason, resultReason(r)); diff != "" {
+				t.Errorf("%s\ntoResult(...): -want reason, +got reason:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestSuccessResults(t *testing.T) {
+	created := func(name string) map[string]interface{} {
+		return map[string]interface{}{"apiVersion": "example.org/v1", "kind": "Bucket", "metadata": map[string]interface{}{"name": name}}
+	}
+	data := []map[string]interface{}{created("a"), created("b")}
+
+	cases := map[string]struct {
+		reason string
+		output successOutput
+		want   []*fnv1beta1.Result
+	}{
+		"PerResource": {
+			reason: "A result should be returned for each resource by default",
+			output: successOutput{target: v1beta1.PatchDesired, object: data[:1], msgCount: 1, created: data[1:]},
+			want: []*fnv1beta1.Result{
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `created resource "b:Bucket"`}, string(actionCreated)),
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `updated resource "a:Bucket"`}, string(actionUpdated)),
+			},
+		},
+		"Summary": {
+			reason: "A result counting the resources of each action should be returned",
+			output: successOutput{target: v1beta1.PatchDesired, mode: v1beta1.ResultsSummary, object: data[:1], msgCount: 1, created: data},
+			want: []*fnv1beta1.Result{
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: "created 2 resources"}, string(actionCreated)),
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: "updated 1 resource"}, string(actionUpdated)),
+			},
+		},
+		"SummaryContext": {
+			reason: "The result of a context key should be kept in a summary",
+			output: successOutput{target: v1beta1.Context, mode: v1beta1.ResultsSummary, object: "example.org/network", msgCount: 1},
+			want: []*fnv1beta1.Result{
+				withReason(&fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `updated context key "example.org/network"`}, string(actionUpdated)),
+			},
+		},
+		"None": {
+			reason: "No results should be returned",
+			output: successOutput{target: v1beta1.Resources, mode: v1beta1.ResultsNone, object: data, msgCount: 2},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			tc.output.setSuccessResults()
+			got := tc.output.successResults()
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nsuccessResults(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// crdSchemas are the OpenAPI schemas of the served versions of the CRDs the
+// generated resources are validated against, keyed by the kind they describe
+type crdSchemas map[schema.GroupVersionKind]*apiextensionsv1.JSONSchemaProps
+
+// loadCRDSchemas reads the CRDs of the YAML and JSON files of the directory
+// and its subdirectories, documents that are not CRDs are ignored
+func loadCRDSchemas(dir string) (crdSchemas, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	schemas := crdSchemas{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		b, err := os.ReadFile(path) //nolint:gosec // the directory is set by the operator of the function
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(schemas.add(b), "cannot load CRDs of %s", path)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load CRD schemas")
+	}
+	return schemas, nil
+}
+
+// add adds the schemas of the CRDs of the YAML or JSON stream
+func (s crdSchemas) add(b []byte) error {
+	dec := kyaml.NewYAMLOrJSONDecoder(bytes.NewReader(b), 4096)
+	for {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		err := dec.Decode(crd)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if crd.Kind != "CustomResourceDefinition" {
+			continue
+		}
+		for _, v := range crd.Spec.Versions {
+			if !v.Served || v.Schema == nil || v.Schema.OpenAPIV3Schema == nil {
+				continue
+			}
+			s[schema.GroupVersionKind{Group: crd.Spec.Group, Version: v.Name, Kind: crd.Spec.Names.Kind}] = v.Schema.OpenAPIV3Schema
+		}
+	}
+}
+
+// validate returns the violations of the documents routed to the target of
+// the schemas of their kind, documents of kinds without a schema are not
+// validated. Documents patching desired resources may be partial, so only the
+// documents of the Resources target are checked for their required fields.
+func (s crdSchemas) validate(target v1beta1.Target, data []map[string]interface{}) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	switch target {
+	case v1beta1.Resources, v1beta1.PatchResources, v1beta1.PatchDesired:
+	default:
+		return nil
+	}
+	var violations []string
+	for _, d := range data {
+		u := unstructured.Unstructured{Object: d}
+		sch, ok := s[u.GroupVersionKind()]
+		if !ok {
+			continue
+		}
+		// The metadata of a resource is validated by the API server rather
+		// than by the schema of its CRD, and the resourceName field only
+		// selects the desired resource a document patches
+		doc := make(map[string]interface{}, len(d))
+		for k, f := range d {
+			if k != "metadata" && k != resourceNameField {
+				doc[k] = f
+			}
+		}
+		v := schemaValidator{required: target == v1beta1.Resources}
+		v.validateObject("", doc, sch)
+		for _, msg := range v.violations {
+			violations = append(violations, fmt.Sprintf("%s %q: %s", u.GetKind(), u.GetName(), msg))
+		}
+	}
+	return violations
+}
+
+// check validates the documents routed to the target for the validation
+// policy of the export, the violations are returned as warnings, or as an
+// error with the Fatal policy
+func (s crdSchemas) check(policy v1beta1.SchemaValidationPolicy, target v1beta1.Target, data []map[string]interface{}) ([]string, error) {
+	if policy == v1beta1.SchemaValidationIgnore {
+		return nil, nil
+	}
+	violations := s.validate(target, data)
+	if len(violations) == 0 {
+		return nil, nil
+	}
+	if policy == v1beta1.SchemaValidationFatal {
+		return nil, errors.Errorf("generated resources violate the schemas of their CRDs: %s", strings.Join(violations, "; "))
+	}
+	warnings := make([]string, len(violations))
+	for i, v := range violations {
+		warnings[i] = "schema violation: " + v
+	}
+	return warnings, nil
+}
+
+// schemaValidator structurally validates a value against an OpenAPI schema
+type schemaValidator struct {
+	// required checks the required fields of objects
+	required   bool
+	violations []string
+}
+
+// violation records a violation of the value at the path
+func (v *schemaValidator) violation(path, msg string) {
+	v.violations = append(v.violations, path+": "+msg)
+}
+
+// validate checks the value at the path against the schema
+func (v *schemaValidator) validate(path string, val interface{}, s *apiextensionsv1.JSONSchemaProps) {
+	if s == nil || val == nil {
+		return
+	}
+	if s.XIntOrString {
+		switch val.(type) {
+		case string:
+		default:
+			if !isInteger(val) {
+				v.violation(path, "must be an integer or a string")
+			}
+		}
+		return
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			v.violation(path, "must be of type object")
+			return
+		}
+		v.validateObject(path, obj, s)
+	case "array":
+		arr, ok := val.([]interface{})
+		if !ok {
+			v.violation(path, "must be of type array")
+			return
+		}
+		if s.Items == nil {
+			return
+		}
+		for i, e := range arr {
+			v.validate(fmt.Sprintf("%s[%d]", path, i), e, s.Items.Schema)
+		}
+	case "string":
+		if _, ok := val.(string); !ok {
+			v.violation(path, "must be of type string")
+			return
+		}
+	case "integer":
+		if !isInteger(val) {
+			v.violation(path, "must be of type integer")
+			return
+		}
+	case "number":
+		if _, ok := number(val); !ok {
+			v.violation(path, "must be of type number")
+			return
+		}
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			v.violation(path, "must be of type boolean")
+			return
+		}
+	}
+	if len(s.Enum) != 0 {
+		v.validateEnum(path, val, s.Enum)
+	}
+}
+
+// validateObject checks the fields of the object against their schemas, the
+// fields the schema does not declare are only allowed by additionalProperties
+// or x-kubernetes-preserve-unknown-fields
+func (v *schemaValidator) validateObject(path string, obj map[string]interface{}, s *apiextensionsv1.JSONSchemaProps) {
+	// An embedded resource is validated by the API server of its kind
+	if s.XEmbeddedResource {
+		return
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fp := fieldPath(path, k)
+		if p, ok := s.Properties[k]; ok {
+			v.validate(fp, obj[k], &p)
+			continue
+		}
+		if ap := s.AdditionalProperties; ap != nil {
+			if ap.Schema != nil {
+				v.validate(fp, obj[k], ap.Schema)
+			}
+			if ap.Schema != nil || ap.Allows {
+				continue
+			}
+		}
+		if !preservesUnknownFields(s) {
+			v.violation(fp, "field not declared in schema")
+		}
+	}
+	if v.required {
+		for _, k := range s.Required {
+			if _, ok := obj[k]; !ok {
+				v.violation(fieldPath(path, k), "required field is missing")
+			}
+		}
+	}
+}
+
+// fieldPath returns the path of the field of the object at the path
+func fieldPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// validateEnum checks the value is one of the values of the enum
+func (v *schemaValidator) validateEnum(path string, val interface{}, enum []apiextensionsv1.JSON) {
+	allowed := make([]string, len(enum))
+	for i, e := range enum {
+		allowed[i] = string(e.Raw)
+		var want interface{}
+		if err := kyaml.Unmarshal(e.Raw, &want); err != nil {
+			continue
+		}
+		if fmt.Sprint(want) == fmt.Sprint(val) {
+			return
+		}
+	}
+	v.violation(path, "must be one of "+strings.Join(allowed, ", "))
+}
+
+// preservesUnknownFields returns whether the schema allows fields it does not
+// declare
+func preservesUnknownFields(s *apiextensionsv1.JSONSchemaProps) bool {
+	return s.XPreserveUnknownFields != nil && *s.XPreserveUnknownFields
+}
+
+// number returns the value as a float64 when it is a number
+func number(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// isInteger returns whether the value is a number without a fractional part
+func isInteger(val interface{}) bool {
+	n, ok := number(val)
+	return ok && n == math.Trunc(n)
+}
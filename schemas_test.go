@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+const bucketCRD = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: buckets.s3.aws.upbound.io
+spec:
+  group: s3.aws.upbound.io
+  names:
+    kind: Bucket
+    plural: buckets
+  scope: Cluster
+  versions:
+  - name: v1beta1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          apiVersion:
+            type: string
+          kind:
+            type: string
+          metadata:
+            type: object
+          spec:
+            type: object
+            required:
+            - forProvider
+            properties:
+              deletionPolicy:
+                type: string
+                enum:
+                - Orphan
+                - Delete
+              forProvider:
+                type: object
+                properties:
+                  region:
+                    type: string
+                  objectLockEnabled:
+                    type: boolean
+                  tags:
+                    type: object
+                    additionalProperties:
+                      type: string
+                  size:
+                    x-kubernetes-int-or-string: true
+          status:
+            type: object
+            x-kubernetes-preserve-unknown-fields: true
+`
+
+func TestCRDSchemasCheck(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bucket.yaml"), []byte(bucketCRD), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := loadCRDSchemas(dir)
+	if err != nil {
+		t.Fatalf("loadCRDSchemas(...): unexpected error: %v", err)
+	}
+
+	bucket := func(spec map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "s3.aws.upbound.io/v1beta1",
+			"kind":       "Bucket",
+			"metadata":   map[string]interface{}{"name": "my-bucket", "labels": map[string]interface{}{"app": "bucket"}},
+			"spec":       spec,
+		}
+	}
+
+	cases := map[string]struct {
+		reason  string
+		policy  v1beta1.SchemaValidationPolicy
+		target  v1beta1.Target
+		data    []map[string]interface{}
+		want    []string
+		wantErr bool
+	}{
+		"Valid": {
+			reason: "A resource matching its schema should have no violations",
+			target: v1beta1.Resources,
+			data: []map[string]interface{}{bucket(map[string]interface{}{
+				"forProvider": map[string]interface{}{"region": "eu-west-1", "tags": map[string]interface{}{"team": "a"}, "size": float64(3)},
+			})},
+		},
+		"Violations": {
+			reason: "Undeclared fields, wrong types and values outside the enum should be warned about",
+			target: v1beta1.Resources,
+			data: []map[string]interface{}{bucket(map[string]interface{}{
+				"deletionPolicy": "Keep",
+				"forProvider":    map[string]interface{}{"regoin": "eu-west-1", "objectLockEnabled": "yes", "tags": map[string]interface{}{"team": float64(1)}},
+			})},
+			want: []string{
+				`schema violation: Bucket "my-bucket": spec.deletionPolicy: must be one of "Orphan", "Delete"`,
+				`schema violation: Bucket "my-bucket": spec.forProvider.objectLockEnabled: must be of type boolean`,
+				`schema violation: Bucket "my-bucket": spec.forProvider.regoin: field not declared in schema`,
+				`schema violation: Bucket "my-bucket": spec.forProvider.tags.team: must be of type string`,
+			},
+		},
+		"Required": {
+			reason: "The required fields of the documents of the Resources target should be checked",
+			target: v1beta1.Resources,
+			data:   []map[string]interface{}{bucket(map[string]interface{}{})},
+			want:   []string{`schema violation: Bucket "my-bucket": spec.forProvider: required field is missing`},
+		},
+		"PartialPatch": {
+			reason: "The documents patching desired resources should not be checked for their required fields",
+			target: v1beta1.PatchDesired,
+			data:   []map[string]interface{}{bucket(map[string]interface{}{})},
+		},
+		"UnknownKind": {
+			reason: "The documents of kinds without a schema should not be validated",
+			target: v1beta1.Resources,
+			data:   []map[string]interface{}{{"apiVersion": "v1", "kind": "ConfigMap", "data": map[string]interface{}{"a": "b"}}},
+		},
+		"OtherTarget": {
+			reason: "The documents of targets other than resources should not be validated",
+			target: v1beta1.XR,
+			data:   []map[string]interface{}{bucket(map[string]interface{}{})},
+		},
+		"Ignore": {
+			reason: "Nothing should be validated with the Ignore policy",
+			policy: v1beta1.SchemaValidationIgnore,
+			target: v1beta1.Resources,
+			data:   []map[string]interface{}{bucket(map[string]interface{}{})},
+		},
+		"Fatal": {
+			reason:  "The violations should be an error with the Fatal policy",
+			policy:  v1beta1.SchemaValidationFatal,
+			target:  v1beta1.Resources,
+			data:    []map[string]interface{}{bucket(map[string]interface{}{})},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := schemas.check(tc.policy, tc.target, tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s\ncheck(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\ncheck(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// fnv1ServiceName is the FunctionRunnerService of the GA fnv1 RunFunction
+// protocol that Crossplane moves to as it deprecates v1beta1
+const fnv1ServiceName = "apiextensions.fn.proto.v1.FunctionRunnerService"
+
+const (
+	// fnv1Package is the proto package of the GA fnv1 RunFunction protocol
+	fnv1Package = "apiextensions.fn.proto.v1"
+	// fnv1FileName is the file the fnv1 descriptors are registered as
+	fnv1FileName = "v1/run_function.proto"
+)
+
+// fnv1ServiceDesc describes the GA fnv1 FunctionRunnerService served by the
+// v1beta1 implementation, the v1 messages are wire compatible with v1beta1 so
+// the v1beta1 handlers decode and encode them unchanged
+func fnv1ServiceDesc() *grpc.ServiceDesc {
+	desc := fnv1beta1.FunctionRunnerService_ServiceDesc
+	desc.ServiceName = fnv1ServiceName
+	desc.Metadata = fnv1FileName
+	return &desc
+}
+
+var (
+	registerFnv1Once sync.Once
+	errRegisterFnv1  error
+)
+
+// registerFnv1Descriptors registers the descriptors of the fnv1 protocol, the
+// v1beta1 descriptors renamed into the fnv1 package, so that reflection
+// describes the fnv1 service and its messages like it does for v1beta1. The
+// descriptors are registered once however often it is called.
+func registerFnv1Descriptors() error {
+	registerFnv1Once.Do(func() {
+		fd := protodesc.ToFileDescriptorProto(fnv1beta1.File_v1beta1_run_function_proto)
+		from := "." + fd.GetPackage() + "."
+		rename := func(name *string) *string {
+			if name == nil || !strings.HasPrefix(*name, from) {
+				return name
+			}
+			return proto.String("." + fnv1Package + "." + strings.TrimPrefix(*name, from))
+		}
+		var renameMessages func([]*descriptorpb.DescriptorProto)
+		renameMessages = func(ms []*descriptorpb.DescriptorProto) {
+			for _, m := range ms {
+				for _, f := range m.GetField() {
+					f.TypeName = rename(f.TypeName)
+				}
+				renameMessages(m.GetNestedType())
+			}
+		}
+		fd.Name = proto.String(fnv1FileName)
+		fd.Package = proto.String(fnv1Package)
+		renameMessages(fd.GetMessageType())
+		for _, svc := range fd.GetService() {
+			for _, m := range svc.GetMethod() {
+				m.InputType = rename(m.InputType)
+				m.OutputType = rename(m.OutputType)
+			}
+		}
+		f, err := protodesc.NewFile(fd, protoregistry.GlobalFiles)
+		if err != nil {
+			errRegisterFnv1 = errors.Wrap(err, "cannot build fnv1 descriptors")
+			return
+		}
+		errRegisterFnv1 = errors.Wrap(protoregistry.GlobalFiles.RegisterFile(f), "cannot register fnv1 descriptors")
+	})
+	return errRegisterFnv1
+}
+
+// newServer returns a gRPC server that serves the function under both the
+// v1beta1 and the GA fnv1 RunFunction protocols, and the health service for
+// grpc-health-probe liveness and readiness probes. The server receives
+// messages of up to maxRecvMsgSize bytes, the gRPC default of 4MB when it is 0
+func newServer(fn fnv1beta1.FunctionRunnerServiceServer, creds credentials.TransportCredentials, hs *health.Server, maxRecvMsgSize int) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.Creds(creds)}
+	if maxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(maxRecvMsgSize))
+	}
+	srv := grpc.NewServer(opts...)
+	reflection.Register(srv)
+	healthpb.RegisterHealthServer(srv, hs)
+	fnv1beta1.RegisterFunctionRunnerServiceServer(srv, fn)
+	srv.RegisterService(fnv1ServiceDesc(), fn)
+	return srv
+}
+
+// newHealthServer returns a health service reporting the server and both
+// RunFunction protocols as serving
+func newHealthServer() *health.Server {
+	hs := health.NewServer()
+	for _, service := range []string{"", fnv1beta1.FunctionRunnerService_ServiceDesc.ServiceName, fnv1ServiceName} {
+		hs.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	return hs
+}
+
+// drain stops the server once it has finished its in-flight RunFunction calls,
+// or once the grace period elapses, cancelling the calls still running. The
+// health service reports not serving as soon as draining starts, so that no
+// new calls are routed to the server.
+func drain(log logging.Logger, srv *grpc.Server, hs *health.Server, grace time.Duration) {
+	hs.Shutdown()
+	if grace <= 0 {
+		srv.Stop()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	t := time.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-done:
+		log.Info("Drained in-flight calls")
+	case <-t.C:
+		log.Info("Grace period elapsed, cancelling in-flight calls", "grace-period", grace)
+		srv.Stop()
+		<-done
+	}
+}
+
+// serve serves the function like function.Serve, under both the v1beta1 and
+// the GA fnv1 RunFunction protocols. On SIGTERM or SIGINT the server drains
+// its in-flight calls for up to the grace period before it stops.
+func serve(log logging.Logger, fn fnv1beta1.FunctionRunnerServiceServer, grace time.Duration, maxRecvMsgSize int, o ...function.ServeOption) error {
+	so := &function.ServeOptions{
+		Network: function.DefaultNetwork,
+		Address: function.DefaultAddress,
+	}
+	for _, fn := range o {
+		if err := fn(so); err != nil {
+			return errors.Wrap(err, "cannot apply ServeOption")
+		}
+	}
+	if so.Credentials == nil {
+		return errors.New("no credentials provided - did you specify the Insecure or MTLSCertificates options?")
+	}
+
+	if err := registerFnv1Descriptors(); err != nil {
+		return err
+	}
+
+	lis, err := net.Listen(so.Network, so.Address)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen for %s connections at address %q", so.Network, so.Address)
+	}
+	hs := newHealthServer()
+	srv := newServer(fn, so.Credentials, hs, maxRecvMsgSize)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		s, ok := <-sig
+		if !ok {
+			return
+		}
+		log.Info("Draining in-flight calls", "signal", s.String(), "grace-period", grace)
+		drain(log, srv, hs, grace)
+	}()
+
+	err = srv.Serve(lis)
+	signal.Stop(sig)
+	if err != nil {
+		close(sig)
+		return errors.Wrap(err, "cannot serve mTLS gRPC connections")
+	}
+	// Serve returns as soon as draining starts, wait for the calls to drain
+	<-drained
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestServeProtocols(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(&Function{log: logging.NewNopLogger()}, insecure.NewCredentials(), newHealthServer(), 0)
+	go srv.Serve(lis) //nolint:errcheck // the server is stopped by the test
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	req := &fnv1beta1.RunFunctionRequest{
+		Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "protocols"},
+			"export": {
+				"target": "Resources",
+				"value": "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n"
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+			},
+		},
+	}
+	want, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		reason string
+		method string
+	}{
+		"V1Beta1": {
+			reason: "The function should be served under the v1beta1 protocol",
+			method: "/apiextensions.fn.proto.v1beta1.FunctionRunnerService/RunFunction",
+		},
+		"V1": {
+			reason: "The function should be served under the GA v1 protocol with the same implementation",
+			method: "/" + fnv1ServiceName + "/RunFunction",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rsp := &fnv1beta1.RunFunctionResponse{}
+			if err := conn.Invoke(context.Background(), tc.method, req, rsp); err != nil {
+				t.Fatalf("%s\nconn.Invoke(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(want, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nconn.Invoke(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestServeReflection(t *testing.T) {
+	if err := registerFnv1Descriptors(); err != nil {
+		t.Fatalf("registerFnv1Descriptors(): unexpected error: %v", err)
+	}
+	// Registering again should be a no-op rather than a conflict
+	if err := registerFnv1Descriptors(); err != nil {
+		t.Fatalf("registerFnv1Descriptors(): unexpected error registering twice: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(&Function{log: logging.NewNopLogger()}, insecure.NewCredentials(), newHealthServer(), 0)
+	go srv.Serve(lis) //nolint:errcheck // the server is stopped by the test
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: fnv1ServiceName},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := rsp.GetFileDescriptorResponse().GetFileDescriptorProto()
+	if len(files) == 0 {
+		t.Fatalf("ServerReflectionInfo(...): no file describes %s: %v", fnv1ServiceName, rsp.GetErrorResponse())
+	}
+	fd := &descriptorpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(files[0], fd); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{fd.GetName(), fd.GetPackage(), fd.GetService()[0].GetMethod()[0].GetInputType()}
+	want := []string{fnv1FileName, fnv1Package, "." + fnv1Package + ".RunFunctionRequest"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ServerReflectionInfo(...): -want file, +got file:\n%s", diff)
+	}
+}
+
+// blockingFunction holds each RunFunction call until it is released
+type blockingFunction struct {
+	fnv1beta1.UnimplementedFunctionRunnerServiceServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFunction) RunFunction(ctx context.Context, _ *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
+	f.started <- struct{}{}
+	select {
+	case <-f.release:
+		return &fnv1beta1.RunFunctionResponse{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cases := map[string]struct {
+		reason   string
+		grace    time.Duration
+		release  bool
+		wantCode codes.Code
+	}{
+		"Drained": {
+			reason:   "An in-flight call that finishes within the grace period should succeed",
+			grace:    time.Minute,
+			release:  true,
+			wantCode: codes.OK,
+		},
+		"GracePeriodElapsed": {
+			reason:   "An in-flight call still running when the grace period elapses should be cancelled",
+			grace:    10 * time.Millisecond,
+			wantCode: codes.Unavailable,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fn := &blockingFunction{started: make(chan struct{}, 1), release: make(chan struct{})}
+			hs := newHealthServer()
+			srv := newServer(fn, insecure.NewCredentials(), hs, 0)
+			go srv.Serve(lis) //nolint:errcheck // the server is stopped by drain
+
+			conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+
+			hc, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+			if err != nil {
+				t.Fatalf("%s\nCheck(...): unexpected error: %v", tc.reason, err)
+			}
+			if hc.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("%s\nCheck(...): want SERVING before draining, got %s", tc.reason, hc.GetStatus())
+			}
+
+			errs := make(chan error, 1)
+			go func() {
+				_, err := fnv1beta1.NewFunctionRunnerServiceClient(conn).RunFunction(context.Background(), &fnv1beta1.RunFunctionRequest{})
+				errs <- err
+			}()
+			<-fn.started
+
+			drained := make(chan struct{})
+			go func() {
+				drain(logging.NewNopLogger(), srv, hs, tc.grace)
+				close(drained)
+			}()
+			if tc.release {
+				close(fn.release)
+			}
+			<-drained
+
+			if got := status.Code(<-errs); got != tc.wantCode {
+				t.Errorf("%s\nRunFunction(...): want code %s, got %s", tc.reason, tc.wantCode, got)
+			}
+			if got, _ := hs.Check(context.Background(), &healthpb.HealthCheckRequest{}); got.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+				t.Errorf("%s\nCheck(...): want NOT_SERVING after draining, got %s", tc.reason, got.GetStatus())
+			}
+		})
+	}
+}
+
+// echoFunction returns an empty response to every RunFunction call
+type echoFunction struct {
+	fnv1beta1.UnimplementedFunctionRunnerServiceServer
+}
+
+func (f *echoFunction) RunFunction(_ context.Context, _ *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
+	return &fnv1beta1.RunFunctionResponse{}, nil
+}
+
+func TestServeMaxRecvMsgSize(t *testing.T) {
+	// A request holding an observed XR of 5MB, over the 4MB gRPC default
+	xr := resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`)
+	xr.Fields["spec"] = structpb.NewStringValue(strings.Repeat("x", 5<<20))
+	req := &fnv1beta1.RunFunctionRequest{Observed: &fnv1beta1.State{Composite: &fnv1beta1.Resource{Resource: xr}}}
+
+	cases := map[string]struct {
+		reason         string
+		maxRecvMsgSize int
+		wantCode       codes.Code
+	}{
+		"Default": {
+			reason:   "A request over the 4MB gRPC default should be rejected",
+			wantCode: codes.ResourceExhausted,
+		},
+		"Raised": {
+			reason:         "A request under the raised maximum message size should be served",
+			maxRecvMsgSize: 8 << 20,
+			wantCode:       codes.OK,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := newServer(&echoFunction{}, insecure.NewCredentials(), newHealthServer(), tc.maxRecvMsgSize)
+			go srv.Serve(lis) //nolint:errcheck // the server is stopped by the test
+			t.Cleanup(srv.Stop)
+
+			conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+
+			_, err = fnv1beta1.NewFunctionRunnerServiceClient(conn).RunFunction(context.Background(), req)
+			if got := status.Code(err); got != tc.wantCode {
+				t.Errorf("%s\nRunFunction(...): want code %s, got %s: %v", tc.reason, tc.wantCode, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// etcdObjectSizeLimit is the default maximum size of an object stored in etcd
+const etcdObjectSizeLimit = 1572864
+
+// sizeWarnings returns a warning for each desired composed resource whose
+// serialized size is at least threshold bytes, oversized resources otherwise
+// only fail once Crossplane applies them. A threshold of 0 disables the check.
+func sizeWarnings(desired map[resource.Name]*resource.DesiredComposed, threshold int) ([]string, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(desired))
+	for n := range desired {
+		names = append(names, string(n))
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, n := range names {
+		size, err := jsonSize(desired[resource.Name(n)].Resource.Object)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot serialize desired resource %q", n)
+		}
+		if size >= threshold {
+			warnings = append(warnings, fmt.Sprintf("desired resource %q is %d bytes, near the etcd object size limit of %d bytes", n, size, etcdObjectSizeLimit))
+		}
+	}
+	return warnings, nil
+}
+
+// jsonSize returns the size of v serialized as json, the serialized bytes are
+// counted rather than kept so measuring a large desired state does not copy it
+func jsonSize(v interface{}) (int, error) {
+	var c byteCounter
+	e := json.NewEncoder(&c)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return 0, err
+	}
+	// the encoder terminates the value with a newline
+	return c.n - 1, nil
+}
+
+// byteCounter is a writer that counts the bytes written to it
+type byteCounter struct {
+	n int
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSizeWarnings(t *testing.T) {
+	desired := func() map[resource.Name]*resource.DesiredComposed {
+		small := composed.New()
+		small.SetAPIVersion("v1")
+		small.SetKind("ConfigMap")
+		small.SetName("small")
+
+		large := composed.New()
+		large.SetAPIVersion("v1")
+		large.SetKind("ConfigMap")
+		large.SetName("large")
+		_ = large.SetValue("data.blob", strings.Repeat("x", 100))
+
+		return map[resource.Name]*resource.DesiredComposed{
+			"small": {Resource: small},
+			"large": {Resource: large},
+		}
+	}
+
+	cases := map[string]struct {
+		reason    string
+		threshold int
+		want      []string
+	}{
+		"Disabled": {
+			reason:    "A zero threshold should not warn",
+			threshold: 0,
+		},
+		"BelowThreshold": {
+			reason:    "Resources smaller than the threshold should not warn",
+			threshold: 1000,
+		},
+		"AboveThreshold": {
+			reason:    "Resources at least as large as the threshold should warn",
+			threshold: 100,
+			want: []string{
+				`desired resource "large" is 185 bytes, near the etcd object size limit of 1572864 bytes`,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := sizeWarnings(desired(), tc.threshold)
+			if err != nil {
+				t.Fatalf("sizeWarnings(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nsizeWarnings(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
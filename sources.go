@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// templateSource resolves the templates referenced by CUEInput.Export.TemplateRef
+//
+// Inline templates in CUEInput.Export.Value never reach a source, the built in
+// dir source serves templates mounted into the pod, for example from a
+// ConfigMap or an OCI image volume, and the built in oci source fetches them
+// from an OCI registry. Derived images add sources for other
+// stores, such as Git, HTTP or an internal artifact store, by registering a
+// factory with registerTemplateSource.
+type templateSource interface {
+	// Resolve returns the template referenced by ref, and whether it is
+	// served stale because the source cannot be refreshed. A source that
+	// does not hold the template returns a templateNotFoundError so that the
+	// next source is tried
+	Resolve(ref v1beta1.TemplateRef) (string, *staleValue, error)
+}
+
+// templateNotFoundError is returned by a template source that does not hold
+// the referenced template
+type templateNotFoundError struct {
+	msg string
+}
+
+func (e templateNotFoundError) Error() string {
+	return e.msg
+}
+
+// isTemplateNotFound returns whether the error is a templateNotFoundError
+func isTemplateNotFound(err error) bool {
+	nf := templateNotFoundError{}
+	return errors.As(err, &nf)
+}
+
+// templateSources resolves a template from the first source that holds it
+type templateSources []templateSource
+
+// Resolve returns the template from the first source that holds it, and
+// whether it is served stale, when no source does the error of the first
+// source is returned
+func (s templateSources) Resolve(ref v1beta1.TemplateRef) (string, *staleValue, error) {
+	var notFound error
+	for _, src := range s {
+		value, stale, err := src.Resolve(ref)
+		if err == nil {
+			return value, stale, nil
+		}
+		if !isTemplateNotFound(err) {
+			return "", nil, err
+		}
+		if notFound == nil {
+			notFound = err
+		}
+	}
+	if notFound == nil {
+		return "", nil, templateNotFoundError{msg: fmt.Sprintf("template %q is not registered", ref.Name)}
+	}
+	return "", nil, notFound
+}
+
+// templateSourceFactory builds a template source from the location given to
+// the --template-source flag
+type templateSourceFactory func(location string) (templateSource, error)
+
+// templateSourceFactories are the registered template source kinds
+var templateSourceFactories = map[string]templateSourceFactory{
+	"dir": func(location string) (templateSource, error) {
+		return loadTemplates(location)
+	},
+	"oci": func(location string) (templateSource, error) {
+		return newOCITemplateSource(location)
+	},
+}
+
+// registerTemplateSource registers the factory for a kind of template source
+// Derived images call it from an init function in a file added to this package
+// to serve templates from their own stores without changing the rendering code
+func registerTemplateSource(kind string, factory templateSourceFactory) {
+	if _, ok := templateSourceFactories[kind]; ok {
+		panic(fmt.Sprintf("template source %q is already registered", kind))
+	}
+	templateSourceFactories[kind] = factory
+}
+
+// newTemplateSources builds the template sources from their <kind>:<location>
+// specs, templates are resolved from the sources in the order given
+func newTemplateSources(specs []string) (templateSources, error) {
+	sources := make(templateSources, 0, len(specs))
+	for _, spec := range specs {
+		kind, location, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, errors.Errorf("invalid template source %q, expected <kind>:<location>", spec)
+		}
+		factory, ok := templateSourceFactories[kind]
+		if !ok {
+			return nil, errors.Errorf("unknown template source kind %q, registered kinds: %s", kind, strings.Join(templateSourceKinds(), ", "))
+		}
+		src, err := factory(location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create %s template source", kind)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// templateSourceKinds returns the sorted registered template source kinds
+func templateSourceKinds() []string {
+	out := make([]string, 0, len(templateSourceFactories))
+	for k := range templateSourceFactories {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeSource is a template source returning a fixed value or error
+type fakeSource struct {
+	value string
+	err   error
+}
+
+func (s fakeSource) Resolve(_ v1beta1.TemplateRef) (string, *staleValue, error) {
+	return s.value, nil, s.err
+}
+
+func TestTemplateSources(t *testing.T) {
+	ref := v1beta1.TemplateRef{Name: "bucket", Version: "v1"}
+	reg := templateRegistry{}
+	reg.add("bucket", "v1", "kind: \"Bucket\"")
+
+	type want struct {
+		value string
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason  string
+		sources templateSources
+		want    want
+	}{
+		"NoSources": {
+			reason: "Without sources the template should not be registered",
+			want:   want{err: templateNotFoundError{msg: "template \"bucket\" is not registered"}},
+		},
+		"FirstSource": {
+			reason:  "The template should be resolved from the first source that holds it",
+			sources: templateSources{reg, fakeSource{value: "kind: \"Other\""}},
+			want:    want{value: "kind: \"Bucket\""},
+		},
+		"FallThrough": {
+			reason:  "A source that does not hold the template should fall through to the next source",
+			sources: templateSources{templateRegistry{}, reg},
+			want:    want{value: "kind: \"Bucket\""},
+		},
+		"SourceError": {
+			reason:  "A source that fails should not fall through to the next source",
+			sources: templateSources{fakeSource{err: errors.New("store unavailable")}, reg},
+			want:    want{err: errors.New("store unavailable")},
+		},
+		"NotFound": {
+			reason:  "The error of the first source should be returned when no source holds the template",
+			sources: templateSources{templateRegistry{}, fakeSource{err: templateNotFoundError{msg: "not in store"}}},
+			want:    want{err: templateNotFoundError{msg: "template \"bucket\" is not registered"}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			value, _, err := tc.sources.Resolve(ref)
+
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\ns.Resolve(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\ns.Resolve(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestNewTemplateSources(t *testing.T) {
+	registerTemplateSource("fake", func(location string) (templateSource, error) {
+		if location == "broken" {
+			return nil, errors.New("cannot connect")
+		}
+		return fakeSource{value: location}, nil
+	})
+	t.Cleanup(func() { delete(templateSourceFactories, "fake") })
+
+	type want struct {
+		value string
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		specs  []string
+		want   want
+	}{
+		"RegisteredKind": {
+			reason: "A registered kind of source should be built from its location",
+			specs:  []string{"fake:kind: \"Fake\""},
+			want:   want{value: "kind: \"Fake\""},
+		},
+		"EmptyDir": {
+			reason: "An empty templates directory should hold no templates",
+			specs:  []string{"dir:", "fake:kind: \"Fake\""},
+			want:   want{value: "kind: \"Fake\""},
+		},
+		"InvalidSpec": {
+			reason: "A spec without a kind should return an error",
+			specs:  []string{"templates"},
+			want:   want{err: errors.New("invalid template source \"templates\", expected <kind>:<location>")},
+		},
+		"UnknownKind": {
+			reason: "An unregistered kind should return an error listing the registered kinds",
+			specs:  []string{"git:https://example.org/templates.git"},
+			want:   want{err: errors.New("unknown template source kind \"git\", registered kinds: dir, fake, oci")},
+		},
+		"FactoryError": {
+			reason: "An error building the source should be returned",
+			specs:  []string{"fake:broken"},
+			want:   want{err: errors.Wrap(errors.New("cannot connect"), "cannot create fake template source")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sources, err := newTemplateSources(tc.specs)
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nnewTemplateSources(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if err != nil {
+				return
+			}
+
+			value, _, err := sources.Resolve(v1beta1.TemplateRef{Name: "bucket", Version: "v1"})
+			if err != nil {
+				t.Fatalf("%s\nsources.Resolve(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\nsources.Resolve(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
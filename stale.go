@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// staleValue is a cached value of a remote source served after a refresh of
+// the source failed, so that composites keep reconciling through an outage of
+// the source
+type staleValue struct {
+	// source names the source, such as ConfigMap crossplane-system/templates
+	source string
+	// age is the time since the value was last fetched
+	age time.Duration
+	// err is the error the refresh failed with
+	err error
+}
+
+// warning returns the message of the warning result of the stale value
+func (s *staleValue) warning() string {
+	return fmt.Sprintf("serving a stale copy of %s fetched %s ago: cannot refresh it: %v", s.source, s.age.Round(time.Second), s.err)
+}
+
+// unavailableError is a failure to reach a remote source, as opposed to a
+// source that does not hold the value, a stale copy is only served for it
+type unavailableError struct {
+	error
+}
+
+func (e unavailableError) Unwrap() error {
+	return e.error
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+	"github.com/crossplane/function-sdk-go/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// targetAnnotation sends the document it annotates to a target of its own,
+// ahead of the routes and the target of the export, it is removed from the
+// document before the document is applied
+const targetAnnotation = "function-cue.fn/target"
+
+// unwrapTargets replaces the documents that wrap a resource with its target,
+// {target: "XR", resource: {...}}, by the resource annotated with the target
+func unwrapTargets(data []map[string]interface{}) []map[string]interface{} {
+	for i, d := range data {
+		target, ok := d["target"].(string)
+		if !ok || len(d) != 2 {
+			continue
+		}
+		r, ok := d["resource"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		u := unstructured.Unstructured{Object: r}
+		annotations := u.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[targetAnnotation] = target
+		u.SetAnnotations(annotations)
+		data[i] = u.Object
+	}
+	return data
+}
+
+// annotateTarget annotates the documents with the target, the documents that
+// name a target of their own keep it, nothing is annotated without a target
+func annotateTarget(data []map[string]interface{}, target v1beta1.Target) []map[string]interface{} {
+	if target == "" {
+		return data
+	}
+	data = unwrapTargets(data)
+	for _, d := range data {
+		u := unstructured.Unstructured{Object: d}
+		annotations := u.GetAnnotations()
+		if _, ok := annotations[targetAnnotation]; ok {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[targetAnnotation] = string(target)
+		u.SetAnnotations(annotations)
+	}
+	return data
+}
+
+// takeTarget removes the targetAnnotation from the document and returns the
+// target it held, or an empty target when the document is not annotated
+func takeTarget(d map[string]interface{}) (v1beta1.Target, error) {
+	u := unstructured.Unstructured{Object: d}
+	annotations := u.GetAnnotations()
+	v, ok := annotations[targetAnnotation]
+	if !ok {
+		return "", nil
+	}
+	switch t := v1beta1.Target(v); t {
+	case v1beta1.Context, v1beta1.PatchDesired, v1beta1.PatchResources, v1beta1.Resources, v1beta1.XR, v1beta1.XRStatus:
+	default:
+		return "", errors.Errorf("invalid %s annotation %q of %s %q: must be Context, PatchDesired, PatchResources, Resources, XR or XRStatus", targetAnnotation, v, u.GetKind(), u.GetName())
+	}
+	delete(annotations, targetAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	u.SetAnnotations(annotations)
+	return v1beta1.Target(v), nil
+}
+
+// immutableXRFields are the fields of the XR the documents of the XR target
+// cannot change, changing them corrupts the desired composite
+var immutableXRFields = []string{"apiVersion", "kind", "metadata.name", "spec.resourceRefs", "spec.claimRef"}
+
+// protectXR checks the documents of the XR target do not change the immutable
+// fields of the observed XR, a document may repeat their observed values. With
+// the Ignore policy the changes are dropped from the documents instead.
+func protectXR(oxr *resource.Composite, data []map[string]interface{}, policy v1beta1.ImmutableFieldsPolicy) error {
+	for i, d := range data {
+		p := fieldpath.Pave(d)
+		for _, path := range immutableXRFields {
+			v, err := p.GetValue(path)
+			if fieldpath.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "cannot get %s of document at index %d", path, i)
+			}
+			observed, err := oxr.Resource.GetValue(path)
+			if err != nil && !fieldpath.IsNotFound(err) {
+				return errors.Wrapf(err, "cannot get %s of the XR", path)
+			}
+			if err == nil && reflect.DeepEqual(v, observed) {
+				continue
+			}
+			if policy == v1beta1.ImmutableFieldsIgnore {
+				if err := p.DeleteField(path); err != nil {
+					return errors.Wrapf(err, "cannot drop %s of document at index %d", path, i)
+				}
+				continue
+			}
+			return errors.Errorf("document at index %d changes %s of the XR to %v, the field is immutable: set immutableFields to Ignore to drop the change", i, path, v)
+		}
+	}
+	return nil
+}
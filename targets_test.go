@@ -0,0 +1,209 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestRouteData(t *testing.T) {
+	annotated := func(target string, kind string) map[string]interface{} {
+		return map[string]interface{}{
+			"kind":     kind,
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{targetAnnotation: target}},
+		}
+	}
+	doc := func(kind string) map[string]interface{} {
+		return map[string]interface{}{"kind": kind, "metadata": map[string]interface{}{}}
+	}
+
+	type args struct {
+		routes []v1beta1.Route
+		target v1beta1.Target
+		data   []map[string]interface{}
+	}
+	cases := map[string]struct {
+		reason  string
+		args    args
+		want    []routedData
+		wantErr bool
+	}{
+		"DefaultTarget": {
+			reason: "Documents without routes or annotated targets should be sent to the default target",
+			args: args{
+				target: v1beta1.Resources,
+				data:   []map[string]interface{}{{"kind": "A"}, {"kind": "B"}},
+			},
+			want: []routedData{{target: v1beta1.Resources, data: []map[string]interface{}{{"kind": "A"}, {"kind": "B"}}}},
+		},
+		"Routes": {
+			reason: "Documents should be sent to the target of the first route they match",
+			args: args{
+				routes: []v1beta1.Route{{Match: v1beta1.RouteMatch{Kind: "XR"}, Target: v1beta1.XR}},
+				target: v1beta1.Resources,
+				data:   []map[string]interface{}{{"kind": "XR"}, {"kind": "B"}},
+			},
+			want: []routedData{
+				{target: v1beta1.XR, data: []map[string]interface{}{{"kind": "XR"}}},
+				{target: v1beta1.Resources, data: []map[string]interface{}{{"kind": "B"}}},
+			},
+		},
+		"AnnotatedTargets": {
+			reason: "Documents annotated with a target should be sent to it ahead of the routes, without the annotation",
+			args: args{
+				routes: []v1beta1.Route{{Match: v1beta1.RouteMatch{Kind: "XR"}, Target: v1beta1.XR}},
+				target: v1beta1.Resources,
+				data: []map[string]interface{}{
+					annotated("PatchDesired", "XR"),
+					doc("B"),
+					annotated("XR", "C"),
+					annotated("PatchDesired", "D"),
+				},
+			},
+			want: []routedData{
+				{target: v1beta1.Resources, data: []map[string]interface{}{doc("B")}},
+				{target: v1beta1.PatchDesired, data: []map[string]interface{}{doc("XR"), doc("D")}},
+				{target: v1beta1.XR, data: []map[string]interface{}{doc("C")}},
+			},
+		},
+		"InvalidAnnotatedTarget": {
+			reason: "A document annotated with a target that cannot be applied should be an error",
+			args: args{
+				target: v1beta1.Resources,
+				data:   []map[string]interface{}{annotated("Validate", "A")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := routeData(tc.args.routes, tc.args.target, tc.args.data)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\nrouteData(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nrouteData(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(routedData{})); diff != "" {
+				t.Errorf("%s\nrouteData(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestUnwrapTargets(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		data   []map[string]interface{}
+		want   []map[string]interface{}
+	}{
+		"Wrapped": {
+			reason: "A wrapped resource should be annotated with its target",
+			data: []map[string]interface{}{
+				{"target": "XR", "resource": map[string]interface{}{"status": map[string]interface{}{"ready": true}}},
+			},
+			want: []map[string]interface{}{
+				{
+					"metadata": map[string]interface{}{"annotations": map[string]interface{}{targetAnnotation: "XR"}},
+					"status":   map[string]interface{}{"ready": true},
+				},
+			},
+		},
+		"NotWrapped": {
+			reason: "A resource with a target field should not be unwrapped",
+			data: []map[string]interface{}{
+				{"kind": "Service", "target": "XR", "resource": map[string]interface{}{}},
+			},
+			want: []map[string]interface{}{
+				{"kind": "Service", "target": "XR", "resource": map[string]interface{}{}},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := unwrapTargets(tc.data)
+			if diff := cmp.Diff(tc.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\nunwrapTargets(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProtectXR(t *testing.T) {
+	oxr := &resource.Composite{Resource: composite.New()}
+	oxr.Resource.SetAPIVersion("example.org/v1")
+	oxr.Resource.SetKind("XR")
+	oxr.Resource.SetName("example")
+
+	type args struct {
+		data   []map[string]interface{}
+		policy v1beta1.ImmutableFieldsPolicy
+	}
+	cases := map[string]struct {
+		reason  string
+		args    args
+		want    []map[string]interface{}
+		wantErr bool
+	}{
+		"Unchanged": {
+			reason: "Documents repeating the immutable fields of the XR should be applied",
+			args: args{
+				data: []map[string]interface{}{
+					{"apiVersion": "example.org/v1", "kind": "XR", "metadata": map[string]interface{}{"name": "example"}},
+				},
+			},
+			want: []map[string]interface{}{
+				{"apiVersion": "example.org/v1", "kind": "XR", "metadata": map[string]interface{}{"name": "example"}},
+			},
+		},
+		"Rejected": {
+			reason: "A document changing an immutable field of the XR should be an error",
+			args: args{
+				data: []map[string]interface{}{
+					{"spec": map[string]interface{}{"claimRef": map[string]interface{}{"name": "claim"}}},
+				},
+			},
+			wantErr: true,
+		},
+		"Ignored": {
+			reason: "Changes to the immutable fields of the XR should be dropped with the Ignore policy",
+			args: args{
+				data: []map[string]interface{}{
+					{"metadata": map[string]interface{}{"name": "other"}, "spec": map[string]interface{}{"resourceRefs": []interface{}{}, "replicas": 3.0}},
+				},
+				policy: v1beta1.ImmutableFieldsIgnore,
+			},
+			want: []map[string]interface{}{
+				{"metadata": map[string]interface{}{}, "spec": map[string]interface{}{"replicas": 3.0}},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := protectXR(oxr, tc.args.data, tc.args.policy)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("%s\nprotectXR(...): want error, got none", tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nprotectXR(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, tc.args.data); diff != "" {
+				t.Errorf("%s\nprotectXR(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// templateExt is the file extension of templates loaded into the registry
+const templateExt = ".cue"
+
+// templateRegistry holds named CUE templates registered at startup
+// Templates are keyed by name and then by version
+type templateRegistry map[string]map[string]string
+
+// loadTemplates loads the named templates stored under dir
+// Templates are expected to be laid out as <dir>/<name>/<version>.cue
+// An empty dir returns an empty registry
+func loadTemplates(dir string) (templateRegistry, error) {
+	reg := templateRegistry{}
+	if dir == "" {
+		return reg, nil
+	}
+
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read templates directory %q", dir)
+	}
+	for _, n := range names {
+		if !n.IsDir() || strings.HasPrefix(n.Name(), ".") {
+			continue
+		}
+		versions, err := os.ReadDir(filepath.Join(dir, n.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read template %q", n.Name())
+		}
+		for _, v := range versions {
+			if v.IsDir() || filepath.Ext(v.Name()) != templateExt {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(dir, n.Name(), v.Name()))
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot read template %q version %q", n.Name(), v.Name())
+			}
+			reg.add(n.Name(), strings.TrimSuffix(v.Name(), templateExt), string(b))
+		}
+	}
+	return reg, nil
+}
+
+// add registers the template source under the given name and version
+func (r templateRegistry) add(name, version, value string) {
+	if _, ok := r[name]; !ok {
+		r[name] = map[string]string{}
+	}
+	r[name][version] = value
+}
+
+// Resolve returns the template source referenced by ref, templates loaded
+// from disk are never stale
+func (r templateRegistry) Resolve(ref v1beta1.TemplateRef) (string, *staleValue, error) {
+	versions, ok := r[ref.Name]
+	if !ok {
+		return "", nil, templateNotFoundError{msg: fmt.Sprintf("template %q is not registered", ref.Name)}
+	}
+	value, ok := versions[ref.Version]
+	if !ok {
+		return "", nil, templateNotFoundError{msg: fmt.Sprintf("template %q has no version %q, registered versions: %s", ref.Name, ref.Version, strings.Join(r.versions(ref.Name), ", "))}
+	}
+	return value, nil, nil
+}
+
+// versions returns the sorted versions registered for the named template
+func (r templateRegistry) versions(name string) []string {
+	out := make([]string, 0, len(r[name]))
+	for v := range r[name] {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
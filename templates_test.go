@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTemplateRegistry(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"bucket/v1.cue":    "kind: \"Bucket\"",
+		"bucket/v2.cue":    "kind: \"BucketV2\"",
+		"bucket/README.md": "ignored",
+		"network/v1.cue":   "kind: \"Network\"",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatalf("loadTemplates(...): unexpected error: %v", err)
+	}
+
+	type want struct {
+		value string
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		ref    v1beta1.TemplateRef
+		want   want
+	}{
+		"ResolveVersion": {
+			reason: "A registered template version should resolve to its source",
+			ref:    v1beta1.TemplateRef{Name: "bucket", Version: "v2"},
+			want:   want{value: "kind: \"BucketV2\""},
+		},
+		"UnknownTemplate": {
+			reason: "An unregistered template should return an error",
+			ref:    v1beta1.TemplateRef{Name: "database", Version: "v1"},
+			want:   want{err: templateNotFoundError{msg: "template \"database\" is not registered"}},
+		},
+		"UnknownVersion": {
+			reason: "An unregistered version should return an error listing the known versions",
+			ref:    v1beta1.TemplateRef{Name: "bucket", Version: "v3"},
+			want:   want{err: templateNotFoundError{msg: "template \"bucket\" has no version \"v3\", registered versions: v1, v2"}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			value, _, err := reg.Resolve(tc.ref)
+
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\nreg.Resolve(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nreg.Resolve(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
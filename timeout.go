@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// evalTimeout returns the timeout of the evaluation of the export, the timeout
+// of the export can only shorten the timeout of the function, 0 is unlimited
+func (f *Function) evalTimeout(in *v1beta1.CUEInput) time.Duration {
+	timeout := f.timeout
+	if t := in.Export.Options.Timeout; t != nil && (timeout == 0 || t.Duration < timeout) {
+		timeout = t.Duration
+	}
+	return timeout
+}
+
+// States of an evaluation, an evaluation either finishes or is abandoned first
+const (
+	evalRunning int32 = iota
+	evalFinished
+	evalAbandoned
+)
+
+// abandonedEvals counts the evaluations abandoned by their timeout or request
+// that still run in the background, so that a template that never finishes
+// cannot pile up goroutines burning CPU, one for each reconcile
+type abandonedEvals struct {
+	max     int64
+	running atomic.Int64
+}
+
+// newAbandonedEvals returns a bound of max abandoned evaluations, a max of 0
+// does not bound them
+func newAbandonedEvals(max int) *abandonedEvals {
+	if max <= 0 {
+		return nil
+	}
+	return &abandonedEvals{max: int64(max)}
+}
+
+// full returns whether the maximum number of abandoned evaluations still run,
+// a nil bound is never full
+func (a *abandonedEvals) full() bool {
+	return a != nil && a.running.Load() >= a.max
+}
+
+func (a *abandonedEvals) add(n int64) {
+	if a != nil {
+		a.running.Add(n)
+	}
+}
+
+// evaluate runs the evaluation of the export until it returns, its timeout
+// expires or the context of the request is done. A cue evaluation cannot be
+// interrupted, an abandoned evaluation runs on in the background until it
+// returns, only the worker of an isolated evaluation is killed. No evaluation
+// starts while the maximum number of abandoned evaluations still run.
+func (f *Function) evaluate(ctx context.Context, in *v1beta1.CUEInput, eval func(ctx context.Context) error) error {
+	if f.abandoned.full() {
+		return errors.Errorf("cannot start cue evaluation: %d evaluations abandoned after their timeout are still running", f.abandoned.max)
+	}
+	timeout := f.evalTimeout(in)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	var state atomic.Int32
+	go func() {
+		err := eval(ctx)
+		// An evaluation that was abandoned no longer counts once it returns
+		if !state.CompareAndSwap(evalRunning, evalFinished) {
+			f.abandoned.add(-1)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// An evaluation that returned as the context was done is not
+		// abandoned
+		if state.CompareAndSwap(evalRunning, evalAbandoned) {
+			f.abandoned.add(1)
+		}
+		if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errors.Errorf("cue evaluation exceeded its %s timeout", timeout)
+		}
+		return errors.Wrap(ctx.Err(), "cue evaluation cancelled")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestEvaluate(t *testing.T) {
+	errBoom := errors.New("boom")
+	// block is an evaluation that only returns once it is abandoned
+	block := func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := map[string]struct {
+		reason  string
+		ctx     context.Context
+		timeout time.Duration
+		export  *metav1.Duration
+		eval    func(ctx context.Context) error
+		want    error
+	}{
+		"Returns": {
+			reason:  "The error of an evaluation that returns in time should be returned",
+			ctx:     context.Background(),
+			timeout: time.Minute,
+			eval:    func(context.Context) error { return errBoom },
+			want:    errBoom,
+		},
+		"FunctionTimeout": {
+			reason:  "An evaluation should time out after the timeout of the function",
+			ctx:     context.Background(),
+			timeout: 10 * time.Millisecond,
+			eval:    block,
+			want:    errors.New("cue evaluation exceeded its 10ms timeout"),
+		},
+		"ExportTimeout": {
+			reason:  "The timeout of the export should shorten the timeout of the function",
+			ctx:     context.Background(),
+			timeout: time.Minute,
+			export:  &metav1.Duration{Duration: 10 * time.Millisecond},
+			eval:    block,
+			want:    errors.New("cue evaluation exceeded its 10ms timeout"),
+		},
+		"ExportTimeoutUnlimited": {
+			reason: "The timeout of the export should apply when the function has none",
+			ctx:    context.Background(),
+			export: &metav1.Duration{Duration: 10 * time.Millisecond},
+			eval:   block,
+			want:   errors.New("cue evaluation exceeded its 10ms timeout"),
+		},
+		"Cancelled": {
+			reason:  "An evaluation should be abandoned when the request is cancelled",
+			ctx:     cancelled,
+			timeout: time.Minute,
+			eval:    block,
+			want:    errors.Wrap(context.Canceled, "cue evaluation cancelled"),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := &v1beta1.CUEInput{Export: v1beta1.Export{Options: v1beta1.ExportOptions{Timeout: tc.export}}}
+			err := (&Function{timeout: tc.timeout}).evaluate(tc.ctx, in, tc.eval)
+			if diff := cmp.Diff(tc.want, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.evaluate(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestEvaluateAbandoned(t *testing.T) {
+	// release lets the abandoned evaluations return
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	block := func(context.Context) error {
+		<-release
+		returned <- struct{}{}
+		return nil
+	}
+	in := &v1beta1.CUEInput{}
+	f := &Function{timeout: 10 * time.Millisecond, abandoned: newAbandonedEvals(1)}
+
+	want := errors.New("cue evaluation exceeded its 10ms timeout")
+	if diff := cmp.Diff(want, f.evaluate(context.Background(), in, block), test.EquateErrors()); diff != "" {
+		t.Errorf("f.evaluate(...): -want err, +got err:\n%s", diff)
+	}
+	want = errors.New("cannot start cue evaluation: 1 evaluations abandoned after their timeout are still running")
+	if diff := cmp.Diff(want, f.evaluate(context.Background(), in, block), test.EquateErrors()); diff != "" {
+		t.Errorf("f.evaluate(...): -want err, +got err:\n%s", diff)
+	}
+
+	// An evaluation starts again once the abandoned evaluation returns
+	close(release)
+	<-returned
+	// The count is released right after the evaluation returns
+	for f.abandoned.full() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := f.evaluate(context.Background(), in, func(context.Context) error { return nil }); err != nil {
+		t.Errorf("f.evaluate(...): unexpected error: %v", err)
+	}
+}
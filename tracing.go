@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"google.golang.org/grpc/metadata"
+)
+
+// spanLogStdout is the destination of the span log writing the spans to stdout
+const spanLogStdout = "-"
+
+// tracer records the spans of RunFunction calls and writes each span to the
+// span log as it ends, a nil tracer records nothing. The spans are not exported
+// with the OpenTelemetry protocol, they only continue the W3C trace context of
+// the request so that they can be joined with the traces of Crossplane.
+type tracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newTracer returns the tracer writing to the span log at dest, appended to
+// the file dest or written to stdout when dest is -. No spans are recorded
+// without a destination.
+func newTracer(dest string, stdout io.Writer) (*tracer, error) {
+	switch dest {
+	case "":
+		return nil, nil
+	case spanLogStdout:
+		return &tracer{w: stdout}, nil
+	}
+	f, err := os.OpenFile(filepath.Clean(dest), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open span log")
+	}
+	return &tracer{w: f}, nil
+}
+
+// span is a timed operation of a RunFunction call, written in the shape of an
+// OpenTelemetry span
+type span struct {
+	tracer *tracer
+
+	Name         string            `json:"name"`
+	TraceID      string            `json:"traceId"`
+	SpanID       string            `json:"spanId"`
+	ParentSpanID string            `json:"parentSpanId,omitempty"`
+	StartTime    time.Time         `json:"startTime"`
+	EndTime      time.Time         `json:"endTime"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type spanKey struct{}
+
+// start starts a span as a child of the span of the context, the returned
+// context carries the new span. The span inherits the attributes of its
+// parent, such as the tag of the request, and adds the attributes given as
+// key and value pairs.
+func (t *tracer) start(ctx context.Context, name string, attributes ...string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:     t,
+		Name:       name,
+		SpanID:     randomID(8),
+		StartTime:  time.Now(),
+		Attributes: map[string]string{},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+		for k, v := range parent.Attributes {
+			s.Attributes[k] = v
+		}
+	} else if traceID, parentID, ok := traceParent(ctx); ok {
+		s.TraceID = traceID
+		s.ParentSpanID = parentID
+	} else {
+		s.TraceID = randomID(16)
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.Attributes[attributes[i]] = attributes[i+1]
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// end ends the span, failed by the error when it is not nil, and writes it to
+// the span log
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.EndTime = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	b, mErr := json.Marshal(s)
+	if mErr != nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	_, _ = s.tracer.w.Write(append(b, '\n'))
+}
+
+// traceParentHeader is the gRPC metadata key of the W3C trace context of the
+// caller
+const traceParentHeader = "traceparent"
+
+// traceParent returns the trace id and the parent span id of the W3C
+// traceparent of the incoming gRPC metadata, in version-traceid-parentid-flags
+// form such as 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func traceParent(ctx context.Context) (string, string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(traceParentHeader)) == 0 {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimSpace(md.Get(traceParentHeader)[0]), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, parentID := parts[1], parts[2]
+	if !isHexID(traceID, 16) || !isHexID(parentID, 8) {
+		return "", "", false
+	}
+	return traceID, parentID, true
+}
+
+// isHexID returns whether s is a lowercase hex id of n bytes that is not all
+// zeros, which W3C trace context treats as invalid
+func isHexID(s string, n int) bool {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != n || s != strings.ToLower(s) {
+		return false
+	}
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// randomID returns a random hex id of n bytes
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// fatalResult returns the message of the first fatal result of the response as
+// an error, or nil when the response has no fatal result
+func fatalResult(rsp *fnv1beta1.RunFunctionResponse) error {
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+			return errors.New(r.GetMessage())
+		}
+	}
+	return nil
+}
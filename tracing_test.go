@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tr, err := newTracer(spanLogStdout, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Function{log: logging.NewNopLogger(), tracer: tr}
+	req := &fnv1beta1.RunFunctionRequest{
+		Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+		Input: resource.MustStructJSON(`{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "traced"},
+			"export": {
+				"target": "PatchDesired",
+				"value": "apiVersion: \"example.org/v1\"\nkind: \"Generated\"\nmetadata: name: \"generated\"\n"
+			}
+		}`),
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}}`),
+			},
+		},
+	}
+	if _, err := f.RunFunction(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	type exported struct {
+		name, parent string
+		attributes   map[string]string
+		failed       bool
+	}
+	var got []exported
+	names := map[string]string{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		s := span{}
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		names[s.SpanID] = s.Name
+		got = append(got, exported{name: s.Name, parent: s.ParentSpanID, attributes: s.Attributes, failed: s.Error != ""})
+	}
+	for i := range got {
+		got[i].parent = names[got[i].parent]
+	}
+
+	// The spans are exported as they end, children before their parents,
+	// and the unmatched patch fails the step
+	want := []exported{
+		{name: "cueCompile", parent: "runExport", attributes: map[string]string{"tag": "hello", "input": "traced", "target": "PatchDesired"}},
+		{name: "matchResources", parent: "runExport", attributes: map[string]string{"tag": "hello", "input": "traced", "target": "PatchDesired"}},
+		{name: "runExport", parent: "RunFunction", attributes: map[string]string{"tag": "hello", "input": "traced", "target": "PatchDesired"}, failed: true},
+		{name: "RunFunction", attributes: map[string]string{"tag": "hello"}, failed: true},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(exported{})); diff != "" {
+		t.Errorf("RunFunction(...): -want spans, +got spans:\n%s", diff)
+	}
+
+	if tr, err := newTracer("", &buf); tr != nil || err != nil {
+		t.Errorf("newTracer(\"\"): want no tracer, got %v, %v", tr, err)
+	}
+}
+
+func TestTracerSpanLogFile(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "spans.json")
+	tr, err := newTracer(dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sp := tr.start(context.Background(), "RunFunction")
+	sp.end(nil)
+
+	b, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := span{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatalf("json.Unmarshal(...): the span log should hold the span as a json line: %v", err)
+	}
+	if s.Name != "RunFunction" {
+		t.Errorf("span.Name: want RunFunction, got %q", s.Name)
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	cases := map[string]struct {
+		reason      string
+		traceparent string
+		traceID     string
+		parentID    string
+	}{
+		"Valid": {
+			reason:      "The span should continue the trace of the traceparent of the request",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID:     "4bf92f3577b34da6a3ce929d0e0e4736",
+			parentID:    "00f067aa0ba902b7",
+		},
+		"ZeroTraceID": {
+			reason:      "A traceparent with an all zero trace id should start a new trace",
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		"Malformed": {
+			reason:      "A malformed traceparent should start a new trace",
+			traceparent: "00-4bf92f3577b34da6-01",
+		},
+		"Missing": {
+			reason: "A request without a traceparent should start a new trace",
+		},
+	}
+
+	tr := &tracer{w: io.Discard}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.traceparent != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(traceParentHeader, tc.traceparent))
+			}
+			_, sp := tr.start(ctx, "RunFunction")
+			if tc.traceID == "" {
+				if len(sp.TraceID) != 32 || sp.ParentSpanID != "" {
+					t.Errorf("%s\nstart(...): want a new trace, got trace %q parent %q", tc.reason, sp.TraceID, sp.ParentSpanID)
+				}
+				return
+			}
+			if sp.TraceID != tc.traceID || sp.ParentSpanID != tc.parentID {
+				t.Errorf("%s\nstart(...): want trace %q parent %q, got trace %q parent %q", tc.reason, tc.traceID, tc.parentID, sp.TraceID, sp.ParentSpanID)
+			}
+		})
+	}
+}
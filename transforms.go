@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// truncateHashLen is the number of hex characters of the hash appended to truncated values
+const truncateHashLen = 8
+
+// transformTag applies the transforms in order to the tag value
+func transformTag(value string, transforms []v1beta1.TagTransform) (string, error) {
+	for i, t := range transforms {
+		var err error
+		if value, err = runTagTransform(value, t); err != nil {
+			return "", errors.Wrapf(err, "cannot run transform at index %d", i)
+		}
+	}
+	return value, nil
+}
+
+// runTagTransform runs a single transform against the tag value
+func runTagTransform(value string, t v1beta1.TagTransform) (string, error) {
+	switch t.Type {
+	case v1beta1.ToLower:
+		return strings.ToLower(value), nil
+	case v1beta1.ToUpper:
+		return strings.ToUpper(value), nil
+	case v1beta1.TrimPrefix:
+		return strings.TrimPrefix(value, t.Value), nil
+	case v1beta1.TrimSuffix:
+		return strings.TrimSuffix(value, t.Value), nil
+	case v1beta1.Truncate:
+		return truncate(value, t.Length, t.Hash)
+	case v1beta1.Replace:
+		re, err := regexp.Compile(t.Regex)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid regex %q", t.Regex)
+		}
+		return re.ReplaceAllString(value, t.Replacement), nil
+	default:
+		return "", fmt.Errorf("unknown transform type %q", t.Type)
+	}
+}
+
+// truncate shortens the value to length characters, if hash is set the
+// truncated value is suffixed with a short hash of the full value so that it
+// remains unique. The value is cut at characters rather than bytes so that a
+// multi-byte character is never split.
+func truncate(value string, length int, hash bool) (string, error) {
+	if length <= 0 {
+		return "", fmt.Errorf("truncate length must be greater than 0, got %d", length)
+	}
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value, nil
+	}
+	if !hash {
+		return string(runes[:length]), nil
+	}
+	// Leave room for the separator and hash
+	if length <= truncateHashLen+1 {
+		return "", fmt.Errorf("truncate length must be greater than %d when hashing, got %d", truncateHashLen+1, length)
+	}
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("%s-%s", string(runes[:length-truncateHashLen-1]), hex.EncodeToString(sum[:])[:truncateHashLen]), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTransformTag(t *testing.T) {
+	type args struct {
+		value      string
+		transforms []v1beta1.TagTransform
+	}
+	type want struct {
+		value string
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NoTransforms": {
+			reason: "The value should be returned unchanged without transforms",
+			args:   args{value: "My-Cluster"},
+			want:   want{value: "My-Cluster"},
+		},
+		"Chained": {
+			reason: "Transforms should be applied in order",
+			args: args{
+				value: "team-My_Cluster.",
+				transforms: []v1beta1.TagTransform{
+					{Type: v1beta1.TrimPrefix, Value: "team-"},
+					{Type: v1beta1.TrimSuffix, Value: "."},
+					{Type: v1beta1.ToLower},
+					{Type: v1beta1.Replace, Regex: "[^a-z0-9-]", Replacement: "-"},
+				},
+			},
+			want: want{value: "my-cluster"},
+		},
+		"ToUpper": {
+			reason: "ToUpper should uppercase the value",
+			args: args{
+				value:      "prod",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.ToUpper}},
+			},
+			want: want{value: "PROD"},
+		},
+		"ReplaceCaptureGroup": {
+			reason: "Replace should support capture group references",
+			args: args{
+				value:      "us-east-2",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Replace, Regex: "^([a-z]+)-.*$", Replacement: "$1"}},
+			},
+			want: want{value: "us"},
+		},
+		"Truncate": {
+			reason: "Truncate should shorten values longer than length",
+			args: args{
+				value:      "a-very-long-cluster-name",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Truncate, Length: 6}},
+			},
+			want: want{value: "a-very"},
+		},
+		"TruncateShortValue": {
+			reason: "Truncate should not change values shorter than length",
+			args: args{
+				value:      "short",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Truncate, Length: 10, Hash: true}},
+			},
+			want: want{value: "short"},
+		},
+		"TruncateWithHash": {
+			reason: "Truncate with hash should suffix the value with a hash of the full value",
+			args: args{
+				value:      "a-very-long-cluster-name",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Truncate, Length: 17, Hash: true}},
+			},
+			want: want{value: "a-very-l-e53598dd"},
+		},
+		"TruncateMultiByte": {
+			reason: "Truncate should count characters rather than bytes and never split a character",
+			args: args{
+				value:      "café-größe",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Truncate, Length: 4}},
+			},
+			want: want{value: "café"},
+		},
+		"TruncateMultiByteWithHash": {
+			reason: "Truncate with hash should keep whole characters before the hash",
+			args: args{
+				value:      "日本語のクラスター名前です",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Truncate, Length: 12, Hash: true}},
+			},
+			want: want{value: "日本語-02f2a7a7"},
+		},
+		"TruncateHashTooShort": {
+			reason: "Truncate with hash should fail if there is no room for the hash",
+			args: args{
+				value:      "a-very-long-cluster-name",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.Truncate, Length: 5, Hash: true}},
+			},
+			want: want{err: errors.Wrap(errors.New("truncate length must be greater than 9 when hashing, got 5"), "cannot run transform at index 0")},
+		},
+		"InvalidRegex": {
+			reason: "An invalid regex should return an error",
+			args: args{
+				value:      "value",
+				transforms: []v1beta1.TagTransform{{Type: v1beta1.ToLower}, {Type: v1beta1.Replace, Regex: "("}},
+			},
+			want: want{err: errors.Wrap(errors.New("invalid regex \"(\": error parsing regexp: missing closing ): `(`"), "cannot run transform at index 1")},
+		},
+		"UnknownType": {
+			reason: "An unknown transform type should return an error",
+			args: args{
+				value:      "value",
+				transforms: []v1beta1.TagTransform{{Type: "Reverse"}},
+			},
+			want: want{err: errors.Wrap(errors.New("unknown transform type \"Reverse\""), "cannot run transform at index 0")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			value, err := transformTag(tc.args.value, tc.args.transforms)
+
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\ntransformTag(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\ntransformTag(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
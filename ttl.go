@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+// responseTTL returns how long Crossplane may cache the response of the input,
+// the shortest ttl of its exports or response.DefaultTTL when none sets one
+func responseTTL(in *v1beta1.CUEInput) time.Duration {
+	var ttl time.Duration
+	for _, e := range in.Inputs() {
+		if t := e.Export.Options.TTL; t != nil && (ttl == 0 || t.Duration < ttl) {
+			ttl = t.Duration
+		}
+	}
+	if ttl == 0 {
+		return response.DefaultTTL
+	}
+	return ttl
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crossplane/function-sdk-go/response"
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+)
+
+func TestResponseTTL(t *testing.T) {
+	ttl := func(d time.Duration) v1beta1.Export {
+		return v1beta1.Export{Options: v1beta1.ExportOptions{TTL: &metav1.Duration{Duration: d}}}
+	}
+
+	cases := map[string]struct {
+		reason string
+		in     v1beta1.CUEInput
+		want   time.Duration
+	}{
+		"Default": {
+			reason: "The default ttl should be used when no export sets one",
+			in:     v1beta1.CUEInput{Export: v1beta1.Export{}},
+			want:   response.DefaultTTL,
+		},
+		"Export": {
+			reason: "The ttl of the export should be used",
+			in:     v1beta1.CUEInput{Export: ttl(10 * time.Minute)},
+			want:   10 * time.Minute,
+		},
+		"Exports": {
+			reason: "The shortest ttl of the exports should be used",
+			in:     v1beta1.CUEInput{Exports: []v1beta1.Export{{}, ttl(5 * time.Second), ttl(time.Hour)}},
+			want:   5 * time.Second,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := responseTTL(&tc.in)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nresponseTTL(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// The function SDK this function is built on predates the pipeline context,
+// the extra resources protocol and the reason and target of results, so its
+// v1beta1 messages do not declare their fields. Crossplane sends and reads them
+// regardless and they are kept as unknown fields of the decoded messages, so
+// they are read from and written to the wire encoding of those fields. The
+// field numbers are those of the v1beta1 protocol of Crossplane, the encoding
+// is dropped once the SDK is bumped to a release that declares them.
+const (
+	// requestContextField is the field number of RunFunctionRequest.context
+	requestContextField protowire.Number = 5
+	// requestExtraResourcesField is the field number of the
+	// RunFunctionRequest.extra_resources map of Resources
+	requestExtraResourcesField protowire.Number = 6
+
+	// responseContextField is the field number of RunFunctionResponse.context
+	responseContextField protowire.Number = 4
+	// responseRequirementsField is the field number of the
+	// RunFunctionResponse.requirements Requirements
+	responseRequirementsField protowire.Number = 5
+
+	// resultReasonField is the field number of Result.reason
+	resultReasonField protowire.Number = 3
+	// resultTargetField is the field number of Result.target
+	resultTargetField protowire.Number = 4
+)
+
+// unknownStruct decodes the struct in the unknown field of the message, the
+// struct is empty when the message does not have the field
+func unknownStruct(m proto.Message, field protowire.Number) (*structpb.Struct, error) {
+	s := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	values, err := unknownBytes(m, field)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		// Repeated occurrences of a message field are merged
+		if err := (proto.UnmarshalOptions{Merge: true}).Unmarshal(v, s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// unknownBytes returns the values of each occurrence of the length delimited
+// unknown field of the message
+func unknownBytes(m proto.Message, field protowire.Number) ([][]byte, error) {
+	return consumeBytesField(m.ProtoReflect().GetUnknown(), field)
+}
+
+// consumeBytesField returns the values of each occurrence of the length
+// delimited field in the wire encoded message
+func consumeBytesField(b []byte, field protowire.Number) ([][]byte, error) {
+	var values [][]byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num != field || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// setUnknownStruct encodes the struct into an unknown field of the message
+func setUnknownStruct(m proto.Message, field protowire.Number, s *structpb.Struct) error {
+	v, err := proto.MarshalOptions{Deterministic: true}.Marshal(s)
+	if err != nil {
+		return err
+	}
+	setUnknownBytes(m, field, v)
+	return nil
+}
+
+// setUnknownBytes appends the length delimited unknown field to the message
+func setUnknownBytes(m proto.Message, field protowire.Number, v []byte) {
+	b := protowire.AppendTag(m.ProtoReflect().GetUnknown(), field, protowire.BytesType)
+	m.ProtoReflect().SetUnknown(protowire.AppendBytes(b, v))
+}
+
+// setUnknownVarint appends the varint unknown field, such as an enum, to the
+// message
+func setUnknownVarint(m proto.Message, field protowire.Number, v uint64) {
+	b := protowire.AppendTag(m.ProtoReflect().GetUnknown(), field, protowire.VarintType)
+	m.ProtoReflect().SetUnknown(protowire.AppendVarint(b, v))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// TestUnknownFields fails once the function SDK declares a field that is
+// written to the wire encoding of the unknown fields, the SDK would then
+// decode it into the declared field and the unknown field would be empty
+func TestUnknownFields(t *testing.T) {
+	cases := map[string]struct {
+		message proto.Message
+		field   protowire.Number
+	}{
+		"RequestContext":        {message: &fnv1beta1.RunFunctionRequest{}, field: requestContextField},
+		"RequestExtraResources": {message: &fnv1beta1.RunFunctionRequest{}, field: requestExtraResourcesField},
+		"ResponseContext":       {message: &fnv1beta1.RunFunctionResponse{}, field: responseContextField},
+		"ResponseRequirements":  {message: &fnv1beta1.RunFunctionResponse{}, field: responseRequirementsField},
+		"ResultReason":          {message: &fnv1beta1.Result{}, field: resultReasonField},
+		"ResultTarget":          {message: &fnv1beta1.Result{}, field: resultTargetField},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			d := tc.message.ProtoReflect().Descriptor()
+			if f := d.Fields().ByNumber(tc.field); f != nil {
+				t.Errorf("%s declares field %d as %s, read and write it through the SDK instead of its unknown fields", d.FullName(), tc.field, f.Name())
+			}
+		})
+	}
+}
+
+func TestUnknownFieldsRoundTrip(t *testing.T) {
+	r := &fnv1beta1.Result{Message: "created"}
+	setUnknownBytes(r, resultReasonField, []byte("Created"))
+	setUnknownVarint(r, resultTargetField, resultTargetCompositeAndClaim)
+
+	// The fields should survive the wire like any declared field
+	b, err := proto.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &fnv1beta1.Result{}
+	if err := proto.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(r, got, protocmp.Transform()); diff != "" {
+		t.Errorf("proto.Unmarshal(...): -want, +got:\n%s", diff)
+	}
+	if reason := resultReason(got); reason != "Created" {
+		t.Errorf("resultReason(...): want Created, got %q", reason)
+	}
+
+	// Repeated occurrences of a struct field should be merged
+	req := &fnv1beta1.RunFunctionRequest{}
+	for _, s := range []*structpb.Struct{
+		{Fields: map[string]*structpb.Value{"a": structpb.NewStringValue("1")}},
+		{Fields: map[string]*structpb.Value{"b": structpb.NewStringValue("2")}},
+	} {
+		if err := setUnknownStruct(req, requestContextField, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, err := unknownStruct(req, requestContextField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"a": "1", "b": "2"}
+	if diff := cmp.Diff(want, ctx.AsMap()); diff != "" {
+		t.Errorf("unknownStruct(...): -want, +got:\n%s", diff)
+	}
+
+	// A truncated encoding should fail to parse
+	m := &fnv1beta1.RunFunctionRequest{}
+	m.ProtoReflect().SetUnknown(protowire.AppendTag(nil, requestContextField, protowire.BytesType))
+	if _, err := unknownStruct(m, requestContextField); err == nil {
+		t.Error("unknownStruct(...): want an error for a truncated field, got none")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// validationResults vets the observed XR against the schema of the input and
+// returns a result for each violation, or a normal result when it is valid
+func validationResults(in *v1beta1.CUEInput, oxr *resource.Composite) ([]*fnv1beta1.Result, error) {
+	violations, err := validateXR(string(in.Export.Value), oxr.Resource.UnstructuredContent())
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) == 0 {
+		return []*fnv1beta1.Result{{
+			Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+			Message:  fmt.Sprintf("validated XR %q", oxr.Resource.GetName()),
+		}}, nil
+	}
+
+	severity := fnv1beta1.Severity_SEVERITY_FATAL
+	if in.Export.ValidationSeverity == v1beta1.ValidationWarning {
+		severity = fnv1beta1.Severity_SEVERITY_WARNING
+	}
+	results := make([]*fnv1beta1.Result, 0, len(violations))
+	for _, v := range violations {
+		results = append(results, &fnv1beta1.Result{
+			Severity: severity,
+			Message:  fmt.Sprintf("invalid XR %q: %s", oxr.Resource.GetName(), v),
+		})
+	}
+	return results, nil
+}
+
+// validateXR unifies the XR with the schema and returns the violations of its
+// constraints, an error is returned when the schema does not compile
+func validateXR(schema string, xr map[string]interface{}) ([]string, error) {
+	ctx := cuecontext.New()
+	s := ctx.CompileString(schema, cue.Filename("schema"))
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot compile schema")
+	}
+
+	// Incomplete values of the schema are not violations, only conflicts
+	// with the XR are
+	err := s.Unify(ctx.Encode(xr)).Validate()
+	var violations []string
+	for _, e := range cueerrors.Errors(err) {
+		violations = append(violations, e.Error())
+	}
+	return violations, nil
+}
+
+// vetDocuments vets each document against the definition of the schema named
+// after its kind, the violations of every document are returned in one error
+func vetDocuments(schema string, data []map[string]interface{}) error {
+	ctx := cuecontext.New()
+	s := ctx.CompileString(schema, cue.Filename("validate"))
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("cannot compile validation schema: %w", err)
+	}
+
+	var violations []string
+	for _, d := range data {
+		u := unstructured.Unstructured{Object: d}
+		def := s.LookupPath(cue.MakePath(cue.Def(u.GetKind())))
+		if u.GetKind() == "" || !def.Exists() {
+			continue
+		}
+		err := def.Unify(ctx.Encode(d)).Validate(cue.Concrete(true))
+		for _, e := range cueerrors.Errors(err) {
+			violations = append(violations, fmt.Sprintf("%s %q: %s", u.GetKind(), u.GetName(), e.Error()))
+		}
+	}
+	if len(violations) != 0 {
+		return fmt.Errorf("generated documents violate the validation schema:\n%s", strings.Join(violations, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestValidateXR(t *testing.T) {
+	xr := map[string]interface{}{
+		"apiVersion": "example.org/v1",
+		"kind":       "XR",
+		"spec":       map[string]interface{}{"replicas": 15, "region": "eu-west-1"},
+	}
+
+	cases := map[string]struct {
+		reason  string
+		schema  string
+		want    []string
+		wantErr bool
+	}{
+		"Valid": {
+			reason: "An XR that satisfies the schema should have no violations",
+			schema: `spec: replicas: int & >0`,
+		},
+		"Incomplete": {
+			reason: "Fields of the schema missing from the XR should not be violations",
+			schema: `spec: size?: "small" | "large"`,
+		},
+		"Violations": {
+			reason: "Each constraint the XR violates should be returned",
+			schema: `spec: {replicas: <=10, region: =~"^us-"}`,
+			want: []string{
+				"spec.replicas: invalid value 15 (out of bound <=10)",
+				`spec.region: invalid value "eu-west-1" (out of bound =~"^us-")`,
+			},
+		},
+		"Closed": {
+			reason: "Fields not allowed by a closed schema should be violations",
+			schema: "#Spec: replicas: int\nspec: #Spec",
+			want:   []string{"spec.region: field not allowed"},
+		},
+		"InvalidSchema": {
+			reason:  "A schema that does not compile should return an error",
+			schema:  `spec: {`,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := validateXR(tc.schema, xr)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s\nvalidateXR(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nvalidateXR(...): -want violations, +got violations:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestVetDocuments(t *testing.T) {
+	schema := "#Deployment: {\n\tapiVersion: \"apps/v1\"\n\tkind: \"Deployment\"\n\tmetadata: name: string\n\tspec: replicas: int & >0\n}\n"
+	deployment := func(replicas interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "web"},
+			"spec":       map[string]interface{}{"replicas": replicas},
+		}
+	}
+
+	cases := map[string]struct {
+		reason  string
+		schema  string
+		data    []map[string]interface{}
+		wantErr string
+	}{
+		"Valid": {
+			reason: "Documents that satisfy the definition of their kind should be accepted",
+			schema: schema,
+			data:   []map[string]interface{}{deployment(3)},
+		},
+		"OtherKind": {
+			reason: "Documents without a definition of their kind should not be vetted",
+			schema: schema,
+			data:   []map[string]interface{}{{"apiVersion": "v1", "kind": "Service", "metadata": map[string]interface{}{"name": "web"}}},
+		},
+		"Violations": {
+			reason: "The violations of every document should be returned",
+			schema: schema,
+			data: []map[string]interface{}{
+				deployment(0),
+				deployment("3"),
+				{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": map[string]interface{}{"name": "api"}, "spec": map[string]interface{}{"replicas": 1, "paused": true}},
+			},
+			wantErr: "generated documents violate the validation schema:\n" +
+				`Deployment "web": #Deployment.spec.replicas: invalid value 0 (out of bound >0)` + "\n" +
+				`Deployment "web": #Deployment.spec.replicas: conflicting values int and "3" (mismatched types int and string)` + "\n" +
+				`Deployment "api": #Deployment.spec.paused: field not allowed`,
+		},
+		"InvalidSchema": {
+			reason:  "A schema that does not compile should return an error",
+			schema:  "#Deployment: {",
+			wantErr: "cannot compile validation schema: expected '}', found 'EOF'",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var got string
+			if err := vetDocuments(tc.schema, tc.data); err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.wantErr, got); diff != "" {
+				t.Errorf("%s\nvetDocuments(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionValidate(t *testing.T) {
+	input := func(severity string) string {
+		return `{
+			"apiVersion": "cue.fn.crossplane.io/v1beta1",
+			"kind": "CUEInput",
+			"metadata": {"name": "validate"},
+			"export": {
+				"target": "Validate",
+				"validationSeverity": "` + severity + `",
+				"value": "spec: replicas: <=10\n"
+			}
+		}`
+	}
+	desired := func() map[string]*fnv1beta1.Resource {
+		return map[string]*fnv1beta1.Resource{
+			"bucket": {Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "Bucket"}`)},
+		}
+	}
+
+	cases := map[string]struct {
+		reason   string
+		input    string
+		replicas string
+		want     []*fnv1beta1.Result
+	}{
+		"Valid": {
+			reason:   "A valid XR should return a normal result",
+			input:    input(""),
+			replicas: "3",
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: `validated XR "my-xr"`},
+			},
+		},
+		"Fatal": {
+			reason:   "The violations of an invalid XR should be fatal by default",
+			input:    input(""),
+			replicas: "15",
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `invalid XR "my-xr": spec.replicas: invalid value 15 (out of bound <=10)`},
+			},
+		},
+		"Warning": {
+			reason:   "The violations of an invalid XR should be warnings with the Warning severity",
+			input:    input("Warning"),
+			replicas: "15",
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: `invalid XR "my-xr": spec.replicas: invalid value 15 (out of bound <=10)`},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructJSON(tc.input),
+				Observed: &fnv1beta1.State{
+					Composite: &fnv1beta1.Resource{
+						Resource: resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "my-xr"}, "spec": {"replicas": ` + tc.replicas + `}}`),
+					},
+				},
+				Desired: &fnv1beta1.State{Resources: desired()},
+			}
+
+			rsp, err := (&Function{log: logging.NewNopLogger()}).RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(desired(), rsp.GetDesired().GetResources(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired, +got desired:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
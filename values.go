@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// maxExactFloat is the largest integer a float64 represents exactly
+const maxExactFloat = 1 << 53
+
+// typedValue returns the value with the integral numbers decoded as float64 by
+// JSON and CUE converted to int64, the type of the integers of unstructured
+// objects, so that setting an integer does not turn it into a float. Numbers
+// with a fractional part stay float64 and strings are never converted, so an
+// IntOrString field keeps the type the template sets. Values of other types are
+// converted to their JSON value.
+func typedValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= maxExactFloat {
+			return int64(v)
+		}
+		return v
+	case float32:
+		return typedValue(float64(v))
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, f := range v {
+			out[k] = typedValue(f)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = typedValue(e)
+		}
+		return out
+	case string, bool, int64, nil:
+		return v
+	}
+	// Other types, such as typed slices, are converted to their JSON value
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return v
+	}
+	return typedValue(out)
+}
+
+// sameValue returns whether setting the value over the current value of a
+// field leaves it semantically unchanged: numbers are compared by value, so 1
+// and 1.0 are the same, and strings are compared exactly. Strings are not
+// compared as quantities, the type of the field is unknown and a version such
+// as 1.20 is not the same as 1.2. An integer and a string are never the same,
+// they are different values of an IntOrString field. Lists and objects are the
+// same when their items and fields are.
+func sameValue(cur, v interface{}) bool {
+	switch cv := cur.(type) {
+	case []interface{}:
+		l, ok := v.([]interface{})
+		if !ok || len(cv) != len(l) {
+			return false
+		}
+		for i := range cv {
+			if !sameValue(cv[i], l[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		m, ok := v.(map[string]interface{})
+		if !ok || len(cv) != len(m) {
+			return false
+		}
+		for k, f := range cv {
+			mf, ok := m[k]
+			if !ok || !sameValue(f, mf) {
+				return false
+			}
+		}
+		return true
+	}
+	if cb, ok := cur.(bool); ok {
+		b, ok := v.(bool)
+		return ok && cb == b
+	}
+	if cn, ok := number(cur); ok {
+		n, ok := number(v)
+		return ok && cn == n
+	}
+	cs, ok := cur.(string)
+	if !ok {
+		return false
+	}
+	s, ok := v.(string)
+	return ok && cs == s
+}
+
+// keepValue returns the value of the field after merging the value over its
+// current value, the current value is kept when both are the same so that its
+// representation does not change
+func keepValue(cur, v interface{}) interface{} {
+	v = typedValue(v)
+	if cur != nil && sameValue(cur, v) {
+		return cur
+	}
+	return v
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTypedValue(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		value  interface{}
+		want   interface{}
+	}{
+		"Integral": {
+			reason: "Integral floats should be converted to int64",
+			value:  map[string]interface{}{"replicas": 3.0, "ports": []interface{}{80.0}},
+			want:   map[string]interface{}{"replicas": int64(3), "ports": []interface{}{int64(80)}},
+		},
+		"Fractional": {
+			reason: "Floats with a fractional part should stay float64",
+			value:  0.5,
+			want:   0.5,
+		},
+		"String": {
+			reason: "Numeric strings should not be converted",
+			value:  "80",
+			want:   "80",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := typedValue(tc.value)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ntypedValue(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		cur    interface{}
+		value  interface{}
+		want   bool
+	}{
+		"Numbers": {
+			reason: "An int64 and a float64 of the same value should be the same",
+			cur:    int64(1),
+			value:  1.0,
+			want:   true,
+		},
+		"DifferentNumbers": {
+			reason: "Different numbers should not be the same",
+			cur:    int64(1),
+			value:  1.5,
+		},
+		"Quantities": {
+			reason: "Strings of the same quantity should not be the same, the field may not hold a quantity",
+			cur:    "1Gi",
+			value:  "1024Mi",
+		},
+		"Versions": {
+			reason: "Versions that parse as the same quantity should not be the same",
+			cur:    "1.2",
+			value:  "1.20",
+		},
+		"Tags": {
+			reason: "Tags that parse as the same quantity should not be the same",
+			cur:    "1000",
+			value:  "1k",
+		},
+		"SameStrings": {
+			reason: "Equal strings should be the same",
+			cur:    "1.20",
+			value:  "1.20",
+			want:   true,
+		},
+		"IntOrString": {
+			reason: "An integer and a string should not be the same",
+			cur:    int64(80),
+			value:  "80",
+		},
+		"Strings": {
+			reason: "Different strings should not be the same",
+			cur:    "http",
+			value:  "https",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := sameValue(tc.cur, tc.value)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nsameValue(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestKeepValue(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		cur    interface{}
+		value  interface{}
+		want   interface{}
+	}{
+		"Number": {
+			reason: "The current representation of the same number should be kept",
+			cur:    int64(1),
+			value:  1.0,
+			want:   int64(1),
+		},
+		"Version": {
+			reason: "A version should be set over a version that parses as the same quantity",
+			cur:    "1.2",
+			value:  "1.20",
+			want:   "1.20",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := keepValue(tc.cur, tc.value)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nkeepValue(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestContainsValue(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		list   []interface{}
+		value  interface{}
+		want   bool
+	}{
+		"Number": {
+			reason: "A list should hold a number of the same value",
+			list:   []interface{}{int64(80)},
+			value:  80.0,
+			want:   true,
+		},
+		"Tag": {
+			reason: "A list should not hold a tag that parses as the same quantity as one of its items",
+			list:   []interface{}{"1000"},
+			value:  "1k",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := containsValue(tc.list, tc.value)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ncontainsValue(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
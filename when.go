@@ -0,0 +1,44 @@
+package main
+
+import (
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/parser"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// evaluateWhen evaluates the when expression of an export against the states,
+// each available to the expression as its definition, for example
+//
+//	#observed.composite.spec.parameters.monitoring == true
+//
+// The expression must evaluate to a bool, an empty expression is true
+func evaluateWhen(when string, states map[string]interface{}) (bool, error) {
+	if when == "" {
+		return true, nil
+	}
+	return evaluateBool("when", when, states)
+}
+
+// evaluateBool evaluates the named expression against the states, each
+// available to the expression as its definition, it must evaluate to a bool
+func evaluateBool(name, src string, states map[string]interface{}) (bool, error) {
+	expr, err := parser.ParseExpr(name, src)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot parse %s expression", name)
+	}
+
+	ctx := cuecontext.New()
+	scope := ctx.CompileString("_")
+	for def, state := range states {
+		scope = scope.FillPath(cue.MakePath(cue.Def(def)), state)
+	}
+
+	v := ctx.BuildExpr(expr, cue.Scope(scope), cue.InferBuiltins(true))
+	ok, err := v.Bool()
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot evaluate %s expression", name)
+	}
+	return ok, nil
+}
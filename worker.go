@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// workerLimits are the resource limits of the subprocess each cue evaluation
+// runs in when isolation is enabled, a zero limit is not enforced
+type workerLimits struct {
+	// memory is the maximum data segment size of the worker in bytes
+	memory uint64
+	// cpu is the maximum cpu time of the worker in seconds
+	cpu uint64
+	// timeout is the maximum wall clock time of the worker
+	timeout time.Duration
+}
+
+// workerRequest is sent to the worker on stdin
+type workerRequest struct {
+	Out            cueOutputFmt           `json:"out"`
+	Input          v1beta1.CUEInput       `json:"input"`
+	ParseData      bool                   `json:"parseData"`
+	Tags           []string               `json:"tags,omitempty"`
+	Values         map[string]interface{} `json:"values,omitempty"`
+	Now            time.Time              `json:"now"`
+	Observed       map[string]interface{} `json:"observed,omitempty"`
+	Desired        map[string]interface{} `json:"desired,omitempty"`
+	Context        map[string]interface{} `json:"context,omitempty"`
+	ExtraResources map[string]interface{} `json:"extraResources,omitempty"`
+	Meta           map[string]interface{} `json:"meta,omitempty"`
+	Request        map[string]interface{} `json:"request,omitempty"`
+	MaxOutputBytes int                    `json:"maxOutputBytes,omitempty"`
+	MaxResources   int                    `json:"maxResources,omitempty"`
+	MaxEvalSteps   int                    `json:"maxEvalSteps,omitempty"`
+}
+
+// workerResponse is written by the worker to stdout
+type workerResponse struct {
+	Data           []map[string]interface{}         `json:"data,omitempty"`
+	ConnectionData []connectionDetail               `json:"connectionData,omitempty"`
+	ReadinessData  []readinessCheck                 `json:"readinessData,omitempty"`
+	Requirements   map[string]extraResourceSelector `json:"requirements,omitempty"`
+	Conditions     []condition                      `json:"conditions,omitempty"`
+	Results        []result                         `json:"results,omitempty"`
+	Incomplete     []incompleteDocument             `json:"incomplete,omitempty"`
+	Expressions    []expressionOutput               `json:"expressions,omitempty"`
+	String         string                           `json:"string,omitempty"`
+	Err            string                           `json:"err,omitempty"`
+	Diagnostics    []diagnostic                     `json:"diagnostics,omitempty"`
+	Expression     string                           `json:"expression,omitempty"`
+}
+
+// WorkerCmd evaluates a single CUE template read from stdin, it is run by the
+// function as a resource limited subprocess when isolation is enabled.
+type WorkerCmd struct {
+	Memory uint64 `help:"Maximum data segment size of the worker in bytes."`
+	CPU    uint64 `help:"Maximum CPU time of the worker in seconds."`
+}
+
+// Run the worker command.
+func (c *WorkerCmd) Run() error {
+	if err := setWorkerLimits(c.Memory, c.CPU); err != nil {
+		return errors.Wrap(err, "cannot set worker resource limits")
+	}
+
+	req := workerRequest{}
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		return errors.Wrap(err, "cannot decode worker request")
+	}
+
+	opts := compileOpts{
+		parseData:      req.ParseData,
+		tags:           req.Tags,
+		values:         req.Values,
+		now:            req.Now,
+		observed:       req.Observed,
+		desired:        req.Desired,
+		context:        req.Context,
+		extraResources: req.ExtraResources,
+		meta:           req.Meta,
+		request:        req.Request,
+		limits: evalLimits{
+			outputBytes: req.MaxOutputBytes,
+			resources:   req.MaxResources,
+			steps:       req.MaxEvalSteps,
+		},
+	}
+	rsp := workerResponse{}
+	out, err := cueCompile(req.Out, req.Input, opts)
+	if err != nil {
+		rsp.Err = err.Error()
+		var ce *compileError
+		if errors.As(diagnose(err, req.Input, opts), &ce) {
+			rsp.Diagnostics = ce.diagnostics
+			rsp.Expression = ce.expression
+		}
+	}
+	rsp.Data = out.data
+	rsp.ConnectionData = out.connectionData
+	rsp.ReadinessData = out.readinessData
+	rsp.Requirements = out.requirements
+	rsp.Conditions = out.conditions
+	rsp.Results = out.results
+	rsp.Incomplete = out.incomplete
+	rsp.Expressions = out.expressions
+	rsp.String = out.string
+	return json.NewEncoder(os.Stdout).Encode(rsp)
+}
+
+// compile runs cueCompile, in a resource limited worker subprocess when
+// isolation is enabled so a pathological template only crashes its worker
+// Templates are only cached when they are compiled in the function process
+// The worker is killed when the context is done
+// Compilations wait for a worker of the evaluation pool, which also bounds the
+// number of concurrent worker subprocesses
+func (f *Function) compile(ctx context.Context, out cueOutputFmt, input v1beta1.CUEInput, opts compileOpts) (compileOutput, error) {
+	opts.limits = f.limits
+	if f.pool != nil {
+		w, err := f.pool.acquire(ctx)
+		if err != nil {
+			return compileOutput{}, errors.Wrap(err, "cannot acquire a cue evaluation worker")
+		}
+		defer f.pool.release(w)
+		opts.cueCtx = w
+	}
+	defer func(start time.Time) { f.metrics.observeCompile(time.Since(start)) }(time.Now())
+	ctx, sp := f.tracer.start(ctx, "cueCompile", "input", input.Name)
+	if f.isolation == nil {
+		opts.cache = f.cache
+		output, err := cueCompile(out, input, opts)
+		err = diagnose(err, input, opts)
+		sp.end(err)
+		return output, err
+	}
+	output, err := compileInWorker(ctx, *f.isolation, out, input, opts)
+	sp.end(err)
+	return output, err
+}
+
+// compileInWorker runs cueCompile in a worker subprocess of the function binary
+func compileInWorker(ctx context.Context, limits workerLimits, out cueOutputFmt, input v1beta1.CUEInput, opts compileOpts) (compileOutput, error) {
+	output := compileOutput{}
+
+	self, err := os.Executable()
+	if err != nil {
+		return output, errors.Wrap(err, "cannot find function executable")
+	}
+	req, err := json.Marshal(workerRequest{
+		Out:            out,
+		Input:          input,
+		ParseData:      opts.parseData,
+		Tags:           opts.tags,
+		Values:         opts.values,
+		Now:            opts.now,
+		Observed:       opts.observed,
+		Desired:        opts.desired,
+		Context:        opts.context,
+		ExtraResources: opts.extraResources,
+		Meta:           opts.meta,
+		Request:        opts.request,
+		MaxOutputBytes: opts.limits.outputBytes,
+		MaxResources:   opts.limits.resources,
+		MaxEvalSteps:   opts.limits.steps,
+	})
+	if err != nil {
+		return output, errors.Wrap(err, "cannot encode worker request")
+	}
+
+	if limits.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.timeout)
+		defer cancel()
+	}
+	args := []string{"worker"}
+	if limits.memory > 0 {
+		args = append(args, "--memory", strconv.FormatUint(limits.memory, 10))
+	}
+	if limits.cpu > 0 {
+		args = append(args, "--cpu", strconv.FormatUint(limits.cpu, 10))
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return output, errors.Errorf("cue evaluation worker exceeded its %s timeout", limits.timeout)
+		}
+		// a crashed worker writes its stack traces to stderr, only the reason is kept
+		reason, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		return output, errors.Wrapf(err, "cue evaluation worker failed: %s", reason)
+	}
+
+	rsp := workerResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), &rsp); err != nil {
+		return output, errors.Wrap(err, "cannot decode worker response")
+	}
+	output.data = rsp.Data
+	output.connectionData = rsp.ConnectionData
+	output.readinessData = rsp.ReadinessData
+	output.requirements = rsp.Requirements
+	output.conditions = rsp.Conditions
+	output.results = rsp.Results
+	output.incomplete = rsp.Incomplete
+	output.expressions = rsp.Expressions
+	output.string = rsp.String
+	if rsp.Err != "" {
+		if len(rsp.Diagnostics) != 0 {
+			return output, &compileError{err: errors.New(rsp.Err), diagnostics: rsp.Diagnostics, expression: rsp.Expression}
+		}
+		return output, errors.New(rsp.Err)
+	}
+	return output, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "github.com/crossplane/crossplane-runtime/pkg/errors"
+
+// setWorkerLimits is not supported without rlimits
+func setWorkerLimits(memory, cpu uint64) error {
+	if memory > 0 || cpu > 0 {
+		return errors.New("worker resource limits are only supported on unix")
+	}
+	return nil
+}
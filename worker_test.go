@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/crossplane-contrib/function-cue/input/v1beta1"
+	"github.com/google/go-cmp/cmp"
+)
+
+// workerTestEnv makes the test binary run as the worker subprocess
+const workerTestEnv = "FUNCTION_CUE_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(workerTestEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestCompileInWorker(t *testing.T) {
+	t.Setenv(workerTestEnv, "true")
+
+	type want struct {
+		data []map[string]interface{}
+		err  string
+	}
+
+	cases := map[string]struct {
+		reason string
+		value  string
+		limits workerLimits
+		want   want
+	}{
+		"Success": {
+			reason: "The worker should return the compiled documents",
+			value:  "apiVersion: \"nobu.dev/v1\"\nkind: \"Cluster\"\nspec: replicas: 3",
+			limits: workerLimits{memory: 1 << 30, cpu: 10, timeout: time.Minute},
+			want: want{
+				data: []map[string]interface{}{
+					{"apiVersion": "nobu.dev/v1", "kind": "Cluster", "spec": map[string]interface{}{"replicas": float64(3)}},
+				},
+			},
+		},
+		"CompileError": {
+			reason: "The worker should return the compile error of the template",
+			value:  "a: 1 & 2",
+			limits: workerLimits{timeout: time.Minute},
+			want: want{
+				err: "failed creating cue compiler: failed to validate: a: conflicting values 2 and 1",
+			},
+		},
+		"Timeout": {
+			reason: "A worker exceeding its timeout should be killed",
+			value:  "a: 1",
+			limits: workerLimits{timeout: time.Nanosecond},
+			want: want{
+				err: "cue evaluation worker exceeded its 1ns timeout",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := v1beta1.CUEInput{Export: v1beta1.Export{Value: v1beta1.Value(tc.value)}}
+			out, err := compileInWorker(context.Background(), tc.limits, outputJSON, in, compileOpts{parseData: true})
+
+			if diff := cmp.Diff(tc.want.data, out.data); diff != "" {
+				t.Errorf("%s\ncompileInWorker(...): -want data, +got data:\n%s", tc.reason, diff)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, gotErr); diff != "" {
+				t.Errorf("%s\ncompileInWorker(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setWorkerLimits sets the data segment and cpu time limits of the worker process
+func setWorkerLimits(memory, cpu uint64) error {
+	if memory > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: memory, Max: memory}); err != nil {
+			return err
+		}
+	}
+	if cpu > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: cpu, Max: cpu}); err != nil {
+			return err
+		}
+	}
+	return nil
+}